@@ -1,8 +1,14 @@
 package db
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 
@@ -12,6 +18,27 @@ import (
 type DBConfig struct {
 	DriverName string
 	DSN        string
+	SQLite     SQLiteOptions
+	Pool       PoolOptions
+}
+
+// PoolOptions configure the connection pool. Up to MaxIdleConns connections
+// are opened when connecting, so the first requests don't wait for them.
+type PoolOptions struct {
+	MaxOpenConns    int           // 0 for no limit
+	MaxIdleConns    int           // 0 keeps no idle connections
+	ConnMaxLifetime time.Duration // 0 for no limit
+}
+
+// how long opening the connections of the pool may take when connecting
+const warmUpTimeout = 10 * time.Second
+
+// SQLiteOptions are applied as pragmas when connecting to a sqlite3 database,
+// unless the DSN sets them itself. Empty values keep the SQLite defaults.
+type SQLiteOptions struct {
+	BusyTimeout time.Duration
+	JournalMode string
+	Synchronous string
 }
 
 type DatabaseConnection struct {
@@ -19,13 +46,32 @@ type DatabaseConnection struct {
 	DBConfig
 }
 
+// MemoryDSN is the sqlite3 DSN of a database held in memory, e.g. for tests.
+// All connections in the process share the same database, which lasts until
+// the process exits.
+const MemoryDSN = ":memory:"
+
+// connections holding on to in-memory databases by DSN, see keepMemoryDBAlive
+var memoryDBs = struct {
+	sync.Mutex
+	conns map[string]*sql.DB
+}{conns: make(map[string]*sql.DB)}
+
 func ConnectToDB(log *zerolog.Logger, dbConfig DBConfig) *DatabaseConnection {
-	if !strings.Contains(dbConfig.DSN, "?") {
+	switch dbConfig.DriverName {
+	case "sqlite3":
+		isMemory := isMemoryDSN(dbConfig.DSN)
+		if isMemory {
+			// the URI form is needed to share the database between connections
+			dbConfig.DSN = "file:" + dbConfig.DSN
+		}
+		dbConfig.DSN = sqliteDSN(dbConfig.DSN, dbConfig.SQLite)
+		if isMemory {
+			keepMemoryDBAlive(log, dbConfig.DSN)
+		}
+	case "mysql":
 		// Add the default connection options if none are given
-		switch dbConfig.DriverName {
-		case "sqlite3":
-			dbConfig.DSN += "?_busy_timeout=5000&cache=shared"
-		case "mysql":
+		if !strings.Contains(dbConfig.DSN, "?") {
 			dbConfig.DSN += "?parseTime=true"
 		}
 	}
@@ -35,13 +81,18 @@ func ConnectToDB(log *zerolog.Logger, dbConfig DBConfig) *DatabaseConnection {
 		log.Fatal().Err(err).Msg("Could not open database")
 	}
 
-	// note that we don't do db.SetMaxOpenConns(1), as we don't want to limit
-	// read concurrency unnecessarily. sqlite will handle write locking on its
-	// own, even across multiple processes accessing the same database file.
+	// note that we don't default to db.SetMaxOpenConns(1), as we don't want to
+	// limit read concurrency unnecessarily. sqlite will handle write locking on
+	// its own, even across multiple processes accessing the same database file.
 	// https://www.sqlite.org/faq.html#q5
+	db.SetMaxOpenConns(dbConfig.Pool.MaxOpenConns)
+	db.SetMaxIdleConns(dbConfig.Pool.MaxIdleConns)
+	db.SetConnMaxLifetime(dbConfig.Pool.ConnMaxLifetime)
 
-	// we also don't enable the write-ahead-log because it does not work over a
-	// networked filesystem
+	// the write-ahead-log is not enabled by default because it does not work
+	// over a networked filesystem, see SQLiteOptions.JournalMode
+
+	warmUp(log, db, dbConfig.Pool)
 
 	return &DatabaseConnection{
 		db,
@@ -49,6 +100,108 @@ func ConnectToDB(log *zerolog.Logger, dbConfig DBConfig) *DatabaseConnection {
 	}
 }
 
+// isMemoryDSN reports whether a sqlite3 DSN refers to an in-memory database
+func isMemoryDSN(dsn string) bool {
+	if i := strings.Index(dsn, "?"); i >= 0 {
+		dsn = dsn[:i]
+	}
+	return dsn == MemoryDSN
+}
+
+// keepMemoryDBAlive holds a connection to an in-memory database until the
+// process exits. SQLite drops such a database when its last connection closes,
+// which would otherwise happen whenever the connection pool is idle or the
+// server is reloaded.
+func keepMemoryDBAlive(log *zerolog.Logger, dsn string) {
+	memoryDBs.Lock()
+	defer memoryDBs.Unlock()
+
+	if _, ok := memoryDBs.conns[dsn]; ok {
+		return
+	}
+	conn, err := sql.Open("sqlite3", dsn)
+	if err == nil {
+		conn.SetMaxOpenConns(1)
+		conn.SetMaxIdleConns(1)
+		err = conn.Ping()
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not open in-memory database")
+	}
+	memoryDBs.conns[dsn] = conn
+}
+
+// warmUp opens the idle connections of the pool in advance. Failures are only
+// logged, as the database may become reachable later.
+func warmUp(log *zerolog.Logger, db *sqlx.DB, pool PoolOptions) {
+	count := pool.MaxIdleConns
+	if pool.MaxOpenConns > 0 && pool.MaxOpenConns < count {
+		count = pool.MaxOpenConns
+	}
+	if count <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), warmUpTimeout)
+	defer cancel()
+
+	// hold all connections until the end, otherwise the same one is reused
+	conns := make([]*sql.Conn, 0, count)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close() // returns it to the pool
+		}
+	}()
+	for len(conns) < count {
+		conn, err := db.Conn(ctx)
+		if err == nil {
+			if err = conn.PingContext(ctx); err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Int("connections", len(conns)).
+				Msg("Failed to open database connections in advance")
+			return
+		}
+		conns = append(conns, conn)
+	}
+
+	log.Debug().
+		Int("connections", len(conns)).
+		Msg("Opened database connections in advance")
+}
+
+// sqliteDSN adds the connection options to a sqlite3 DSN, keeping any option
+// that is already present
+func sqliteDSN(dsn string, options SQLiteOptions) string {
+	params := url.Values{}
+	if i := strings.Index(dsn, "?"); i >= 0 {
+		params, _ = url.ParseQuery(dsn[i+1:])
+		dsn = dsn[:i]
+	}
+
+	setDefault := func(keys []string, value string) {
+		if value == "" {
+			return
+		}
+		for _, key := range keys {
+			if _, ok := params[key]; ok {
+				return
+			}
+		}
+		params.Set(keys[0], value)
+	}
+	setDefault([]string{"cache"}, "shared")
+	setDefault([]string{"_busy_timeout", "_timeout"}, strconv.FormatInt(int64(options.BusyTimeout/time.Millisecond), 10))
+	setDefault([]string{"_journal_mode", "_journal"}, options.JournalMode)
+	setDefault([]string{"_synchronous", "_sync"}, options.Synchronous)
+
+	return dsn + "?" + params.Encode()
+}
+
 // UpdateRow wraps db.Exec and ensures that exactly one row was affected
 func UpdateRow(db *sqlx.DB, query string, args ...interface{}) (err error) {
 	res, err := db.Exec(query, args...)
@@ -2,23 +2,81 @@ package events
 
 import (
 	"sync"
+	"sync/atomic"
 
 	"github.com/tus/tusd"
 	"github.com/tus/tusd/cmd/tusd/cli/hooks"
 )
 
-// how many events can be unread by a listener before everything starts to block
-const bufferSize = 16
+// DefaultBufferSize is how many events can be unread by a listener before its
+// overflow policy applies
+const DefaultBufferSize = 16
+
+// OverflowPolicy decides what happens to an event for a listener whose buffer is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits until the listener has read an event. No events are
+	// lost, but all other listeners wait as well. Use it for listeners that
+	// must see every event, such as the uploader IP recorder.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest discards the oldest unread event to make room
+	OverflowDropOldest
+	// OverflowDropNewest discards the new event
+	OverflowDropNewest
+	// OverflowDisconnect discards the new event and removes the listener,
+	// closing its channel. Use it for consumers that can't work with gaps in
+	// the events and would rather start over, such as streaming clients.
+	OverflowDisconnect
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
 
 type TusEvent struct {
 	Info tusd.FileInfo
 	Type hooks.HookType
 }
 
+type listener struct {
+	name    string
+	ch      chan *TusEvent
+	policy  OverflowPolicy
+	blocked uint64 // events that had to wait for a full buffer, accessed atomically
+	dropped uint64 // events dropped because of a full buffer, accessed atomically
+
+	backlogged bool // only accessed by broadcast
+}
+
+// ListenerStats describes the backlog of a listener
+type ListenerStats struct {
+	Name     string `json:"name"`
+	Policy   string `json:"policy"`
+	Queued   int    `json:"queued"`
+	Capacity int    `json:"capacity"`
+	// number of events the broadcaster had to wait on because the buffer was full
+	Blocked uint64 `json:"blocked"`
+	// number of events lost because the buffer was full
+	Dropped uint64 `json:"dropped"`
+}
+
 type TusEventBroadcaster struct {
-	mu        sync.RWMutex
-	listeners []chan *TusEvent
-	quitChan  chan struct{} // closes to signal quitting
+	mu               sync.RWMutex
+	listeners        []*listener
+	backlogThreshold int
+	onBacklog        func(name string, queued int)
+	quitChan         chan struct{} // closes to signal quitting
 }
 
 func NewTusEventBroadcaster(handler *tusd.UnroutedHandler) *TusEventBroadcaster {
@@ -31,32 +89,70 @@ func NewTusEventBroadcaster(handler *tusd.UnroutedHandler) *TusEventBroadcaster
 	return broadcaster
 }
 
-func (b *TusEventBroadcaster) Listen() <-chan *TusEvent {
+// Listen returns a channel receiving all events, buffering up to bufferSize
+// unread events. When the buffer is full, policy decides whether the
+// broadcaster waits, an event is dropped or the listener is disconnected. The
+// name identifies the listener in stats and backlog warnings.
+func (b *TusEventBroadcaster) Listen(name string, bufferSize int, policy OverflowPolicy) <-chan *TusEvent {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
-	newListener := make(chan *TusEvent, bufferSize)
+	newListener := &listener{
+		name:   name,
+		ch:     make(chan *TusEvent, bufferSize),
+		policy: policy,
+	}
 
 	b.listeners = append(b.listeners, newListener)
 
-	return newListener
+	return newListener.ch
 }
 
-func (b *TusEventBroadcaster) Unlisten(listener chan *TusEvent) {
+func (b *TusEventBroadcaster) Unlisten(ch <-chan *TusEvent) {
 	b.mu.Lock()
 	defer b.mu.Unlock()
 
 	// delete the listener
 	kept := 0
 	for _, l := range b.listeners {
-		if l == listener {
-			b.listeners[kept] = listener
+		if l.ch != ch {
+			b.listeners[kept] = l
 			kept++
 		}
 	}
 	b.listeners = b.listeners[:kept]
 }
 
+// OnBacklog sets a callback that is called when the number of unread events
+// of a listener reaches threshold. It is called again for the listener only
+// after its backlog dropped below the threshold. The callback must not block.
+func (b *TusEventBroadcaster) OnBacklog(threshold int, callback func(name string, queued int)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.backlogThreshold = threshold
+	b.onBacklog = callback
+}
+
+// Stats returns the current backlog of every listener
+func (b *TusEventBroadcaster) Stats() []ListenerStats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	stats := make([]ListenerStats, 0, len(b.listeners))
+	for _, l := range b.listeners {
+		stats = append(stats, ListenerStats{
+			Name:     l.name,
+			Policy:   l.policy.String(),
+			Queued:   len(l.ch),
+			Capacity: cap(l.ch),
+			Blocked:  atomic.LoadUint64(&l.blocked),
+			Dropped:  atomic.LoadUint64(&l.dropped),
+		})
+	}
+	return stats
+}
+
 func (b *TusEventBroadcaster) readLoop(handler *tusd.UnroutedHandler) {
 	for {
 		select {
@@ -77,17 +173,87 @@ func (b *TusEventBroadcaster) readLoop(handler *tusd.UnroutedHandler) {
 }
 
 func (b *TusEventBroadcaster) broadcast(hookType hooks.HookType, info tusd.FileInfo) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-
 	event := &TusEvent{
 		Type: hookType,
 		Info: info,
 	}
 
+	var overflowed []*listener
+	b.mu.RLock()
+	for _, l := range b.listeners {
+		if !l.send(event) {
+			overflowed = append(overflowed, l)
+			continue
+		}
+
+		if b.onBacklog == nil || b.backlogThreshold <= 0 {
+			continue
+		}
+		queued := len(l.ch)
+		if queued >= b.backlogThreshold && !l.backlogged {
+			b.onBacklog(l.name, queued)
+		}
+		l.backlogged = queued >= b.backlogThreshold
+	}
+	b.mu.RUnlock()
+
+	if len(overflowed) > 0 {
+		b.disconnect(overflowed)
+	}
+}
+
+// disconnect removes listeners with the OverflowDisconnect policy and closes
+// their channels, unless they were removed in the meantime
+func (b *TusEventBroadcaster) disconnect(overflowed []*listener) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	kept := 0
 	for _, l := range b.listeners {
-		l <- event
+		remove := false
+		for _, o := range overflowed {
+			remove = remove || l == o
+		}
+		if remove {
+			close(l.ch)
+			continue
+		}
+		b.listeners[kept] = l
+		kept++
+	}
+	b.listeners = b.listeners[:kept]
+}
+
+// send delivers an event to the listener, applying its overflow policy if the
+// buffer is full. Only called by the broadcaster, which is the only sender.
+// Returns false if the listener must be disconnected.
+func (l *listener) send(event *TusEvent) bool {
+	select {
+	case l.ch <- event:
+		return true
+	default:
+	}
+
+	switch l.policy {
+	case OverflowDropOldest:
+		select {
+		case <-l.ch:
+			atomic.AddUint64(&l.dropped, 1)
+		default:
+			// the listener caught up in the meantime
+		}
+		l.ch <- event
+	case OverflowDropNewest:
+		atomic.AddUint64(&l.dropped, 1)
+	case OverflowDisconnect:
+		atomic.AddUint64(&l.dropped, 1)
+		return false
+	default:
+		// wait for the listener to catch up
+		atomic.AddUint64(&l.blocked, 1)
+		l.ch <- event
 	}
+	return true
 }
 
 func (b *TusEventBroadcaster) Close() {
@@ -95,8 +261,9 @@ func (b *TusEventBroadcaster) Close() {
 	defer b.mu.Unlock()
 
 	for _, l := range b.listeners {
-		close(l)
+		close(l.ch)
 	}
+	b.listeners = nil
 
 	close(b.quitChan)
 }
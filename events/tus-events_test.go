@@ -0,0 +1,174 @@
+package events
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/tus/tusd"
+	"github.com/tus/tusd/cmd/tusd/cli/hooks"
+)
+
+// newTestBroadcaster returns a broadcaster that is only fed by calling
+// broadcast directly
+func newTestBroadcaster() *TusEventBroadcaster {
+	return &TusEventBroadcaster{quitChan: make(chan struct{})}
+}
+
+// broadcastIDs broadcasts one post-create event per id
+func broadcastIDs(b *TusEventBroadcaster, ids ...int) {
+	for _, id := range ids {
+		b.broadcast(hooks.HookPostCreate, tusd.FileInfo{ID: strconv.Itoa(id)})
+	}
+}
+
+// queuedIDs reads the events queued for a listener without waiting, stopping
+// early if the channel was closed. Returns the ids and whether it was closed.
+func queuedIDs(t *testing.T, ch <-chan *TusEvent) (ids []int, closed bool) {
+	t.Helper()
+	for {
+		select {
+		case event, ok := <-ch:
+			if !ok {
+				return ids, true
+			}
+			id, err := strconv.Atoi(event.Info.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		default:
+			return ids, false
+		}
+	}
+}
+
+// listenerStats returns the stats of the named listener, nil if it is gone
+func listenerStats(b *TusEventBroadcaster, name string) *ListenerStats {
+	for _, stats := range b.Stats() {
+		if stats.Name == name {
+			return &stats
+		}
+	}
+	return nil
+}
+
+func assertIDs(t *testing.T, what string, got []int, want ...int) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("Expected %s to be %v, got %v", what, want, got)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("Expected %s to be %v, got %v", what, want, got)
+		}
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	b := newTestBroadcaster()
+	stalled := b.Listen("stalled", 2, OverflowBlock)
+	other := b.Listen("other", 10, OverflowBlock)
+
+	broadcastIDs(b, 1, 2)
+	done := make(chan struct{})
+	go func() {
+		broadcastIDs(b, 3)
+		close(done)
+	}()
+
+	// the third event waits for the listener that never reads
+	deadline := time.Now().Add(5 * time.Second)
+	for listenerStats(b, "stalled").Blocked != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Broadcaster did not block on the full listener")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("Broadcast returned although the listener's buffer is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if ids, _ := queuedIDs(t, other); len(ids) != 2 {
+		t.Fatalf("Expected the other listener to wait for the blocked event, got %v", ids)
+	}
+
+	// reading one event makes room for the blocked one
+	if event := <-stalled; event.Info.ID != "1" {
+		t.Fatalf("Expected event 1 first, got %s", event.Info.ID)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Broadcast did not continue after the listener read an event")
+	}
+
+	ids, _ := queuedIDs(t, stalled)
+	assertIDs(t, "the queued events", ids, 2, 3)
+	ids, _ = queuedIDs(t, other)
+	assertIDs(t, "the other listener's events", ids, 3)
+	if stats := listenerStats(b, "stalled"); stats.Dropped != 0 || stats.Policy != "block" {
+		t.Fatalf("Unexpected stats %+v", *stats)
+	}
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	b := newTestBroadcaster()
+	stalled := b.Listen("stalled", 2, OverflowDropNewest)
+	other := b.Listen("other", 10, OverflowBlock)
+
+	broadcastIDs(b, 1, 2, 3, 4, 5)
+
+	ids, _ := queuedIDs(t, stalled)
+	assertIDs(t, "the queued events", ids, 1, 2)
+	ids, _ = queuedIDs(t, other)
+	assertIDs(t, "the other listener's events", ids, 1, 2, 3, 4, 5)
+	stats := listenerStats(b, "stalled")
+	if stats.Dropped != 3 || stats.Blocked != 0 || stats.Policy != "drop-newest" {
+		t.Fatalf("Unexpected stats %+v", *stats)
+	}
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	b := newTestBroadcaster()
+	stalled := b.Listen("stalled", 2, OverflowDropOldest)
+	other := b.Listen("other", 10, OverflowBlock)
+
+	broadcastIDs(b, 1, 2, 3, 4, 5)
+
+	ids, _ := queuedIDs(t, stalled)
+	assertIDs(t, "the queued events", ids, 4, 5)
+	ids, _ = queuedIDs(t, other)
+	assertIDs(t, "the other listener's events", ids, 1, 2, 3, 4, 5)
+	stats := listenerStats(b, "stalled")
+	if stats.Dropped != 3 || stats.Blocked != 0 || stats.Policy != "drop-oldest" {
+		t.Fatalf("Unexpected stats %+v", *stats)
+	}
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	b := newTestBroadcaster()
+	stalled := b.Listen("stalled", 2, OverflowDisconnect)
+	other := b.Listen("other", 10, OverflowBlock)
+
+	broadcastIDs(b, 1, 2, 3)
+	if listenerStats(b, "stalled") != nil {
+		t.Fatal("Expected the overflowing listener to be removed")
+	}
+
+	// the listener keeps the events it had, then its channel is closed
+	ids, closed := queuedIDs(t, stalled)
+	assertIDs(t, "the queued events", ids, 1, 2)
+	if !closed {
+		t.Fatal("Expected the channel of the overflowing listener to be closed")
+	}
+
+	// the other listeners are unaffected, and removing or closing afterwards
+	// doesn't close the channel again
+	broadcastIDs(b, 4)
+	ids, _ = queuedIDs(t, other)
+	assertIDs(t, "the other listener's events", ids, 1, 2, 3, 4)
+	b.Unlisten(stalled)
+	b.Close()
+}
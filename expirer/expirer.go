@@ -7,6 +7,9 @@ import (
 	"github.com/rs/zerolog"
 )
 
+// maximum number of expired uploads fetched from the database at once
+const gcBatchSize = 1000
+
 type Expirer struct {
 	ticker             *time.Ticker
 	store              *shardedfilestore.ShardedFileStore
@@ -60,58 +63,64 @@ func (expirer *Expirer) gc(t time.Time) {
 		Str("event", "gc_tick").
 		Msg("Filestore GC tick")
 
-	expiredIds, err := expirer.getExpired()
-	if err != nil {
-		expirer.log.Error().
-			Err(err).
-			Msg("Failed to enumerate expired uploads")
-		return
-	}
-
-	for _, id := range expiredIds {
-		err = expirer.store.Terminate(id)
+	// work through the expired uploads in batches to bound memory use, stopping
+	// early if an upload can't be terminated so it isn't retried in a loop
+	for {
+		expiredIds, err := expirer.getExpired(t)
 		if err != nil {
 			expirer.log.Error().
 				Err(err).
-				Msg("Failed to terminate expired upload")
-			continue
+				Msg("Failed to enumerate expired uploads")
+			return
+		}
+
+		failed := false
+		for _, id := range expiredIds {
+			err = expirer.store.TerminateWithReason(id, shardedfilestore.DeletedReasonExpired)
+			if err != nil {
+				expirer.log.Error().
+					Err(err).
+					Msg("Failed to terminate expired upload")
+				failed = true
+				continue
+			}
+			expirer.log.Info().
+				Str("event", "expired").
+				Str("id", id).
+				Msg("Terminated upload id")
+		}
+
+		if failed || len(expiredIds) < gcBatchSize {
+			return
 		}
-		expirer.log.Info().
-			Str("event", "expired").
-			Str("id", id).
-			Msg("Terminated upload id")
 	}
 }
 
-func (expirer *Expirer) getExpired() (expiredIds []string, err error) {
-	switch expirer.store.DBConn.DBConfig.DriverName {
-	case "sqlite3":
-		err = expirer.store.DBConn.DB.Select(&expiredIds, `
-			SELECT id FROM uploads
-			WHERE
-				CAST(strftime('%s', 'now') AS INTEGER) -- current time
-				>=
-				created_at + (CASE WHEN jwt_account IS NULL THEN $1 ELSE $2 END) -- expiration time
-			AND deleted != 1
-			`,
-			expirer.maxAge.Seconds(),
-			expirer.identifiedMaxAge.Seconds(),
-		)
-	case "mysql":
-		err = expirer.store.DBConn.DB.Select(&expiredIds, `
-			SELECT id FROM uploads
-			WHERE
-				UNIX_TIMESTAMP() -- current time
-				>=
-				created_at + (CASE WHEN jwt_account IS NULL THEN ? ELSE ? END) -- expiration time
-			AND deleted != 1
-			`,
-			expirer.maxAge.Seconds(),
-			expirer.identifiedMaxAge.Seconds(),
-		)
-	default:
-		panic("Unhandled database driver")
+// getExpired returns up to gcBatchSize uploads that have expired at time t.
+// The bound on created_at lets the database use the (deleted, created_at)
+// index instead of scanning every upload.
+func (expirer *Expirer) getExpired(t time.Time) (expiredIds []string, err error) {
+	anonymousCutoff := t.Add(-expirer.maxAge).Unix()
+	identifiedCutoff := t.Add(-expirer.identifiedMaxAge).Unix()
+
+	latestCutoff := anonymousCutoff
+	if identifiedCutoff > latestCutoff {
+		latestCutoff = identifiedCutoff
 	}
 
+	err = expirer.store.DBConn.DB.Select(&expiredIds, `
+		SELECT id FROM uploads
+		WHERE
+			deleted = 0
+		AND created_at <= ?
+		AND created_at <= (CASE WHEN jwt_account IS NULL THEN ? ELSE ? END)
+		LIMIT ?
+		`,
+		latestCutoff,
+		anonymousCutoff,
+		identifiedCutoff,
+		gcBatchSize,
+	)
+
 	return
 }
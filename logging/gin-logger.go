@@ -16,17 +16,18 @@ func GinLogger(log *zerolog.Logger) gin.HandlerFunc {
 		end := time.Now()
 
 		duration := end.Sub(start)
+		reqLog := RequestLogger(c.Request, log)
 
 		var logEvent *zerolog.Event
 
 		status := c.Writer.Status()
 		switch {
 		case 100 <= status && status <= 399:
-			logEvent = log.Debug()
+			logEvent = reqLog.Debug()
 		case 400 <= status && status <= 499:
-			logEvent = log.Warn()
+			logEvent = reqLog.Warn()
 		case 500 <= status && status <= 599:
-			logEvent = log.Error()
+			logEvent = reqLog.Error()
 		default:
 			panic("Invalid status code")
 		}
@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+// RequestIDHeader carries the correlation ID of a request in both directions
+const RequestIDHeader = "X-Request-ID"
+
+// longest incoming request ID that is accepted as-is
+const maxRequestIDLength = 128
+
+type requestLoggerKey struct{}
+
+// RequestID assigns each request a correlation ID, taken from an incoming
+// X-Request-ID header or generated, and echoes it back in the response. A
+// logger including the ID is attached to the request and can be retrieved with
+// RequestLogger, so that every log line about a request can be correlated.
+func RequestID(log *zerolog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(RequestIDHeader)
+		if !isValidRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		c.Header(RequestIDHeader, requestID)
+
+		reqLog := log.With().Str("requestId", requestID).Logger()
+		ctx := context.WithValue(c.Request.Context(), requestLoggerKey{}, &reqLog)
+		c.Request = c.Request.WithContext(ctx)
+	}
+}
+
+// RequestLogger returns the logger attached to the request by RequestID, or
+// fallback if there is none
+func RequestLogger(req *http.Request, fallback *zerolog.Logger) *zerolog.Logger {
+	if reqLog, ok := req.Context().Value(requestLoggerKey{}).(*zerolog.Logger); ok {
+		return reqLog
+	}
+	return fallback
+}
+
+// isValidRequestID only accepts reasonably short IDs of printable ASCII, so a
+// client can't inject arbitrary content into our logs and headers
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -11,7 +11,7 @@ import (
 )
 
 func TusdLogger(log *zerolog.Logger, broadcaster *events.TusEventBroadcaster) {
-	channel := broadcaster.Listen()
+	channel := broadcaster.Listen("tusd-logger", events.DefaultBufferSize, events.OverflowBlock)
 	for {
 		event, ok := <-channel
 		if !ok {
@@ -0,0 +1,54 @@
+// Package receipts signs and verifies upload receipts. A receipt is a JWT
+// signed by the upload server stating that a file with a given SHA-256 hash
+// and size was uploaded at a given time, and by which account if any.
+package receipts
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Receipt holds the claims of an upload receipt
+type Receipt struct {
+	ID         string `json:"id"`
+	SHA256     string `json:"sha256"`
+	Size       int64  `json:"size"`
+	Account    string `json:"account,omitempty"`
+	Issuer     string `json:"issuer,omitempty"`
+	UploadedAt int64  `json:"uploadedAt"`
+	IssuedAt   int64  `json:"iat"`
+}
+
+// Valid implements jwt.Claims
+func (r *Receipt) Valid() error {
+	if r.ID == "" || r.SHA256 == "" {
+		return errors.New("Receipt is missing the upload id or hash")
+	}
+	return nil
+}
+
+// Sign returns the receipt as a JWT signed with HS256 using key. IssuedAt is
+// set to the current time.
+func Sign(receipt Receipt, key []byte) (string, error) {
+	receipt.IssuedAt = time.Now().Unix()
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, &receipt).SignedString(key)
+}
+
+// Verify checks the signature of a receipt signed with key and returns its
+// claims
+func Verify(token string, key []byte) (*Receipt, error) {
+	receipt := &Receipt{}
+	_, err := jwt.ParseWithClaims(token, receipt, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodHS256 {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
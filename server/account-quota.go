@@ -0,0 +1,141 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/gin-gonic/gin"
+)
+
+// how shared files are charged to an account quota (Storage.AccountQuotaCharge)
+const (
+	quotaChargeLogical  = "logical"
+	quotaChargePhysical = "physical"
+)
+
+// header added to creation responses once an account passes
+// Storage.AccountQuotaSoft, when Storage.AccountQuotaWarningHeader is enabled
+const accountQuotaWarningHeader = "X-Account-Quota-Warning"
+
+// validateAccountQuota checks that the soft threshold of the account quota
+// isn't above the hard one and the charging mode is known
+func validateAccountQuota(soft datasize.ByteSize, hard datasize.ByteSize, charge string) error {
+	if soft > 0 && hard > 0 && soft > hard {
+		return fmt.Errorf("Storage.AccountQuotaSoft (%s) must not be greater than Storage.AccountQuotaHard (%s)", soft, hard)
+	}
+	switch charge {
+	case quotaChargeLogical, quotaChargePhysical:
+		return nil
+	}
+	return fmt.Errorf("Unsupported Storage.AccountQuotaCharge %#v, expected %#v or %#v",
+		charge, quotaChargeLogical, quotaChargePhysical)
+}
+
+// accountStoredBytes returns the bytes of the completed uploads an account
+// currently stores, plus the declared length of its uploads in progress, which
+// may still be written. Uploads with a deferred length are counted as empty.
+//
+// Identical files are stored once and shared by all uploads of them, whichever
+// account they belong to; each upload keeps its own id and row, and the file is
+// only removed with the last upload using it. With Storage.AccountQuotaCharge
+// = "logical", every upload is charged its full size regardless. With
+// "physical", a file is charged once to an account however many of its uploads
+// share it. Files shared with other accounts are charged to each of them.
+func (serv *UploadServer) accountStoredBytes(account string, issuer string) (int64, error) {
+	query := `
+		SELECT COALESCE(SUM(size), 0) FROM uploads
+		WHERE jwt_account = ? AND COALESCE(jwt_issuer, '') = ? AND deleted = 0
+		AND sha256sum IS NOT NULL
+	`
+	if serv.cfg.Storage.AccountQuotaCharge == quotaChargePhysical {
+		query = `
+			SELECT COALESCE(SUM(size), 0) FROM (
+				SELECT MAX(size) AS size FROM uploads
+				WHERE jwt_account = ? AND COALESCE(jwt_issuer, '') = ? AND deleted = 0
+				AND sha256sum IS NOT NULL
+				GROUP BY sha256sum
+			) AS files
+		`
+	}
+
+	var stored, incomplete int64
+	err := serv.DBConn.DB.Get(&stored, query, account, issuer)
+	if err != nil {
+		return 0, err
+	}
+	err = serv.DBConn.DB.Get(&incomplete, `
+		SELECT COALESCE(SUM(upload_length), 0) FROM uploads
+		WHERE jwt_account = ? AND COALESCE(jwt_issuer, '') = ? AND deleted = 0
+		AND sha256sum IS NULL
+	`, account, issuer)
+	return stored + incomplete, err
+}
+
+// enforceAccountQuota checks the bytes an account would store with a new
+// upload of the given size against the account quota. Past
+// Storage.AccountQuotaHard the upload is rejected with 413 and the error code
+// "account_quota_exceeded". Past Storage.AccountQuotaSoft it is accepted, but
+// a warning is logged and, with Storage.AccountQuotaWarningHeader, reported to
+// the client. Anonymous uploads have no quota. As the size of an upload with a
+// deferred length isn't known, such uploads are rejected with 411 and the
+// error code "upload_length_required" for accounts with a hard quota. Returns
+// false if the request was rejected and aborted.
+//
+// With a hard quota, concurrent creations by the same account wait for each
+// other's upload row to be stored, so they can't all pass against the same
+// total. The caller must defer releaseIncompleteSlot before calling this.
+func (serv *UploadServer) enforceAccountQuota(c *gin.Context, metadata map[string]string, size int64, deferred bool) bool {
+	soft := int64(serv.cfg.Storage.AccountQuotaSoft.Bytes())
+	hard := int64(serv.cfg.Storage.AccountQuotaHard.Bytes())
+	account := metadata["account"]
+	if account == "" || (soft <= 0 && hard <= 0) {
+		return true
+	}
+
+	if hard > 0 {
+		if deferred {
+			abortWithErrorResponse(c, http.StatusLengthRequired, "upload_length_required",
+				"Uploads of this account must declare their Upload-Length", nil)
+			return false
+		}
+		if !serv.acquireIncompleteSlot(c, metadata) {
+			return false
+		}
+	}
+
+	stored, err := serv.accountStoredBytes(account, metadata["issuer"])
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return false
+	}
+	total := stored + size
+
+	if hard > 0 && total > hard {
+		metrics.add("uploads.accountQuotaExceeded", 1)
+		serv.requestLog(c.Request).Warn().
+			Str("event", "account_quota_exceeded").
+			Str("account", account).
+			Int64("stored", stored).
+			Int64("size", size).
+			Msg("Rejected upload, Storage.AccountQuotaHard reached")
+		abortWithErrorResponse(c, http.StatusRequestEntityTooLarge, "account_quota_exceeded",
+			fmt.Sprintf("The account may store at most %s", serv.cfg.Storage.AccountQuotaHard.HR()),
+			gin.H{"stored": stored, "quota": hard})
+		return false
+	}
+
+	if soft > 0 && total > soft {
+		metrics.add("uploads.accountQuotaWarnings", 1)
+		serv.requestLog(c.Request).Warn().
+			Str("event", "account_quota_warning").
+			Str("account", account).
+			Int64("stored", stored).
+			Int64("size", size).
+			Msg("Account passed Storage.AccountQuotaSoft")
+		if serv.cfg.Storage.AccountQuotaWarningHeader {
+			c.Header(accountQuotaWarningHeader, fmt.Sprintf("stored=%d; soft=%d; hard=%d", total, soft, hard))
+		}
+	}
+	return true
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// accountJwt returns an EXTJWT of testJwtIssuer for account
+func accountJwt(t *testing.T, account string) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":     testJwtIssuer,
+		"account": account,
+	}).SignedString([]byte(testJwtSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// storedBlobExists reports whether the shared file holding content is stored
+func (ts *testServer) storedBlobExists(content string) bool {
+	ts.t.Helper()
+
+	name := fmt.Sprintf("%x.bin", sha256.Sum256([]byte(content)))
+	found := false
+	err := filepath.Walk(filepath.Join(ts.cfg.Storage.Path, "complete"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		found = found || info.Name() == name
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		ts.t.Fatal(err)
+	}
+	return found
+}
+
+func TestSharedFileAcrossAccounts(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.JwtSecretsByIssuer = map[string]string{testJwtIssuer: testJwtSecret}
+	})
+	defer ts.Close()
+
+	const content = "the same file uploaded by two accounts"
+	aliceURL := ts.upload(content, map[string]string{"filename": "alice.txt", "extjwt": accountJwt(t, "alice")})
+	bobURL := ts.upload(content, map[string]string{"filename": "bob.txt", "extjwt": accountJwt(t, "bob")})
+
+	// each account has its own upload of the one stored file
+	var rows []struct {
+		ID      string `db:"id"`
+		Account string `db:"jwt_account"`
+		Hash    []byte `db:"sha256sum"`
+	}
+	err := ts.DBConn.DB.Select(&rows, `SELECT id, jwt_account, sha256sum FROM uploads WHERE deleted = 0 ORDER BY jwt_account`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Account != "alice" || rows[1].Account != "bob" ||
+		rows[0].ID != uploadID(aliceURL) || rows[1].ID != uploadID(bobURL) {
+		t.Fatalf("Expected one upload row for each account, got %+v", rows)
+	}
+	if string(rows[0].Hash) != string(rows[1].Hash) || !ts.storedBlobExists(content) {
+		t.Fatal("Expected both uploads to share one stored file")
+	}
+
+	// deleting alice's upload leaves bob's intact
+	resp, body := ts.do(ts.newTusRequest(http.MethodDelete, aliceURL, ""))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Deleting alice's upload: got status %d, body %q", resp.StatusCode, body)
+	}
+	if resp, _ := ts.get(aliceURL); resp.StatusCode == http.StatusOK {
+		t.Fatal("Expected alice's upload to be gone")
+	}
+	if !ts.storedBlobExists(content) {
+		t.Fatal("Expected the shared file to be kept for bob")
+	}
+	if resp, body := ts.get(bobURL); resp.StatusCode != http.StatusOK || body != content {
+		t.Fatalf("Expected bob's upload to still be served, got status %d, body %q", resp.StatusCode, body)
+	}
+	if stored := ts.storedContent(bobURL); stored != content {
+		t.Fatalf("Expected bob's stored content %q, got %q", content, stored)
+	}
+
+	// the file goes with the last upload using it
+	resp, body = ts.do(ts.newTusRequest(http.MethodDelete, bobURL, ""))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Deleting bob's upload: got status %d, body %q", resp.StatusCode, body)
+	}
+	if ts.storedBlobExists(content) {
+		t.Fatal("Expected the shared file to be removed with its last upload")
+	}
+}
+
+func TestAccountQuotaChargeSharedFiles(t *testing.T) {
+	tests := []struct {
+		charge     string
+		aliceBytes int64
+		bobBytes   int64
+	}{
+		// alice has two uploads of the shared file, bob one
+		{quotaChargeLogical, 20, 10},
+		{quotaChargePhysical, 10, 10},
+	}
+	for _, test := range tests {
+		t.Run(test.charge, func(t *testing.T) {
+			ts := newTestServer(t, func(cfg *Config) {
+				cfg.JwtSecretsByIssuer = map[string]string{testJwtIssuer: testJwtSecret}
+				cfg.Storage.AccountQuotaCharge = test.charge
+			})
+			defer ts.Close()
+
+			const content = "0123456789"
+			ts.upload(content, map[string]string{"filename": "1.txt", "extjwt": accountJwt(t, "alice")})
+			ts.upload(content, map[string]string{"filename": "2.txt", "extjwt": accountJwt(t, "alice")})
+			ts.upload(content, map[string]string{"filename": "3.txt", "extjwt": accountJwt(t, "bob")})
+
+			for account, want := range map[string]int64{"alice": test.aliceBytes, "bob": test.bobBytes} {
+				stored, err := ts.accountStoredBytes(account, testJwtIssuer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if stored != want {
+					t.Errorf("Expected %s to be charged %d bytes, got %d", account, want, stored)
+				}
+			}
+		})
+	}
+}
+
+func TestAccountQuotaHard(t *testing.T) {
+	newQuotaServer := func(t *testing.T) *testServer {
+		return newTestServer(t, func(cfg *Config) {
+			cfg.JwtSecretsByIssuer = map[string]string{testJwtIssuer: testJwtSecret}
+			cfg.Storage.AccountQuotaHard = 10
+			cfg.Server.EnableMultipartUploads = true
+		})
+	}
+	expectQuotaExceeded := func(t *testing.T, resp *http.Response, body string) {
+		t.Helper()
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Fatalf("Expected status 413, got %d with body %q", resp.StatusCode, body)
+		}
+		if errResp := decodeErrorResponse(t, body); errResp.Code != "account_quota_exceeded" {
+			t.Fatalf("Expected error code account_quota_exceeded, got %q", errResp.Code)
+		}
+	}
+
+	t.Run("multipart", func(t *testing.T) {
+		ts := newQuotaServer(t)
+		defer ts.Close()
+
+		token := accountJwt(t, "alice")
+		if resp, body := ts.do(ts.newMultipartRequest("0123456", "a.txt", token)); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d with body %q", resp.StatusCode, body)
+		}
+		resp, body := ts.do(ts.newMultipartRequest("0123456", "b.txt", token))
+		expectQuotaExceeded(t, resp, body)
+	})
+
+	t.Run("deferred length", func(t *testing.T) {
+		ts := newQuotaServer(t)
+		defer ts.Close()
+
+		req := ts.newTusRequest(http.MethodPost, ts.url("/files"), "")
+		req.Header.Set("Upload-Defer-Length", "1")
+		req.Header.Set("Upload-Metadata", encodeTestMetadata(map[string]string{"filename": "a.txt", "extjwt": accountJwt(t, "alice")}))
+		resp, body := ts.do(req)
+		if resp.StatusCode != http.StatusLengthRequired {
+			t.Fatalf("Expected status 411, got %d with body %q", resp.StatusCode, body)
+		}
+		if errResp := decodeErrorResponse(t, body); errResp.Code != "upload_length_required" {
+			t.Fatalf("Expected error code upload_length_required, got %q", errResp.Code)
+		}
+	})
+
+	t.Run("incomplete uploads", func(t *testing.T) {
+		ts := newQuotaServer(t)
+		defer ts.Close()
+
+		token := accountJwt(t, "alice")
+		ts.createUpload(6, map[string]string{"filename": "a.txt", "extjwt": token})
+		resp, body := ts.do(ts.newCreationRequest(6, map[string]string{"filename": "b.txt", "extjwt": token}))
+		expectQuotaExceeded(t, resp, body)
+	})
+
+	t.Run("concurrent creations", func(t *testing.T) {
+		ts := newQuotaServer(t)
+		defer ts.Close()
+
+		const burst = 10
+		statuses := make(chan int, burst)
+		var wg sync.WaitGroup
+		for i := 0; i < burst; i++ {
+			req := ts.newCreationRequest(4, map[string]string{"filename": "a.txt", "extjwt": accountJwt(t, "alice")})
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					statuses <- 0
+					return
+				}
+				resp.Body.Close()
+				statuses <- resp.StatusCode
+			}()
+		}
+		wg.Wait()
+		close(statuses)
+
+		created := 0
+		for status := range statuses {
+			switch status {
+			case http.StatusCreated:
+				created++
+			case http.StatusRequestEntityTooLarge:
+			default:
+				t.Errorf("Unexpected status %d", status)
+			}
+		}
+		if created != 2 {
+			t.Fatalf("Expected 2 of %d concurrent 4 byte uploads to fit a 10 byte quota, %d were created", burst, created)
+		}
+	})
+}
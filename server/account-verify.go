@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// when the verification cache grows beyond this many entries, expired ones are purged
+const accountVerifyCachePurgeThreshold = 10000
+
+// accountVerifier asks an external service whether an EXTJWT account may still
+// upload, e.g. because it could have been banned since the token was issued.
+// Positive results are cached.
+type accountVerifier struct {
+	url      string
+	client   *http.Client
+	cacheTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]time.Time // account key => expiry of the positive result
+}
+
+func newAccountVerifier(url string, connectTimeout time.Duration, timeout time.Duration, cacheTTL time.Duration) *accountVerifier {
+	return &accountVerifier{
+		url:      url,
+		client:   newHTTPClient(connectTimeout, timeout),
+		cacheTTL: cacheTTL,
+		cache:    make(map[string]time.Time),
+	}
+}
+
+// verify calls the verification URL with a JSON body of the form
+// {"account": "...", "issuer": "..."}. A 200 response allows the account and
+// any other response below 500 rejects it. Connection errors, timeouts and
+// 5xx responses are returned as err.
+func (v *accountVerifier) verify(account string, issuer string) (allowed bool, err error) {
+	key := issuer + "/" + account
+	now := time.Now()
+
+	v.mu.Lock()
+	expires, ok := v.cache[key]
+	v.mu.Unlock()
+	if ok && now.Before(expires) {
+		return true, nil
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"account": account,
+		"issuer":  issuer,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := v.client.Post(v.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return false, fmt.Errorf("Account verification returned status %d", resp.StatusCode)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, nil
+	}
+
+	v.mu.Lock()
+	if len(v.cache) >= accountVerifyCachePurgeThreshold {
+		for k, e := range v.cache {
+			if now.After(e) {
+				delete(v.cache, k)
+			}
+		}
+	}
+	v.cache[key] = now.Add(v.cacheTTL)
+	v.mu.Unlock()
+
+	return true, nil
+}
+
+// verifyAccount checks the account resolved from the EXTJWT with the
+// Integration.AccountVerifyURL callback. Uploads without an account are not
+// checked. Returns false if the request was rejected and aborted.
+func (serv *UploadServer) verifyAccount(c *gin.Context) bool {
+	if serv.accountVerifier == nil {
+		return true
+	}
+
+	metadata := parseMeta(c.Request.Header.Get("Upload-Metadata"))
+	account := metadata["account"]
+	if account == "" {
+		return true
+	}
+
+	allowed, err := serv.accountVerifier.verify(account, metadata["issuer"])
+	if err != nil {
+		failOpen := serv.cfg.Integration.AccountVerifyFailOpen
+		serv.requestLog(c.Request).Error().
+			Err(err).
+			Str("account", account).
+			Bool("failOpen", failOpen).
+			Msg("Account verification failed")
+		if failOpen {
+			return true
+		}
+		abortWithErrorResponse(c, http.StatusServiceUnavailable, "account_verification_unavailable",
+			"The account could not be verified, try again later", nil)
+		return false
+	}
+
+	if !allowed {
+		serv.requestLog(c.Request).Warn().
+			Str("event", "account_rejected").
+			Str("account", account).
+			Str("issuer", metadata["issuer"]).
+			Msg("Rejected upload from account")
+		abortWithErrorResponse(c, http.StatusForbidden, "account_rejected", "Uploads are not accepted from this account", nil)
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// adminTokenStore holds the token guarding the admin API. It outlives a single
+// UploadServer, so a rotated token stays in effect across config reloads until
+// the configured token itself is changed.
+type adminTokenStore struct {
+	mu         sync.RWMutex
+	configured string // token last loaded from the config
+	current    string // token currently accepted
+}
+
+// configure updates the store with the token from a newly loaded config. The
+// current token is only replaced if the configured one changed.
+func (s *adminTokenStore) configure(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if token != s.configured {
+		s.configured = token
+		s.current = token
+	}
+}
+
+// enabled reports whether the admin API is enabled, i.e. a token is set
+func (s *adminTokenStore) enabled() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.current != ""
+}
+
+// matches compares a presented token with the current one in constant time
+func (s *adminTokenStore) matches(token string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.current == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.current)) == 1
+}
+
+func (s *adminTokenStore) set(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.current = token
+}
+
+// loadAdminToken returns the admin token from Server.AdminTokenFile if it
+// exists and is not empty, otherwise Server.AdminToken
+func loadAdminToken(cfg *Config) (string, error) {
+	if cfg.Server.AdminTokenFile != "" {
+		data, err := ioutil.ReadFile(cfg.Server.AdminTokenFile)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token, nil
+		}
+	}
+	return cfg.Server.AdminToken, nil
+}
+
+// hasAdminToken reports whether a request has the current admin token in an
+// "Authorization: Bearer <token>" header
+func (serv *UploadServer) hasAdminToken(c *gin.Context) bool {
+	const bearerPrefix = "Bearer "
+
+	auth := c.GetHeader("Authorization")
+	return strings.HasPrefix(auth, bearerPrefix) && serv.adminToken.matches(strings.TrimPrefix(auth, bearerPrefix))
+}
+
+// requireAdmin rejects requests without the current admin token
+func (serv *UploadServer) requireAdmin(c *gin.Context) {
+	if !serv.hasAdminToken(c) {
+		c.Header("WWW-Authenticate", "Bearer")
+		abortWithErrorResponse(c, http.StatusUnauthorized, "admin_unauthorized", "A valid admin token is required", nil)
+		return
+	}
+
+	// admin responses are never cacheable
+	c.Header("Cache-Control", "no-store")
+}
+
+// registerAdminHandlers mounts the admin API under Server.AdminPath
+func (serv *UploadServer) registerAdminHandlers(r *gin.Engine) {
+	admin := r.Group(serv.cfg.Server.AdminPath, serv.requireAdmin)
+	admin.POST("token/rotate", serv.adminAction(adminActionRotateToken), serv.rotateAdminToken)
+	admin.POST("fsck", serv.adminAction(adminActionFsck), serv.fsck)
+	admin.GET("manifest", serv.manifestHandler(true))
+	admin.GET("uploads/pending", serv.listPendingUploads)
+	admin.POST("uploads/:id/approve", serv.adminAction(adminActionApproveUpload), serv.approveUpload)
+	admin.POST("uploads/:id/reprocess", serv.adminAction(adminActionReprocessUpload), serv.reprocessUpload)
+	admin.POST("reprocess", serv.adminAction(adminActionReprocess), serv.reprocessUploads)
+	admin.POST("uploads/:id/verify", serv.adminAction(adminActionVerifyUpload), serv.verifyUpload)
+	admin.POST("verify", serv.adminAction(adminActionVerify), serv.verifyUploads)
+	admin.GET("tombstones", serv.listTombstones)
+	admin.GET("metrics", serv.reportMetrics)
+	admin.GET("stats", serv.reportStats)
+	admin.GET("usage", serv.reportUsage)
+	admin.POST("pause", serv.adminAction(adminActionPause), serv.pauseUploads)
+	admin.POST("resume", serv.adminAction(adminActionResume), serv.resumeUploads)
+	if serv.cfg.Security.ReceiptSigningKey != "" {
+		admin.GET("receipts/:id", serv.issueReceipt)
+		admin.POST("receipts/verify", serv.verifyReceipt)
+	}
+}
+
+// rotateAdminToken replaces the admin token with a new random one, which is
+// returned only in this response. The old token stops working immediately. If
+// Server.AdminTokenFile is set, the new token is written there so it survives
+// restarts.
+func (serv *UploadServer) rotateAdminToken(c *gin.Context) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+	token := hex.EncodeToString(buf)
+
+	persisted := false
+	if tokenFile := serv.cfg.Server.AdminTokenFile; tokenFile != "" {
+		if err := ioutil.WriteFile(tokenFile, []byte(token+"\n"), 0600); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+		persisted = true
+	}
+
+	serv.adminToken.set(token)
+
+	serv.requestLog(c.Request).Warn().
+		Str("event", "admin_token_rotated").
+		Bool("persisted", persisted).
+		Msg("Admin token rotated")
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":     token,
+		"persisted": persisted,
+	})
+}
+
+// fsck reports inconsistencies between the stored files and the uploads table.
+// Nothing is changed unless the request has the query parameter repair=true.
+func (serv *UploadServer) fsck(c *gin.Context) {
+	repair := c.Query("repair") == "true"
+
+	report, err := serv.store.Fsck(repair)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+
+	serv.requestLog(c.Request).Info().
+		Str("event", "fsck").
+		Bool("repair", repair).
+		Int("orphanedFiles", len(report.OrphanedFiles)).
+		Int("danglingRecords", len(report.DanglingRecords)).
+		Msg("Checked store consistency")
+
+	c.JSON(http.StatusOK, report)
+}
@@ -0,0 +1,492 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// maximum number of events sent in one delivery
+	auditBatchSize = 100
+	// delay before retrying a failed delivery, doubled up to auditMaxRetryDelay
+	auditRetryDelay    = time.Second
+	auditMaxRetryDelay = 5 * time.Minute
+	// delivered bytes at the start of the spool after which it is compacted, if
+	// they also make up at least half of it
+	auditCompactThreshold = 1024 * 1024
+)
+
+// auditExporter ships audit events to Audit.Endpoint. Events are appended to
+// the spool file before they are sent and the offset of the first unsent event
+// is kept next to it, so events that couldn't be delivered before a restart
+// are sent afterwards. Delivery is at least once: an event may be sent again
+// if the process stops between sending it and saving the offset. The spool is
+// truncated once everything was delivered, and compacted when new events keep
+// it from getting there.
+//
+// Like the admin token it outlives a single UploadServer and is shared by the
+// virtual hosts, as only one exporter may own the spool.
+type auditExporter struct {
+	endpoint      *url.URL
+	format        string
+	authorization string
+	maxSpoolSize  int64
+	timeout       time.Duration
+	client        *http.Client
+	hostname      string
+	log           *zerolog.Logger
+
+	mu         sync.Mutex
+	spool      *os.File
+	spoolPath  string
+	offsetPath string
+	size       int64 // bytes in the spool
+	offset     int64 // bytes of the spool already delivered
+	dropped    int   // events dropped since the last warning
+
+	conn net.Conn // syslog connection, only used by the sender
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+// newAuditExporter opens the spool and starts sending the events in it
+func newAuditExporter(cfg *Config, log *zerolog.Logger) (*auditExporter, error) {
+	endpoint, err := url.Parse(cfg.Audit.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	spool, err := os.OpenFile(cfg.Audit.SpoolPath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := spool.Stat()
+	if err != nil {
+		spool.Close()
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	exporter := &auditExporter{
+		endpoint:      endpoint,
+		format:        cfg.Audit.Format,
+		authorization: cfg.Audit.HTTPAuthorization,
+		maxSpoolSize:  int64(cfg.Audit.MaxSpoolSize.Bytes()),
+		timeout:       cfg.Audit.Timeout.Duration,
+		client:        newHTTPClient(cfg.Integration.ConnectTimeout.Duration, cfg.Audit.Timeout.Duration),
+		hostname:      hostname,
+		log:           log,
+		spool:         spool,
+		spoolPath:     cfg.Audit.SpoolPath,
+		offsetPath:    cfg.Audit.SpoolPath + ".offset",
+		size:          stat.Size(),
+		wake:          make(chan struct{}, 1),
+		quit:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	if data, err := ioutil.ReadFile(exporter.offsetPath); err == nil {
+		offset, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		// the spool was replaced if it's shorter than the offset
+		if err == nil && offset >= 0 && offset <= exporter.size {
+			exporter.offset = offset
+		}
+	}
+
+	// terminate an event cut short by a crash, so it doesn't swallow the next one
+	if exporter.size > 0 {
+		last := make([]byte, 1)
+		if _, err := spool.ReadAt(last, exporter.size-1); err == nil && last[0] != '\n' {
+			n, _ := spool.Write([]byte("\n"))
+			exporter.size += int64(n)
+		}
+	}
+
+	if exporter.offset < exporter.size {
+		log.Info().
+			Str("event", "audit_spool").
+			Int64("bytes", exporter.size-exporter.offset).
+			Msg("Sending audit events left in the spool")
+	}
+
+	go exporter.send()
+	exporter.signal()
+	return exporter, nil
+}
+
+// record appends an event to the spool. Events are dropped with a warning when
+// the undelivered events in the spool have reached Audit.MaxSpoolSize.
+func (exporter *auditExporter) record(event auditEvent) {
+	if exporter == nil {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	if event.Outcome == "" {
+		event.Outcome = auditSuccess
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+
+	if exporter.maxSpoolSize > 0 && exporter.size-exporter.offset+int64(len(line)) > exporter.maxSpoolSize {
+		metrics.add("audit.dropped", 1)
+		if exporter.dropped == 0 {
+			exporter.log.Error().
+				Str("event", "audit_spool_full").
+				Str("action", event.Action).
+				Msg("Audit spool is full, dropping audit events until it is drained")
+		}
+		exporter.dropped++
+		return
+	}
+
+	n, err := exporter.spool.Write(line)
+	exporter.size += int64(n)
+	if err != nil {
+		metrics.add("audit.dropped", 1)
+		exporter.log.Error().
+			Err(err).
+			Str("event", "audit_spool_failed").
+			Str("action", event.Action).
+			Msg("Failed to write audit event to the spool")
+		return
+	}
+	metrics.add("audit.recorded", 1)
+	exporter.signal()
+}
+
+func (exporter *auditExporter) signal() {
+	select {
+	case exporter.wake <- struct{}{}:
+	default:
+	}
+}
+
+// send delivers the spooled events until Close is called, retrying failed
+// deliveries with exponential backoff
+func (exporter *auditExporter) send() {
+	defer close(exporter.done)
+
+	delay := auditRetryDelay
+	for {
+		processed, err := exporter.deliverBatch()
+		if err != nil {
+			metrics.add("audit.deliveryFailures", 1)
+			exporter.log.Warn().
+				Err(err).
+				Str("event", "audit_delivery_failed").
+				Dur("retryIn", delay).
+				Msg("Failed to deliver audit events, retrying later")
+
+			select {
+			case <-time.After(delay):
+			case <-exporter.quit:
+				return
+			}
+			if delay *= 2; delay > auditMaxRetryDelay {
+				delay = auditMaxRetryDelay
+			}
+			continue
+		}
+		delay = auditRetryDelay
+		if processed > 0 {
+			continue
+		}
+
+		select {
+		case <-exporter.wake:
+		case <-exporter.quit:
+			// last attempt for the events recorded during shutdown
+			for {
+				if processed, err := exporter.deliverBatch(); err != nil || processed == 0 {
+					return
+				}
+			}
+		}
+	}
+}
+
+// deliverBatch sends the next unsent events and advances the offset past them.
+// Returns the number of spooled lines processed, including unreadable ones that
+// were skipped.
+func (exporter *auditExporter) deliverBatch() (processed int, err error) {
+	exporter.mu.Lock()
+	offset, size := exporter.offset, exporter.size
+	exporter.mu.Unlock()
+	if offset >= size {
+		return 0, nil
+	}
+
+	var batch []auditEvent
+	consumed := int64(0)
+	reader := bufio.NewReader(io.NewSectionReader(exporter.spool, offset, size-offset))
+	for processed < auditBatchSize {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break // only complete lines are sent
+		}
+		consumed += int64(len(line))
+		processed++
+
+		var event auditEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			exporter.log.Warn().
+				Err(err).
+				Str("event", "audit_spool_corrupt").
+				Msg("Skipping unreadable event in the audit spool")
+			continue
+		}
+		batch = append(batch, event)
+	}
+
+	if len(batch) > 0 {
+		if err := exporter.deliver(batch); err != nil {
+			return 0, err
+		}
+		metrics.add("audit.delivered", uint64(len(batch)))
+	}
+
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+
+	exporter.offset += consumed
+	if exporter.offset == exporter.size {
+		// everything was delivered, start over with an empty spool
+		if err := exporter.spool.Truncate(0); err == nil {
+			exporter.offset, exporter.size = 0, 0
+		}
+	} else if exporter.offset >= auditCompactThreshold && exporter.offset >= exporter.size-exporter.offset {
+		if err := exporter.compact(); err != nil {
+			exporter.log.Error().
+				Err(err).
+				Str("event", "audit_spool_failed").
+				Msg("Failed to compact the audit spool")
+		}
+	}
+	if err := exporter.saveOffset(); err != nil {
+		exporter.log.Error().
+			Err(err).
+			Str("event", "audit_spool_failed").
+			Msg("Failed to save the audit spool offset, events may be sent again after a restart")
+	}
+	if exporter.dropped > 0 && exporter.size-exporter.offset < exporter.maxSpoolSize {
+		exporter.log.Warn().
+			Str("event", "audit_spool_full").
+			Int("dropped", exporter.dropped).
+			Msg("Audit spool has room again")
+		exporter.dropped = 0
+	}
+	return processed, nil
+}
+
+// compact replaces the spool with a copy of its undelivered events, so the
+// delivered ones don't take up disk space while new events keep coming in. The
+// offset is reset before the copy replaces the spool, so a crash in between
+// sends the delivered events again rather than skipping undelivered ones. Must
+// be called with mu held, by the sender.
+func (exporter *auditExporter) compact() error {
+	tmpPath := exporter.spoolPath + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	pending := exporter.size - exporter.offset
+	_, err = io.Copy(tmp, io.NewSectionReader(exporter.spool, exporter.offset, pending))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	delivered := exporter.offset
+	exporter.offset = 0
+	if err := exporter.saveOffset(); err != nil {
+		exporter.offset = delivered
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, exporter.spoolPath); err != nil {
+		// keep using the old spool
+		exporter.offset = delivered
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	exporter.spool.Close()
+	exporter.spool = tmp
+	exporter.size = pending
+	return nil
+}
+
+// saveOffset replaces the offset file, so a crash leaves either the old or the
+// new offset
+func (exporter *auditExporter) saveOffset() error {
+	tmpPath := exporter.offsetPath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(strconv.FormatInt(exporter.offset, 10)+"\n"), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, exporter.offsetPath)
+}
+
+// deliver sends a batch of events to the endpoint
+func (exporter *auditExporter) deliver(batch []auditEvent) error {
+	messages := make([]string, len(batch))
+	for i, event := range batch {
+		if exporter.format == "cef" {
+			messages[i] = event.cef()
+		} else {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			messages[i] = string(data)
+		}
+	}
+
+	switch exporter.endpoint.Scheme {
+	case "http", "https":
+		return exporter.deliverHTTP(messages)
+	default:
+		for i, event := range batch {
+			messages[i] = exporter.syslogMessage(event, messages[i])
+		}
+		return exporter.deliverSyslog(messages)
+	}
+}
+
+// deliverHTTP posts the events as lines of a single request body. Any 2xx
+// response counts as delivered.
+func (exporter *auditExporter) deliverHTTP(messages []string) error {
+	body := strings.Join(messages, "\n") + "\n"
+	req, err := http.NewRequest(http.MethodPost, exporter.endpoint.String(), strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if exporter.format == "cef" {
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	if exporter.authorization != "" {
+		req.Header.Set("Authorization", exporter.authorization)
+	}
+
+	resp, err := exporter.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Audit endpoint responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// syslogMessage wraps an event in an RFC 5424 syslog message with the log
+// audit facility
+func (exporter *auditExporter) syslogMessage(event auditEvent, payload string) string {
+	const facility = 13
+	severity := 6 // informational
+	if event.Outcome == auditFailure {
+		severity = 4 // warning
+	}
+	return fmt.Sprintf("<%d>1 %s %s fileuploader - %s - %s",
+		facility*8+severity, event.Time.UTC().Format(time.RFC3339Nano), exporter.hostname, event.Action, payload)
+}
+
+// deliverSyslog writes the messages to the syslog server, one per line over
+// TCP and TLS and one per datagram over UDP. The connection is kept open for
+// later deliveries. Over UDP, a message lost on the way can't be noticed.
+func (exporter *auditExporter) deliverSyslog(messages []string) error {
+	if exporter.conn == nil {
+		dialer := &net.Dialer{Timeout: exporter.timeout}
+		var conn net.Conn
+		var err error
+		switch exporter.endpoint.Scheme {
+		case "syslog+tls":
+			conn, err = tls.DialWithDialer(dialer, "tcp", exporter.endpoint.Host, &tls.Config{ServerName: exporter.endpoint.Hostname()})
+		case "syslog+udp":
+			conn, err = dialer.Dial("udp", exporter.endpoint.Host)
+		default:
+			conn, err = dialer.Dial("tcp", exporter.endpoint.Host)
+		}
+		if err != nil {
+			return err
+		}
+		exporter.conn = conn
+	}
+
+	exporter.conn.SetWriteDeadline(time.Now().Add(exporter.timeout))
+	var err error
+	if exporter.endpoint.Scheme == "syslog+udp" {
+		for _, message := range messages {
+			if _, err = exporter.conn.Write([]byte(message)); err != nil {
+				break
+			}
+		}
+	} else {
+		var buf bytes.Buffer
+		for _, message := range messages {
+			buf.WriteString(message)
+			buf.WriteByte('\n')
+		}
+		_, err = exporter.conn.Write(buf.Bytes())
+	}
+	if err != nil {
+		exporter.conn.Close()
+		exporter.conn = nil
+	}
+	return err
+}
+
+// Close makes a last attempt at delivering the spooled events and closes the
+// spool. Undelivered events are sent after the next start.
+func (exporter *auditExporter) Close() {
+	if exporter == nil {
+		return
+	}
+	close(exporter.quit)
+	<-exporter.done
+
+	if exporter.conn != nil {
+		exporter.conn.Close()
+	}
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	exporter.spool.Close()
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestAuditSpoolLimitAndCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileuploader-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	spoolPath := filepath.Join(dir, "audit-spool.jsonl")
+	delivered := strings.Repeat(`{"action":"delivered"}`+"\n", 100)
+	pending := `{"action":"pending"}` + "\n"
+	if err := ioutil.WriteFile(spoolPath, []byte(delivered+pending), 0600); err != nil {
+		t.Fatal(err)
+	}
+	spool, err := os.OpenFile(spoolPath, os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := zerolog.Nop()
+	exporter := &auditExporter{
+		log:          &log,
+		spool:        spool,
+		spoolPath:    spoolPath,
+		offsetPath:   spoolPath + ".offset",
+		size:         int64(len(delivered + pending)),
+		offset:       int64(len(delivered)),
+		maxSpoolSize: int64(len(delivered + pending)),
+		wake:         make(chan struct{}, 1),
+	}
+	defer exporter.spool.Close()
+
+	// only the undelivered events count towards MaxSpoolSize
+	exporter.record(auditEvent{Action: "recorded"})
+	if exporter.dropped != 0 {
+		t.Fatal("Expected the event to be spooled, as most of the spool was delivered")
+	}
+
+	if err := exporter.compact(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(spoolPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 2 || lines[0] != strings.TrimSuffix(pending, "\n") || !strings.Contains(lines[1], `"action":"recorded"`) {
+		t.Fatalf("Expected only the undelivered events to be kept, got %q", content)
+	}
+	if exporter.offset != 0 || exporter.size != int64(len(content)) {
+		t.Fatalf("Expected offset 0 and size %d, got %d and %d", len(content), exporter.offset, exporter.size)
+	}
+	if offset, err := ioutil.ReadFile(exporter.offsetPath); err != nil || string(offset) != "0\n" {
+		t.Fatalf("Expected the saved offset to be reset, got %q (%v)", offset, err)
+	}
+
+	// events are appended to the compacted spool
+	exporter.record(auditEvent{Action: "appended"})
+	content, err = ioutil.ReadFile(spoolPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(content)) != exporter.size || !strings.Contains(string(content), `"action":"appended"`) {
+		t.Fatalf("Expected the event to be appended to the compacted spool, got %q", content)
+	}
+}
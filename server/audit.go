@@ -0,0 +1,243 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/events"
+	"github.com/tus/tusd/cmd/tusd/cli/hooks"
+)
+
+// actions of audit events
+const (
+	auditUploadCreated     = "upload.created"
+	auditUploadCompleted   = "upload.completed"
+	auditUploadDeleted     = "upload.deleted"
+	auditUploadQuarantined = "upload.quarantined"
+	auditUploadDownloaded  = "upload.downloaded"
+	auditAuthFailure       = "auth.failure"
+	auditAccessDenied      = "access.denied"
+	auditAdminAction       = "admin.action"
+)
+
+// outcomes of audit events
+const (
+	auditSuccess = "success"
+	auditFailure = "failure"
+)
+
+// validateAudit checks the [Audit] section when the export is enabled
+func (cfg *Config) validateAudit() error {
+	if cfg.Audit.Endpoint == "" {
+		return nil
+	}
+
+	endpoint, err := url.Parse(cfg.Audit.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return fmt.Errorf("Audit.Endpoint %#v is not a valid URL", cfg.Audit.Endpoint)
+	}
+	switch endpoint.Scheme {
+	case "syslog+tcp", "syslog+tls", "syslog+udp":
+		if endpoint.Port() == "" {
+			return fmt.Errorf("Audit.Endpoint %#v must include a port", cfg.Audit.Endpoint)
+		}
+	case "http", "https":
+	default:
+		return fmt.Errorf("Unsupported Audit.Endpoint scheme %#v, expected syslog+tcp, syslog+tls, syslog+udp, http or https", endpoint.Scheme)
+	}
+
+	switch cfg.Audit.Format {
+	case "json", "cef":
+	default:
+		return fmt.Errorf("Unsupported Audit.Format %#v", cfg.Audit.Format)
+	}
+	if cfg.Audit.Timeout.Duration <= 0 {
+		return fmt.Errorf("Audit.Timeout must be greater than 0, got %s", cfg.Audit.Timeout)
+	}
+	if cfg.Audit.SpoolPath == "" {
+		return errors.New("Audit.SpoolPath must be set when Audit.Endpoint is set")
+	}
+	return nil
+}
+
+// CEF names and severities of the audit actions
+var auditActionSignatures = map[string]struct {
+	name     string
+	severity int
+}{
+	auditUploadCreated:     {"Upload created", 3},
+	auditUploadCompleted:   {"Upload completed", 3},
+	auditUploadDeleted:     {"Upload deleted", 5},
+	auditUploadQuarantined: {"Upload quarantined", 7},
+	auditUploadDownloaded:  {"Upload downloaded", 2},
+	auditAuthFailure:       {"Authentication failure", 7},
+	auditAccessDenied:      {"Access denied", 6},
+	auditAdminAction:       {"Admin action", 5},
+}
+
+// auditEvent is a security relevant event for Audit.Endpoint. Unlike the
+// operational log, the fields are stable and it is only written when the
+// audit export is enabled.
+type auditEvent struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	Outcome     string    `json:"outcome"`
+	RemoteIP    string    `json:"remoteIp,omitempty"`
+	Account     string    `json:"account,omitempty"`
+	Issuer      string    `json:"issuer,omitempty"`
+	UploadID    string    `json:"uploadId,omitempty"`
+	Method      string    `json:"method,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	AdminAction string    `json:"adminAction,omitempty"`
+	DownloadURL string    `json:"downloadUrl,omitempty"`
+}
+
+// cef formats the event in the ArcSight Common Event Format
+func (event auditEvent) cef() string {
+	signature := auditActionSignatures[event.Action]
+	if signature.name == "" {
+		signature.name = event.Action
+	}
+
+	extensions := [][2]string{
+		{"rt", strconv.FormatInt(event.Time.UnixNano()/int64(time.Millisecond), 10)},
+		{"act", event.Action},
+		{"outcome", event.Outcome},
+		{"src", event.RemoteIP},
+		{"suser", event.Account},
+		{"fileId", event.UploadID},
+		{"requestMethod", event.Method},
+		{"request", event.Path},
+		{"reason", event.Reason},
+	}
+	if event.Issuer != "" {
+		extensions = append(extensions, [2]string{"cs1Label", "issuer"}, [2]string{"cs1", event.Issuer})
+	}
+	if event.AdminAction != "" {
+		extensions = append(extensions, [2]string{"cs2Label", "adminAction"}, [2]string{"cs2", event.AdminAction})
+	}
+	if event.DownloadURL != "" {
+		extensions = append(extensions, [2]string{"cs3Label", "downloadUrl"}, [2]string{"cs3", event.DownloadURL})
+	}
+	if event.Status != 0 {
+		extensions = append(extensions, [2]string{"cn1Label", "status"}, [2]string{"cn1", strconv.Itoa(event.Status)})
+	}
+
+	var parts []string
+	for _, extension := range extensions {
+		if key, value := extension[0], extension[1]; value != "" {
+			parts = append(parts, key+"="+cefExtensionEscaper.Replace(value))
+		}
+	}
+
+	return fmt.Sprintf("CEF:0|Kiwi IRC|fileuploader|1.0|%s|%s|%d|%s",
+		cefHeaderEscaper.Replace(event.Action),
+		cefHeaderEscaper.Replace(signature.name),
+		signature.severity,
+		strings.Join(parts, " "))
+}
+
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+var cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+
+// auditRequests is a middleware recording the admin API requests, rejected
+// credentials, denied requests and downloads as audit events
+func (serv *UploadServer) auditRequests(c *gin.Context) {
+	c.Next()
+
+	status := c.Writer.Status()
+	event := auditEvent{
+		Method: c.Request.Method,
+		Path:   c.Request.URL.Path,
+		Status: status,
+	}
+	if status >= http.StatusBadRequest {
+		event.Outcome = auditFailure
+	}
+	if code, ok := c.Get(errorCodeKey); ok {
+		event.Reason, _ = code.(string)
+	}
+
+	adminPath := strings.TrimSuffix(serv.cfg.Server.AdminPath, "/")
+	isAdmin := serv.adminToken.enabled() && (event.Path == adminPath || strings.HasPrefix(event.Path, adminPath+"/"))
+
+	switch {
+	case status == http.StatusUnauthorized:
+		event.Action = auditAuthFailure
+	case status == http.StatusForbidden:
+		event.Action = auditAccessDenied
+	case isAdmin:
+		event.Action = auditAdminAction
+		if action, ok := c.Get(adminActionKey); ok {
+			event.AdminAction, _ = action.(string)
+			event.UploadID = c.Param("id")
+		}
+	case c.Request.Method == http.MethodGet && c.Param("id") != "" && status != http.StatusNotFound:
+		event.Action = auditUploadDownloaded
+		event.UploadID = c.Param("id")
+	default:
+		return
+	}
+
+	event.RemoteIP, _ = serv.getDirectOrForwardedRemoteIP(c.Request)
+	serv.audit.record(event)
+}
+
+// auditRecorder records the creation and completion of uploads as audit events
+func (serv *UploadServer) auditRecorder(broadcaster *events.TusEventBroadcaster) {
+	channel := broadcaster.Listen("audit", events.DefaultBufferSize, events.OverflowBlock)
+	for {
+		event, ok := <-channel
+		if !ok {
+			return // channel closed
+		}
+
+		var action string
+		switch event.Type {
+		case hooks.HookPostCreate:
+			action = auditUploadCreated
+		case hooks.HookPostFinish:
+			action = auditUploadCompleted
+		default:
+			continue
+		}
+
+		metadata := event.Info.MetaData
+		record := auditEvent{
+			Action:   action,
+			RemoteIP: metadata["RemoteIP"],
+			Account:  metadata["account"],
+			Issuer:   metadata["issuer"],
+			UploadID: event.Info.ID,
+		}
+		if action == auditUploadCompleted {
+			record.DownloadURL = serv.eventDownloadURL(event.Info)
+		}
+		serv.audit.record(record)
+		if action == auditUploadCreated && serv.cfg.Moderation.HoldNewUploads {
+			serv.audit.record(auditEvent{
+				Action:   auditUploadQuarantined,
+				UploadID: event.Info.ID,
+				Reason:   "held_for_moderation",
+			})
+		}
+	}
+}
+
+// auditRemoval records the removal of an upload from the store as an audit
+// event, whether terminated by the client, expired or removed by the server
+func (serv *UploadServer) auditRemoval(id string, reason string) {
+	serv.audit.record(auditEvent{
+		Action:   auditUploadDeleted,
+		UploadID: id,
+		Reason:   reason,
+	})
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tus/tusd"
+)
+
+// maximum number of recent uploads compared when looking for a duplicate POST
+const duplicateCandidateLimit = 20
+
+// metadata field carrying the hex encoded SHA-256 hash of the file a client is
+// about to upload, which lets it be recognised as a duplicate
+const sha256MetadataKey = "sha256"
+
+func isUploadComplete(info tusd.FileInfo) bool {
+	return !info.SizeIsDeferred && info.Offset == info.Size
+}
+
+func (serv *UploadServer) headFile(handler *tusd.UnroutedHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		info, err := serv.store.GetInfo(c.Param("id"))
+		if serv.respondIfUploadGone(c, err) {
+			return
+		}
+		if err == nil && isUploadComplete(info) {
+			// HEAD responses have no body, so the state is signalled in a header
+			c.Header("X-Upload-State", "complete")
+		} else if err == nil {
+			serv.setUploadExpiresForID(c, info.ID)
+		}
+		handler.HeadFile(c.Writer, c.Request)
+	}
+}
+
+// respondIfAlreadyComplete rejects a PATCH to a completed upload with an
+// upload_already_complete error, unless the client's offset already matches the
+// final offset (which tusd answers with a harmless 204). Without this, a client
+// retrying an upload that actually succeeded gets a bare offset mismatch error.
+func (serv *UploadServer) respondIfAlreadyComplete(c *gin.Context) (handled bool) {
+	info, err := serv.store.GetInfo(c.Param("id"))
+	if err != nil || !isUploadComplete(info) {
+		return false
+	}
+
+	finalOffset := strconv.FormatInt(info.Size, 10)
+	if c.GetHeader("Upload-Offset") == finalOffset {
+		return false
+	}
+
+	c.Header("Upload-Offset", finalOffset)
+	c.Header("X-Upload-State", "complete")
+	abortWithErrorResponse(c, http.StatusConflict, "upload_already_complete",
+		"The upload has already been completed", gin.H{"offset": info.Size})
+	return true
+}
+
+// metadataSHA256 returns the hash a client declared in the sha256 metadata
+// field, or nil if it is missing or not a hex encoded SHA-256 hash
+func metadataSHA256(metadata map[string]string) []byte {
+	hash, err := hex.DecodeString(metadata[sha256MetadataKey])
+	if err != nil || len(hash) != sha256.Size {
+		return nil
+	}
+	return hash
+}
+
+// findRecentDuplicate looks for a completed upload created within
+// Storage.DuplicateUploadWindow by the same account with the content hash,
+// size, filename and type of the new upload, to recognise a client retrying an
+// upload that actually succeeded. The content is only known before it is
+// stored if its hash is given, by the client in the sha256 metadata field or
+// by the caller, so nothing matches without one. Anonymous uploads are never
+// matched, as clients sharing an IP address would get each other's uploads.
+func (serv *UploadServer) findRecentDuplicate(req *http.Request, metadata map[string]string, size int64, hash []byte) (id string) {
+	window := serv.cfg.Storage.DuplicateUploadWindow.Duration
+	account := metadata["account"]
+	if window <= 0 || account == "" || hash == nil {
+		return ""
+	}
+
+	since := time.Now().Add(-window).Unix()
+	var candidates []string
+	err := serv.DBConn.DB.Select(&candidates, `
+		SELECT id FROM uploads
+		WHERE jwt_account = ? AND jwt_issuer = ?
+		AND created_at >= ?
+		AND sha256sum = ? AND size = ?
+		AND deleted = 0
+		ORDER BY created_at DESC
+		LIMIT ?
+	`, account, metadata["issuer"], since, hash, size, duplicateCandidateLimit)
+	if err != nil {
+		serv.requestLog(req).Error().
+			Err(err).
+			Msg("Failed to look up recent uploads")
+		return ""
+	}
+
+	for _, candidate := range candidates {
+		info, err := serv.store.GetInfo(candidate)
+		if err != nil || !isUploadComplete(info) {
+			continue
+		}
+		if metadataFilename(info.MetaData) == metadataFilename(metadata) &&
+			info.MetaData["filetype"] == metadata["filetype"] {
+			return candidate
+		}
+	}
+
+	return ""
+}
+
+// respondWithExistingUpload answers a creation request with an existing upload,
+// the same way tusd would answer with a newly created one
+func (serv *UploadServer) respondWithExistingUpload(c *gin.Context, id string, metadata map[string]string) {
+	serv.requestLog(c.Request).Info().
+		Str("event", "duplicate_upload").
+		Str("id", id).
+		Msg("Creation request matched a recently completed upload")
+
+	c.Header("Location", serv.publicBaseURL(c.Request)+"/"+url.PathEscape(id))
+	c.Header("X-Download-URL", serv.downloadURL(c.Request, id, metadata))
+	c.Header("X-Upload-State", "complete")
+	if serv.cfg.Server.CreationResponseBody {
+		serv.writeCreationResponse(c, id, metadata, true)
+		c.Abort()
+		return
+	}
+	c.Status(http.StatusCreated)
+	c.Abort()
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRecentDuplicateUploads(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.JwtSecretsByIssuer = map[string]string{testJwtIssuer: testJwtSecret}
+		cfg.Storage.DuplicateUploadWindow.Duration = time.Hour
+	})
+	defer ts.Close()
+
+	hashOf := func(content string) string {
+		sum := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(sum[:])
+	}
+
+	const content = "0123456789"
+	alice := accountJwt(t, "alice")
+	uploaded := ts.upload(content, map[string]string{"filename": "a.txt", "extjwt": alice, "sha256": hashOf(content)})
+	// and an anonymous one of the same content from the same IP
+	anonymous := ts.upload(content, map[string]string{"filename": "a.txt", "sha256": hashOf(content)})
+
+	tests := []struct {
+		name      string
+		metadata  map[string]string
+		duplicate bool
+	}{
+		{
+			name:      "retry with the same content",
+			metadata:  map[string]string{"filename": "a.txt", "extjwt": accountJwt(t, "alice"), "sha256": hashOf(content)},
+			duplicate: true,
+		},
+		{
+			name:     "different content with the same name and size",
+			metadata: map[string]string{"filename": "a.txt", "extjwt": accountJwt(t, "alice"), "sha256": hashOf("abcdefghij")},
+		},
+		{
+			name:     "no declared hash",
+			metadata: map[string]string{"filename": "a.txt", "extjwt": accountJwt(t, "alice")},
+		},
+		{
+			name:     "malformed hash",
+			metadata: map[string]string{"filename": "a.txt", "extjwt": accountJwt(t, "alice"), "sha256": "0123"},
+		},
+		{
+			name:     "different filename",
+			metadata: map[string]string{"filename": "b.txt", "extjwt": accountJwt(t, "alice"), "sha256": hashOf(content)},
+		},
+		{
+			name:     "another account",
+			metadata: map[string]string{"filename": "a.txt", "extjwt": accountJwt(t, "bob"), "sha256": hashOf(content)},
+		},
+		{
+			name:     "anonymous from the same IP",
+			metadata: map[string]string{"filename": "a.txt", "sha256": hashOf(content)},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp, body := ts.do(ts.newCreationRequest(len(content), test.metadata))
+			if resp.StatusCode != http.StatusCreated {
+				t.Fatalf("Expected status 201, got %d with body %q", resp.StatusCode, body)
+			}
+			location := resp.Header.Get("Location")
+			if test.duplicate {
+				if location != uploaded || resp.Header.Get("X-Upload-State") != "complete" {
+					t.Fatalf("Expected the existing upload %s, got %s", uploaded, location)
+				}
+				return
+			}
+			if location == uploaded || location == anonymous {
+				t.Fatalf("Expected a new upload, got the existing %s", location)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/kiwiirc/plugin-fileuploader/events"
+)
+
+// optional fields of the completion webhook payload, selected with
+// Integration.CompletionWebhookFields
+const (
+	webhookFieldAccount  = "account"
+	webhookFieldIssuer   = "issuer"
+	webhookFieldIP       = "ip"
+	webhookFieldFilename = "filename"
+	webhookFieldTags     = "tags"
+	webhookFieldHash     = "hash"
+	webhookFieldURL      = "url"
+)
+
+var webhookFields = map[string]bool{
+	webhookFieldAccount:  true,
+	webhookFieldIssuer:   true,
+	webhookFieldIP:       true,
+	webhookFieldFilename: true,
+	webhookFieldTags:     true,
+	webhookFieldHash:     true,
+	webhookFieldURL:      true,
+}
+
+// validateCompletionWebhook checks Integration.CompletionWebhookURL and
+// Integration.CompletionWebhookFields
+func (cfg *Config) validateCompletionWebhook() error {
+	for _, field := range cfg.Integration.CompletionWebhookFields {
+		if !webhookFields[field] {
+			return fmt.Errorf("Unknown Integration.CompletionWebhookFields entry %#v, expected one of account, issuer, ip, filename, tags, hash or url", field)
+		}
+	}
+
+	if cfg.Integration.CompletionWebhookURL == "" {
+		return nil
+	}
+	endpoint, err := url.Parse(cfg.Integration.CompletionWebhookURL)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return fmt.Errorf("Integration.CompletionWebhookURL %#v is not a valid http(s) URL", cfg.Integration.CompletionWebhookURL)
+	}
+	return nil
+}
+
+// completionWebhookPayload is POSTed to Integration.CompletionWebhookURL for
+// every completed upload. Only the fields listed in
+// Integration.CompletionWebhookFields are filled in besides the id and size.
+type completionWebhookPayload struct {
+	ID          string    `json:"id"`
+	Size        int64     `json:"size"`
+	CompletedAt time.Time `json:"completedAt"`
+	Account     string    `json:"account,omitempty"`
+	Issuer      string    `json:"issuer,omitempty"`
+	IP          string    `json:"ip,omitempty"`
+	Filename    string    `json:"filename,omitempty"`
+	Tags        string    `json:"tags,omitempty"`
+	Hash        string    `json:"sha256sum,omitempty"`
+	DownloadURL string    `json:"url,omitempty"`
+}
+
+// notifyCompletionWebhook is a post-finish processor sending the completion
+// webhook. A failed delivery is returned as error and not retried.
+func (serv *UploadServer) notifyCompletionWebhook(event *events.TusEvent) error {
+	info := event.Info
+	payload := completionWebhookPayload{
+		ID:          info.ID,
+		Size:        info.Size,
+		CompletedAt: time.Now().UTC(),
+	}
+
+	metadata := info.MetaData
+	for _, field := range serv.cfg.Integration.CompletionWebhookFields {
+		switch field {
+		case webhookFieldAccount:
+			payload.Account = metadata[accountKey]
+		case webhookFieldIssuer:
+			payload.Issuer = metadata[issuerKey]
+		case webhookFieldIP:
+			payload.IP = metadata[remoteIPKey]
+		case webhookFieldFilename:
+			payload.Filename = sanitizeFilename(metadataFilename(metadata))
+		case webhookFieldTags:
+			payload.Tags = metadata["tags"]
+		case webhookFieldHash:
+			var hash []byte
+			err := serv.DBConn.DB.QueryRow(`SELECT sha256sum FROM uploads WHERE id = ?`, info.ID).Scan(&hash)
+			if err != nil {
+				return err
+			}
+			payload.Hash = hex.EncodeToString(hash)
+		case webhookFieldURL:
+			payload.DownloadURL = serv.eventDownloadURL(info)
+		}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	resp, err := serv.webhookClient.Post(serv.cfg.Integration.CompletionWebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		metrics.add("webhook.failures", 1)
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		metrics.add("webhook.failures", 1)
+		return fmt.Errorf("Completion webhook returned status %d", resp.StatusCode)
+	}
+	metrics.add("webhook.delivered", 1)
+	return nil
+}
@@ -7,12 +7,14 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/c2h5oh/datasize"
 	"github.com/kiwiirc/plugin-fileuploader/logging"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
 	"github.com/rs/zerolog"
 )
 
@@ -24,27 +26,170 @@ type LoggerConfig struct {
 
 type Config struct {
 	Server struct {
-		ListenAddress             string
-		BasePath                  string
-		CorsOrigins               []string
-		TrustedReverseProxyRanges []ipnet
+		ListenAddress                string
+		DownloadListenAddress        string
+		DownloadRedirectBase         string
+		DownloadRedirectBypassRanges []ipnet
+		RejectUnknownHosts           bool
+		ListPageSize                 int
+		MaxListPageSize              int
+		BasePath                     string
+		PublicBaseURL                string
+		CreationResponseBody         bool
+		ExplainUnsupportedTusVersion bool
+		ExplainMethodNotAllowed      bool
+		ConcurrentPatches            string
+		ConcurrentPatchWait          duration
+		MaxErrorMessageLength        int
+		CorsOrigins                  []string
+		RequireOrigin                bool
+		TrustedReverseProxyRanges    []ipnet
+		UndeterminedRemoteIP         string
+		ForwardedProtoHeader         string
+		StripUntrustedHeaders        []string
+		EnableMultipartUploads       bool
+		AdminToken                   string
+		AdminTokenFile               string
+		AdminPath                    string
+		PublicManifestPath           string
+		ReadTimeout                  duration
+		ReadHeaderTimeout            duration
+		WriteTimeout                 duration
+		IdleTimeout                  duration
+		MaxConnections               int
+		TLS                          struct {
+			CertFile     string
+			KeyFile      string
+			MinVersion   tlsVersion
+			CipherSuites []cipherSuite
+		}
 	}
 	Storage struct {
-		Path              string
-		ShardLayers       int
-		MaximumUploadSize datasize.ByteSize
+		Path                      string
+		ShardLayers               int
+		MaximumUploadSize         datasize.ByteSize
+		DuplicateUploadWindow     duration
+		UploadIDBits              int
+		DerivativesDir            string
+		MaxUploadDuration         duration
+		ExcessPatchData           string
+		PreallocateSpace          bool
+		AllowEmptyUploads         bool
+		MaxSizePerMimeType        map[string]datasize.ByteSize
+		MaxSizePerOrigin          map[string]datasize.ByteSize
+		Tiers                     []storageTier
+		MaxTotalUploads           int
+		EvictOldestUploads        bool
+		AccountQuotaSoft          datasize.ByteSize
+		AccountQuotaHard          datasize.ByteSize
+		AccountQuotaWarningHeader bool
+		AccountQuotaCharge        string
+		CreateDirectories         bool
+		FileMode                  fileMode
+		DirMode                   fileMode
 	}
 	Database struct {
-		Type string
-		Path string
+		Type                       string
+		Path                       string
+		HardDeleteTerminated       bool
+		KeepTombstones             bool
+		RequireForUpload           bool
+		PersistedMetadataFields    []string
+		MaxPersistedMetadataFields int
+		MaxPersistedMetadataBytes  datasize.ByteSize
+		MaxOpenConns               int
+		MaxIdleConns               int
+		ConnMaxLifetime            duration
+		SQLite                     struct {
+			BusyTimeout duration
+			JournalMode string
+			Synchronous string
+		}
+	}
+	Metadata struct {
+		ReservedFields  []string
+		SensitiveFields []string
 	}
 	Expiration struct {
-		MaxAge           duration
-		IdentifiedMaxAge duration
-		CheckInterval    duration
+		MaxAge            duration
+		IdentifiedMaxAge  duration
+		CheckInterval     duration
+		ReportGoneUploads bool
+	}
+	Downloads struct {
+		SniffContentType   bool
+		DefaultContentType string
+		FilenameOverride   string
+	}
+	Moderation struct {
+		HoldNewUploads bool
+	}
+	Filenames struct {
+		Mode                 filenameMode
+		MaxLength            int
+		DisallowedCharacters string
+	}
+	Watermark struct {
+		Enabled  bool
+		LogoPath string
+		Text     string
+		Position string
+		Opacity  float64
+	}
+	Processing struct {
+		PostFinishConcurrency        int
+		ImageConcurrency             int
+		MaxImageDimension            int
+		MaxImagePixels               int64
+		EventBacklogWarning          int
+		IntegrityCheckBytesPerSecond datasize.ByteSize
+		ContentCategories            map[string][]string
+	}
+	RateLimit struct {
+		CreationsPerAccountPerHour   int
+		CreationsPerIPPerHour        int
+		ManifestRequestsPerIPPerHour int
+		MaxIncompletePerAccount      int
+		MaxIncompletePerIP           int
+	}
+	Security struct {
+		DenyIPRanges      []ipnet
+		DNSBLZones        []string
+		DNSBLCacheTTL     duration
+		ReceiptSigningKey string
+		GeoIPDatabase     string
+		AllowedCountries  []string
+		DeniedCountries   []string
+		UnknownCountry    string
+	}
+	Integration struct {
+		ConnectTimeout           duration
+		AccountVerifyURL         string
+		AccountVerifyTimeout     duration
+		AccountVerifyCacheTTL    duration
+		AccountVerifyFailOpen    bool
+		CompletionWebhookURL     string
+		CompletionWebhookTimeout duration
+		CompletionWebhookFields  []string
+	}
+	Audit struct {
+		Endpoint          string
+		Format            string
+		HTTPAuthorization string
+		Timeout           duration
+		SpoolPath         string
+		MaxSpoolSize      datasize.ByteSize
+	}
+	Jwt struct {
+		RejectUnknownIssuer bool
+		SingleUse           bool
+		AllowedAlgorithms   []string
+		MinSecretLength     int
 	}
-	JwtSecretsByIssuer map[string]string
-	Loggers            []LoggerConfig
+	JwtSecretsByIssuer   map[string]string
+	VirtualHosts         []virtualHostConfig
+	MetadataTransformers []metadataTransformerConfig
+	Loggers              []LoggerConfig
 }
 
 func NewConfig() *Config {
@@ -65,6 +210,269 @@ func (cfg *Config) Load(log *zerolog.Logger, configPath string) (toml.MetaData,
 	return md, configLoadErr
 }
 
+// Validate checks the loaded configuration for values that cannot be used
+func (cfg *Config) Validate() error {
+	if err := cfg.validateTLS(); err != nil {
+		return err
+	}
+
+	timeouts := []struct {
+		key   string
+		value duration
+	}{
+		{"Server.ReadTimeout", cfg.Server.ReadTimeout},
+		{"Server.ReadHeaderTimeout", cfg.Server.ReadHeaderTimeout},
+		{"Server.WriteTimeout", cfg.Server.WriteTimeout},
+		{"Server.IdleTimeout", cfg.Server.IdleTimeout},
+		{"Server.ConcurrentPatchWait", cfg.Server.ConcurrentPatchWait},
+		{"Storage.DuplicateUploadWindow", cfg.Storage.DuplicateUploadWindow},
+		{"Storage.MaxUploadDuration", cfg.Storage.MaxUploadDuration},
+		{"Database.SQLite.BusyTimeout", cfg.Database.SQLite.BusyTimeout},
+		{"Database.ConnMaxLifetime", cfg.Database.ConnMaxLifetime},
+		{"Security.DNSBLCacheTTL", cfg.Security.DNSBLCacheTTL},
+		{"Integration.AccountVerifyCacheTTL", cfg.Integration.AccountVerifyCacheTTL},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value.Duration < 0 {
+			return fmt.Errorf("%s must not be negative, got %s", timeout.key, timeout.value)
+		}
+	}
+
+	// requests to external services must always be bounded, as zero disables the timeout
+	outboundTimeouts := []struct {
+		key   string
+		value duration
+	}{
+		{"Integration.ConnectTimeout", cfg.Integration.ConnectTimeout},
+		{"Integration.AccountVerifyTimeout", cfg.Integration.AccountVerifyTimeout},
+		{"Integration.CompletionWebhookTimeout", cfg.Integration.CompletionWebhookTimeout},
+	}
+	for _, timeout := range outboundTimeouts {
+		if timeout.value.Duration <= 0 {
+			return fmt.Errorf("%s must be greater than 0, got %s", timeout.key, timeout.value)
+		}
+	}
+
+	for _, name := range cfg.Server.StripUntrustedHeaders {
+		if !isHeaderName(name) {
+			return fmt.Errorf("Server.StripUntrustedHeaders entry %#v is not a valid header name", name)
+		}
+	}
+
+	routePrefix, err := routePrefixFromBasePath(cfg.Server.BasePath)
+	if err != nil {
+		return err
+	}
+	if cfg.Server.AdminToken != "" || cfg.Server.AdminTokenFile != "" {
+		if err := validateMountPath("Server.AdminPath", cfg.Server.AdminPath, routePrefix); err != nil {
+			return err
+		}
+	}
+	if manifestPath := cfg.Server.PublicManifestPath; manifestPath != "" {
+		if err := validateMountPath("Server.PublicManifestPath", manifestPath, routePrefix); err != nil {
+			return err
+		}
+		if strings.HasPrefix(manifestPath+"/", strings.TrimSuffix(cfg.Server.AdminPath, "/")+"/") {
+			return fmt.Errorf("Server.PublicManifestPath %#v must not be inside the AdminPath %#v", manifestPath, cfg.Server.AdminPath)
+		}
+	}
+
+	if cfg.Moderation.HoldNewUploads && cfg.Server.AdminToken == "" && cfg.Server.AdminTokenFile == "" {
+		return errors.New("Moderation.HoldNewUploads requires the admin API to be enabled with Server.AdminToken or Server.AdminTokenFile")
+	}
+
+	if key := cfg.Security.ReceiptSigningKey; key != "" {
+		if len(key) < minReceiptKeyLength {
+			return fmt.Errorf("Security.ReceiptSigningKey must be at least %d characters long", minReceiptKeyLength)
+		}
+		if cfg.Server.AdminToken == "" && cfg.Server.AdminTokenFile == "" {
+			return errors.New("Security.ReceiptSigningKey requires the admin API to be enabled with Server.AdminToken or Server.AdminTokenFile")
+		}
+	}
+
+	if err := validatePersistedMetadataFields(cfg.Database.PersistedMetadataFields); err != nil {
+		return err
+	}
+	if cfg.Database.MaxOpenConns < 0 || cfg.Database.MaxIdleConns < 0 {
+		return errors.New("Database.MaxOpenConns and Database.MaxIdleConns must not be negative")
+	}
+
+	if cfg.Database.MaxPersistedMetadataFields < 0 {
+		return fmt.Errorf("Database.MaxPersistedMetadataFields must not be negative, got %d", cfg.Database.MaxPersistedMetadataFields)
+	}
+
+	if err := validateReservedMetadataFields(cfg.Metadata.ReservedFields); err != nil {
+		return err
+	}
+	if err := validateSensitiveMetadataFields(cfg.Metadata.SensitiveFields); err != nil {
+		return err
+	}
+
+	switch strings.ToUpper(cfg.Database.SQLite.JournalMode) {
+	case "", "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF":
+	default:
+		return fmt.Errorf("Unsupported Database.SQLite.JournalMode %#v", cfg.Database.SQLite.JournalMode)
+	}
+	switch strings.ToUpper(cfg.Database.SQLite.Synchronous) {
+	case "", "OFF", "NORMAL", "FULL", "EXTRA":
+	default:
+		return fmt.Errorf("Unsupported Database.SQLite.Synchronous %#v", cfg.Database.SQLite.Synchronous)
+	}
+
+	if err := validateMaxSizePerMimeType(cfg.Storage.MaxSizePerMimeType); err != nil {
+		return err
+	}
+
+	if cfg.Server.MaxErrorMessageLength < 0 {
+		return fmt.Errorf("Server.MaxErrorMessageLength must not be negative, got %d", cfg.Server.MaxErrorMessageLength)
+	}
+	if cfg.Server.MaxConnections < 0 {
+		return fmt.Errorf("Server.MaxConnections must not be negative, got %d", cfg.Server.MaxConnections)
+	}
+	if err := validateUndeterminedRemoteIP(cfg.Server.UndeterminedRemoteIP); err != nil {
+		return err
+	}
+	if err := validateRequireOrigin(cfg.Server.RequireOrigin, cfg.Server.CorsOrigins); err != nil {
+		return err
+	}
+	if err := validateMaxSizePerOrigin(cfg.Storage.MaxSizePerOrigin, cfg.Server.CorsOrigins); err != nil {
+		return err
+	}
+
+	if err := validateConcurrentPatches(cfg.Server.ConcurrentPatches); err != nil {
+		return err
+	}
+
+	if err := validateExcessPatchData(cfg.Storage.ExcessPatchData); err != nil {
+		return err
+	}
+
+	if cfg.Server.ListPageSize < 1 || cfg.Server.ListPageSize > cfg.Server.MaxListPageSize {
+		return fmt.Errorf("Server.ListPageSize must be between 1 and Server.MaxListPageSize (%d), got %d",
+			cfg.Server.MaxListPageSize, cfg.Server.ListPageSize)
+	}
+
+	if base := cfg.Server.DownloadRedirectBase; base != "" {
+		if u, err := url.Parse(base); err != nil || !u.IsAbs() {
+			return fmt.Errorf("Server.DownloadRedirectBase must be an absolute URL, got %#v", base)
+		}
+	}
+
+	if err := cfg.validateCountries(); err != nil {
+		return err
+	}
+
+	if err := validateMetadataTransformers(cfg.MetadataTransformers); err != nil {
+		return err
+	}
+
+	if err := cfg.validateAudit(); err != nil {
+		return err
+	}
+	if err := cfg.validateCompletionWebhook(); err != nil {
+		return err
+	}
+	if err := validateContentCategories(cfg.Processing.ContentCategories); err != nil {
+		return err
+	}
+	if err := validateJwtAlgorithms(cfg.Jwt.AllowedAlgorithms); err != nil {
+		return err
+	}
+	if err := validateJwtSecrets(cfg.JwtSecretsByIssuer, cfg.Jwt.MinSecretLength); err != nil {
+		return err
+	}
+
+	if err := validateVirtualHosts(cfg.VirtualHosts); err != nil {
+		return err
+	}
+
+	if err := validateStorageTiers(cfg.Storage.Tiers); err != nil {
+		return err
+	}
+
+	if cfg.Storage.FileMode.FileMode&0600 != 0600 {
+		return fmt.Errorf("Storage.FileMode %#o must allow the owner to read and write", cfg.Storage.FileMode.FileMode)
+	}
+	if cfg.Storage.DirMode.FileMode&0700 != 0700 {
+		return fmt.Errorf("Storage.DirMode %#o must allow the owner to read, write and enter", cfg.Storage.DirMode.FileMode)
+	}
+
+	if cfg.RateLimit.MaxIncompletePerAccount < 0 {
+		return fmt.Errorf("RateLimit.MaxIncompletePerAccount must not be negative, got %d", cfg.RateLimit.MaxIncompletePerAccount)
+	}
+	if cfg.RateLimit.MaxIncompletePerIP < 0 {
+		return fmt.Errorf("RateLimit.MaxIncompletePerIP must not be negative, got %d", cfg.RateLimit.MaxIncompletePerIP)
+	}
+	if cfg.Storage.MaxTotalUploads < 0 {
+		return fmt.Errorf("Storage.MaxTotalUploads must not be negative, got %d", cfg.Storage.MaxTotalUploads)
+	}
+	if err := validateAccountQuota(cfg.Storage.AccountQuotaSoft, cfg.Storage.AccountQuotaHard, cfg.Storage.AccountQuotaCharge); err != nil {
+		return err
+	}
+
+	idBits := cfg.Storage.UploadIDBits
+	if idBits < shardedfilestore.MinIDBits || idBits > shardedfilestore.MaxIDBits || idBits%8 != 0 {
+		return fmt.Errorf("Storage.UploadIDBits must be a multiple of 8 between %d and %d, got %d",
+			shardedfilestore.MinIDBits, shardedfilestore.MaxIDBits, idBits)
+	}
+
+	if baseMediaType(cfg.Downloads.DefaultContentType) == "" {
+		return fmt.Errorf("Downloads.DefaultContentType %#v is not a valid content type", cfg.Downloads.DefaultContentType)
+	}
+
+	if err := validateFilenameOverride(cfg.Downloads.FilenameOverride); err != nil {
+		return err
+	}
+
+	if cfg.Filenames.MaxLength < 0 {
+		return fmt.Errorf("Filenames.MaxLength must not be negative, got %d", cfg.Filenames.MaxLength)
+	}
+
+	if cfg.Watermark.Enabled {
+		if (cfg.Watermark.LogoPath == "") == (cfg.Watermark.Text == "") {
+			return errors.New("Either Watermark.LogoPath or Watermark.Text must be set when watermarking is enabled")
+		}
+		switch cfg.Watermark.Position {
+		case "top-left", "top-right", "bottom-left", "bottom-right", "center":
+		default:
+			return fmt.Errorf("Unsupported Watermark.Position %#v", cfg.Watermark.Position)
+		}
+		if cfg.Watermark.Opacity < 0 || cfg.Watermark.Opacity > 1 {
+			return fmt.Errorf("Watermark.Opacity must be between 0 and 1, got %g", cfg.Watermark.Opacity)
+		}
+	}
+
+	if cfg.RateLimit.CreationsPerAccountPerHour < 0 || cfg.RateLimit.CreationsPerIPPerHour < 0 || cfg.RateLimit.ManifestRequestsPerIPPerHour < 0 {
+		return errors.New("RateLimit values must not be negative")
+	}
+
+	if cfg.Processing.PostFinishConcurrency < 1 {
+		return fmt.Errorf("Processing.PostFinishConcurrency must be at least 1, got %d", cfg.Processing.PostFinishConcurrency)
+	}
+
+	if cfg.Processing.EventBacklogWarning < 0 {
+		return fmt.Errorf("Processing.EventBacklogWarning must not be negative, got %d", cfg.Processing.EventBacklogWarning)
+	}
+
+	if cfg.Processing.ImageConcurrency < 1 {
+		return fmt.Errorf("Processing.ImageConcurrency must be at least 1, got %d", cfg.Processing.ImageConcurrency)
+	}
+
+	return nil
+}
+
+// validateMountPath checks a path that is mounted next to the upload routes
+func validateMountPath(key string, path string, routePrefix string) error {
+	if !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("%s must start with /, got %#v", key, path)
+	}
+	// gin can't route a static path next to the upload :id parameter
+	if strings.HasPrefix(path+"/", strings.TrimSuffix(routePrefix, "/")+"/") {
+		return fmt.Errorf("%s %#v must not be inside the BasePath %#v", key, path, routePrefix)
+	}
+	return nil
+}
+
 func (cfg *Config) DoPostLoadLogging(log *zerolog.Logger, configPath string, md toml.MetaData) {
 	undecoded := md.Undecoded()
 	if len(undecoded) > 0 {
@@ -77,6 +485,12 @@ func (cfg *Config) DoPostLoadLogging(log *zerolog.Logger, configPath string, md
 			Msg("Extraneous configuration data")
 	}
 
+	if maxDuration := cfg.Storage.MaxUploadDuration.Duration; maxDuration > cfg.Expiration.MaxAge.Duration && maxDuration > cfg.Expiration.IdentifiedMaxAge.Duration {
+		log.Warn().
+			Dur("maxUploadDuration", maxDuration).
+			Msg("Storage.MaxUploadDuration exceeds Expiration.MaxAge and IdentifiedMaxAge, incomplete uploads are expired before reaching it")
+	}
+
 	if len(cfg.Server.TrustedReverseProxyRanges) > 0 {
 		ranges := []string{}
 		for _, rang := range cfg.Server.TrustedReverseProxyRanges {
@@ -88,8 +502,81 @@ func (cfg *Config) DoPostLoadLogging(log *zerolog.Logger, configPath string, md
 	}
 }
 
+// enabledFeatures lists the optional features turned on by this config, for the startup summary
+func (cfg *Config) enabledFeatures() []string {
+	features := []string{}
+	if len(cfg.Server.CorsOrigins) > 0 {
+		features = append(features, "cors")
+	}
+	if len(cfg.Security.DenyIPRanges) > 0 {
+		features = append(features, "ip-denylist")
+	}
+	if len(cfg.Security.DNSBLZones) > 0 {
+		features = append(features, "dnsbl")
+	}
+	if cfg.RateLimit.CreationsPerAccountPerHour > 0 || cfg.RateLimit.CreationsPerIPPerHour > 0 {
+		features = append(features, "rate-limit")
+	}
+	if len(cfg.JwtSecretsByIssuer) > 0 {
+		features = append(features, "extjwt")
+	}
+	if cfg.Jwt.RejectUnknownIssuer {
+		features = append(features, "reject-unknown-issuer")
+	}
+	if cfg.Security.GeoIPDatabase != "" {
+		features = append(features, "geoip")
+	}
+	if cfg.tlsEnabled() {
+		features = append(features, "tls")
+	}
+	if cfg.Jwt.SingleUse {
+		features = append(features, "single-use-jwt")
+	}
+	if cfg.Audit.Endpoint != "" {
+		features = append(features, "audit")
+	}
+	if cfg.Integration.AccountVerifyURL != "" {
+		features = append(features, "account-verification")
+	}
+	if cfg.Integration.CompletionWebhookURL != "" {
+		features = append(features, "completion-webhook")
+	}
+	if cfg.Server.AdminToken != "" || cfg.Server.AdminTokenFile != "" {
+		features = append(features, "admin-api")
+	}
+	if cfg.Server.PublicManifestPath != "" {
+		features = append(features, "public-manifest")
+	}
+	if cfg.Server.EnableMultipartUploads {
+		features = append(features, "multipart-uploads")
+	}
+	if cfg.Filenames.Mode.string == "reject" {
+		features = append(features, "filename-rejection")
+	}
+	if cfg.Watermark.Enabled {
+		features = append(features, "watermark")
+	}
+	if cfg.Database.RequireForUpload {
+		features = append(features, "require-database")
+	}
+	if cfg.Storage.DuplicateUploadWindow.Duration > 0 {
+		features = append(features, "duplicate-upload-window")
+	}
+	if cfg.Moderation.HoldNewUploads {
+		features = append(features, "moderation")
+	}
+	if cfg.Security.ReceiptSigningKey != "" {
+		features = append(features, "receipts")
+	}
+	if cfg.Storage.MaxUploadDuration.Duration > 0 {
+		features = append(features, "max-upload-duration")
+	}
+	return features
+}
+
 func createMultiLogger(loggerConfigs []LoggerConfig) (*zerolog.Logger, error) {
 	var writers []io.Writer
+	minLevel := zerolog.Disabled
 	for _, loggerCfg := range loggerConfigs {
 		var output io.Writer
 		url := loggerCfg.Output.URL
@@ -115,14 +602,13 @@ func createMultiLogger(loggerConfigs []LoggerConfig) (*zerolog.Logger, error) {
 			}
 			output = conn
 		default:
-			fmt.Printf("working url %#v\n", url)
 			return nil, errors.New("invalid log url scheme: " + url.Scheme)
 		}
 
 		switch loggerCfg.Format {
 		case logFormat{"json"}:
 			break
-		case logFormat{"pretty"}:
+		case logFormat{"pretty"}, logFormat{"console"}:
 			output = zerolog.ConsoleWriter{Out: output}
 		default:
 			return nil, errors.New("invalid log format")
@@ -133,9 +619,13 @@ func createMultiLogger(loggerConfigs []LoggerConfig) (*zerolog.Logger, error) {
 			Level:  loggerCfg.Level.Level,
 		}
 		writers = append(writers, levelWriter)
+		if loggerCfg.Level.Level < minLevel {
+			minLevel = loggerCfg.Level.Level
+		}
 	}
 
-	multiLogger := zerolog.New(zerolog.MultiLevelWriter(writers...)).With().Timestamp().Logger()
+	// skip building events that no logger would write
+	multiLogger := zerolog.New(zerolog.MultiLevelWriter(writers...)).Level(minLevel).With().Timestamp().Logger()
 	return &multiLogger, nil
 }
 
@@ -189,7 +679,7 @@ func (f *logFormat) UnmarshalText(text []byte) error {
 	switch formatStr {
 	case "json":
 		fallthrough
-	case "pretty":
+	case "pretty", "console":
 		f.string = formatStr
 	default:
 		return errors.New("Unsupported log serialization format: " + formatStr)
@@ -212,3 +702,67 @@ func (o *logOutput) UnmarshalText(text []byte) error {
 	o.URL = u
 	return nil
 }
+
+////////////////////////////////////////////////////////////////
+
+type fileMode struct {
+	os.FileMode
+}
+
+func (m *fileMode) UnmarshalText(text []byte) error {
+	mode, err := strconv.ParseUint(string(text), 8, 32)
+	if err != nil || mode > 0777 {
+		return errors.New("Unsupported file mode, expected octal permissions such as 0775: " + string(text))
+	}
+	m.FileMode = os.FileMode(mode)
+	return nil
+}
+
+////////////////////////////////////////////////////////////////
+
+type tlsVersion struct {
+	uint16
+}
+
+func (v *tlsVersion) UnmarshalText(text []byte) error {
+	version, ok := tlsVersionsByName[string(text)]
+	if !ok {
+		return errors.New("Unsupported TLS version, expected 1.0, 1.1, 1.2 or 1.3: " + string(text))
+	}
+	v.uint16 = version
+	return nil
+}
+
+////////////////////////////////////////////////////////////////
+
+type cipherSuite struct {
+	uint16
+}
+
+func (s *cipherSuite) UnmarshalText(text []byte) error {
+	suite, ok := cipherSuitesByName[string(text)]
+	if !ok {
+		return errors.New("Unsupported TLS cipher suite: " + string(text))
+	}
+	s.uint16 = suite
+	return nil
+}
+
+////////////////////////////////////////////////////////////////
+
+type filenameMode struct {
+	string
+}
+
+func (m *filenameMode) UnmarshalText(text []byte) error {
+	modeStr := string(text)
+	switch modeStr {
+	case "sanitize":
+		fallthrough
+	case "reject":
+		m.string = modeStr
+	default:
+		return errors.New("Unsupported filename mode: " + modeStr)
+	}
+	return nil
+}
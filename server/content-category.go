@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/kiwiirc/plugin-fileuploader/events"
+)
+
+// category of uploads whose content type matches no Processing.ContentCategories entry
+const otherContentCategory = "other"
+
+// validateContentCategories checks that Processing.ContentCategories maps
+// category names to media types such as "application/pdf" or wildcards such
+// as "image/*", and that no media type is listed for two categories
+func validateContentCategories(categories map[string][]string) error {
+	owners := make(map[string]string)
+	for category, patterns := range categories {
+		if category == "" || len(category) > 32 {
+			return fmt.Errorf("Processing.ContentCategories name %#v must be between 1 and 32 characters long", category)
+		}
+		for _, pattern := range patterns {
+			if !isMimeTypePattern(pattern) {
+				return fmt.Errorf("Processing.ContentCategories entry %#v of %#v is not a media type such as \"text/plain\" or \"image/*\"", pattern, category)
+			}
+			key := strings.ToLower(pattern)
+			if owner, ok := owners[key]; ok {
+				return fmt.Errorf("Processing.ContentCategories lists %#v for both %#v and %#v", pattern, owner, category)
+			}
+			owners[key] = category
+		}
+	}
+	return nil
+}
+
+// contentCategory returns the category of a content type from
+// Processing.ContentCategories. An exact match takes precedence over a
+// wildcard for the top-level type.
+func (serv *UploadServer) contentCategory(contentType string) string {
+	for _, wildcard := range []bool{false, true} {
+		for category, patterns := range serv.cfg.Processing.ContentCategories {
+			for _, pattern := range patterns {
+				if strings.HasSuffix(pattern, "/*") == wildcard && matchesMimeType(pattern, contentType) {
+					return category
+				}
+			}
+		}
+	}
+	return otherContentCategory
+}
+
+// recordContentCategory is a post-finish processor storing the category of an
+// upload in the content_category column for the stats. The category is
+// determined from the sniffed content type, or the filetype from the metadata
+// when sniffing doesn't identify the content.
+func (serv *UploadServer) recordContentCategory(event *events.TusEvent) error {
+	contentType := serv.sniffContentType(event.Info.ID)
+	if contentType == "" {
+		contentType = event.Info.MetaData["filetype"]
+	}
+	category := serv.contentCategory(contentType)
+
+	return db.UpdateRow(serv.DBConn.DB, `UPDATE uploads SET content_category = ? WHERE id = ?`, category, event.Info.ID)
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// languageTagPattern matches well-formed BCP 47 language tags (RFC 5646
+// section 2.1), e.g. "en", "pt-BR" or "zh-Hant-TW". The irregular
+// grandfathered tags such as "i-klingon" are not accepted.
+var languageTagPattern = regexp.MustCompile(`^(?i)(?:` +
+	`(?:[a-z]{2,3}(?:-[a-z]{3}){0,3}|[a-z]{4,8})` + // language
+	`(?:-[a-z]{4})?` + // script
+	`(?:-(?:[a-z]{2}|[0-9]{3}))?` + // region
+	`(?:-(?:[a-z0-9]{5,8}|[0-9][a-z0-9]{3}))*` + // variants
+	`(?:-[0-9a-wy-z](?:-[a-z0-9]{2,8})+)*` + // extensions
+	`(?:-x(?:-[a-z0-9]{1,8})+)?` + // private use
+	`|x(?:-[a-z0-9]{1,8})+` + // private use only
+	`)$`)
+
+// validateLanguage rejects creation requests whose language metadata field is
+// not a well-formed language tag. Returns false if the request was rejected
+// and aborted.
+func validateLanguage(c *gin.Context) bool {
+	metadata := parseMeta(c.Request.Header.Get("Upload-Metadata"))
+	language, ok := metadata["language"]
+	if !ok || languageTagPattern.MatchString(language) {
+		return true
+	}
+
+	abortWithErrorResponse(c, http.StatusBadRequest, "invalid_language",
+		"The language must be a BCP 47 language tag such as \"en\" or \"pt-BR\"", nil)
+	return false
+}
+
+// contentLanguage returns the Content-Language of a download from the
+// language metadata field, or an empty string if none was given
+func contentLanguage(metadata map[string]string) string {
+	language := metadata["language"]
+	if !languageTagPattern.MatchString(language) {
+		return ""
+	}
+	return language
+}
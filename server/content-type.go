@@ -0,0 +1,103 @@
+package server
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/tus/tusd"
+)
+
+// content types that say nothing about the actual content
+var genericContentTypes = map[string]struct{}{
+	"":                         {},
+	"application/octet-stream": {},
+	"binary/octet-stream":      {},
+	"application/unknown":      {},
+}
+
+// content types that browsers may render inline. Everything else is sent as an
+// attachment, as e.g. HTML or SVG may contain scripts. Mirrors the list tusd
+// uses for its own downloads.
+var inlineContentTypes = map[string]struct{}{
+	"text/plain":      {},
+	"image/png":       {},
+	"image/jpeg":      {},
+	"image/gif":       {},
+	"image/bmp":       {},
+	"image/webp":      {},
+	"audio/wave":      {},
+	"audio/wav":       {},
+	"audio/x-wav":     {},
+	"audio/x-pn-wav":  {},
+	"audio/webm":      {},
+	"video/webm":      {},
+	"audio/ogg":       {},
+	"video/ogg":       {},
+	"application/ogg": {},
+}
+
+// baseMediaType returns the lowercased media type without parameters, or an
+// empty string if contentType is malformed
+func baseMediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+// downloadContentType determines the Content-Type of a download. The filetype
+// from the upload metadata is used unless it is missing or generic, then the
+// content is sniffed if Downloads.SniffContentType is set, and otherwise
+// Downloads.DefaultContentType is used. As all responses carry
+// "X-Content-Type-Options: nosniff", browsers rely on this type as is.
+func (serv *UploadServer) downloadContentType(info tusd.FileInfo) string {
+	filetype := info.MetaData["filetype"]
+	if _, generic := genericContentTypes[baseMediaType(filetype)]; !generic {
+		return filetype
+	}
+
+	if serv.cfg.Downloads.SniffContentType {
+		if sniffed := serv.sniffContentType(info.ID); sniffed != "" {
+			return sniffed
+		}
+	}
+
+	return serv.cfg.Downloads.DefaultContentType
+}
+
+// sniffContentType detects the content type from the first bytes of an
+// upload. Returns an empty string if nothing specific was detected.
+func (serv *UploadServer) sniffContentType(id string) string {
+	reader, err := serv.store.GetReader(id)
+	if err != nil {
+		return ""
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	buf := make([]byte, 512)
+	n, _ := io.ReadFull(reader, buf)
+	sniffed := http.DetectContentType(buf[:n])
+	if _, generic := genericContentTypes[baseMediaType(sniffed)]; generic {
+		return ""
+	}
+	return sniffed
+}
+
+// contentDisposition returns the Content-Disposition for a download, inline
+// only for content types that are safe to render in the browser
+func contentDisposition(contentType string, metadata map[string]string) string {
+	disposition := "attachment"
+	if _, inline := inlineContentTypes[baseMediaType(contentType)]; inline {
+		disposition = "inline"
+	}
+
+	if filename := sanitizeFilename(metadataFilename(metadata)); filename != "" {
+		disposition += ";filename=" + strconv.Quote(filename)
+	}
+	return disposition
+}
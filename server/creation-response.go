@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreationResponse is the JSON body of a creation response when
+// Server.CreationResponseBody is enabled. It holds the metadata as normalised
+// by the server, without internal fields such as the uploader IP or the EXTJWT.
+type CreationResponse struct {
+	ID          string `json:"id"`
+	DownloadURL string `json:"url"`
+	Filename    string `json:"filename,omitempty"`
+	Filetype    string `json:"filetype,omitempty"`
+	Language    string `json:"language,omitempty"`
+	Size        *int64 `json:"size,omitempty"`
+	Account     string `json:"account,omitempty"`
+	Complete    bool   `json:"complete"`
+}
+
+func (serv *UploadServer) creationResponse(c *gin.Context, id string, metadata map[string]string, complete bool) CreationResponse {
+	resp := CreationResponse{
+		ID:          id,
+		DownloadURL: serv.downloadURL(c.Request, id, metadata),
+		Filename:    metadataFilename(metadata),
+		Filetype:    metadata["filetype"],
+		Language:    metadata["language"],
+		Account:     metadata["account"],
+		Complete:    complete,
+	}
+	if size, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64); err == nil {
+		resp.Size = &size
+	}
+	return resp
+}
+
+// writeCreationResponse sends a 201 response with a CreationResponse body.
+// Headers set before, like Location and Tus-Resumable, are kept, so clients
+// that only follow the tus protocol are unaffected.
+func (serv *UploadServer) writeCreationResponse(c *gin.Context, id string, metadata map[string]string, complete bool) {
+	c.JSON(http.StatusCreated, serv.creationResponse(c, id, metadata, complete))
+}
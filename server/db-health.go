@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jmoiron/sqlx"
+)
+
+// how long the result of a database health check is reused
+const dbHealthCheckTTL = 5 * time.Second
+
+// dbHealthCheck pings the database at most once per dbHealthCheckTTL
+type dbHealthCheck struct {
+	db *sqlx.DB
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+func newDBHealthCheck(db *sqlx.DB) *dbHealthCheck {
+	return &dbHealthCheck{db: db}
+}
+
+// check returns the error of the last ping, pinging again if the result is stale
+func (h *dbHealthCheck) check() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if now := time.Now(); now.Sub(h.checkedAt) >= dbHealthCheckTTL {
+		h.err = h.db.Ping()
+		h.checkedAt = now
+	}
+	return h.err
+}
+
+// requireDatabase rejects the request with 503 if Database.RequireForUpload is
+// set and the database is unreachable, so that no upload goes unrecorded.
+// Returns false if the request was rejected and aborted.
+func (serv *UploadServer) requireDatabase(c *gin.Context) bool {
+	if serv.dbHealth == nil {
+		return true
+	}
+
+	if err := serv.dbHealth.check(); err != nil {
+		serv.requestLog(c.Request).Error().
+			Err(err).
+			Msg("Database unavailable, rejecting upload")
+		abortWithErrorResponse(c, http.StatusServiceUnavailable, "database_unavailable",
+			"Uploads are temporarily unavailable", nil)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// quick retries of a failed update, for momentary lock contention, e.g. on
+	// a busy SQLite database
+	dbQuickRetries = 3
+	// delay before the first quick retry, doubled for each further one
+	dbUpdateRetryDelay = 50 * time.Millisecond
+	// maximum number of failed updates kept for a later retry
+	dbRetryBufferSize = 1000
+	// how often the failed updates are retried after the quick retries
+	dbRetryFlushInterval = 30 * time.Second
+	// number of periodic retries before a failed update is dropped
+	dbRetryFlushAttempts = 10
+)
+
+type pendingUpdate struct {
+	description string
+	query       string
+	args        []interface{}
+	attempts    int
+	retryAt     time.Time
+}
+
+// retryDelay returns the time to wait before retrying an update that failed
+// after attempts retries: exponential backoff with jitter for the quick
+// retries, dbRetryFlushInterval afterwards
+func retryDelay(attempts int) time.Duration {
+	if attempts >= dbQuickRetries {
+		return dbRetryFlushInterval
+	}
+	delay := dbUpdateRetryDelay << uint(attempts)
+	// between 0.5 and 1.5 times the delay
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)))
+}
+
+// dbRetryBuffer holds single row updates that failed and retries them in the
+// background, so the goroutine that made the update doesn't wait for the
+// database. Updates are retried dbQuickRetries times with backoff, then every
+// dbRetryFlushInterval, and dropped after dbRetryFlushAttempts more retries, or
+// when the buffer is full, starting with the oldest.
+type dbRetryBuffer struct {
+	conn *sqlx.DB
+	log  *zerolog.Logger
+
+	mu      sync.Mutex
+	pending []pendingUpdate
+	closed  bool
+	wake    chan struct{}
+	quit    chan struct{}
+	done    chan struct{}
+}
+
+func newDBRetryBuffer(conn *sqlx.DB, log *zerolog.Logger) *dbRetryBuffer {
+	buffer := &dbRetryBuffer{
+		conn: conn,
+		log:  log,
+		wake: make(chan struct{}, 1),
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(buffer.done)
+		timer := time.NewTimer(dbRetryFlushInterval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-buffer.wake:
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+			case <-buffer.quit:
+				buffer.flush(true)
+				return
+			}
+			timer.Reset(buffer.flush(false))
+		}
+	}()
+
+	return buffer
+}
+
+// add queues an update for a retry. description identifies the update in log
+// messages.
+func (buffer *dbRetryBuffer) add(description string, query string, args ...interface{}) {
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+
+	if buffer.closed {
+		buffer.log.Error().
+			Str("update", description).
+			Msg("Dropped failed database update, server is shutting down")
+		return
+	}
+
+	if len(buffer.pending) >= dbRetryBufferSize {
+		buffer.log.Error().
+			Str("update", buffer.pending[0].description).
+			Msg("Dropped failed database update, retry buffer is full")
+		buffer.pending[0] = pendingUpdate{}
+		buffer.pending = buffer.pending[1:]
+	}
+	buffer.pending = append(buffer.pending, pendingUpdate{
+		description: description,
+		query:       query,
+		args:        args,
+		retryAt:     time.Now().Add(retryDelay(0)),
+	})
+
+	select {
+	case buffer.wake <- struct{}{}:
+	default:
+	}
+}
+
+// flush retries the queued updates that are due, or all of them, keeping the
+// ones that fail again. Returns the time until the next update is due.
+func (buffer *dbRetryBuffer) flush(all bool) (next time.Duration) {
+	now := time.Now()
+
+	buffer.mu.Lock()
+	var due, waiting []pendingUpdate
+	for _, update := range buffer.pending {
+		if all || !update.retryAt.After(now) {
+			due = append(due, update)
+		} else {
+			waiting = append(waiting, update)
+		}
+	}
+	buffer.pending = waiting
+	buffer.mu.Unlock()
+
+	var failed []pendingUpdate
+	delayed := 0
+	for _, update := range due {
+		if err := db.UpdateRow(buffer.conn, update.query, update.args...); err != nil {
+			update.attempts++
+			if update.attempts >= dbQuickRetries+dbRetryFlushAttempts {
+				buffer.log.Error().
+					Err(err).
+					Str("update", update.description).
+					Msg("Dropped failed database update after retrying")
+				continue
+			}
+			update.retryAt = time.Now().Add(retryDelay(update.attempts))
+			failed = append(failed, update)
+			if update.attempts >= dbQuickRetries {
+				delayed++
+			}
+			continue
+		}
+		// only note updates that needed more than a quick retry
+		if update.attempts >= dbQuickRetries {
+			buffer.log.Info().
+				Str("update", update.description).
+				Msg("Applied previously failed database update")
+		}
+	}
+
+	if delayed > 0 {
+		buffer.log.Warn().
+			Int("count", delayed).
+			Msg("Database updates failed again, retrying later")
+	}
+
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+
+	buffer.pending = append(failed, buffer.pending...)
+	if excess := len(buffer.pending) - dbRetryBufferSize; excess > 0 {
+		buffer.pending = buffer.pending[excess:]
+	}
+
+	next = dbRetryFlushInterval
+	for _, update := range buffer.pending {
+		if wait := time.Until(update.retryAt); wait < next {
+			next = wait
+		}
+	}
+	if next < 0 {
+		next = 0
+	}
+	return next
+}
+
+// Close makes a last attempt at the queued updates. Updates added afterwards
+// are dropped.
+func (buffer *dbRetryBuffer) Close() {
+	buffer.mu.Lock()
+	buffer.closed = true
+	buffer.mu.Unlock()
+
+	close(buffer.quit)
+	<-buffer.done
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+)
+
+func TestDBRetryBuffer(t *testing.T) {
+	conn, err := sqlx.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// every connection would get its own in-memory database
+	conn.SetMaxOpenConns(1)
+	if _, err := conn.Exec(`CREATE TABLE uploads (id TEXT PRIMARY KEY, uploader_ip TEXT)`); err != nil {
+		t.Fatal(err)
+	}
+
+	log := zerolog.Nop()
+	buffer := newDBRetryBuffer(conn, &log)
+	defer buffer.Close()
+
+	// the row doesn't exist yet, so the update fails until it is inserted
+	const query = `UPDATE uploads SET uploader_ip = ? WHERE id = ?`
+	added := time.Now()
+	buffer.add("record uploader IP of test", query, "127.0.0.1", "test")
+	if time.Since(added) > dbUpdateRetryDelay/2 {
+		t.Fatal("Expected add to return without waiting for a retry")
+	}
+	if _, err := conn.Exec(`INSERT INTO uploads (id) VALUES ('test')`); err != nil {
+		t.Fatal(err)
+	}
+
+	// a quick retry applies it, long before dbRetryFlushInterval
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var ip *string
+		if err := conn.Get(&ip, `SELECT uploader_ip FROM uploads WHERE id = 'test'`); err != nil {
+			t.Fatal(err)
+		}
+		if ip != nil && *ip == "127.0.0.1" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the failed update to be retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
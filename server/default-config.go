@@ -7,11 +7,74 @@ const defaultConfig = `
 # including HTTPS if configured.
 ListenAddress = "127.0.0.1:8088"
 
+# Optional second listener that only serves downloads (GET <BasePath>/<id>) and
+# the public manifest, so upload creation on ListenAddress can be firewalled
+# while downloads are exposed publicly. ListenAddress keeps serving all routes.
+# Set PublicBaseURL so download URLs point to this listener. Not used when
+# running as a webircgateway plugin.
+DownloadListenAddress = ""
+# DownloadListenAddress = "0.0.0.0:8089"
+
+# Absolute URL of a CDN serving the uploads. When set, downloads are answered
+# with a 302 redirect to <DownloadRedirectBase>/<id>/<filename> instead of being
+# served. Downloads are still served directly on DownloadListenAddress, to
+# requests with the admin token and to clients in DownloadRedirectBypassRanges,
+# so the CDN can fetch the uploads through one of them.
+DownloadRedirectBase = ""
+# DownloadRedirectBase = "https://cdn.example.com/files"
+DownloadRedirectBypassRanges = []
+# DownloadRedirectBypassRanges = [ "198.51.100.0/24" ]
+
+# Reject requests whose Host header matches none of the VirtualHosts below with
+# 421 Misdirected Request, instead of handling them with this config.
+RejectUnknownHosts = false
+
 # When running as a webircgateway plugin, this path will be relative to the
 # webircgateway domain, e.g. https://ws.irc.example.com/files
 BasePath = "/files"
 # BasePath = "https://example.com/files" # external URL for use behind reverse proxy
 
+# Absolute URL that uploads are downloaded from, used to build the URL returned
+# in the X-Download-URL header of a creation response. Set this when the public
+# URL differs from BasePath, e.g. when downloads are served via another host.
+# When empty, BasePath is used if absolute, otherwise the URL is derived from
+# the request. Events without a request, the completion webhook and the audit
+# export, only include the download URL when it is known from the config.
+PublicBaseURL = ""
+# PublicBaseURL = "https://files.example.com/files"
+
+# Include a JSON body in creation responses with the upload id, download URL
+# and the metadata as normalised by the server (filename, filetype, language,
+# size and account). The Location and Tus-Resumable headers are sent as usual.
+CreationResponseBody = false
+
+# Reject requests for an unsupported version of the tus protocol with the JSON
+# error envelope (code "unsupported_tus_version") and the supported version in
+# the Tus-Version header, and log the version the client asked for. When false,
+# tusd's plain text "unsupported version" response is sent instead.
+ExplainUnsupportedTusVersion = true
+
+# Answer requests for an existing route with an unsupported method, e.g. PUT
+# <BasePath>/<id>, with 405 Method Not Allowed in the JSON error envelope (code
+# "method_not_allowed") and the supported methods in the Allow header. Applies
+# to the upload, download and admin routes. Requests on tus routes without a
+# supported Tus-Resumable header are still rejected by the tus version check
+# first. When false, such requests are answered with 404 Not Found.
+ExplainMethodNotAllowed = true
+
+# What happens to a PATCH request for an upload that another PATCH is still
+# writing to, e.g. from a client open in two tabs. "reject" answers 423 Locked
+# right away, "serialize" waits up to ConcurrentPatchWait for the other request
+# to finish. The waiting request then usually gets 409 Conflict, as the upload
+# offset has moved on, and the client resumes from the new offset.
+ConcurrentPatches = "reject"
+ConcurrentPatchWait = "30s"
+
+# Maximum length in bytes of the message in JSON error responses, e.g. for
+# rejection messages returned by metadata transformers. Longer messages are
+# cut off in the response but logged in full. 0 for no limit.
+MaxErrorMessageLength = 256
+
 # Cross-Origin Resource Sharing (CORS)
 # 	If the server will be accessed from a different Origin than the KiwiIRC
 # 	client, it is necessary to explicitly allow the KiwiIRC origin. See
@@ -20,6 +83,51 @@ CorsOrigins = []
 # CorsOrigins = [ "http://example.com" , "https://example.org" ]
 # CorsOrigins = [ "*" ] # to allow all
 
+# Reject requests to BasePath that create, resume, write to or delete uploads
+# with 403 Forbidden (code "origin_required") unless their Origin header is
+# listed in CorsOrigins. Non-browser clients such as curl or native apps send no
+# Origin and are rejected too, which blocks direct use of the upload API.
+# Downloads (GET) are always served, on DownloadListenAddress too, as
+# browsers send no Origin for links and images; CorsOrigins still decides
+# whether scripts of other origins may read them. When disabled, requests
+# without an Origin are served and requests from other origins are only kept
+# from reading the response by the browser. The admin API and metrics are not
+# affected.
+RequireOrigin = false
+
+# Accept plain multipart/form-data uploads at <BasePath>/multipart for legacy
+# clients that don't implement the tus protocol. The file is expected in a
+# "file" form field, an optional EXTJWT token in an "extjwt" field. The response
+# contains the download URL as JSON and in the X-Download-URL header. As the
+# account is only known once the form was read, clients that used up
+# RateLimit.CreationsPerIPPerHour are turned away before, even for an account.
+EnableMultipartUploads = false
+
+# Token required to use the admin API, sent as "Authorization: Bearer <token>".
+# The admin API is disabled while no token is set. When AdminTokenFile is set
+# and the file exists, the token is read from it instead, and tokens rotated
+# through POST <AdminPath>/token/rotate are written to it. Without a token
+# file, a rotated token lasts until AdminToken is changed or the server restarts.
+AdminToken = ""
+AdminTokenFile = ""
+# Path the admin API is mounted on. Must be outside of BasePath. When running
+# as a webircgateway plugin, this path is mounted on the gateway as well.
+AdminPath = "/admin"
+
+# Path of a public JSON manifest listing the completed uploads, with their
+# download URLs, for public file sharing setups. Anyone who can fetch it can
+# download every upload, so leave it empty (disabled) unless all uploads are
+# meant to be public. Uploader IPs and accounts are only included in the admin
+# manifest at GET <AdminPath>/manifest. Must be outside of BasePath.
+PublicManifestPath = ""
+# PublicManifestPath = "/manifest.json"
+
+# Page size of the manifests and admin listings when the request has no limit
+# parameter, and the largest limit accepted. Pages are addressed by cursors and
+# linked in the Link header (rel="next" and rel="prev").
+ListPageSize = 100
+MaxListPageSize = 1000
+
 # Requests from these networks will have their X-Forwarded-For headers trusted
 TrustedReverseProxyRanges = [
 	"10.0.0.0/8",
@@ -30,24 +138,571 @@ TrustedReverseProxyRanges = [
 	"::1/128",
 ]
 
+# What to do with a new upload when the client IP can't be determined, e.g.
+# behind a listener without IP addresses such as a Unix socket, or when a
+# trusted proxy sends a malformed X-Forwarded-For header. "reject" fails the
+# request, "placeholder" stores "unknown" as the uploader IP and continues.
+# IP based checks such as DenyIPRanges don't apply to such uploads, and they
+# share one per-IP rate limit. The reason is logged either way.
+UndeterminedRemoteIP = "reject" # reject | placeholder
+
+# Header used by trusted reverse proxies to pass the scheme (http or https) of
+# the original request. It is used when building absolute URLs such as the
+# Location of a new upload. The header is ignored, and removed, on requests
+# that do not come from TrustedReverseProxyRanges.
+ForwardedProtoHeader = "X-Forwarded-Proto"
+
+# Headers that are only meaningful when set by a trusted reverse proxy. They are
+# removed from requests that do not come from TrustedReverseProxyRanges before
+# any handler runs, so spoofed values can't confuse later processing. The
+# Forwarded, X-Forwarded-Host and ForwardedProtoHeader headers are always
+# removed from such requests.
+StripUntrustedHeaders = [ "X-Forwarded-For", "X-Real-IP" ]
+
+# HTTP server timeouts. These are not used when running as a webircgateway plugin.
+# 	ReadHeaderTimeout limits how long a client may take to send the request
+# 	headers and is the main protection against slow-loris style clients.
+# 	ReadTimeout and WriteTimeout apply to the whole request, including the body
+# 	of every PATCH. Resumable uploads send large chunks over slow links, so keep
+# 	these generous or disabled ("0s") and rely on ReadHeaderTimeout and
+# 	IdleTimeout instead. A stalled PATCH is resumed by the client after the
+# 	connection is dropped, so only the current chunk is lost.
+# 	IdleTimeout limits how long an idle keep-alive connection is held open.
+ReadHeaderTimeout = "10s"
+ReadTimeout = "0s" # 0s disables the timeout
+WriteTimeout = "0s"
+IdleTimeout = "120s"
+
+# Maximum number of TCP connections open at once on ListenAddress, and
+# separately on DownloadListenAddress, to keep a connection flood from
+# exhausting file descriptors. Further connections are not accepted until one
+# closes and wait in the operating system's accept queue, which refuses them
+# once full. Idle keep-alive connections count until IdleTimeout closes them.
+# This is coarser than the per-IP and upload concurrency limits. 0 disables the
+# limit. Not used when running as a webircgateway plugin.
+MaxConnections = 0
+
+# Serve HTTPS instead of HTTP on ListenAddress and DownloadListenAddress. TLS is
+# enabled by setting CertFile and KeyFile, PEM encoded files that are re-read
+# on config reload. Not used when running as a webircgateway plugin.
+[Server.TLS]
+CertFile = ""
+KeyFile = ""
+# Oldest accepted protocol version: 1.0 | 1.1 | 1.2 | 1.3
+MinVersion = "1.2"
+# Cipher suites offered for TLS 1.2 and older, using the names from
+# https://golang.org/pkg/crypto/tls/#pkg-constants. When empty, only suites
+# with forward secrecy and authenticated encryption (ECDHE with AES-GCM or
+# ChaCha20-Poly1305) are offered. The suites of TLS 1.3 are not configurable.
+CipherSuites = []
+# CipherSuites = [ "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384" ]
+
 [Storage]
+# a directory, or ":memory:" to keep uploaded files in memory so they are lost
+# when the process exits, e.g. for tests together with a Database.Path of
+# ":memory:". DerivativesDir and the Tiers paths are then kept in memory too.
 Path = "./uploads"
 ShardLayers = 6
 MaximumUploadSize = "10 MB" # accepts units such as: MB, g, tB, peta, kilobytes, gigabyte
 
+# When a client creates an upload matching one it completed within this window
+# (same account, content hash, length, filename and type), the existing upload
+# is returned instead of creating a new one. This lets clients retrying an
+# upload that actually succeeded finish immediately. As the content isn't known
+# before it is sent, tus clients must declare its hash in the "sha256" metadata
+# field (hex encoded) to be matched. Anonymous uploads are never matched, as
+# clients sharing an IP address would be handed each other's uploads.
+# 0s disables the check.
+DuplicateUploadWindow = "0s"
+
+# Random bits in newly generated upload IDs, which double as the secret needed
+# to download an upload. A multiple of 8 between 128 and 512. Existing uploads
+# keep working when this is changed.
+UploadIDBits = 128
+
+# Directory for files generated from uploads, such as watermarked images. When
+# empty, they are stored next to the upload metadata in Path. A separate
+# directory can be excluded from backups or wiped at any time; missing files
+# are generated again when next requested.
+DerivativesDir = ""
+
+# Maximum time between creating an upload and completing it, regardless of
+# activity. Further PATCH requests to an upload created longer ago are rejected
+# with 410 Gone, and the incomplete upload is removed by the expirer. 0s
+# disables the limit.
+# Independently, the expirer removes every upload, complete or not, after
+# Expiration.MaxAge (IdentifiedMaxAge with an account), so a limit longer than
+# those has no effect. Responses for incomplete uploads carry the end of the
+# earlier of both windows in the Upload-Expires header (tus expiration
+# extension), so clients know until when an upload can be resumed. PATCH
+# requests after that are answered with 410 Gone (code "upload_expired", or
+# "upload_duration_exceeded" when this limit ended the window), even before
+# the next expirer run has removed the upload.
+MaxUploadDuration = "0s"
+
+# PATCH requests carrying more data than the rest of the declared Upload-Length
+# are answered with 400 Bad Request (code "upload_length_exceeded"); data past
+# the declared length is never stored. "reject" stores nothing from a request
+# whose Content-Length is too long, "truncate" stores the data up to the
+# declared length first. Requests without a Content-Length are always
+# truncated, as their length is only known once they have been read.
+ExcessPatchData = "reject"
+
+# Reserve the disk space for the declared length of an upload when it is
+# created, so it can't fail halfway because other uploads filled the disk.
+# Creation fails with 507 Insufficient Storage if the space isn't available.
+# The reservation is released when an incomplete upload is removed. Uploads
+# with a deferred length are not preallocated. Only supported on linux, and
+# ignored on filesystems without fallocate support.
+PreallocateSpace = false
+
+# Accept uploads created with "Upload-Length: 0" (or an empty multipart file).
+# They are complete as soon as they are created and go through the usual
+# post-finish processing. When false, they are rejected with 400 Bad Request
+# and the error code "empty_upload", as an empty file is usually a client
+# mistake. Uploads with a deferred length are not affected.
+AllowEmptyUploads = true
+
+# Maximum number of stored uploads, including uploads in progress, regardless
+# of their size. 0 means unlimited. Once reached, new uploads are rejected with
+# 507 Insufficient Storage and the error code "storage_full", unless
+# EvictOldestUploads is set, in which case the oldest completed uploads are
+# removed to make room.
+MaxTotalUploads = 0
+EvictOldestUploads = false
+
+# Bytes an account may store, summed from the database: the size of its
+# completed uploads and the declared Upload-Length of its uploads in progress.
+# Once a new upload would take an account past AccountQuotaHard, it is rejected
+# with 413 Request Entity Too Large and the error code "account_quota_exceeded".
+# As their size isn't known, uploads with a deferred length are rejected with
+# 411 Length Required and the error code "upload_length_required" for accounts
+# while AccountQuotaHard is set. This applies to tus and multipart uploads
+# alike. Past AccountQuotaSoft it
+# is still accepted, but a warning is logged and, with
+# AccountQuotaWarningHeader, the creation response carries an
+# X-Account-Quota-Warning header with the stored bytes and both thresholds.
+# Anonymous uploads are not limited. 0 disables a threshold.
+AccountQuotaSoft = "0"
+AccountQuotaHard = "0"
+AccountQuotaWarningHeader = false
+# Identical files are stored once, however many uploads of them exist, but
+# every upload keeps its own id and is deleted independently; the file is
+# removed with the last upload using it. "logical" charges every upload of an
+# account its full size, "physical" charges a file once per account however
+# many of the account's uploads share it. Files shared between accounts are
+# charged to each of them in both modes.
+AccountQuotaCharge = "logical" # logical | physical
+
+# Create Path, DerivativesDir and the tier paths at startup if they don't
+# exist, with DirMode permissions. The server refuses to start if one of them
+# is missing or not writable.
+CreateDirectories = true
+
+# Permissions of the stored files and of the directories created for them, as
+# octal numbers. The owner must be able to read and write. The process umask
+# may still remove permissions from new files and directories, so use e.g.
+# "0640" with a umask of 027 to give a backup group read access.
+FileMode = "0664"
+DirMode = "0775"
+
+# Lower size limits for specific content types, keyed by media type or by a
+# wildcard such as "image/*". The size limit of the origin still applies on
+# top. The type declared by the client is checked when the upload is created,
+# and both the declared and the sniffed type are checked when it finishes,
+# terminating uploads that exceed either limit.
+# [Storage.MaxSizePerMimeType]
+# "text/plain" = "100 KB"
+# "image/*" = "20 MB"
+
+# Upload size limits for specific origins, replacing MaximumUploadSize for
+# requests with a matching Origin header. The origins must be listed in
+# Server.CorsOrigins. Limits may be higher or lower than MaximumUploadSize.
+# [Storage.MaxSizePerOrigin]
+# "https://kiwiirc.example.com" = "100 MB"
+# "https://embed.example.org" = "5 MB"
+
+# Additional storage roots for finished uploads, e.g. to keep images on fast
+# storage and large files on cheaper storage. When an upload finishes, it is
+# moved to the first tier whose MimeTypes include its declared filetype (any
+# type if empty) and whose MinSize it reaches, or stays below Path if no tier
+# matches. Uploads in progress always stay below Path. The tier of each upload
+# is recorded in the database, so a tier must not be removed or renamed while
+# it still holds uploads.
+# [[Storage.Tiers]]
+# Name = "archive"
+# Path = "/mnt/archive/uploads"
+# MimeTypes = [ "video/*", "application/zip" ]
+# MinSize = "100 MB"
+
 [Database]
 Type = "sqlite3" # sqlite3 | mysql
 
-# for sqlite3: a filesystem path
+# for sqlite3: a filesystem path, or ":memory:" for a database held in memory
+# that is lost when the process exits, e.g. for tests
 # for mysql: a DSN like "user:password@tcp(127.0.0.1:3306)/database". see https://github.com/go-sql-driver/mysql#dsn-data-source-name
 Path = "./uploads.db"
 
+# What happens to the database record of an upload that was deleted by the
+# client or removed by expiration.
+# 	false: the record is kept and marked as deleted, preserving the uploader IP
+# 	       and account for later review. Deleted records are excluded from
+# 	       listings and duplicate checks.
+# 	true:  the record is removed
+HardDeleteTerminated = false
+
+# Record every removed upload in the tombstones table with its id, hash, size,
+# account, the reason it was removed and when. Tombstones are kept when
+# HardDeleteTerminated removes the record and are listed at
+# GET <AdminPath>/tombstones.
+KeepTombstones = false
+
+# What to do with new uploads while the database is unreachable:
+# 	false: accept them; the upload still works but its uploader IP may not be recorded
+# 	true:  reject them with 503 so that every upload is recorded
+RequireForUpload = false
+
+# Client supplied metadata fields stored as JSON in the metadata column of the
+# uploads table. Fields not listed here are never written to the database. The
+# uploader IP and EXTJWT account are stored in their own columns and can't be
+# listed; the EXTJWT token itself is never stored.
+PersistedMetadataFields = []
+# PersistedMetadataFields = [ "filename", "filetype" ]
+
+# Limits on the metadata stored for each upload, counting field names and values
+# towards the bytes. Fields are taken in the order of PersistedMetadataFields; a
+# value exceeding the remaining bytes is truncated and further fields are
+# dropped, with a warning. The upload itself keeps all of its metadata. 0
+# disables a limit.
+MaxPersistedMetadataFields = 0
+MaxPersistedMetadataBytes = "4 KB"
+
+# Connection pool. MaxIdleConns connections are opened at startup so the first
+# uploads don't wait for them, and kept open while idle. 0 for MaxOpenConns or
+# ConnMaxLifetime means no limit. For mysql, set ConnMaxLifetime below the
+# server's wait_timeout. SQLite allows only one writer at a time however many
+# connections are open; more connections only help concurrent reads, such as
+# downloads and the manifest, and are most useful with JournalMode = "WAL".
+MaxOpenConns = 0
+MaxIdleConns = 2
+ConnMaxLifetime = "0s"
+
+# Connection options for sqlite3, ignored for mysql. Options already given in
+# Path, e.g. "./uploads.db?_journal_mode=WAL", take precedence.
+[Database.SQLite]
+# How long a query waits for a lock held by another connection before failing
+# with "database is locked".
+BusyTimeout = "5s"
+# DELETE | TRUNCATE | PERSIST | MEMORY | WAL | OFF, empty for the SQLite default
+# (DELETE). WAL lets downloads read while uploads are recorded and greatly
+# reduces lock errors during upload bursts, but does not work when the database
+# is on a networked filesystem.
+JournalMode = ""
+# JournalMode = "WAL"
+# OFF | NORMAL | FULL | EXTRA, empty for the SQLite default (FULL). NORMAL is
+# safe and faster in WAL mode.
+Synchronous = ""
+
+[Metadata]
+# Upload metadata fields that clients may not set, in addition to the fields
+# set by the server (RemoteIP, RemoteCountry, account and issuer). Creating an
+# upload with one of them is rejected with 400 Bad Request and the error code
+# "reserved_metadata_field". Useful for fields added by a metadata transformer.
+ReservedFields = []
+# ReservedFields = [ "useragent" ]
+
+# Metadata fields whose values are replaced with "[redacted]" when the metadata
+# of a new upload is logged at debug level. The EXTJWT token is always redacted.
+SensitiveFields = []
+# SensitiveFields = [ "email" ]
+
 [Expiration]
 # Valid time units are "ns", "us" (or "µs"), "ms", "s", "m", "h".
 MaxAge = "24h" # 1 day
 IdentifiedMaxAge = "168h" # 1 week
 CheckInterval = "5m"
 
+# Answer HEAD requests for uploads that were expired or terminated with
+# 410 Gone instead of 404, with the reason ("expired", "terminated",
+# "rejected", "evicted" or "missing") in the X-Upload-Gone-Reason header.
+# Clients can then give up instead of restarting the upload. Uploads removed
+# before this version report "deleted", and uploads removed with
+# Database.HardDeleteTerminated are answered with 404 as their record is gone.
+ReportGoneUploads = false
+
+[Watermark]
+# Overlay a logo or a line of text on downloaded PNG and JPEG images. The
+# watermarked copy is produced once when the upload finishes and served instead
+# of the original. Other files, and images finished while this was disabled, are
+# served unchanged. Either LogoPath or Text must be set.
+# Changing the logo, Text, Position or Opacity changes the ?v= version of
+# download URLs, and new watermarked copies are produced when they are next
+# downloaded.
+Enabled = false
+LogoPath = "" # path to a PNG or JPEG logo, drawn at its original size
+# ASCII text in a small bitmap font on a darkened background, enlarged to about
+# a quarter of the width of larger images
+Text = ""
+Position = "bottom-right" # top-left | top-right | bottom-left | bottom-right | center
+Opacity = 0.5 # 0.0 (invisible) to 1.0 (opaque)
+
+[Processing]
+# Maximum number of completed uploads run through the post-finish processing
+# steps at the same time. Further completed uploads wait in a queue.
+PostFinishConcurrency = 4
+
+# Maximum number of images decoded at the same time, e.g. for watermarking.
+# Decoding needs about 4 bytes of memory per pixel, so this bounds memory use.
+ImageConcurrency = 2
+
+# Images larger than this in either dimension or in total pixels are not
+# decoded. The limits are checked against the image header before decoding, so
+# small files that expand to huge images (decompression bombs) are caught.
+MaxImageDimension = 16384
+MaxImagePixels = 40000000
+
+# Upload events are passed to internal listeners such as the uploader IP
+# recorder and the post-finish queue, each buffering up to 16 events. When a
+# listener has this many unread events, a warning is logged, as a full buffer
+# delays all other listeners. The backlog of each listener is reported at
+# GET <AdminPath>/metrics. 0 disables the warning.
+EventBacklogWarning = 12
+
+# POST <AdminPath>/verify hashes the stored files of all completed uploads
+# again in the background and quarantines those that no longer match. It
+# pauses between files so that on average no more than this is read from
+# disk. 0 disables the throttle.
+IntegrityCheckBytesPerSecond = "20 MB"
+
+# Completed uploads are grouped into categories by their content type for the
+# breakdown in GET <AdminPath>/stats. The type is sniffed from the content, or
+# taken from the filetype metadata if sniffing doesn't identify it. Each
+# category lists media types such as "application/pdf" or wildcards such as
+# "image/*"; exact types take precedence over wildcards. Uploads matching no
+# category are counted as "other". A media type may only be listed once.
+# Categories set in the config file are added to these defaults or replace
+# them; an empty list disables a default category.
+[Processing.ContentCategories]
+image = [ "image/*" ]
+video = [ "video/*" ]
+audio = [ "audio/*", "application/ogg" ]
+document = [ "text/*", "application/pdf", "application/postscript", "application/rtf" ]
+archive = [ "application/zip", "application/x-gzip", "application/x-rar-compressed", "application/x-7z-compressed", "application/x-tar" ]
+
+[RateLimit]
+# Maximum number of uploads created per hour, enforced with a token bucket so
+# short bursts up to the limit are allowed. Uploads with a validated EXTJWT
+# account are counted per account, regardless of the IP they come from; other
+# uploads are counted per client IP. Exceeding the limit results in
+# 429 Too Many Requests with a Retry-After header. 0 disables the limit.
+# Counters are kept in memory and restored from the uploads of the past hour on
+# startup and config reload. Uploads removed with HardDeleteTerminated are not
+# counted then.
+CreationsPerAccountPerHour = 0
+CreationsPerIPPerHour = 0
+# Maximum number of requests to the public manifest per client IP and hour.
+ManifestRequestsPerIPPerHour = 60
+
+# Maximum number of uploads a client may have created but not yet completed,
+# counted per EXTJWT account or, for anonymous uploads, per client IP. Further
+# uploads are rejected with 429 Too Many Requests and the error code
+# "too_many_incomplete" until one is completed, terminated or expired. This
+# stops clients from leaving many abandoned uploads behind, while the rate
+# limits above cap how many uploads are created at all. 0 disables the limit.
+MaxIncompletePerAccount = 0
+MaxIncompletePerIP = 0
+
+[Security]
+# Uploads from these networks are rejected with 403 Forbidden. The resolved
+# client IP is checked, i.e. after X-Forwarded-For from trusted proxies.
+DenyIPRanges = []
+# DenyIPRanges = [ "192.0.2.0/24", "2001:db8::/32" ]
+
+# DNS-based blocklists to query for the client IP. A client listed in any zone
+# is rejected. Results, including negative ones, are cached for DNSBLCacheTTL.
+DNSBLZones = []
+# DNSBLZones = [ "dnsbl.dronebl.org", "tor.dan.me.uk" ]
+DNSBLCacheTTL = "1h"
+
+# Restrict uploads by the country of the client IP, looked up in a MaxMind DB
+# file such as GeoLite2-Country.mmdb. The database is read when the server
+# starts, and again on a config reload if the file was modified. The country of
+# each upload is recorded in the country column of the uploads table.
+# 	AllowedCountries: when not empty, only these countries may upload
+# 	DeniedCountries:  these countries are rejected with 403 Forbidden
+# 	UnknownCountry:   "allow" or "deny" clients whose country is unknown, such
+# 	                  as private addresses and addresses missing from the database
+# Countries are ISO 3166-1 alpha-2 codes such as "NZ".
+GeoIPDatabase = ""
+# GeoIPDatabase = "/usr/share/GeoIP/GeoLite2-Country.mmdb"
+AllowedCountries = []
+DeniedCountries = []
+UnknownCountry = "allow"
+
+# Secret used to sign upload receipts, at least 32 characters long. When set,
+# GET <AdminPath>/receipts/<id> returns a signed receipt for a completed upload
+# stating its SHA-256 hash, size, uploader account and upload time, and
+# POST <AdminPath>/receipts/verify checks a receipt. Requires the admin API.
+# Changing the secret invalidates all receipts issued before.
+ReceiptSigningKey = ""
+
+[Downloads]
+# The Content-Type of a download is taken from the "filetype" metadata sent by
+# the uploading client. When that is missing or generic (application/octet-stream),
+# the first 512 bytes of the file are inspected if SniffContentType is enabled,
+# and DefaultContentType is used if that doesn't identify the content either.
+# Downloads are sent with "X-Content-Type-Options: nosniff", so browsers don't
+# sniff on their own. Only safe types such as images are displayed inline.
+SniffContentType = true
+DefaultContentType = "application/octet-stream"
+
+# Who may replace the filename a download is sent with in its
+# Content-Disposition header by adding ?filename=<name> to the download URL.
+# The stored metadata is not changed. The name must conform to the
+# [Filenames] policy and is at most 255 bytes long.
+# 	disabled: nobody, ?filename= is ignored and the stored filename is sent
+# 	admin:    requests with the admin token (Server.AdminToken), others are
+# 	          answered with 403 and the error code "filename_override_forbidden"
+# 	public:   anyone who can download the upload
+FilenameOverride = "admin" # disabled | admin | public
+
+[Moderation]
+# Hold new uploads until a moderator approves them. Downloads of held uploads
+# are answered with 403 and the error code "pending_approval". Held uploads are
+# listed at GET <AdminPath>/uploads/pending and approved with
+# POST <AdminPath>/uploads/<id>/approve, so the admin API must be enabled.
+# Uploads created while this was disabled stay approved.
+HoldNewUploads = false
+
+[Filenames]
+# How filenames supplied in the upload metadata are checked when an upload is created:
+# 	sanitize: the filename is rewritten to conform. Path components, control
+# 	          and disallowed characters are removed and the name is shortened
+# 	          to MaxLength, keeping the extension where possible.
+# 	reject:   the upload is rejected with 400 Bad Request if the filename does
+# 	          not already conform. Nothing is rewritten.
+# The modes are exclusive; only the selected one applies.
+Mode = "sanitize" # sanitize | reject
+
+# Maximum filename length in bytes, 0 for no limit
+MaxLength = 0
+
+# Characters not allowed in filenames, in addition to path separators and
+# control characters which are never allowed
+DisallowedCharacters = ""
+# DisallowedCharacters = "<>:\"|?*"
+
+[Integration]
+# Maximum time to establish a connection, including the TLS handshake, to the
+# external services below. Each service also has a timeout for the whole
+# request. Neither can be disabled.
+ConnectTimeout = "3s"
+
+# Optional callback to check that an EXTJWT account may still upload, e.g. that
+# it hasn't been banned since the token was issued. Uploads with an account
+# POST {"account": "...", "issuer": "..."} to this URL. A 200 response allows
+# the upload and any other response below 500 rejects it with 403 Forbidden.
+# Allowed accounts are remembered for AccountVerifyCacheTTL.
+AccountVerifyURL = ""
+AccountVerifyTimeout = "5s" # whole request, including the connection
+AccountVerifyCacheTTL = "1m"
+# When the callback fails (connection error, timeout or 5xx response), accept
+# the upload if true, otherwise reject it with 503 Service Unavailable.
+AccountVerifyFailOpen = false
+
+# Optional webhook notified of every completed upload with a POST of
+# {"id": "...", "size": 123, "completedAt": "..."}. The fields listed in
+# CompletionWebhookFields are added to the payload: account, issuer, ip (of
+# the uploader), filename, tags (the "tags" metadata), hash (the sha256sum
+# of the content) and url (the public download URL, only known when
+# Server.PublicBaseURL or an absolute BasePath is set). Only add the fields the receiving service may see, as
+# uploader IPs and accounts are personal data. Failed deliveries are logged and
+# not retried.
+CompletionWebhookURL = ""
+CompletionWebhookTimeout = "5s" # whole request, including the connection
+CompletionWebhookFields = [ "hash" ]
+
+[Audit]
+# Optional export of security relevant events to a SIEM, separate from the
+# operational logs: upload creation, completion and deletion, quarantined
+# uploads, downloads, rejected credentials, denied requests and admin API
+# requests. Disabled when Endpoint is empty. Supported endpoints are
+# syslog+tcp://, syslog+tls:// and syslog+udp:// for RFC 5424 syslog, one event
+# per line, and http:// or https:// to POST batches of events, one per line.
+# These settings are only read from the main config and require a restart.
+Endpoint = ""
+# Endpoint = "syslog+tls://siem.example.com:6514"
+# Endpoint = "https://siem.example.com/fileuploader/audit"
+Format = "json" # "json" or "cef" (ArcSight Common Event Format)
+# Authorization header sent to an http(s) endpoint, e.g. "Splunk <token>"
+HTTPAuthorization = ""
+Timeout = "10s" # per delivery, including the connection
+# Events are written to the spool before they are sent and kept there until
+# delivered, also across restarts. An event may be sent twice if the server
+# stops right after sending it. When the undelivered events reach
+# MaxSpoolSize, new events are dropped with an error in the log. Delivered
+# events are removed from the spool as it is drained.
+SpoolPath = "./audit-spool.jsonl"
+MaxSpoolSize = "100 MB"
+
+[Jwt]
+# An EXTJWT from an issuer missing from JwtSecretsByIssuer is ignored by
+# default and the upload proceeds as anonymous. Set this to reject such uploads
+# with 401 Unauthorized and the error code "jwt_unknown_issuer" instead.
+RejectUnknownIssuer = false
+
+# Accept every EXTJWT for a single upload only, so a captured token can't be
+# replayed. Tokens must then carry jti and exp claims. The jti is remembered
+# until the token expires and a second upload with it is rejected with 401
+# Unauthorized and the error code "jwt_replayed". Used jtis are kept in memory,
+# across config reloads but not restarts.
+SingleUse = false
+
+# Signing algorithms accepted for an EXTJWT, regardless of the issuer. Tokens
+# signed with another algorithm are rejected before the issuer's secret is
+# looked up. Only HS256, HS384 and HS512 are supported; unsigned tokens
+# ("none") are never accepted.
+AllowedAlgorithms = [ "HS256", "HS384", "HS512" ]
+
+# Minimum length in bytes of every secret in JwtSecretsByIssuer, not counting
+# surrounding whitespace. The server refuses to start with an empty or shorter
+# secret and lists the affected issuers. Secrets shorter than recommended for
+# the strongest algorithm in AllowedAlgorithms (32 bytes for HS256, 48 for
+# HS384, 64 for HS512) are accepted but logged as a warning at startup.
+MinSecretLength = 8
+
+# Virtual hosts serve several networks from one process. Requests whose Host
+# header matches one of the Hosts of an entry are handled with the profile in
+# its Config file, a complete config of its own with separate issuers, storage,
+# database, CORS origins and limits. Its Server.ListenAddress and VirtualHosts
+# are not used. Profiles must not share a Storage.Path or Database.Path.
+# Relative paths are resolved against the directory of this file. Requests for
+# other hosts are handled with this config, unless Server.RejectUnknownHosts is
+# set. When running as a webircgateway plugin, only the paths of this config
+# are mounted on the gateway, so profiles should use the same BasePath.
+# [[VirtualHosts]]
+# Hosts = [ "files.network-a.example" ]
+# Config = "network-a.config.toml"
+
+# Metadata transformers normalise, enrich or validate the metadata of new
+# uploads before they are created. They run in order, after the uploader IP and
+# EXTJWT account have been added. Each entry sets exactly one of:
+# 	Name:    a transformer implemented in Go and registered with
+# 	         server.RegisterMetadataTransformer
+# 	Command: a program receiving {"metadata": {...}} as JSON on stdin
+# 	URL:     an HTTP endpoint receiving the same JSON in a POST request
+# External transformers answer with {"metadata": {...}}, the complete new
+# metadata, or {"reject": "<message for the client>"} to refuse the upload with
+# RejectStatus (default 422) and the error code "metadata_rejected". A failing
+# transformer, or one exceeding Timeout (default "5s"), fails the upload with
+# 500. The RemoteIP, account and issuer fields can't be changed.
+# [[MetadataTransformers]]
+# Command = [ "/usr/local/bin/normalise-tags" ]
+# Timeout = "2s"
+# [[MetadataTransformers]]
+# URL = "http://127.0.0.1:9000/check-metadata"
+# RejectStatus = 403
+
 # If EXTJWT is supported by the gateway or network, a validated token with an account present (when
 # the user is authenticated to an irc services account) will use the IdentifiedMaxAge setting above
 # instead of the base MaxAge.
@@ -62,7 +717,7 @@ CheckInterval = "5m"
 
 [[Loggers]]
 Level = "info" # debug | info | warn | error | fatal | panic
-Format = "json" # pretty | json
+Format = "json" # json for machine-parseable logs | pretty (or console) for humans
 Output = "stderr:" # stderr: | stdout: | file:/path | udp:ip:port | unix:/path
 
 # [[Loggers]]
@@ -0,0 +1,8 @@
+package server
+
+import "errors"
+
+// freeDiskSpace is not implemented on windows
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, errors.New("Free disk space is not available on windows")
+}
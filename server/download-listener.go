@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/logging"
+)
+
+// binding the download listener is retried while a reloaded server releases it
+const (
+	downloadListenAttempts   = 10
+	downloadListenRetryDelay = 200 * time.Millisecond
+)
+
+// registerDownloadRoutes adds the download routes for uploads to rg. The
+// filename in ":id/:filename" is only there for the benefit of browsers and
+// download managers; both routes serve the upload by its id.
+func (serv *UploadServer) registerDownloadRoutes(rg *gin.RouterGroup) {
+	rg.GET(":id", serv.getFile("id"))
+	rg.GET(":id/:filename", serv.getFile("filename"))
+}
+
+// newDownloadRouter returns a router for Server.DownloadListenAddress that only
+// serves downloads and the public manifest. Creating, resuming and deleting
+// uploads remains limited to Server.ListenAddress.
+func (serv *UploadServer) newDownloadRouter(routePrefix string) *gin.Engine {
+	r := gin.New()
+	r.Use(logging.RequestID(serv.log), logging.GinLogger(serv.log), gin.Recovery(), serv.limitErrorMessages)
+	if serv.audit != nil {
+		r.Use(serv.auditRequests)
+	}
+	serv.handleMethodNotAllowed(r)
+	r.Use(serv.sanitizeForwardedHeaders())
+	// downloads are exempt from Server.RequireOrigin, see requireOrigin
+	r.Use(customizedCors(serv.cfg.Server.CorsOrigins, serv.log))
+	r.Use(func(c *gin.Context) {
+		c.Set(directDownloadKey, true)
+	})
+
+	serv.registerDownloadRoutes(r.Group(routePrefix, requireValidUploadID))
+	if serv.cfg.Server.PublicManifestPath != "" {
+		serv.registerPublicManifestHandler(r)
+	}
+	return r
+}
+
+// serveDownloads runs the download-only listener until Shutdown is called.
+// Failures are logged, as the main listener keeps working without it.
+func (serv *UploadServer) serveDownloads(routePrefix string) {
+	serv.downloadServer = &http.Server{
+		Addr:              serv.cfg.Server.DownloadListenAddress,
+		Handler:           serv.newDownloadRouter(routePrefix),
+		ReadTimeout:       serv.cfg.Server.ReadTimeout.Duration,
+		ReadHeaderTimeout: serv.cfg.Server.ReadHeaderTimeout.Duration,
+		WriteTimeout:      serv.cfg.Server.WriteTimeout.Duration,
+		IdleTimeout:       serv.cfg.Server.IdleTimeout.Duration,
+		TLSConfig:         serv.cfg.tlsConfig(),
+	}
+
+	server := serv.downloadServer
+	go func() {
+		// after a config reload the previous listener may still be closing
+		var listener net.Listener
+		var err error
+		for attempt := 1; attempt <= downloadListenAttempts; attempt++ {
+			if listener, err = net.Listen("tcp", server.Addr); err == nil {
+				break
+			}
+			time.Sleep(downloadListenRetryDelay)
+		}
+		if err != nil {
+			serv.log.Error().
+				Err(err).
+				Str("address", server.Addr).
+				Msg("Failed to start download listener")
+			return
+		}
+
+		serv.log.Info().
+			Str("event", "startup").
+			Str("address", server.Addr).
+			Msg("Download listener listening")
+		if err := serv.serve(server, listener); err != nil && err != http.ErrServerClosed {
+			serv.log.Error().
+				Err(err).
+				Str("address", server.Addr).
+				Msg("Download listener failed")
+		}
+	}()
+}
+
+// shutdownDownloads stops the download-only listener, waiting for downloads in
+// progress to finish
+func (serv *UploadServer) shutdownDownloads() {
+	if serv.downloadServer != nil {
+		serv.downloadServer.Shutdown(context.Background())
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDownloadsAreSentWithNosniff(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.Close()
+
+	routePrefix, err := routePrefixFromBasePath(ts.cfg.Server.BasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloads := httptest.NewServer(ts.newDownloadRouter(routePrefix))
+	defer downloads.Close()
+
+	const content = "<script>alert(1)</script>"
+	uploadURL := ts.upload(content, map[string]string{"filename": "page.html", "filetype": "text/html"})
+	id := uploadID(uploadURL)
+
+	urls := map[string]string{
+		"main listener":                   uploadURL,
+		"main listener with filename":     uploadURL + "/page.html",
+		"download listener":               downloads.URL + "/files/" + id,
+		"download listener with filename": downloads.URL + "/files/" + id + "/page.html",
+	}
+	for name, url := range urls {
+		resp, body := ts.get(url)
+		if resp.StatusCode != http.StatusOK || body != content {
+			t.Fatalf("%s: expected the upload to be served, got status %d with body %q", name, resp.StatusCode, body)
+		}
+		if values := resp.Header["X-Content-Type-Options"]; len(values) != 1 || values[0] != "nosniff" {
+			t.Errorf("%s: expected X-Content-Type-Options: nosniff, got %q", name, values)
+		}
+	}
+}
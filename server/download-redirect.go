@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tus/tusd"
+)
+
+// context key set on requests to the download-only listener
+const directDownloadKey = "directDownload"
+
+// redirectDownload responds with a redirect to the copy of an upload under
+// Server.DownloadRedirectBase, in the <base>/<id>/<filename> form, so a CDN
+// serves the bytes. The CDN pulls from this server through a bypass: the
+// download-only listener, the admin token or an address in
+// Server.DownloadRedirectBypassRanges. Returns true if the request was
+// redirected.
+func (serv *UploadServer) redirectDownload(c *gin.Context, info tusd.FileInfo) (handled bool) {
+	base := serv.cfg.Server.DownloadRedirectBase
+	if base == "" || serv.bypassesDownloadRedirect(c) {
+		return false
+	}
+
+	location := strings.TrimSuffix(base, "/") + "/" + url.PathEscape(info.ID)
+	if filename := sanitizeFilename(metadataFilename(info.MetaData)); filename != "" {
+		location += "/" + url.PathEscape(filename)
+	}
+	if c.Request.URL.RawQuery != "" {
+		location += "?" + c.Request.URL.RawQuery
+	}
+
+	c.Redirect(http.StatusFound, location)
+	c.Abort()
+	return true
+}
+
+// bypassesDownloadRedirect reports whether a download is served directly
+// despite Server.DownloadRedirectBase
+func (serv *UploadServer) bypassesDownloadRedirect(c *gin.Context) bool {
+	if c.GetBool(directDownloadKey) {
+		return true
+	}
+
+	if serv.hasAdminToken(c) {
+		return true
+	}
+
+	remoteIP, err := serv.getDirectOrForwardedRemoteIP(c.Request)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(remoteIP)
+	for _, bypassNet := range serv.cfg.Server.DownloadRedirectBypassRanges {
+		if ip != nil && bypassNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/tus/tusd"
+)
+
+// number of hex digits of the content hash used as the download URL version
+const contentVersionLength = 12
+
+// metadataFilename returns the client supplied filename of an upload, if any
+func metadataFilename(metadata map[string]string) string {
+	if filename := metadata["filename"]; filename != "" {
+		return filename
+	}
+	return metadata["name"]
+}
+
+// sanitizeFilename reduces a client supplied filename to a single path segment
+// without control characters. Returns an empty string if nothing usable remains.
+func sanitizeFilename(filename string) string {
+	filename = strings.Replace(filename, "\\", "/", -1)
+	filename = path.Base(filename)
+
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, filename)
+	filename = strings.TrimSpace(filename)
+
+	switch filename {
+	case ".", "..", "/":
+		return ""
+	}
+	return filename
+}
+
+// configuredBaseURL returns the absolute URL that uploads are publicly
+// reachable under as far as it is known without a request: Server.PublicBaseURL,
+// or else BasePath if it is absolute. Returns an empty string otherwise.
+func (serv *UploadServer) configuredBaseURL() string {
+	if serv.cfg.Server.PublicBaseURL != "" {
+		return strings.TrimSuffix(serv.cfg.Server.PublicBaseURL, "/")
+	}
+
+	basePath := strings.TrimSuffix(serv.cfg.Server.BasePath, "/")
+	if u, err := url.Parse(basePath); err == nil && u.IsAbs() {
+		return basePath
+	}
+	return ""
+}
+
+// publicBaseURL returns the absolute URL that uploads are publicly reachable
+// under. Server.PublicBaseURL takes precedence, then an absolute BasePath, and
+// otherwise the URL is derived from the request.
+func (serv *UploadServer) publicBaseURL(req *http.Request) string {
+	if baseURL := serv.configuredBaseURL(); baseURL != "" {
+		return baseURL
+	}
+
+	basePath := strings.TrimSuffix(serv.cfg.Server.BasePath, "/")
+	return requestScheme(req) + "://" + requestHost(req) + basePath
+}
+
+// downloadURL returns the public download URL for an upload id, in the
+// <base>/<id>/<filename>?v=<version> form when a usable filename and the
+// content version are known
+func (serv *UploadServer) downloadURL(req *http.Request, id string, metadata map[string]string) string {
+	return serv.buildDownloadURL(serv.publicBaseURL(req), id, metadata)
+}
+
+// eventDownloadURL returns the public download URL of the upload of an event,
+// for listeners that have no request to derive the host from, such as the
+// completion webhook and the audit export. Returns an empty string unless
+// Server.PublicBaseURL or an absolute BasePath is configured.
+func (serv *UploadServer) eventDownloadURL(info tusd.FileInfo) string {
+	baseURL := serv.configuredBaseURL()
+	if baseURL == "" {
+		return ""
+	}
+	return serv.buildDownloadURL(baseURL, info.ID, info.MetaData)
+}
+
+// buildDownloadURL appends the id, sanitized filename and content version of
+// an upload to baseURL, see downloadURL
+func (serv *UploadServer) buildDownloadURL(baseURL string, id string, metadata map[string]string) string {
+	downloadURL := baseURL + "/" + url.PathEscape(id)
+
+	if filename := sanitizeFilename(metadataFilename(metadata)); filename != "" {
+		downloadURL += "/" + url.PathEscape(filename)
+	}
+
+	if version := serv.contentVersion(id); version != "" {
+		downloadURL += "?v=" + version
+	}
+
+	return downloadURL
+}
+
+// contentVersion returns a short version string derived from the content hash
+// of a finished upload, or an empty string if the upload isn't finished. When
+// watermarking is enabled, the watermark logo and settings are included, as
+// they change what is downloaded too. Adding it to download URLs changes the
+// URL whenever the downloaded content changes, so caches in front of the
+// server don't serve stale copies. The download handlers ignore the query
+// string, so URLs with an outdated version keep working.
+func (serv *UploadServer) contentVersion(id string) string {
+	var hash []byte
+	err := serv.DBConn.DB.QueryRow(`SELECT sha256sum FROM uploads WHERE id = ?`, id).Scan(&hash)
+	if err != nil || hash == nil {
+		return ""
+	}
+	if serv.watermarker != nil {
+		sum := sha256.Sum256(append(hash, serv.watermarker.fingerprint...))
+		hash = sum[:]
+	}
+	return hex.EncodeToString(hash)[:contentVersionLength]
+}
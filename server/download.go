@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tus/tusd"
+)
+
+// getFile serves the content of an upload. Unlike tusd's GetFile, it supports
+// Range requests with single and multiple ranges (multipart/byteranges) and
+// conditional requests, so media players can seek without downloading the
+// whole file. Requests are counted in the downloads.requests metric, labeled
+// with route, the download route the handler is registered for.
+func (serv *UploadServer) getFile(route string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		metrics.addLabeled("downloads.requests", "route", route, 1)
+		id := c.Param("id")
+
+		// the Content-Type comes from client supplied metadata, which browsers
+		// must not second-guess. Set here as tusd's middleware, which sets it
+		// too, doesn't run on the download listener.
+		c.Header("X-Content-Type-Options", "nosniff")
+
+		info, err := serv.store.GetInfo(id)
+		if err != nil {
+			if os.IsNotExist(err) {
+				respondUploadNotFound(c)
+				return
+			}
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		if serv.rejectIfPendingApproval(c, id) {
+			return
+		}
+
+		if !serv.applyFilenameOverride(c, &info) {
+			return
+		}
+
+		if serv.redirectDownload(c, info) {
+			return
+		}
+
+		if serv.watermarker != nil && serv.serveWatermarked(c.Writer, c.Request, info) {
+			return
+		}
+
+		// like tusd, respond with 204 No Content if no data has been uploaded yet.
+		// Finished empty uploads are served as an empty file.
+		if info.Offset == 0 && (info.Size != 0 || info.SizeIsDeferred) {
+			c.Status(http.StatusNoContent)
+			return
+		}
+
+		reader, err := serv.store.GetReader(id)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+		if closer, ok := reader.(io.Closer); ok {
+			defer closer.Close()
+		}
+		readerAt, ok := reader.(io.ReaderAt)
+		if !ok {
+			c.AbortWithError(http.StatusInternalServerError, fmt.Errorf("Reader for upload %s is not seekable", id)).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		// limit to the current offset, as an incomplete upload may still grow
+		content := io.NewSectionReader(readerAt, 0, info.Offset)
+		serv.serveDownload(c.Writer, c.Request, info, serv.downloadContentType(info), "", content)
+	}
+}
+
+// serveDownload sends content for an upload with http.ServeContent, which
+// handles Range, If-Range and If-None-Match. Finished uploads get an ETag from
+// their content version, with etagSuffix appended for derived variants.
+func (serv *UploadServer) serveDownload(w http.ResponseWriter, req *http.Request, info tusd.FileInfo, contentType string, etagSuffix string, content io.ReadSeeker) {
+	header := w.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Disposition", contentDisposition(contentType, info.MetaData))
+	if language := contentLanguage(info.MetaData); language != "" {
+		header.Set("Content-Language", language)
+	}
+	if version := serv.contentVersion(info.ID); version != "" {
+		header.Set("ETag", `"`+version+etagSuffix+`"`)
+	}
+
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		http.Error(w, "failed to read upload", http.StatusInternalServerError)
+		return
+	}
+	if rangeHeader := req.Header.Get("Range"); rangeHeader != "" {
+		req.Header.Set("Range", withoutEmptySuffixRanges(rangeHeader, size))
+	}
+
+	counter := &countingResponseWriter{ResponseWriter: &rangeErrorResponseWriter{ResponseWriter: w, size: size}}
+	http.ServeContent(counter, req, "", time.Time{}, content)
+	serv.recordDownloadUsage(info, counter.written)
+}
+
+// withoutEmptySuffixRanges removes the suffix ranges of length 0 ("-0") from a
+// Range header, which can't be satisfied but are answered by http.ServeContent
+// with an empty 206 response. If no range is left, a range starting at the end
+// of the content is put in, so the request is answered with 416.
+func withoutEmptySuffixRanges(rangeHeader string, size int64) string {
+	const unit = "bytes="
+	if !strings.HasPrefix(rangeHeader, unit) {
+		return rangeHeader
+	}
+
+	var kept []string
+	for _, spec := range strings.Split(rangeHeader[len(unit):], ",") {
+		spec = strings.TrimSpace(spec)
+		if len(spec) > 1 && spec[0] == '-' && strings.Trim(spec[1:], "0") == "" {
+			continue
+		}
+		kept = append(kept, spec)
+	}
+	if len(kept) == 0 {
+		return fmt.Sprintf("%s%d-", unit, size)
+	}
+	return unit + strings.Join(kept, ",")
+}
+
+// rangeErrorResponseWriter adds the Content-Range header with the length of the
+// content to 416 responses, which http.ServeContent leaves out for malformed
+// ranges
+type rangeErrorResponseWriter struct {
+	http.ResponseWriter
+	size int64
+}
+
+func (w *rangeErrorResponseWriter) WriteHeader(status int) {
+	if status == http.StatusRequestedRangeNotSatisfiable && w.Header().Get("Content-Range") == "" {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", w.size))
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDownloadRanges(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.Close()
+
+	const content = "0123456789abcdefghij"
+	uploadURL := ts.upload(content, map[string]string{"filename": "data.bin"})
+
+	// an upload with 10 of 20 bytes written is served up to its offset
+	incompleteURL := ts.createUpload(len(content), map[string]string{"filename": "partial.bin"})
+	if resp, body := ts.patch(incompleteURL, 0, content[:10]); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Writing upload: got status %d, body %q", resp.StatusCode, body)
+	}
+
+	type part struct {
+		contentRange string
+		body         string
+	}
+	tests := []struct {
+		name         string
+		url          string
+		rangeHeader  string
+		wantStatus   int
+		contentRange string
+		body         string
+		parts        []part // for multipart/byteranges responses
+	}{
+		{
+			name:       "no range",
+			wantStatus: http.StatusOK,
+			body:       content,
+		},
+		{
+			name:         "single range",
+			rangeHeader:  "bytes=2-5",
+			wantStatus:   http.StatusPartialContent,
+			contentRange: "bytes 2-5/20",
+			body:         "2345",
+		},
+		{
+			name:         "single byte",
+			rangeHeader:  "bytes=0-0",
+			wantStatus:   http.StatusPartialContent,
+			contentRange: "bytes 0-0/20",
+			body:         "0",
+		},
+		{
+			name:         "suffix",
+			rangeHeader:  "bytes=-4",
+			wantStatus:   http.StatusPartialContent,
+			contentRange: "bytes 16-19/20",
+			body:         "ghij",
+		},
+		{
+			name:         "suffix longer than the file",
+			rangeHeader:  "bytes=-50",
+			wantStatus:   http.StatusPartialContent,
+			contentRange: "bytes 0-19/20",
+			body:         content,
+		},
+		{
+			name:         "open-ended",
+			rangeHeader:  "bytes=15-",
+			wantStatus:   http.StatusPartialContent,
+			contentRange: "bytes 15-19/20",
+			body:         "fghij",
+		},
+		{
+			name:         "end past the end of the file",
+			rangeHeader:  "bytes=18-100",
+			wantStatus:   http.StatusPartialContent,
+			contentRange: "bytes 18-19/20",
+			body:         "ij",
+		},
+		{
+			name:         "start at the end of the file",
+			rangeHeader:  "bytes=20-",
+			wantStatus:   http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */20",
+		},
+		{
+			name:         "start past the end of the file",
+			rangeHeader:  "bytes=25-30",
+			wantStatus:   http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */20",
+		},
+		{
+			name:         "empty suffix",
+			rangeHeader:  "bytes=-0",
+			wantStatus:   http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */20",
+		},
+		{
+			name:         "empty suffix with another range",
+			rangeHeader:  "bytes=-0,2-3",
+			wantStatus:   http.StatusPartialContent,
+			contentRange: "bytes 2-3/20",
+			body:         "23",
+		},
+		{
+			name:         "malformed",
+			rangeHeader:  "bytes=abc",
+			wantStatus:   http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */20",
+		},
+		{
+			name:         "end before start",
+			rangeHeader:  "bytes=5-2",
+			wantStatus:   http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */20",
+		},
+		{
+			name:        "multiple ranges",
+			rangeHeader: "bytes=0-1,5-6",
+			wantStatus:  http.StatusPartialContent,
+			parts: []part{
+				{"bytes 0-1/20", "01"},
+				{"bytes 5-6/20", "56"},
+			},
+		},
+		{
+			name:        "multiple ranges with suffix and open end",
+			rangeHeader: "bytes=-2, 10-",
+			wantStatus:  http.StatusPartialContent,
+			parts: []part{
+				{"bytes 18-19/20", "ij"},
+				{"bytes 10-19/20", "abcdefghij"},
+			},
+		},
+		{
+			name:         "multiple ranges with one satisfiable",
+			rangeHeader:  "bytes=30-40,3-4",
+			wantStatus:   http.StatusPartialContent,
+			contentRange: "bytes 3-4/20",
+			body:         "34",
+		},
+		{
+			name:         "multiple unsatisfiable ranges",
+			rangeHeader:  "bytes=30-40,50-",
+			wantStatus:   http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */20",
+		},
+		{
+			name:         "open-ended on an incomplete upload",
+			url:          incompleteURL,
+			rangeHeader:  "bytes=5-",
+			wantStatus:   http.StatusPartialContent,
+			contentRange: "bytes 5-9/10",
+			body:         "56789",
+		},
+		{
+			name:         "past the offset of an incomplete upload",
+			url:          incompleteURL,
+			rangeHeader:  "bytes=10-15",
+			wantStatus:   http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */10",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			url := uploadURL
+			if test.url != "" {
+				url = test.url
+			}
+			req, err := http.NewRequest(http.MethodGet, url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.rangeHeader != "" {
+				req.Header.Set("Range", test.rangeHeader)
+			}
+			resp, body := ts.do(req)
+
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("Expected status %d, got %d with body %q", test.wantStatus, resp.StatusCode, body)
+			}
+			if contentRange := resp.Header.Get("Content-Range"); contentRange != test.contentRange {
+				t.Fatalf("Expected Content-Range %q, got %q", test.contentRange, contentRange)
+			}
+			if test.parts == nil {
+				if test.wantStatus != http.StatusRequestedRangeNotSatisfiable && body != test.body {
+					t.Fatalf("Expected body %q, got %q", test.body, body)
+				}
+				return
+			}
+
+			mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+			if err != nil || mediaType != "multipart/byteranges" {
+				t.Fatalf("Expected a multipart/byteranges response, got Content-Type %q", resp.Header.Get("Content-Type"))
+			}
+			reader := multipart.NewReader(strings.NewReader(body), params["boundary"])
+			for i, want := range test.parts {
+				p, err := reader.NextPart()
+				if err != nil {
+					t.Fatalf("Reading part %d: %v", i, err)
+				}
+				data, err := ioutil.ReadAll(p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if contentRange := p.Header.Get("Content-Range"); contentRange != want.contentRange || string(data) != want.body {
+					t.Fatalf("Expected part %d to be %q with Content-Range %q, got %q with %q",
+						i, want.body, want.contentRange, data, contentRange)
+				}
+			}
+			if _, err := reader.NextPart(); err == nil {
+				t.Fatalf("Expected %d parts, got more", len(test.parts))
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rejectEmptyUpload rejects the creation of an upload with a declared length
+// of 0 with 400 and the error code "empty_upload" unless
+// Storage.AllowEmptyUploads is set. Allowed empty uploads are finished by tusd
+// as soon as they are created. Uploads with a deferred length are not
+// affected. Returns true if the request was rejected and aborted.
+func (serv *UploadServer) rejectEmptyUpload(c *gin.Context, size int64) (handled bool) {
+	if size != 0 || serv.cfg.Storage.AllowEmptyUploads {
+		return false
+	}
+
+	abortWithErrorResponse(c, http.StatusBadRequest, "empty_upload", "Empty files cannot be uploaded", nil)
+	return true
+}
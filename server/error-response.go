@@ -0,0 +1,54 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrorResponse is the JSON envelope sent to clients when a request is rejected.
+// Code is a stable machine readable identifier, Message is for humans.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details gin.H  `json:"details,omitempty"`
+}
+
+// context key holding the code of the error response, for the audit events
+const errorCodeKey = "errorCode"
+
+// context key holding Server.MaxErrorMessageLength for the request
+const maxErrorMessageLengthKey = "maxErrorMessageLength"
+
+// limitErrorMessages is a middleware making Server.MaxErrorMessageLength
+// available to abortWithErrorResponse
+func (serv *UploadServer) limitErrorMessages(c *gin.Context) {
+	c.Set(maxErrorMessageLengthKey, serv.cfg.Server.MaxErrorMessageLength)
+}
+
+// abortWithErrorResponse aborts the request and responds with the JSON error envelope.
+// The message is also attached to the gin context so that it shows up in the request log.
+// The message sent to the client is shortened to Server.MaxErrorMessageLength
+// bytes, the log gets it in full. Messages must not contain internal details
+// such as file paths or database errors; attach those as private errors instead.
+func abortWithErrorResponse(c *gin.Context, status int, code string, message string, details gin.H) {
+	c.Error(errors.New(message)).SetType(gin.ErrorTypePublic)
+	c.Set(errorCodeKey, code)
+
+	if maxLength := c.GetInt(maxErrorMessageLengthKey); maxLength > 0 {
+		message = truncateUTF8(message, maxLength)
+	}
+
+	// tusd may have already set these for its own plain text error body
+	header := c.Writer.Header()
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+
+	c.AbortWithStatusJSON(status, gin.H{
+		"error": ErrorResponse{
+			Code:    code,
+			Message: message,
+			Details: details,
+		},
+	})
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// how PATCH requests carrying more data than the rest of the upload are handled
+const (
+	excessPatchDataReject   = "reject"
+	excessPatchDataTruncate = "truncate"
+)
+
+func validateExcessPatchData(mode string) error {
+	switch mode {
+	case excessPatchDataReject, excessPatchDataTruncate:
+		return nil
+	}
+	return fmt.Errorf("Unsupported Storage.ExcessPatchData %#v, expected %#v or %#v",
+		mode, excessPatchDataReject, excessPatchDataTruncate)
+}
+
+// checkPatchLength handles a PATCH request whose body is longer than the rest
+// of the upload's declared length. tusd never stores data past the declared
+// length, but it silently ignores the excess of a body without Content-Length.
+//
+// With Storage.ExcessPatchData = "reject", a request with a Content-Length that
+// is too long is rejected before anything is stored. A body without a length
+// can only be measured while it is stored, so the data up to the declared
+// length is kept and the request fails afterwards, as with "truncate", which
+// does the same for every request.
+//
+// Returns true if the request was rejected and aborted. Otherwise, excess
+// reports after tusd has read the body whether data past the declared length
+// was sent; it is nil when there can't be any.
+func (serv *UploadServer) checkPatchLength(c *gin.Context) (excess func() bool, handled bool) {
+	info, err := serv.store.GetInfo(c.Param("id"))
+	if err != nil || info.SizeIsDeferred {
+		// tusd responds to unknown uploads and enforces MaxSize for deferred lengths
+		return nil, false
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset != info.Offset {
+		// tusd rejects the request for its offset
+		return nil, false
+	}
+	remaining := info.Size - offset
+
+	if length := c.Request.ContentLength; length >= 0 {
+		if length <= remaining {
+			return nil, false
+		}
+		if serv.cfg.Storage.ExcessPatchData == excessPatchDataReject {
+			respondExcessPatchData(c, info.Offset, info.Size)
+			return nil, true
+		}
+		// let tusd store up to the declared length instead of rejecting it all
+		c.Request.ContentLength = remaining
+		return func() bool { return true }, false
+	}
+
+	body := c.Request.Body
+	return func() bool {
+		var next [1]byte
+		n, _ := io.ReadFull(body, next[:])
+		return n > 0
+	}, false
+}
+
+// respondExcessPatchData rejects a PATCH request that carried more data than
+// the rest of the upload. offset is the offset of the upload after the
+// request.
+func respondExcessPatchData(c *gin.Context, offset int64, size int64) {
+	metrics.add("uploads.excessPatchData", 1)
+	c.Header("Upload-Offset", strconv.FormatInt(offset, 10))
+	abortWithErrorResponse(c, http.StatusBadRequest, "upload_length_exceeded",
+		"The request carried more data than the rest of the declared Upload-Length",
+		gin.H{"offset": offset, "length": size})
+}
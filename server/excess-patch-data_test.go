@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestExcessPatchData(t *testing.T) {
+	tests := []struct {
+		name          string
+		mode          string
+		offset        int    // written before the tested PATCH
+		data          string // body of the tested PATCH
+		contentLength bool
+		stored        string
+	}{
+		{"reject", excessPatchDataReject, 0, "0123456789abcde", true, ""},
+		{"reject at offset", excessPatchDataReject, 4, "456789abcde", true, "0123"},
+		{"truncate", excessPatchDataTruncate, 0, "0123456789abcde", true, "0123456789"},
+		{"truncate at offset", excessPatchDataTruncate, 4, "456789abcde", true, "0123456789"},
+		{"reject without Content-Length", excessPatchDataReject, 0, "0123456789abcde", false, "0123456789"},
+		{"truncate without Content-Length", excessPatchDataTruncate, 0, "0123456789abcde", false, "0123456789"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := newTestServer(t, func(cfg *Config) {
+				cfg.Storage.ExcessPatchData = test.mode
+			})
+			defer ts.Close()
+
+			const length = 10
+			uploadURL := ts.createUpload(length, nil)
+			if test.offset > 0 {
+				if resp, body := ts.patch(uploadURL, 0, "0123456789"[:test.offset]); resp.StatusCode != http.StatusNoContent {
+					t.Fatalf("Writing the start of the upload: got status %d, body %q", resp.StatusCode, body)
+				}
+			}
+
+			req := ts.newPatchRequest(uploadURL, test.offset, test.data)
+			if !test.contentLength {
+				req.ContentLength = -1
+			}
+			resp, body := ts.do(req)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("Expected status 400, got %d: %q", resp.StatusCode, body)
+			}
+			if code := decodeErrorResponse(t, body).Code; code != "upload_length_exceeded" {
+				t.Errorf("Expected error code upload_length_exceeded, got %q", code)
+			}
+
+			stored := ts.storedContent(uploadURL)
+			if stored != test.stored {
+				t.Errorf("Expected %q to be stored, got %q", test.stored, stored)
+			}
+			if len(stored) > length {
+				t.Errorf("Stored %d bytes, more than the declared length of %d", len(stored), length)
+			}
+			if strings.ContainsAny(stored, "abcde") {
+				t.Error("Data past the declared length was stored")
+			}
+		})
+	}
+}
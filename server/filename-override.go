@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tus/tusd"
+)
+
+// who may override the download filename with ?filename=
+const (
+	filenameOverrideDisabled = "disabled"
+	filenameOverrideAdmin    = "admin"
+	filenameOverridePublic   = "public"
+)
+
+// maximum length in bytes of a filename override when Filenames.MaxLength
+// doesn't set a lower limit
+const maxFilenameOverrideLength = 255
+
+func validateFilenameOverride(mode string) error {
+	switch mode {
+	case filenameOverrideDisabled, filenameOverrideAdmin, filenameOverridePublic:
+		return nil
+	}
+	return fmt.Errorf("Unsupported Downloads.FilenameOverride %#v, expected %#v, %#v or %#v",
+		mode, filenameOverrideDisabled, filenameOverrideAdmin, filenameOverridePublic)
+}
+
+// applyFilenameOverride replaces the filename a download is sent with by the
+// ?filename= query parameter, as allowed by Downloads.FilenameOverride. The
+// stored metadata is not changed. When overrides are disabled the parameter is
+// ignored, so the stored filename is sent. An override that doesn't conform to
+// the [Filenames] policy is rejected with 400 and the error code
+// "invalid_filename", one from a request that may not override the filename
+// with 403 and "filename_override_forbidden". Returns false if the request was
+// rejected and aborted.
+func (serv *UploadServer) applyFilenameOverride(c *gin.Context, info *tusd.FileInfo) bool {
+	filename, ok := c.GetQuery("filename")
+	if !ok || serv.cfg.Downloads.FilenameOverride == filenameOverrideDisabled {
+		return true
+	}
+
+	switch serv.cfg.Downloads.FilenameOverride {
+	case filenameOverridePublic:
+	case filenameOverrideAdmin:
+		if serv.hasAdminToken(c) {
+			break
+		}
+		fallthrough
+	default:
+		abortWithErrorResponse(c, http.StatusForbidden, "filename_override_forbidden",
+			"The download filename cannot be overridden by this request", nil)
+		return false
+	}
+
+	policy := serv.cfg.Filenames
+	maxLength := policy.MaxLength
+	if maxLength <= 0 || maxLength > maxFilenameOverrideLength {
+		maxLength = maxFilenameOverrideLength
+	}
+	problem := filenameProblem(filename, maxLength, policy.DisallowedCharacters)
+	if filename == "" {
+		problem = "must not be empty"
+	}
+	if problem != "" {
+		abortWithErrorResponse(c, http.StatusBadRequest, "invalid_filename",
+			fmt.Sprintf("The filename %s", problem),
+			gin.H{"maxLength": maxLength, "disallowedCharacters": policy.DisallowedCharacters},
+		)
+		return false
+	}
+
+	// copy the metadata, as info may be shared with the store
+	metadata := make(map[string]string, len(info.MetaData)+1)
+	for key, value := range info.MetaData {
+		metadata[key] = value
+	}
+	metadata["filename"] = filename
+	info.MetaData = metadata
+	return true
+}
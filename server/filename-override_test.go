@@ -0,0 +1,68 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+	"testing"
+)
+
+func TestFilenameOverride(t *testing.T) {
+	const adminToken = "admin-secret"
+
+	tests := []struct {
+		mode       string
+		admin      bool
+		wantStatus int
+		wantName   string
+		wantCode   string
+	}{
+		{filenameOverrideDisabled, false, http.StatusOK, "stored.txt", ""},
+		{filenameOverrideDisabled, true, http.StatusOK, "stored.txt", ""},
+		{filenameOverrideAdmin, false, http.StatusForbidden, "", "filename_override_forbidden"},
+		{filenameOverrideAdmin, true, http.StatusOK, "override.txt", ""},
+		{filenameOverridePublic, false, http.StatusOK, "override.txt", ""},
+	}
+	for _, test := range tests {
+		name := test.mode
+		if test.admin {
+			name += " as admin"
+		}
+		t.Run(name, func(t *testing.T) {
+			ts := newTestServer(t, func(cfg *Config) {
+				cfg.Downloads.FilenameOverride = test.mode
+			})
+			defer ts.Close()
+			ts.adminToken.configure(adminToken)
+
+			uploadURL := ts.upload("hello", map[string]string{"filename": "stored.txt"})
+			req, err := http.NewRequest(http.MethodGet, uploadURL+"?filename=override.txt", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.admin {
+				req.Header.Set("Authorization", "Bearer "+adminToken)
+			}
+			resp, body := ts.do(req)
+
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("Expected status %d, got %d with body %q", test.wantStatus, resp.StatusCode, body)
+			}
+			if test.wantCode != "" {
+				if errResp := decodeErrorResponse(t, body); errResp.Code != test.wantCode {
+					t.Fatalf("Expected error code %q, got %q", test.wantCode, errResp.Code)
+				}
+				return
+			}
+			if body != "hello" {
+				t.Fatalf("Expected the upload to be served, got body %q", body)
+			}
+			_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+			if err != nil {
+				t.Fatalf("Invalid Content-Disposition %q: %v", resp.Header.Get("Content-Disposition"), err)
+			}
+			if params["filename"] != test.wantName {
+				t.Fatalf("Expected the download to be named %q, got %q", test.wantName, params["filename"])
+			}
+		})
+	}
+}
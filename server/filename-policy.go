@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metadata fields that hold the client supplied filename
+var filenameMetadataKeys = []string{"filename", "name"}
+
+// applyFilenamePolicy checks the filename metadata of a creation request against
+// the [Filenames] config. In "sanitize" mode the filenames are rewritten to
+// conform, in "reject" mode a non-conforming filename fails the request with
+// 400. Returns false if the request was rejected and aborted.
+func (serv *UploadServer) applyFilenamePolicy(c *gin.Context) bool {
+	metadata := parseMeta(c.Request.Header.Get("Upload-Metadata"))
+	policy := serv.cfg.Filenames
+
+	for _, key := range filenameMetadataKeys {
+		filename, ok := metadata[key]
+		if !ok {
+			continue
+		}
+
+		if policy.Mode.string == "reject" {
+			if problem := filenameProblem(filename, policy.MaxLength, policy.DisallowedCharacters); problem != "" {
+				abortWithErrorResponse(c, http.StatusBadRequest, "invalid_filename",
+					fmt.Sprintf("The filename %s", problem),
+					gin.H{"maxLength": policy.MaxLength, "disallowedCharacters": policy.DisallowedCharacters},
+				)
+				return false
+			}
+			continue
+		}
+
+		sanitized := conformFilename(filename, policy.MaxLength, policy.DisallowedCharacters)
+		if sanitized == "" {
+			delete(metadata, key)
+		} else {
+			metadata[key] = sanitized
+		}
+	}
+
+	// override original header
+	c.Request.Header.Set("Upload-Metadata", serializeMeta(metadata))
+	return true
+}
+
+// filenameProblem describes why a filename does not conform to the policy, or
+// returns an empty string if it does
+func filenameProblem(filename string, maxLength int, disallowed string) string {
+	switch {
+	case !utf8.ValidString(filename):
+		return "is not valid UTF-8"
+	case maxLength > 0 && len(filename) > maxLength:
+		return fmt.Sprintf("exceeds the maximum length of %d bytes", maxLength)
+	case strings.ContainsAny(filename, disallowed):
+		return "contains disallowed characters"
+	case sanitizeFilename(filename) != filename:
+		return "must be a single path segment without control characters or surrounding whitespace"
+	}
+	return ""
+}
+
+// conformFilename sanitizes a filename, strips disallowed characters and
+// shortens it to maxLength bytes, keeping the extension where possible
+func conformFilename(filename string, maxLength int, disallowed string) string {
+	filename = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(disallowed, r) {
+			return -1
+		}
+		return r
+	}, filename)
+	filename = sanitizeFilename(filename)
+
+	if maxLength <= 0 || len(filename) <= maxLength {
+		return filename
+	}
+
+	ext := path.Ext(filename)
+	if len(ext) >= maxLength {
+		ext = ""
+	}
+	base := strings.TrimSuffix(filename, ext)
+	return strings.TrimSpace(truncateUTF8(base, maxLength-len(ext))) + ext
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// headers that tusd consults when building absolute URLs (RespectForwardedHeaders)
+var forwardedURLHeaders = []string{
+	"Forwarded",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+}
+
+// isFromTrustedProxy reports whether the direct peer of the request is a trusted reverse proxy
+func (serv *UploadServer) isFromTrustedProxy(req *http.Request) bool {
+	remoteIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	return serv.remoteIPisTrusted(net.ParseIP(remoteIP))
+}
+
+// sanitizeForwardedHeaders removes the headers used to reconstruct the public URL
+// of a request, and the headers listed in Server.StripUntrustedHeaders, unless
+// the request comes from a trusted reverse proxy. For trusted proxies using a
+// custom scheme header, the value is copied to X-Forwarded-Proto where tusd
+// expects it.
+func (serv *UploadServer) sanitizeForwardedHeaders() gin.HandlerFunc {
+	protoHeader := serv.cfg.Server.ForwardedProtoHeader
+	stripHeaders := serv.cfg.Server.StripUntrustedHeaders
+
+	return func(c *gin.Context) {
+		header := c.Request.Header
+
+		if !serv.isFromTrustedProxy(c.Request) {
+			for _, name := range forwardedURLHeaders {
+				header.Del(name)
+			}
+			if protoHeader != "" {
+				header.Del(protoHeader)
+			}
+
+			var stripped []string
+			for _, name := range stripHeaders {
+				if _, ok := header[http.CanonicalHeaderKey(name)]; ok {
+					header.Del(name)
+					stripped = append(stripped, name)
+				}
+			}
+			if len(stripped) > 0 {
+				serv.requestLog(c.Request).Debug().
+					Str("event", "untrusted_headers_stripped").
+					Strs("headers", stripped).
+					Msg("Removed headers only accepted from trusted proxies")
+			}
+			return
+		}
+
+		if protoHeader != "" && http.CanonicalHeaderKey(protoHeader) != "X-Forwarded-Proto" {
+			if proto := header.Get(protoHeader); proto != "" {
+				header.Set("X-Forwarded-Proto", proto)
+			}
+		}
+	}
+}
+
+// requestScheme returns the scheme the client used to reach us, honoring the
+// forwarded scheme header. Must be called after sanitizeForwardedHeaders.
+func requestScheme(req *http.Request) string {
+	proto := strings.ToLower(req.Header.Get("X-Forwarded-Proto"))
+	if proto == "http" || proto == "https" {
+		return proto
+	}
+
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestHost returns the host the client used to reach us, honoring
+// X-Forwarded-Host. Must be called after sanitizeForwardedHeaders.
+func requestHost(req *http.Request) string {
+	if forwardedHost := req.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+		return strings.TrimSpace(strings.Split(forwardedHost, ",")[0])
+	}
+	return req.Host
+}
+
+// isHeaderName reports whether name is a valid HTTP header field name, i.e. a
+// non-empty token as defined by RFC 7230
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r > 0x7e || r <= 0x20 || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	maxminddb "github.com/oschwald/maxminddb-golang"
+)
+
+// when the country cache grows beyond this many entries, it is cleared
+const countryCachePurgeThreshold = 10000
+
+// countryResolver looks up the country of client IPs in the GeoIP database of
+// Security.GeoIPDatabase and caches the results. The database doesn't change
+// while the server runs, so entries don't expire.
+type countryResolver struct {
+	reader *maxminddb.Reader
+
+	// of the database file when it was opened
+	modTime time.Time
+	size    int64
+
+	mu    sync.Mutex
+	cache map[string]string
+}
+
+func newCountryResolver(path string) (*countryResolver, error) {
+	reader, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &countryResolver{
+		reader: reader,
+		cache:  make(map[string]string),
+	}, nil
+}
+
+// countryResolvers holds the GeoIP databases opened by the servers of the
+// process by path. Like the audit exporter it outlives a single UploadServer:
+// the server replaced by a config reload keeps handling its outstanding
+// requests while it shuts down, so it can't unmap the database they use. A
+// database is reused by the next server unless its file changed, and only
+// closed when the process stops.
+type countryResolvers struct {
+	mu       sync.Mutex
+	byPath   map[string]*countryResolver
+	replaced []*countryResolver
+}
+
+func newCountryResolvers() *countryResolvers {
+	return &countryResolvers{byPath: make(map[string]*countryResolver)}
+}
+
+// open returns the resolver for the database at path, opening it again if the
+// file was modified since it was last opened
+func (resolvers *countryResolvers) open(path string) (*countryResolver, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	resolvers.mu.Lock()
+	defer resolvers.mu.Unlock()
+
+	current, ok := resolvers.byPath[path]
+	if ok && current.modTime.Equal(stat.ModTime()) && current.size == stat.Size() {
+		return current, nil
+	}
+
+	resolver, err := newCountryResolver(path)
+	if err != nil {
+		return nil, err
+	}
+	resolver.modTime, resolver.size = stat.ModTime(), stat.Size()
+	if ok {
+		// servers that are shutting down may still use it
+		resolvers.replaced = append(resolvers.replaced, current)
+	}
+	resolvers.byPath[path] = resolver
+	return resolver, nil
+}
+
+// Close unmaps all databases. No server may use them anymore.
+func (resolvers *countryResolvers) Close() {
+	resolvers.mu.Lock()
+	defer resolvers.mu.Unlock()
+
+	for path, resolver := range resolvers.byPath {
+		resolver.Close()
+		delete(resolvers.byPath, path)
+	}
+	for _, resolver := range resolvers.replaced {
+		resolver.Close()
+	}
+	resolvers.replaced = nil
+}
+
+// countryRecord holds the fields of a GeoIP2 or GeoLite2 Country or City
+// record needed to find the country of an address
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// Close unmaps the database
+func (r *countryResolver) Close() error {
+	return r.reader.Close()
+}
+
+// country returns the ISO country code of an IP, or an empty string if it is
+// unknown, e.g. for private addresses. Addresses without a located country
+// fall back to the country they are registered in.
+func (r *countryResolver) country(ip net.IP) string {
+	key := ip.String()
+
+	r.mu.Lock()
+	country, ok := r.cache[key]
+	r.mu.Unlock()
+	if ok {
+		return country
+	}
+
+	var record countryRecord
+	if err := r.reader.Lookup(ip, &record); err != nil {
+		// lookup errors are not cached
+		return ""
+	}
+	country = record.Country.ISOCode
+	if country == "" {
+		country = record.RegisteredCountry.ISOCode
+	}
+
+	r.mu.Lock()
+	if len(r.cache) >= countryCachePurgeThreshold {
+		r.cache = make(map[string]string)
+	}
+	r.cache[key] = country
+	r.mu.Unlock()
+	return country
+}
+
+// validateCountries checks the country restriction settings and normalises
+// the country codes to upper case
+func (cfg *Config) validateCountries() error {
+	security := &cfg.Security
+	switch security.UnknownCountry {
+	case "allow", "deny":
+	default:
+		return fmt.Errorf("Security.UnknownCountry must be \"allow\" or \"deny\", got %#v", security.UnknownCountry)
+	}
+
+	for _, list := range []struct {
+		key   string
+		codes []string
+	}{
+		{"Security.AllowedCountries", security.AllowedCountries},
+		{"Security.DeniedCountries", security.DeniedCountries},
+	} {
+		for i, code := range list.codes {
+			code = strings.ToUpper(code)
+			if len(code) != 2 || code[0] < 'A' || code[0] > 'Z' || code[1] < 'A' || code[1] > 'Z' {
+				return fmt.Errorf("%s entry %#v is not a two letter country code", list.key, list.codes[i])
+			}
+			list.codes[i] = code
+		}
+	}
+
+	restricted := len(security.AllowedCountries) > 0 || len(security.DeniedCountries) > 0 || security.UnknownCountry == "deny"
+	if restricted && security.GeoIPDatabase == "" {
+		return errors.New("Security.AllowedCountries, DeniedCountries and UnknownCountry = \"deny\" require Security.GeoIPDatabase")
+	}
+	return nil
+}
+
+// countryAllowed applies Security.AllowedCountries and DeniedCountries to a
+// country code, and Security.UnknownCountry to an empty one
+func (serv *UploadServer) countryAllowed(country string) bool {
+	security := &serv.cfg.Security
+	if country == "" {
+		return security.UnknownCountry == "allow"
+	}
+	for _, denied := range security.DeniedCountries {
+		if country == denied {
+			return false
+		}
+	}
+	if len(security.AllowedCountries) == 0 {
+		return true
+	}
+	for _, allowed := range security.AllowedCountries {
+		if country == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// enforceCountryRestriction looks up the country of the uploader, rejects
+// creation requests from countries that are not allowed with 403
+// country_denied, and records the country in the RemoteCountry metadata field.
+// Returns false if the request was rejected and aborted.
+func (serv *UploadServer) enforceCountryRestriction(c *gin.Context, remoteIP string) bool {
+	if serv.countries == nil {
+		return true
+	}
+
+	ip := net.ParseIP(remoteIP)
+	country := ""
+	if ip != nil {
+		country = serv.countries.country(ip)
+	}
+
+	if !serv.countryAllowed(country) {
+		serv.requestLog(c.Request).Warn().
+			Str("event", "upload_denied").
+			Str("ip", remoteIP).
+			Str("country", country).
+			Msg("Rejected upload from a country that is not allowed")
+		abortWithErrorResponse(c, http.StatusForbidden, "country_denied",
+			"Uploads are not accepted from this location", nil)
+		return false
+	}
+
+	if country != "" {
+		metadata := parseMeta(c.Request.Header.Get("Upload-Metadata"))
+		metadata[remoteCountryKey] = country
+		c.Request.Header.Set("Upload-Metadata", serializeMeta(metadata))
+	}
+	return true
+}
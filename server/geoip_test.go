@@ -0,0 +1,287 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testGeoIPNetworks are written to the fixture database by writeTestGeoIPDatabase
+var testGeoIPNetworks = []struct {
+	network string
+	record  map[string]interface{}
+}{
+	{"1.2.3.0/24", map[string]interface{}{
+		"country": map[string]interface{}{"iso_code": "DE"},
+	}},
+	{"5.6.7.0/24", map[string]interface{}{
+		"registered_country": map[string]interface{}{"iso_code": "NL"},
+	}},
+	{"2001:db8::/32", map[string]interface{}{
+		"country":            map[string]interface{}{"iso_code": "FR"},
+		"registered_country": map[string]interface{}{"iso_code": "BE"},
+	}},
+}
+
+func TestCountryResolver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileuploader-geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeTestGeoIPDatabase(t, dir)
+
+	resolver, err := newCountryResolver(path)
+	if err != nil {
+		t.Fatalf("Failed to open fixture database: %v", err)
+	}
+	defer resolver.Close()
+
+	tests := []struct {
+		name    string
+		ip      string
+		country string
+	}{
+		{"IPv4", "1.2.3.4", "DE"},
+		{"IPv4 mapped to IPv6", "::ffff:1.2.3.4", "DE"},
+		{"registered country", "5.6.7.8", "NL"},
+		{"IPv6", "2001:db8::1", "FR"},
+		{"missing IPv4", "9.9.9.9", ""},
+		{"missing IPv6", "2001:db9::1", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// twice, so the cached result is checked too
+			for i := 0; i < 2; i++ {
+				if country := resolver.country(net.ParseIP(test.ip)); country != test.country {
+					t.Fatalf("Expected country %q for %s, got %q", test.country, test.ip, country)
+				}
+			}
+		})
+	}
+}
+
+func TestCountryResolversOutliveServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileuploader-geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeTestGeoIPDatabase(t, dir)
+
+	// a server shutting down after a reload leaves the database open for its
+	// outstanding requests and the next server
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Security.GeoIPDatabase = path
+	})
+	defer os.RemoveAll(ts.dir)
+	defer ts.countryResolvers.Close()
+	ts.http.Close()
+	ts.Shutdown()
+	first := ts.countries
+	if country := first.country(net.ParseIP("1.2.3.4")); country != "DE" {
+		t.Fatalf("Expected the database to stay open after the server shut down, got country %q", country)
+	}
+
+	resolvers := ts.countryResolvers
+	if again, err := resolvers.open(path); err != nil || again != first {
+		t.Fatalf("Expected the unchanged database to be reused, got %p (%v)", again, err)
+	}
+
+	// an updated database is opened again, without closing the one in use
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	updated, err := resolvers.open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated == first {
+		t.Fatal("Expected the updated database to be opened again")
+	}
+	if country := first.country(net.ParseIP("5.6.7.8")); country != "NL" {
+		t.Fatalf("Expected the replaced database to stay open, got country %q", country)
+	}
+}
+
+func TestCountryResolverInvalidDatabase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileuploader-geoip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := ioutil.ReadFile(writeTestGeoIPDatabase(t, dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	markerIndex := bytes.LastIndex(data, []byte("\xAB\xCD\xEFMaxMind.com"))
+
+	// the data section starts after the search tree of 8 byte nodes and the
+	// 16 byte separator
+	corruptData := append([]byte(nil), data...)
+	for i := bytes.Index(corruptData, make([]byte, 16)) + 16; i < markerIndex; i++ {
+		corruptData[i] = 0xFF
+	}
+	corruptTree := append([]byte(nil), data...)
+	for i := 0; i < 16; i++ {
+		corruptTree[i] = 0xFF
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a database", []byte("not a MaxMind DB file")},
+		{"truncated metadata", data[:len(data)-10]},
+		{"truncated tree", data[:16]},
+		{"truncated data", append(append([]byte(nil), data[:markerIndex-8]...), data[markerIndex:]...)},
+		{"corrupt data", corruptData},
+		{"corrupt tree", corruptTree},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, "corrupt.mmdb")
+			if err := ioutil.WriteFile(path, test.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			resolver, err := newCountryResolver(path)
+			if err != nil {
+				return
+			}
+			defer resolver.Close()
+
+			// lookups in a database that opened fine must fail without panicking
+			for _, ip := range []string{"1.2.3.4", "5.6.7.8", "2001:db8::1", "9.9.9.9"} {
+				if country := resolver.country(net.ParseIP(ip)); country != "" && country != "DE" && country != "NL" && country != "FR" {
+					t.Fatalf("Got garbage country %q for %s", country, ip)
+				}
+			}
+		})
+	}
+}
+
+// writeTestGeoIPDatabase writes testGeoIPNetworks to an IPv6 MaxMind DB with
+// 32 bit records in dir and returns its path. IPv4 networks are stored in the
+// ::/96 subtree, where readers look IPv4 addresses up.
+func writeTestGeoIPDatabase(t *testing.T, dir string) string {
+	t.Helper()
+
+	const empty = -1
+	type record struct {
+		node       int
+		dataOffset int
+	}
+	emptyRecord := record{node: empty, dataOffset: empty}
+	nodes := [][2]record{{emptyRecord, emptyRecord}}
+
+	var data []byte
+	for _, network := range testGeoIPNetworks {
+		_, ipNet, err := net.ParseCIDR(network.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		ip := ipNet.IP.To16()
+		if ipNet.IP.To4() != nil {
+			ip = append(make(net.IP, 12), ipNet.IP.To4()...)
+			ones += 96
+		}
+
+		node := 0
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> uint(7-i%8)) & 1
+			if i == ones-1 {
+				nodes[node][bit] = record{node: empty, dataOffset: len(data)}
+				break
+			}
+			if nodes[node][bit].node == empty {
+				nodes = append(nodes, [2]record{emptyRecord, emptyRecord})
+				nodes[node][bit] = record{node: len(nodes) - 1, dataOffset: empty}
+			}
+			node = nodes[node][bit].node
+		}
+		data = append(data, encodeTestMMDBValue(t, network.record)...)
+	}
+
+	var buffer bytes.Buffer
+	for _, node := range nodes {
+		for _, rec := range node {
+			value := len(nodes)
+			if rec.node != empty {
+				value = rec.node
+			} else if rec.dataOffset != empty {
+				value = len(nodes) + 16 + rec.dataOffset
+			}
+			buffer.Write([]byte{byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	buffer.Write(make([]byte, 16))
+	buffer.Write(data)
+	buffer.WriteString("\xAB\xCD\xEFMaxMind.com")
+	buffer.Write(encodeTestMMDBValue(t, map[string]interface{}{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"database_type":               "Test-Country",
+		"ip_version":                  uint16(6),
+		"node_count":                  uint32(len(nodes)),
+		"record_size":                 uint16(32),
+	}))
+
+	path := filepath.Join(dir, "test.mmdb")
+	if err := ioutil.WriteFile(path, buffer.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// encodeTestMMDBValue encodes the value types used by the fixture database in
+// the MaxMind DB data format
+func encodeTestMMDBValue(t *testing.T, value interface{}) []byte {
+	t.Helper()
+
+	control := func(dataType byte, size int) []byte {
+		if size >= 29 {
+			t.Fatalf("Value too large for the fixture encoder: %#v", value)
+		}
+		return []byte{dataType<<5 | byte(size)}
+	}
+	unsigned := func(dataType byte, n uint64) []byte {
+		var digits []byte
+		for ; n > 0; n >>= 8 {
+			digits = append([]byte{byte(n)}, digits...)
+		}
+		return append(control(dataType, len(digits)), digits...)
+	}
+
+	switch v := value.(type) {
+	case string:
+		return append(control(2, len(v)), v...)
+	case uint16:
+		return unsigned(5, uint64(v))
+	case uint32:
+		return unsigned(6, uint64(v))
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		encoded := control(7, len(v))
+		for _, key := range keys {
+			encoded = append(encoded, encodeTestMMDBValue(t, key)...)
+			encoded = append(encoded, encodeTestMMDBValue(t, v[key])...)
+		}
+		return encoded
+	}
+	t.Fatalf("Unsupported value for the fixture encoder: %#v", value)
+	return nil
+}
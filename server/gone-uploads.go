@@ -0,0 +1,58 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+)
+
+// goneReason returns the reason an upload was removed, or "" if it still
+// exists or was never seen. Uploads removed before reasons were recorded
+// report "deleted". Rows of hard deleted uploads are gone, so those uploads
+// look like they never existed.
+func (serv *UploadServer) goneReason(id string) (string, error) {
+	var record struct {
+		Deleted bool           `db:"deleted"`
+		Reason  sql.NullString `db:"deleted_reason"`
+	}
+	err := serv.DBConn.DB.Get(&record, `SELECT deleted, deleted_reason FROM uploads WHERE id = ?`, id)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil || !record.Deleted {
+		return "", err
+	}
+	if !record.Reason.Valid {
+		return "deleted", nil
+	}
+	return record.Reason.String, nil
+}
+
+// respondIfUploadGone answers a HEAD for an upload that existed but was
+// expired or terminated with 410 Gone and the reason in the
+// X-Upload-Gone-Reason header, so clients can tell it apart from an unknown
+// upload and give up instead of restarting. Returns true if the request was
+// answered.
+func (serv *UploadServer) respondIfUploadGone(c *gin.Context, infoErr error) (handled bool) {
+	if !serv.cfg.Expiration.ReportGoneUploads || !os.IsNotExist(infoErr) {
+		return false
+	}
+
+	reason, err := serv.goneReason(c.Param("id"))
+	if err != nil {
+		serv.requestLog(c.Request).Error().
+			Err(err).
+			Msg("Failed to look up removed upload")
+		return false
+	}
+	if reason == "" {
+		return false
+	}
+
+	c.Header("X-Upload-Gone-Reason", reason)
+	c.Header("Cache-Control", "no-store")
+	c.AbortWithStatus(http.StatusGone)
+	return true
+}
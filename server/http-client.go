@@ -0,0 +1,30 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// newHTTPClient returns a client for outbound requests to external services.
+// Establishing the connection, including the TLS handshake, is bounded by
+// connectTimeout and the whole request by timeout, so a hung service can't
+// stall upload processing. http.DefaultClient has no timeout and must not be
+// used.
+func newHTTPClient(connectTimeout time.Duration, timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   connectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   connectTimeout,
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}
+}
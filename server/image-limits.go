@@ -0,0 +1,42 @@
+package server
+
+import (
+	"fmt"
+	"image"
+)
+
+// ImageTooLargeError occurs when an image exceeds the configured dimension or
+// pixel limits and is not decoded
+type ImageTooLargeError struct {
+	Width  int
+	Height int
+}
+
+func (e ImageTooLargeError) Error() string {
+	return fmt.Sprintf("Image of %dx%d pixels exceeds the processing limits", e.Width, e.Height)
+}
+
+// checkImageLimits rejects images whose decoded size would exceed
+// Processing.MaxImageDimension or Processing.MaxImagePixels. It must be called
+// with the header information from image.DecodeConfig before decoding, so that
+// decompression bombs are caught before any pixel buffer is allocated.
+func (serv *UploadServer) checkImageLimits(imgConfig image.Config) error {
+	limits := serv.cfg.Processing
+	width, height := imgConfig.Width, imgConfig.Height
+
+	if width <= 0 || height <= 0 ||
+		width > limits.MaxImageDimension || height > limits.MaxImageDimension ||
+		int64(width)*int64(height) > limits.MaxImagePixels {
+		return &ImageTooLargeError{Width: width, Height: height}
+	}
+	return nil
+}
+
+// acquireImageSlot blocks until fewer than Processing.ImageConcurrency images
+// are being processed and returns a function releasing the slot
+func (serv *UploadServer) acquireImageSlot() (release func()) {
+	serv.imageSlots <- struct{}{}
+	return func() {
+		<-serv.imageSlots
+	}
+}
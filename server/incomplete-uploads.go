@@ -0,0 +1,178 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tus/tusd"
+)
+
+// incompleteSlotKey is the gin context key holding the creationGate slot taken
+// by enforceIncompleteUploadLimit
+const incompleteSlotKey = "incompleteSlot"
+
+// creationGate serialises creations per client from the incomplete upload
+// check until the upload row is stored, so a burst of concurrent creations
+// can't all pass the check before any of them is counted
+type creationGate struct {
+	mu    sync.Mutex
+	slots map[string]*creationSlot
+}
+
+type creationSlot struct {
+	key      string
+	released chan struct{}
+}
+
+func newCreationGate() *creationGate {
+	return &creationGate{slots: make(map[string]*creationSlot)}
+}
+
+// acquire waits until no other creation holds the slot of key. Returns nil if
+// done was closed first.
+func (gate *creationGate) acquire(key string, done <-chan struct{}) *creationSlot {
+	for {
+		gate.mu.Lock()
+		held, ok := gate.slots[key]
+		if !ok {
+			slot := &creationSlot{key: key, released: make(chan struct{})}
+			gate.slots[key] = slot
+			gate.mu.Unlock()
+			return slot
+		}
+		gate.mu.Unlock()
+
+		select {
+		case <-held.released:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// release frees slot, unless it was already released
+func (gate *creationGate) release(slot *creationSlot) {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	if gate.slots[slot.key] == slot {
+		delete(gate.slots, slot.key)
+		close(slot.released)
+	}
+}
+
+// releaseKey frees whichever slot is held for key
+func (gate *creationGate) releaseKey(key string) {
+	gate.mu.Lock()
+	defer gate.mu.Unlock()
+	if slot, ok := gate.slots[key]; ok {
+		delete(gate.slots, key)
+		close(slot.released)
+	}
+}
+
+// incompleteUploadKey returns the key incomplete uploads are counted by
+func incompleteUploadKey(metadata map[string]string) string {
+	if account := metadata[accountKey]; account != "" {
+		return "account:" + metadata[issuerKey] + "/" + account
+	}
+	return "ip:" + metadata[remoteIPKey]
+}
+
+// onUploadCreated is called by the store once the row of a new upload is
+// stored, after which the upload is counted by enforceIncompleteUploadLimit
+func (serv *UploadServer) onUploadCreated(id string, info tusd.FileInfo) {
+	serv.creationGate.releaseKey(incompleteUploadKey(info.MetaData))
+}
+
+// releaseIncompleteSlot frees the slot taken by enforceIncompleteUploadLimit if
+// the request ended without storing an upload
+func (serv *UploadServer) releaseIncompleteSlot(c *gin.Context) {
+	if slot, ok := c.Get(incompleteSlotKey); ok {
+		serv.creationGate.release(slot.(*creationSlot))
+	}
+}
+
+// enforceIncompleteUploadLimit rejects a creation request with 429 and the
+// error code "too_many_incomplete" while the client already has
+// RateLimit.MaxIncompletePerAccount (with an EXTJWT account) or
+// RateLimit.MaxIncompletePerIP (anonymous) uploads that were created but not
+// completed. Unlike the creation rate limit, completing or terminating an
+// upload frees its slot right away, so this only stops clients from piling up
+// abandoned uploads. Returns false if the request was rejected and aborted.
+//
+// Concurrent creations by the same client wait for each other's upload row to
+// be stored. The caller must defer releaseIncompleteSlot before calling this.
+func (serv *UploadServer) enforceIncompleteUploadLimit(c *gin.Context) bool {
+	metadata := parseMeta(c.Request.Header.Get("Upload-Metadata"))
+
+	var limit, incomplete int
+	var err error
+	if account := metadata[accountKey]; account != "" {
+		limit = serv.cfg.RateLimit.MaxIncompletePerAccount
+		if limit <= 0 {
+			return true
+		}
+		if !serv.acquireIncompleteSlot(c, metadata) {
+			return false
+		}
+		err = serv.DBConn.DB.Get(&incomplete, `
+			SELECT COUNT(*) FROM uploads
+			WHERE deleted = 0 AND sha256sum IS NULL
+			AND jwt_account = ? AND COALESCE(jwt_issuer, '') = ?
+			`,
+			account, metadata[issuerKey],
+		)
+	} else {
+		limit = serv.cfg.RateLimit.MaxIncompletePerIP
+		if limit <= 0 {
+			return true
+		}
+		if !serv.acquireIncompleteSlot(c, metadata) {
+			return false
+		}
+		err = serv.DBConn.DB.Get(&incomplete, `
+			SELECT COUNT(*) FROM uploads
+			WHERE deleted = 0 AND sha256sum IS NULL
+			AND uploader_ip = ? AND jwt_account IS NULL
+			`,
+			metadata[remoteIPKey],
+		)
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return false
+	}
+	if incomplete < limit {
+		return true
+	}
+
+	metrics.add("uploads.tooManyIncomplete", 1)
+	serv.requestLog(c.Request).Warn().
+		Str("event", "too_many_incomplete").
+		Str("account", metadata[accountKey]).
+		Str("ip", metadata[remoteIPKey]).
+		Int("incomplete", incomplete).
+		Msg("Rejected upload, too many incomplete uploads")
+	abortWithErrorResponse(c, http.StatusTooManyRequests, "too_many_incomplete",
+		fmt.Sprintf("Complete or cancel one of your %d unfinished uploads first", incomplete),
+		gin.H{"limit": limit})
+	return false
+}
+
+// acquireIncompleteSlot waits for concurrent creations by the same client to
+// store their upload, unless the request already holds its slot. Returns false
+// if the client went away while waiting.
+func (serv *UploadServer) acquireIncompleteSlot(c *gin.Context, metadata map[string]string) bool {
+	if _, held := c.Get(incompleteSlotKey); held {
+		return true
+	}
+	slot := serv.creationGate.acquire(incompleteUploadKey(metadata), c.Request.Context().Done())
+	if slot == nil {
+		c.Abort()
+		return false
+	}
+	c.Set(incompleteSlotKey, slot)
+	return true
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestIncompleteUploadLimitBurst(t *testing.T) {
+	const limit = 3
+	const burst = 10
+
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.RateLimit.MaxIncompletePerIP = limit
+	})
+	defer ts.Close()
+
+	statuses := make(chan int, burst)
+	var wg sync.WaitGroup
+	for i := 0; i < burst; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := http.DefaultClient.Do(ts.newCreationRequest(10, nil))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+			statuses <- resp.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	created, rejected := 0, 0
+	for status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			created++
+		case http.StatusTooManyRequests:
+			rejected++
+		default:
+			t.Errorf("Unexpected status %d", status)
+		}
+	}
+	if created != limit || rejected != burst-limit {
+		t.Fatalf("Expected %d created and %d rejected, got %d and %d", limit, burst-limit, created, rejected)
+	}
+
+	// the limit still holds once the burst was recorded
+	resp, body := ts.do(ts.newCreationRequest(10, nil))
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429 after the burst, got %d", resp.StatusCode)
+	}
+	if errResp := decodeErrorResponse(t, body); errResp.Code != "too_many_incomplete" {
+		t.Fatalf("Expected error code too_many_incomplete, got %q", errResp.Code)
+	}
+}
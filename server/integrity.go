@@ -0,0 +1,224 @@
+package server
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// results of verifying the stored file of an upload against its recorded hash
+const (
+	integrityOK       = "ok"
+	integrityMismatch = "mismatch"
+	integrityMissing  = "missing"
+)
+
+// verifyIntegrity hashes the stored file of a completed upload again and
+// compares it with the hash recorded when the upload was finished. Files that
+// changed or disappeared are quarantined, see quarantineCorrupt. recorded is
+// nil if the upload isn't finished.
+func (serv *UploadServer) verifyIntegrity(id string) (result string, recorded []byte, actual []byte, err error) {
+	recorded, actual, err = serv.store.VerifyHash(id)
+	switch {
+	case err != nil && os.IsNotExist(err):
+		result = integrityMissing
+	case err != nil:
+		metrics.add("integrity.errors", 1)
+		return "", recorded, nil, err
+	case recorded == nil:
+		return "", nil, nil, nil
+	case bytes.Equal(recorded, actual):
+		metrics.add("integrity.verified", 1)
+		return integrityOK, recorded, actual, nil
+	default:
+		result = integrityMismatch
+	}
+
+	metrics.add("integrity.corrupt", 1)
+	serv.log.Error().
+		Str("event", "upload_corrupt").
+		Str("id", id).
+		Str("result", result).
+		Str("sha256sum", hex.EncodeToString(recorded)).
+		Str("actualSha256sum", hex.EncodeToString(actual)).
+		Msg("Stored file does not match the hash recorded for the upload")
+	return result, recorded, actual, serv.quarantineCorrupt(id, recorded, "hash_"+result)
+}
+
+// quarantineCorrupt marks every upload stored in the file with the given hash
+// as corrupt, as deduplicated uploads share the file, so they are no longer
+// served
+func (serv *UploadServer) quarantineCorrupt(id string, hash []byte, reason string) error {
+	_, err := serv.DBConn.DB.Exec(`UPDATE uploads SET corrupt = 1 WHERE sha256sum = ? AND deleted = 0`, hash)
+	if err != nil {
+		return err
+	}
+	serv.audit.record(auditEvent{
+		Action:   auditUploadQuarantined,
+		UploadID: id,
+		Reason:   reason,
+	})
+	return nil
+}
+
+// verifyUpload checks the stored file of a completed upload against its
+// recorded hash right away and reports the result
+func (serv *UploadServer) verifyUpload(c *gin.Context) {
+	id := c.Param("id")
+	if _, err := serv.store.GetInfo(id); err != nil {
+		if os.IsNotExist(err) {
+			abortWithErrorResponse(c, http.StatusNotFound, "upload_not_found", "No such upload", nil)
+			return
+		}
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+
+	result, recorded, actual, err := serv.verifyIntegrity(id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+	if recorded == nil {
+		abortWithErrorResponse(c, http.StatusConflict, "upload_incomplete", "The upload has not been completed", nil)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":              id,
+		"result":          result,
+		"sha256sum":       hex.EncodeToString(recorded),
+		"actualSha256sum": hex.EncodeToString(actual),
+	})
+}
+
+// integrityCheck runs at most one verification of all stored files at a time
+// in the background
+type integrityCheck struct {
+	mu      sync.Mutex
+	running bool
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+func newIntegrityCheck() *integrityCheck {
+	return &integrityCheck{stop: make(chan struct{})}
+}
+
+// start runs check in the background unless a check is already running
+func (ic *integrityCheck) start(check func(stop <-chan struct{})) (started bool) {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+
+	if ic.running {
+		return false
+	}
+	ic.running = true
+	ic.wg.Add(1)
+	go func() {
+		defer ic.wg.Done()
+		check(ic.stop)
+
+		ic.mu.Lock()
+		ic.running = false
+		ic.mu.Unlock()
+	}()
+	return true
+}
+
+// Close stops a running check and waits for it to return
+func (ic *integrityCheck) Close() {
+	close(ic.stop)
+	ic.wg.Wait()
+}
+
+type integrityCheckRecord struct {
+	ID   string        `db:"id"`
+	Size sql.NullInt64 `db:"size"`
+}
+
+// verifyUploads starts verifying the stored files of all completed uploads in
+// the background, see checkAllUploads. Responds with 409 if a check is already
+// running.
+func (serv *UploadServer) verifyUploads(c *gin.Context) {
+	// every stored file once, deduplicated uploads share it
+	var records []integrityCheckRecord
+	err := serv.DBConn.DB.Select(&records, `
+		SELECT MIN(id) AS id, MAX(size) AS size FROM uploads
+		WHERE deleted = 0 AND sha256sum IS NOT NULL
+		GROUP BY sha256sum
+	`)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+
+	started := serv.integrityCheck.start(func(stop <-chan struct{}) {
+		serv.checkAllUploads(records, stop)
+	})
+	if !started {
+		abortWithErrorResponse(c, http.StatusConflict, "verification_running",
+			"A verification of all uploads is already running", nil)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"files": len(records)})
+}
+
+// checkAllUploads verifies the given uploads one after another. It pauses
+// after every file so that on average no more than
+// Processing.IntegrityCheckBytesPerSecond are read, leaving disk bandwidth for
+// uploads and downloads.
+func (serv *UploadServer) checkAllUploads(records []integrityCheckRecord, stop <-chan struct{}) {
+	bytesPerSecond := float64(serv.cfg.Processing.IntegrityCheckBytesPerSecond.Bytes())
+	counts := make(map[string]int)
+	started := time.Now()
+
+	serv.log.Info().
+		Str("event", "integrity_check_started").
+		Int("files", len(records)).
+		Msg("Verifying stored files")
+
+	for _, record := range records {
+		result, _, _, err := serv.verifyIntegrity(record.ID)
+		if err != nil {
+			result = "error"
+			serv.log.Error().
+				Err(err).
+				Str("id", record.ID).
+				Msg("Failed to verify stored file")
+		}
+		counts[result]++
+
+		if bytesPerSecond > 0 && record.Size.Int64 > 0 {
+			pause := time.Duration(float64(record.Size.Int64) / bytesPerSecond * float64(time.Second))
+			select {
+			case <-time.After(pause):
+			case <-stop:
+			}
+		}
+		select {
+		case <-stop:
+			serv.log.Warn().
+				Str("event", "integrity_check_stopped").
+				Msg("Verification of stored files stopped by shutdown")
+			return
+		default:
+		}
+	}
+
+	serv.log.Info().
+		Str("event", "integrity_check_finished").
+		Int("ok", counts[integrityOK]).
+		Int("mismatch", counts[integrityMismatch]).
+		Int("missing", counts[integrityMissing]).
+		Int("errors", counts["error"]).
+		Dur("duration", time.Since(started)).
+		Msg("Verified stored files")
+}
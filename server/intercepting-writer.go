@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+)
+
+// interceptingResponseWriter lets a wrapping handler replace the response that
+// an inner handler (usually tusd) is about to send.
+//
+// OnWriteHeader is called with the status the inner handler wants to send. If it
+// returns true, the hook has written its own response and everything the inner
+// handler writes afterwards is discarded.
+type interceptingResponseWriter struct {
+	http.ResponseWriter
+	OnWriteHeader func(status int) (handled bool)
+
+	intercepted bool
+}
+
+func (w *interceptingResponseWriter) WriteHeader(status int) {
+	if w.OnWriteHeader != nil && w.OnWriteHeader(status) {
+		w.intercepted = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *interceptingResponseWriter) Write(p []byte) (int, error) {
+	if w.intercepted {
+		// pretend the inner handler's body was written
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
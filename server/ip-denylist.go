@@ -0,0 +1,113 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// when the DNSBL cache grows beyond this many entries, expired ones are purged
+const dnsblCachePurgeThreshold = 10000
+
+// isDeniedIP checks the client IP against the configured deny ranges and DNSBL
+// zones. The returned reason is suitable for logging.
+func (serv *UploadServer) isDeniedIP(ip net.IP) (denied bool, reason string) {
+	if ip == nil {
+		return false, ""
+	}
+
+	for _, deniedNet := range serv.cfg.Security.DenyIPRanges {
+		if deniedNet.Contains(ip) {
+			return true, "range " + deniedNet.String()
+		}
+	}
+
+	if serv.dnsbl != nil {
+		if zone, listed := serv.dnsbl.lookup(ip); listed {
+			return true, "dnsbl " + zone
+		}
+	}
+
+	return false, ""
+}
+
+type dnsblCacheEntry struct {
+	zone    string // zone the IP was listed in, empty if not listed
+	expires time.Time
+}
+
+// dnsblChecker looks up IPs in DNS-based blocklists and caches the results
+type dnsblChecker struct {
+	zones []string
+	ttl   time.Duration
+
+	mu    sync.Mutex
+	cache map[string]dnsblCacheEntry
+}
+
+func newDNSBLChecker(zones []string, ttl time.Duration) *dnsblChecker {
+	return &dnsblChecker{
+		zones: zones,
+		ttl:   ttl,
+		cache: make(map[string]dnsblCacheEntry),
+	}
+}
+
+// lookup returns the first zone listing the IP. Lookup failures other than a
+// negative answer are treated as not listed and are not cached.
+func (d *dnsblChecker) lookup(ip net.IP) (zone string, listed bool) {
+	key := ip.String()
+	now := time.Now()
+
+	d.mu.Lock()
+	entry, ok := d.cache[key]
+	d.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.zone, entry.zone != ""
+	}
+
+	reversed := reverseIPForDNSBL(ip)
+	cacheable := true
+	for _, dnsblZone := range d.zones {
+		_, err := net.LookupHost(reversed + "." + dnsblZone)
+		if err == nil {
+			zone = dnsblZone
+			break
+		}
+		if dnsErr, ok := err.(*net.DNSError); !ok || dnsErr.Temporary() || dnsErr.Timeout() {
+			cacheable = false
+		}
+	}
+
+	if cacheable || zone != "" {
+		d.mu.Lock()
+		if len(d.cache) >= dnsblCachePurgeThreshold {
+			for k, e := range d.cache {
+				if now.After(e.expires) {
+					delete(d.cache, k)
+				}
+			}
+		}
+		d.cache[key] = dnsblCacheEntry{zone: zone, expires: now.Add(d.ttl)}
+		d.mu.Unlock()
+	}
+
+	return zone, zone != ""
+}
+
+// reverseIPForDNSBL formats an IP for a DNSBL query, e.g. 192.0.2.1 => 1.2.0.192
+// and IPv6 addresses as reversed nibbles
+func reverseIPForDNSBL(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+
+	ip16 := ip.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(ip16) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, fmt.Sprintf("%x", ip16[i]&0x0f), fmt.Sprintf("%x", ip16[i]>>4))
+	}
+	return strings.Join(nibbles, ".")
+}
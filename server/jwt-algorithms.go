@@ -0,0 +1,94 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// algorithms that can be listed in Jwt.AllowedAlgorithms, with the recommended
+// minimum secret length in bytes, which is the size of the hash (RFC 7518).
+// Issuers share a secret with the server, so only HMAC algorithms can be
+// verified.
+var jwtAlgorithms = map[string]int{
+	jwt.SigningMethodHS256.Alg(): 32,
+	jwt.SigningMethodHS384.Alg(): 48,
+	jwt.SigningMethodHS512.Alg(): 64,
+}
+
+// validateJwtAlgorithms checks Jwt.AllowedAlgorithms. Unsigned tokens ("none")
+// can never be allowed.
+func validateJwtAlgorithms(algorithms []string) error {
+	if len(algorithms) == 0 {
+		return errors.New("Jwt.AllowedAlgorithms must list at least one algorithm")
+	}
+	for _, alg := range algorithms {
+		if alg == jwt.SigningMethodNone.Alg() {
+			return errors.New("Jwt.AllowedAlgorithms must not contain \"none\", unsigned tokens are never accepted")
+		}
+		if _, ok := jwtAlgorithms[alg]; !ok {
+			return fmt.Errorf("Unsupported Jwt.AllowedAlgorithms entry %#v, expected HS256, HS384 or HS512", alg)
+		}
+	}
+	return nil
+}
+
+// jwtParser returns a parser for EXTJWTs that rejects tokens signed with an
+// algorithm missing from Jwt.AllowedAlgorithms, including unsigned tokens,
+// before the issuer's secret is looked up
+func (serv *UploadServer) jwtParser() *jwt.Parser {
+	return &jwt.Parser{ValidMethods: serv.cfg.Jwt.AllowedAlgorithms}
+}
+
+// validateJwtSecrets checks that every issuer in JwtSecretsByIssuer has a
+// secret of at least Jwt.MinSecretLength bytes, not counting surrounding
+// whitespace, and lists the issuers that don't
+func validateJwtSecrets(secrets map[string]string, minLength int) error {
+	if minLength < 1 {
+		return fmt.Errorf("Jwt.MinSecretLength must be at least 1, got %d", minLength)
+	}
+
+	var invalid []string
+	for issuer, secret := range secrets {
+		if len(strings.TrimSpace(secret)) < minLength {
+			invalid = append(invalid, fmt.Sprintf("%#v", issuer))
+		}
+	}
+	if len(invalid) == 0 {
+		return nil
+	}
+	sort.Strings(invalid)
+	return fmt.Errorf("JwtSecretsByIssuer has empty or too short secrets (Jwt.MinSecretLength is %d bytes) for issuers %s",
+		minLength, strings.Join(invalid, ", "))
+}
+
+// warnWeakJwtSecrets logs the issuers whose secret is shorter than recommended
+// for the strongest algorithm in Jwt.AllowedAlgorithms. Shorter secrets work,
+// but make brute-forcing the secret from a captured token easier.
+func (serv *UploadServer) warnWeakJwtSecrets() {
+	recommended := 0
+	for _, alg := range serv.cfg.Jwt.AllowedAlgorithms {
+		if length := jwtAlgorithms[alg]; length > recommended {
+			recommended = length
+		}
+	}
+
+	var weak []string
+	for issuer, secret := range serv.cfg.JwtSecretsByIssuer {
+		if len(secret) < recommended {
+			weak = append(weak, issuer)
+		}
+	}
+	if len(weak) == 0 {
+		return
+	}
+	sort.Strings(weak)
+	serv.log.Warn().
+		Str("event", "weak_jwt_secrets").
+		Strs("issuers", weak).
+		Int("recommendedLength", recommended).
+		Msg("JwtSecretsByIssuer has secrets shorter than recommended for Jwt.AllowedAlgorithms")
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testJwtIssuer = "irc.example.com"
+
+var testJwtSecret = strings.Repeat("s", 64)
+
+// signTestJwt returns a token for the account "alice" of issuer, signed with
+// method and key
+func signTestJwt(t *testing.T, method jwt.SigningMethod, issuer string, key interface{}) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(method, jwt.MapClaims{
+		"iss":     issuer,
+		"account": "alice",
+	}).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// forgeTestJwt returns a token with the given header and an HMAC-SHA256
+// signature made with the secret of testJwtIssuer, whatever the header claims
+func forgeTestJwt(t *testing.T, header map[string]interface{}) string {
+	t.Helper()
+
+	encode := func(value interface{}) string {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return jwt.EncodeSegment(data)
+	}
+	signingString := encode(header) + "." + encode(jwt.MapClaims{"iss": testJwtIssuer, "account": "alice"})
+	mac := hmac.New(sha256.New, []byte(testJwtSecret))
+	mac.Write([]byte(signingString))
+	return signingString + "." + jwt.EncodeSegment(mac.Sum(nil))
+}
+
+// replaceJwtHeader swaps the header of a token, keeping its claims and signature
+func replaceJwtHeader(t *testing.T, token string, header map[string]interface{}) string {
+	t.Helper()
+
+	data, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jwt.EncodeSegment(data) + token[strings.Index(token, "."):]
+}
+
+func TestJwtAlgorithmRestriction(t *testing.T) {
+	secret := []byte(testJwtSecret)
+	hs512 := signTestJwt(t, jwt.SigningMethodHS512, testJwtIssuer, secret)
+
+	tests := []struct {
+		name       string
+		token      string
+		allowed    []string
+		wantStatus int
+		wantCode   string
+	}{
+		{
+			name:       "allowed algorithm",
+			token:      signTestJwt(t, jwt.SigningMethodHS256, testJwtIssuer, secret),
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "alg none",
+			token:      signTestJwt(t, jwt.SigningMethodNone, testJwtIssuer, jwt.UnsafeAllowNoneSignatureType),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "jwt_invalid",
+		},
+		{
+			// an unknown issuer is not fatal without Jwt.RejectUnknownIssuer,
+			// so this is only rejected if the algorithm is checked first
+			name:       "alg none from an unknown issuer",
+			token:      signTestJwt(t, jwt.SigningMethodNone, "unknown.example.com", jwt.UnsafeAllowNoneSignatureType),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "jwt_invalid",
+		},
+		{
+			name:       "alg None",
+			token:      replaceJwtHeader(t, signTestJwt(t, jwt.SigningMethodNone, testJwtIssuer, jwt.UnsafeAllowNoneSignatureType), map[string]interface{}{"alg": "None", "typ": "JWT"}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "jwt_invalid",
+		},
+		{
+			name:       "algorithm missing from Jwt.AllowedAlgorithms",
+			token:      hs512,
+			allowed:    []string{"HS256"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "jwt_invalid",
+		},
+		{
+			name:       "HS512 signature relabelled as HS256",
+			token:      replaceJwtHeader(t, hs512, map[string]interface{}{"alg": "HS256", "typ": "JWT"}),
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "jwt_invalid_signature",
+		},
+		{
+			name:       "HMAC signature labelled as RS256",
+			token:      forgeTestJwt(t, map[string]interface{}{"alg": "RS256", "typ": "JWT"}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "jwt_invalid",
+		},
+		{
+			name:       "HMAC signature labelled as ES256",
+			token:      forgeTestJwt(t, map[string]interface{}{"alg": "ES256", "typ": "JWT"}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "jwt_invalid",
+		},
+		{
+			name:       "unregistered algorithm",
+			token:      forgeTestJwt(t, map[string]interface{}{"alg": "XS256", "typ": "JWT"}),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "jwt_invalid",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := newTestServer(t, func(cfg *Config) {
+				cfg.JwtSecretsByIssuer = map[string]string{testJwtIssuer: testJwtSecret}
+				if test.allowed != nil {
+					cfg.Jwt.AllowedAlgorithms = test.allowed
+				}
+			})
+			defer ts.Close()
+
+			resp, body := ts.do(ts.newCreationRequest(10, map[string]string{"extjwt": test.token}))
+			if resp.StatusCode != test.wantStatus {
+				t.Fatalf("Expected status %d, got %d with body %q", test.wantStatus, resp.StatusCode, body)
+			}
+
+			var uploads int
+			if err := ts.DBConn.DB.Get(&uploads, `SELECT COUNT(*) FROM uploads`); err != nil {
+				t.Fatal(err)
+			}
+			if test.wantCode == "" {
+				if uploads != 1 {
+					t.Fatalf("Expected the upload to be created, found %d uploads", uploads)
+				}
+				return
+			}
+			if errResp := decodeErrorResponse(t, body); errResp.Code != test.wantCode {
+				t.Fatalf("Expected error code %q, got %q", test.wantCode, errResp.Code)
+			}
+			if uploads != 0 {
+				t.Fatalf("Expected no upload to be created, found %d", uploads)
+			}
+		})
+	}
+}
+
+func TestValidateJwtAlgorithms(t *testing.T) {
+	tests := []struct {
+		algorithms []string
+		valid      bool
+	}{
+		{[]string{"HS256", "HS384", "HS512"}, true},
+		{[]string{"HS256"}, true},
+		{nil, false},
+		{[]string{"none"}, false},
+		{[]string{"HS256", "none"}, false},
+		{[]string{"RS256"}, false},
+	}
+	for _, test := range tests {
+		if err := validateJwtAlgorithms(test.algorithms); (err == nil) != test.valid {
+			t.Errorf("validateJwtAlgorithms(%q): expected valid %v, got error %v", test.algorithms, test.valid, err)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// how often the jwtNonceStore removes the jtis of expired tokens
+const jwtNoncePurgeInterval = time.Minute
+
+var (
+	// ErrJwtReplayed occurs when Jwt.SingleUse is set and an EXTJWT is used a second time
+	ErrJwtReplayed = errors.New("EXTJWT has already been used")
+
+	// ErrJwtNotSingleUse occurs when Jwt.SingleUse is set and an EXTJWT lacks the
+	// jti or exp claim needed to refuse it a second time
+	ErrJwtNotSingleUse = errors.New("EXTJWT must have jti and exp claims")
+)
+
+// jwtNonceStore records the jti claims of used EXTJWTs until the tokens expire,
+// for Jwt.SingleUse. Like the upload pause it outlives a single UploadServer, so
+// tokens can't be replayed after a config reload, but it is not persisted.
+type jwtNonceStore struct {
+	mu        sync.Mutex
+	used      map[string]time.Time // expiry by issuer and jti
+	nextPurge time.Time
+}
+
+func newJwtNonceStore() *jwtNonceStore {
+	return &jwtNonceStore{
+		used: make(map[string]time.Time),
+	}
+}
+
+// use records the jti of a validated token. Returns ErrJwtReplayed if it was
+// already recorded and ErrJwtNotSingleUse if the token lacks jti or exp.
+func (s *jwtNonceStore) use(issuer string, claims jwt.MapClaims) error {
+	jti, _ := claims["jti"].(string)
+	exp, ok := claims["exp"].(float64)
+	if jti == "" || !ok {
+		return ErrJwtNotSingleUse
+	}
+	key := issuer + "\x00" + jti
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.After(s.nextPurge) {
+		for k, expiry := range s.used {
+			if now.After(expiry) {
+				delete(s.used, k)
+			}
+		}
+		s.nextPurge = now.Add(jwtNoncePurgeInterval)
+	}
+
+	if _, ok := s.used[key]; ok {
+		return ErrJwtReplayed
+	}
+	s.used[key] = time.Unix(int64(exp), 0)
+	return nil
+}
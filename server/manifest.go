@@ -0,0 +1,154 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+type manifestRecord struct {
+	ID         string         `db:"id"`
+	Sha256sum  []byte         `db:"sha256sum"`
+	CreatedAt  int64          `db:"created_at"`
+	UploaderIP sql.NullString `db:"uploader_ip"`
+	JwtAccount sql.NullString `db:"jwt_account"`
+	JwtIssuer  sql.NullString `db:"jwt_issuer"`
+	Metadata   sql.NullString `db:"metadata"`
+}
+
+// ManifestEntry describes a completed upload in the manifest. The private
+// fields are only included in the admin manifest.
+type ManifestEntry struct {
+	ID        string `json:"id"`
+	URL       string `json:"url"`
+	CreatedAt int64  `json:"createdAt"`
+	Size      int64  `json:"size"`
+	Sha256sum string `json:"sha256sum"`
+	Filename  string `json:"filename,omitempty"`
+	Filetype  string `json:"filetype,omitempty"`
+
+	UploaderIP string            `json:"uploaderIp,omitempty"`
+	Account    string            `json:"account,omitempty"`
+	Issuer     string            `json:"issuer,omitempty"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+}
+
+// Manifest is a page of completed uploads, oldest first. NextCursor is set when
+// more uploads may follow and is passed as the cursor parameter to fetch them.
+// PrevCursor is set on later pages and is passed as the before parameter to
+// fetch the previous page. The same URLs are sent in the Link header.
+type Manifest struct {
+	Uploads    []ManifestEntry `json:"uploads"`
+	NextCursor string          `json:"nextCursor,omitempty"`
+	PrevCursor string          `json:"prevCursor,omitempty"`
+}
+
+// manifestHandler lists completed and approved uploads that haven't been deleted. The since
+// query parameter restricts the list to uploads created at or after a unix
+// timestamp. The page is selected with limit, cursor and before, see
+// parseListPage. With private set, the uploader IP, account and persisted
+// metadata are included.
+func (serv *UploadServer) manifestHandler(private bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+		if err != nil {
+			abortWithErrorResponse(c, http.StatusBadRequest, "invalid_parameter", "since must be a unix timestamp", nil)
+			return
+		}
+
+		page, ok := serv.parseListPage(c)
+		if !ok {
+			return
+		}
+
+		var records []manifestRecord
+		query, args := page.query(`
+			SELECT id, sha256sum, created_at, uploader_ip, jwt_account, jwt_issuer, metadata
+			FROM uploads
+			WHERE
+				deleted = 0
+			AND approved = 1
+			AND corrupt = 0
+			AND sha256sum IS NOT NULL
+			AND created_at >= ?
+			`,
+			since,
+		)
+		err = serv.DBConn.DB.Select(&records, query, args...)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		manifest := Manifest{Uploads: []ManifestEntry{}}
+		for _, record := range records {
+			// skip uploads whose files are gone, e.g. while being terminated
+			info, err := serv.store.GetInfo(record.ID)
+			if err != nil {
+				continue
+			}
+
+			entry := ManifestEntry{
+				ID:        record.ID,
+				URL:       serv.downloadURL(c.Request, record.ID, info.MetaData),
+				CreatedAt: record.CreatedAt,
+				Size:      info.Size,
+				Sha256sum: hex.EncodeToString(record.Sha256sum),
+				Filename:  sanitizeFilename(metadataFilename(info.MetaData)),
+				Filetype:  info.MetaData["filetype"],
+			}
+			if private {
+				entry.UploaderIP = record.UploaderIP.String
+				entry.Account = record.JwtAccount.String
+				entry.Issuer = record.JwtIssuer.String
+				if record.Metadata.Valid {
+					json.Unmarshal([]byte(record.Metadata.String), &entry.Metadata)
+				}
+			}
+			manifest.Uploads = append(manifest.Uploads, entry)
+		}
+
+		if len(records) > 0 {
+			first, last := records[0], records[len(records)-1]
+			manifest.NextCursor, manifest.PrevCursor = page.setLinks(c, len(records),
+				pageCursor(first.CreatedAt, first.ID), pageCursor(last.CreatedAt, last.ID))
+		}
+
+		c.JSON(http.StatusOK, manifest)
+	}
+}
+
+// registerPublicManifestHandler mounts the manifest without private fields at
+// Server.PublicManifestPath, rate limited per client IP
+func (serv *UploadServer) registerPublicManifestHandler(r *gin.Engine) {
+	r.GET(serv.cfg.Server.PublicManifestPath, serv.enforceManifestRateLimit, serv.manifestHandler(false))
+}
+
+// enforceManifestRateLimit limits public manifest requests per client IP and
+// responds with 429 when the limit is exceeded
+func (serv *UploadServer) enforceManifestRateLimit(c *gin.Context) {
+	if serv.manifestRateLimiter == nil {
+		return
+	}
+
+	remoteIP, err := serv.getDirectOrForwardedRemoteIP(c.Request)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+
+	allowed, retryAfter := serv.manifestRateLimiter.take(remoteIP)
+	if allowed {
+		return
+	}
+
+	retrySeconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retrySeconds))
+	abortWithErrorResponse(c, http.StatusTooManyRequests, "rate_limited",
+		"Too many manifest requests, try again later", gin.H{"retryAfter": retrySeconds})
+}
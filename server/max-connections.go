@@ -0,0 +1,18 @@
+package server
+
+import (
+	"net"
+
+	"golang.org/x/net/netutil"
+)
+
+// limitListener caps the connections open at once on a listener at
+// Server.MaxConnections. Further connections are not accepted until one
+// closes; they wait in the kernel's accept queue, which refuses them once
+// full. Returns listener unchanged when there is no limit.
+func (serv *UploadServer) limitListener(listener net.Listener) net.Listener {
+	if serv.cfg.Server.MaxConnections <= 0 {
+		return listener
+	}
+	return netutil.LimitListener(listener, serv.cfg.Server.MaxConnections)
+}
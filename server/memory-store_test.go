@@ -0,0 +1,84 @@
+package server
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/kiwiirc/plugin-fileuploader/events"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+	"github.com/tus/tusd/cmd/tusd/cli/hooks"
+)
+
+func TestInMemoryStoreAndDatabase(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Storage.Path = shardedfilestore.MemoryPath
+		cfg.Database.Path = db.MemoryDSN
+		cfg.Database.PersistedMetadataFields = []string{"filename"}
+	})
+	defer ts.Close()
+
+	eventsCh := ts.tusEventBroadcaster.Listen("test", events.DefaultBufferSize, events.OverflowBlock)
+	defer ts.tusEventBroadcaster.Unlisten(eventsCh)
+
+	const content = "kept in memory"
+	uploadURL := ts.upload(content, map[string]string{"filename": "memory.txt"})
+	id := uploadID(uploadURL)
+
+	if resp, body := ts.get(uploadURL); resp.StatusCode != http.StatusOK || body != content {
+		t.Fatalf("Expected the upload to be served, got status %d, body %q", resp.StatusCode, body)
+	}
+
+	// events are broadcast as for a store on disk
+	var seen []hooks.HookType
+	timeout := time.After(5 * time.Second)
+	for len(seen) < 2 {
+		select {
+		case event := <-eventsCh:
+			if event.Info.ID == id {
+				seen = append(seen, event.Type)
+			}
+		case <-timeout:
+			t.Fatalf("Expected post-create and post-finish events, got %v", seen)
+		}
+	}
+	if seen[0] != hooks.HookPostCreate || seen[1] != hooks.HookPostFinish {
+		t.Fatalf("Expected post-create and post-finish events, got %v", seen)
+	}
+
+	// and the upload recorder stores the upload's details
+	var metadata sql.NullString
+	for deadline := time.Now().Add(5 * time.Second); !metadata.Valid; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the upload recorder to store the metadata")
+		}
+		err := ts.DBConn.DB.Get(&metadata, `SELECT metadata FROM uploads WHERE id = ?`, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	resp, body := ts.do(ts.newTusRequest(http.MethodDelete, uploadURL, ""))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Deleting upload: got status %d, body %q", resp.StatusCode, body)
+	}
+	if resp, _ := ts.get(uploadURL); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected the deleted upload to be gone, got status %d", resp.StatusCode)
+	}
+
+	// nothing was written to disk
+	if _, err := os.Stat(shardedfilestore.MemoryPath); !os.IsNotExist(err) {
+		t.Fatalf("Expected no %s directory on disk, got %v", shardedfilestore.MemoryPath, err)
+	}
+	entries, err := ioutil.ReadDir(ts.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Expected nothing to be written to the test directory, found %d entries", len(entries))
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// value logged in place of a sensitive metadata field
+const redactedMetadataValue = "[redacted]"
+
+// validateSensitiveMetadataFields checks Metadata.SensitiveFields
+func validateSensitiveMetadataFields(fields []string) error {
+	for _, field := range fields {
+		if field == "" {
+			return fmt.Errorf("Metadata.SensitiveFields must not contain empty field names")
+		}
+	}
+	return nil
+}
+
+// redactedMetadata returns a copy of metadata with the values of secrets, such
+// as the EXTJWT token, and of the fields listed in Metadata.SensitiveFields
+// replaced. Fields are only ever redacted, never dropped, so it's still visible
+// which fields the client sent.
+func (serv *UploadServer) redactedMetadata(metadata map[string]string) map[string]string {
+	redacted := make(map[string]string, len(metadata))
+	for field, value := range metadata {
+		redacted[field] = value
+	}
+	for _, fields := range [][]string{secretMetadataFields, serv.cfg.Metadata.SensitiveFields} {
+		for _, field := range fields {
+			if _, ok := redacted[field]; ok {
+				redacted[field] = redactedMetadataValue
+			}
+		}
+	}
+	return redacted
+}
+
+// logCreationMetadata logs the metadata of a new upload at debug level once the
+// server fields have been injected, with sensitive values redacted. Nothing is
+// computed unless debug logging is enabled.
+func (serv *UploadServer) logCreationMetadata(req *http.Request, metadata map[string]string) {
+	event := serv.requestLog(req).Debug()
+	if !event.Enabled() {
+		return
+	}
+	event.
+		Str("event", "upload_metadata").
+		Interface("metadata", serv.redactedMetadata(metadata)).
+		Msg("Parsed upload metadata")
+}
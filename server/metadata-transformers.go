@@ -0,0 +1,264 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// limits applied to [[MetadataTransformers]] entries that don't set them
+const (
+	defaultMetadataTransformTimeout = 5 * time.Second
+	defaultMetadataRejectStatus     = http.StatusUnprocessableEntity
+)
+
+// largest response accepted from an external transformer
+const maxMetadataTransformResponse = 1 << 20
+
+// MetadataTransformer changes the metadata of a new upload before it is
+// created, e.g. to normalise or derive fields. It returns the complete new
+// metadata, or a *MetadataRejection to refuse the upload. The fields set by
+// the server (RemoteIP, RemoteCountry, account and issuer) can't be changed.
+type MetadataTransformer func(metadata map[string]string) (map[string]string, error)
+
+// MetadataRejection is returned by a MetadataTransformer to refuse an upload.
+// Message is sent to the client.
+type MetadataRejection struct {
+	Message string
+}
+
+func (r *MetadataRejection) Error() string {
+	return r.Message
+}
+
+var (
+	metadataTransformersMu sync.RWMutex
+	metadataTransformers   = make(map[string]MetadataTransformer)
+)
+
+// RegisterMetadataTransformer makes a transformer implemented in Go available
+// to [[MetadataTransformers]] entries with this Name. Must be called before
+// the config is loaded, e.g. from an init function.
+func RegisterMetadataTransformer(name string, transformer MetadataTransformer) {
+	metadataTransformersMu.Lock()
+	defer metadataTransformersMu.Unlock()
+
+	metadataTransformers[name] = transformer
+}
+
+func registeredMetadataTransformer(name string) (MetadataTransformer, bool) {
+	metadataTransformersMu.RLock()
+	defer metadataTransformersMu.RUnlock()
+
+	transformer, ok := metadataTransformers[name]
+	return transformer, ok
+}
+
+// metadataTransformerConfig is a [[MetadataTransformers]] entry. Exactly one of
+// Name, Command and URL selects the transformer.
+type metadataTransformerConfig struct {
+	Name         string
+	Command      []string
+	URL          string
+	Timeout      duration
+	RejectStatus int
+}
+
+func (t metadataTransformerConfig) String() string {
+	switch {
+	case t.Name != "":
+		return t.Name
+	case len(t.Command) > 0:
+		return t.Command[0]
+	}
+	return t.URL
+}
+
+// validateMetadataTransformers checks the [[MetadataTransformers]] entries
+func validateMetadataTransformers(transformers []metadataTransformerConfig) error {
+	for i, t := range transformers {
+		selectors := 0
+		for _, set := range []bool{t.Name != "", len(t.Command) > 0, t.URL != ""} {
+			if set {
+				selectors++
+			}
+		}
+		if selectors != 1 {
+			return fmt.Errorf("MetadataTransformers entry %d must set exactly one of Name, Command and URL", i+1)
+		}
+		if _, ok := registeredMetadataTransformer(t.Name); t.Name != "" && !ok {
+			return fmt.Errorf("MetadataTransformers entry %d: no transformer named %#v is registered", i+1, t.Name)
+		}
+		if t.RejectStatus != 0 && (t.RejectStatus < 400 || t.RejectStatus > 499) {
+			return fmt.Errorf("MetadataTransformers entry %d: RejectStatus must be a 4xx status, got %d", i+1, t.RejectStatus)
+		}
+		if t.Timeout.Duration < 0 {
+			return fmt.Errorf("MetadataTransformers entry %d: Timeout must not be negative", i+1)
+		}
+	}
+	return nil
+}
+
+// metadataTransformRequest and metadataTransformResponse are exchanged with
+// external transformers as JSON, over stdin and stdout or as a POST request
+// and its response
+type metadataTransformRequest struct {
+	Metadata map[string]string `json:"metadata"`
+}
+
+type metadataTransformResponse struct {
+	Metadata map[string]string `json:"metadata"`
+	Reject   string            `json:"reject"`
+}
+
+// configuredTransformer is a [[MetadataTransformers]] entry with its implementation
+type configuredTransformer struct {
+	metadataTransformerConfig
+	transform MetadataTransformer
+}
+
+// newMetadataTransformers prepares the [[MetadataTransformers]] entries
+func newMetadataTransformers(transformers []metadataTransformerConfig, connectTimeout time.Duration) []configuredTransformer {
+	configured := make([]configuredTransformer, 0, len(transformers))
+	for _, t := range transformers {
+		configured = append(configured, configuredTransformer{t, t.transformer(connectTimeout)})
+	}
+	return configured
+}
+
+// transformer returns the function implementing a [[MetadataTransformers]] entry
+func (t metadataTransformerConfig) transformer(connectTimeout time.Duration) MetadataTransformer {
+	timeout := t.Timeout.Duration
+	if timeout == 0 {
+		timeout = defaultMetadataTransformTimeout
+	}
+
+	if t.Name != "" {
+		transformer, _ := registeredMetadataTransformer(t.Name)
+		return transformer
+	}
+
+	if len(t.Command) > 0 {
+		return func(metadata map[string]string) (map[string]string, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			input, err := json.Marshal(metadataTransformRequest{Metadata: metadata})
+			if err != nil {
+				return nil, err
+			}
+			cmd := exec.CommandContext(ctx, t.Command[0], t.Command[1:]...)
+			cmd.Stdin = bytes.NewReader(input)
+			output, err := cmd.Output()
+			if err != nil {
+				return nil, err
+			}
+			return decodeMetadataTransformResponse(output)
+		}
+	}
+
+	client := newHTTPClient(connectTimeout, timeout)
+	return func(metadata map[string]string) (map[string]string, error) {
+		input, err := json.Marshal(metadataTransformRequest{Metadata: metadata})
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Post(t.URL, "application/json", bytes.NewReader(input))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("Transformer responded with status %d", resp.StatusCode)
+		}
+		output, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxMetadataTransformResponse))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMetadataTransformResponse(output)
+	}
+}
+
+func decodeMetadataTransformResponse(output []byte) (map[string]string, error) {
+	var response metadataTransformResponse
+	if err := json.Unmarshal(output, &response); err != nil {
+		return nil, fmt.Errorf("Malformed transformer response: %v", err)
+	}
+	if response.Reject != "" {
+		return nil, &MetadataRejection{Message: response.Reject}
+	}
+	if response.Metadata == nil {
+		return nil, errors.New("Transformer response has neither metadata nor reject")
+	}
+	return response.Metadata, nil
+}
+
+// transformMetadata runs the metadata of a creation request through the
+// [[MetadataTransformers]] in order and replaces the Upload-Metadata header with
+// the result. Returns false if a transformer rejected the upload or failed, in
+// which case the request was aborted.
+func (serv *UploadServer) transformMetadata(c *gin.Context) bool {
+	if len(serv.transformers) == 0 {
+		return true
+	}
+
+	metadata := parseMeta(c.Request.Header.Get("Upload-Metadata"))
+	for _, t := range serv.transformers {
+		transformed, err := t.transform(copyMetadata(metadata))
+		if err == nil && transformed == nil {
+			err = errors.New("Transformer returned no metadata")
+		}
+		if rejection, ok := err.(*MetadataRejection); ok {
+			status := t.RejectStatus
+			if status == 0 {
+				status = defaultMetadataRejectStatus
+			}
+			serv.requestLog(c.Request).Info().
+				Str("event", "metadata_rejected").
+				Str("transformer", t.String()).
+				Str("reason", rejection.Message).
+				Msg("Metadata transformer rejected the upload")
+			abortWithErrorResponse(c, status, "metadata_rejected", rejection.Message, nil)
+			return false
+		}
+		if err != nil {
+			serv.requestLog(c.Request).Error().
+				Err(err).
+				Str("transformer", t.String()).
+				Msg("Metadata transformer failed")
+			abortWithErrorResponse(c, http.StatusInternalServerError, "metadata_transform_failed",
+				"The upload metadata could not be processed", nil)
+			return false
+		}
+
+		for _, field := range serverMetadataFields {
+			if value, ok := metadata[field]; ok {
+				transformed[field] = value
+			} else {
+				delete(transformed, field)
+			}
+		}
+		metadata = transformed
+	}
+
+	c.Request.Header.Set("Upload-Metadata", serializeMeta(metadata))
+	return true
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	copied := make(map[string]string, len(metadata))
+	for key, value := range metadata {
+		copied[key] = value
+	}
+	return copied
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleMethodNotAllowed makes r answer requests for a known path with an
+// unsupported method with 405 Method Not Allowed in the JSON error envelope,
+// and an Allow header listing the methods of the path, instead of 404. OPTIONS
+// requests not answered by tusd or CORS get the Allow header with 204. Disabled
+// with Server.ExplainMethodNotAllowed.
+//
+// Middlewares registered with r.Use run first, so the tus protocol checks still
+// reject requests on tus routes that lack a supported Tus-Resumable header.
+func (serv *UploadServer) handleMethodNotAllowed(r *gin.Engine) {
+	if !serv.cfg.Server.ExplainMethodNotAllowed {
+		return
+	}
+
+	r.HandleMethodNotAllowed = true
+	r.NoMethod(func(c *gin.Context) {
+		// tusd answers OPTIONS requests for its routes itself
+		if c.Writer.Written() {
+			return
+		}
+
+		allowed := allowedMethods(r.Routes(), c.Request.URL.Path)
+		c.Header("Allow", strings.Join(allowed, ", "))
+		if c.Request.Method == http.MethodOptions {
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+
+		metrics.add("requests.methodNotAllowed", 1)
+		abortWithErrorResponse(c, http.StatusMethodNotAllowed, "method_not_allowed",
+			fmt.Sprintf("Method %s is not allowed, expected one of %s", c.Request.Method, strings.Join(allowed, ", ")),
+			gin.H{"allowed": allowed})
+	})
+}
+
+// allowedMethods returns the sorted methods of the routes whose path pattern
+// matches requestPath
+func allowedMethods(routes gin.RoutesInfo, requestPath string) []string {
+	seen := make(map[string]bool)
+	var allowed []string
+	for _, route := range routes {
+		if !seen[route.Method] && matchesRoutePattern(route.Path, requestPath) {
+			seen[route.Method] = true
+			allowed = append(allowed, route.Method)
+		}
+	}
+	sort.Strings(allowed)
+	return allowed
+}
+
+// matchesRoutePattern reports whether requestPath matches a gin route pattern,
+// where a :name segment matches any single segment and *name the remainder of
+// the path
+func matchesRoutePattern(pattern string, requestPath string) bool {
+	patternSegments := strings.Split(pattern, "/")
+	pathSegments := strings.Split(requestPath, "/")
+
+	for i, segment := range patternSegments {
+		if strings.HasPrefix(segment, "*") {
+			return true
+		}
+		if i >= len(pathSegments) {
+			return false
+		}
+		if strings.HasPrefix(segment, ":") {
+			if pathSegments[i] == "" {
+				return false
+			}
+			continue
+		}
+		if segment != pathSegments[i] {
+			return false
+		}
+	}
+	return len(patternSegments) == len(pathSegments)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metricsRegistry holds the values reported at GET <AdminPath>/metrics.
+// Counters live for the whole process, so they keep counting across config
+// reloads. Gauges are read when reported and replaced by each new UploadServer.
+type metricsRegistry struct {
+	mu       sync.RWMutex
+	counters map[string]*uint64
+	gauges   map[string]func() interface{}
+}
+
+var metrics = &metricsRegistry{
+	counters: make(map[string]*uint64),
+	gauges:   make(map[string]func() interface{}),
+}
+
+// add increments the counter name by delta, creating it if needed
+func (m *metricsRegistry) add(name string, delta uint64) {
+	m.mu.RLock()
+	counter, ok := m.counters[name]
+	m.mu.RUnlock()
+
+	if !ok {
+		m.mu.Lock()
+		if counter, ok = m.counters[name]; !ok {
+			counter = new(uint64)
+			m.counters[name] = counter
+		}
+		m.mu.Unlock()
+	}
+
+	atomic.AddUint64(counter, delta)
+}
+
+// addLabeled increments the counter name with a single label, e.g. the usage
+// of an EXTJWT issuer. Only use labels with a bounded set of values.
+func (m *metricsRegistry) addLabeled(name string, label string, value string, delta uint64) {
+	m.add(fmt.Sprintf("%s{%s=%q}", name, label, value), delta)
+}
+
+// setGauge registers a function reporting the current value of the gauge name
+func (m *metricsRegistry) setGauge(name string, read func() interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.gauges[name] = read
+}
+
+// snapshot returns the current value of every counter and gauge
+func (m *metricsRegistry) snapshot() map[string]interface{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	values := make(map[string]interface{}, len(m.counters)+len(m.gauges))
+	for name, counter := range m.counters {
+		values[name] = atomic.LoadUint64(counter)
+	}
+	for name, read := range m.gauges {
+		values[name] = read()
+	}
+	return values
+}
+
+// prometheusText renders the counters in the Prometheus text format. Metric
+// names are prefixed with "fileuploader_", dots become underscores and
+// "_total" is appended. Gauges are not included as their values aren't
+// necessarily numbers.
+func (m *metricsRegistry) prometheusText() string {
+	m.mu.RLock()
+	keys := make([]string, 0, len(m.counters))
+	for key := range m.counters {
+		keys = append(keys, key)
+	}
+	m.mu.RUnlock()
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	lastName := ""
+	for _, key := range keys {
+		name, labels := key, ""
+		if i := strings.IndexByte(key, '{'); i >= 0 {
+			name, labels = key[:i], key[i:]
+		}
+		name = "fileuploader_" + strings.Replace(name, ".", "_", -1) + "_total"
+		if name != lastName {
+			fmt.Fprintf(&buf, "# TYPE %s counter\n", name)
+			lastName = name
+		}
+
+		m.mu.RLock()
+		value := atomic.LoadUint64(m.counters[key])
+		m.mu.RUnlock()
+		fmt.Fprintf(&buf, "%s%s %d\n", name, labels, value)
+	}
+	return buf.String()
+}
+
+// reportMetrics responds with the current metrics as a JSON object, or with
+// the counters in the Prometheus text format for ?format=prometheus
+func (serv *UploadServer) reportMetrics(c *gin.Context) {
+	if c.Query("format") == "prometheus" {
+		c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", []byte(metrics.prometheusText()))
+		return
+	}
+	c.JSON(http.StatusOK, metrics.snapshot())
+}
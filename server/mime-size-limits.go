@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/events"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+// isMimeTypePattern reports whether pattern is a media type such as
+// "text/plain" or a wildcard for a top-level type such as "image/*"
+func isMimeTypePattern(pattern string) bool {
+	pattern = strings.Replace(pattern, "/*", "/x", 1)
+	return baseMediaType(pattern) == strings.ToLower(pattern)
+}
+
+// matchesMimeType reports whether the media type of contentType matches pattern
+func matchesMimeType(pattern string, contentType string) bool {
+	mediaType := baseMediaType(contentType)
+	if mediaType == "" {
+		return false
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.EqualFold(strings.SplitN(mediaType, "/", 2)[0]+"/*", pattern)
+	}
+	return strings.EqualFold(mediaType, pattern)
+}
+
+// validateMaxSizePerMimeType checks that the keys of Storage.MaxSizePerMimeType
+// are media types such as "text/plain" or wildcards such as "image/*"
+func validateMaxSizePerMimeType(limits map[string]datasize.ByteSize) error {
+	for mimeType, limit := range limits {
+		if !isMimeTypePattern(mimeType) {
+			return fmt.Errorf("Storage.MaxSizePerMimeType key %#v is not a media type such as \"text/plain\" or \"image/*\"", mimeType)
+		}
+		if limit == 0 {
+			return fmt.Errorf("Storage.MaxSizePerMimeType limit for %#v must be greater than 0", mimeType)
+		}
+	}
+	return nil
+}
+
+// mimeTypeSizeLimit returns the size limit for a content type from
+// Storage.MaxSizePerMimeType. An exact match takes precedence over a wildcard
+// for the top-level type. Returns 0 if there is no specific limit.
+func (serv *UploadServer) mimeTypeSizeLimit(contentType string) datasize.ByteSize {
+	for pattern, limit := range serv.cfg.Storage.MaxSizePerMimeType {
+		if !strings.HasSuffix(pattern, "/*") && matchesMimeType(pattern, contentType) {
+			return limit
+		}
+	}
+	for pattern, limit := range serv.cfg.Storage.MaxSizePerMimeType {
+		if strings.HasSuffix(pattern, "/*") && matchesMimeType(pattern, contentType) {
+			return limit
+		}
+	}
+	return 0
+}
+
+// enforceMimeTypeSizeLimit rejects a creation request whose declared size
+// exceeds the limit for its declared filetype. Returns false if the request was
+// rejected and aborted.
+func (serv *UploadServer) enforceMimeTypeSizeLimit(c *gin.Context, filetype string, size int64) bool {
+	limit := serv.mimeTypeSizeLimit(filetype)
+	if limit == 0 || size <= int64(limit.Bytes()) {
+		return true
+	}
+
+	abortWithErrorResponse(c, http.StatusRequestEntityTooLarge, "upload_too_large",
+		fmt.Sprintf("Uploads of type %s must not exceed %s", baseMediaType(filetype), limit.String()),
+		gin.H{"maxSize": limit.Bytes(), "filetype": baseMediaType(filetype)},
+	)
+	return false
+}
+
+// checkMimeTypeSizeLimit is a post-finish processor that terminates uploads
+// exceeding the limit for either their declared or their sniffed content type.
+// This catches uploads whose declared length was deferred and clients that
+// declare a type with a larger limit than the actual content.
+func (serv *UploadServer) checkMimeTypeSizeLimit(event *events.TusEvent) error {
+	info := event.Info
+	declared := info.MetaData["filetype"]
+	sniffed := serv.sniffContentType(info.ID)
+
+	for _, contentType := range []string{declared, sniffed} {
+		limit := serv.mimeTypeSizeLimit(contentType)
+		if limit == 0 || info.Size <= int64(limit.Bytes()) {
+			continue
+		}
+
+		if err := serv.store.TerminateWithReason(info.ID, shardedfilestore.DeletedReasonRejected); err != nil {
+			return err
+		}
+		serv.log.Warn().
+			Str("event", "upload_too_large").
+			Str("id", info.ID).
+			Str("declaredType", declared).
+			Str("sniffedType", sniffed).
+			Int64("size", info.Size).
+			Uint64("maxSize", limit.Bytes()).
+			Msg("Terminated upload exceeding the size limit for its type")
+		return errStopProcessing
+	}
+	return nil
+}
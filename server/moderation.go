@@ -0,0 +1,142 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/db"
+)
+
+// isApproved reports whether an upload may be downloaded. Uploads are created
+// unapproved while Moderation.HoldNewUploads is set, and corrupt ones are marked
+// by verifyStoredSize. Uploads without a record predate moderation and count as
+// approved.
+func (serv *UploadServer) isApproved(id string) (approved bool, corrupt bool, err error) {
+	err = serv.DBConn.DB.QueryRow(`SELECT approved, corrupt FROM uploads WHERE id = ?`, id).Scan(&approved, &corrupt)
+	if err == sql.ErrNoRows {
+		return true, false, nil
+	}
+	return approved, corrupt, err
+}
+
+// rejectIfPendingApproval responds with 403 pending_approval to downloads of
+// uploads that have not been approved, and with 500 upload_corrupt to those of
+// corrupt uploads. Returns true if the request was rejected and aborted.
+func (serv *UploadServer) rejectIfPendingApproval(c *gin.Context, id string) (handled bool) {
+	approved, corrupt, err := serv.isApproved(id)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return true
+	}
+	if approved && !corrupt {
+		return false
+	}
+
+	c.Header("Cache-Control", "no-store")
+	if corrupt {
+		abortWithErrorResponse(c, http.StatusInternalServerError, "upload_corrupt",
+			"The stored upload is damaged and can't be served", nil)
+		return true
+	}
+	abortWithErrorResponse(c, http.StatusForbidden, "pending_approval",
+		"The upload is awaiting approval by a moderator", nil)
+	return true
+}
+
+type pendingUpload struct {
+	ID        string         `db:"id"`
+	CreatedAt int64          `db:"created_at"`
+	Complete  bool           `db:"complete"`
+	Account   sql.NullString `db:"jwt_account"`
+	Issuer    sql.NullString `db:"jwt_issuer"`
+	IP        sql.NullString `db:"uploader_ip"`
+}
+
+// listPendingUploads lists the uploads awaiting approval, oldest first, with
+// their download URLs so a moderator can review them. The page is selected
+// with limit, cursor and before, see parseListPage.
+func (serv *UploadServer) listPendingUploads(c *gin.Context) {
+	page, ok := serv.parseListPage(c)
+	if !ok {
+		return
+	}
+
+	var records []pendingUpload
+	query, args := page.query(`
+		SELECT id, created_at, sha256sum IS NOT NULL AS complete, jwt_account, jwt_issuer, uploader_ip
+		FROM uploads
+		WHERE deleted = 0 AND approved = 0
+		`,
+	)
+	err := serv.DBConn.DB.Select(&records, query, args...)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+
+	uploads := make([]gin.H, 0, len(records))
+	for _, record := range records {
+		upload := gin.H{
+			"id":         record.ID,
+			"createdAt":  record.CreatedAt,
+			"complete":   record.Complete,
+			"uploaderIp": record.IP.String,
+			"account":    record.Account.String,
+			"issuer":     record.Issuer.String,
+		}
+		if info, err := serv.store.GetInfo(record.ID); err == nil {
+			upload["url"] = serv.downloadURL(c.Request, record.ID, info.MetaData)
+			upload["filename"] = sanitizeFilename(metadataFilename(info.MetaData))
+			upload["filetype"] = info.MetaData["filetype"]
+			upload["size"] = info.Size
+		}
+		uploads = append(uploads, upload)
+	}
+
+	response := gin.H{"uploads": uploads}
+	if len(records) > 0 {
+		first, last := records[0], records[len(records)-1]
+		next, prev := page.setLinks(c, len(records),
+			pageCursor(first.CreatedAt, first.ID), pageCursor(last.CreatedAt, last.ID))
+		if next != "" {
+			response["nextCursor"] = next
+		}
+		if prev != "" {
+			response["prevCursor"] = prev
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// approveUpload makes an upload held for moderation downloadable. Approving
+// an already approved upload succeeds.
+func (serv *UploadServer) approveUpload(c *gin.Context) {
+	id := c.Param("id")
+
+	var approved bool
+	err := serv.DBConn.DB.QueryRow(`SELECT approved FROM uploads WHERE id = ? AND deleted = 0`, id).Scan(&approved)
+	if err == sql.ErrNoRows {
+		abortWithErrorResponse(c, http.StatusNotFound, "upload_not_found", "No such upload", nil)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+
+	if !approved {
+		err = db.UpdateRow(serv.DBConn.DB, `UPDATE uploads SET approved = 1 WHERE id = ?`, id)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+		serv.requestLog(c.Request).Info().
+			Str("event", "upload_approved").
+			Str("id", id).
+			Msg("Approved upload")
+	}
+
+	c.JSON(http.StatusOK, gin.H{"id": id, "approved": true})
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tus/tusd"
+)
+
+// allowance for the multipart envelope and form fields on top of the file itself
+const multipartOverhead = 64 * 1024
+
+// errBodyTooLarge is returned by a limitedBody past its limit
+var errBodyTooLarge = errors.New("Request body too large")
+
+// limitedBody is a request body that fails reads past limit bytes and records
+// that it did, so a caller can tell an oversized body from a malformed one
+// whatever error the reading code wraps it in
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (body *limitedBody) Read(p []byte) (int, error) {
+	if body.exceeded {
+		return 0, errBodyTooLarge
+	}
+	// read one byte more than allowed to notice a body that is too large
+	if int64(len(p)) > body.remaining+1 {
+		p = p[:body.remaining+1]
+	}
+	n, err := body.ReadCloser.Read(p)
+	if int64(n) > body.remaining {
+		n = int(body.remaining)
+		body.remaining = 0
+		body.exceeded = true
+		return n, errBodyTooLarge
+	}
+	body.remaining -= int64(n)
+	return n, err
+}
+
+// postMultipartFile accepts a plain multipart/form-data upload for clients that
+// don't implement the tus protocol. The file is expected in the "file" field and
+// an EXTJWT token may be passed in the "extjwt" field.
+//
+// The upload goes through the same creation checks as a tus upload, is written
+// through the ShardedFileStore and emits the same post-create and post-finish
+// events, so it is recorded and processed exactly like a tus upload. The checks
+// that don't depend on the form, including the per-IP creation rate limit, run
+// before the body is read. As the account is only known from the form, a client
+// that has used up its per-IP creations is turned away even if it uploads for
+// an account. A retried upload of the same file for an account within
+// Storage.DuplicateUploadWindow is answered with the existing upload.
+func (serv *UploadServer) postMultipartFile(handler *tusd.UnroutedHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// metadata only comes from the form
+		c.Request.Header.Del("Upload-Metadata")
+		if !serv.admitCreation(c) || !serv.rejectIfIPRateLimited(c) {
+			return
+		}
+
+		maxSize := int64(serv.maxUploadSize(c.Request).Bytes())
+		body := &limitedBody{ReadCloser: c.Request.Body, remaining: maxSize + multipartOverhead}
+		c.Request.Body = body
+
+		fileHeader, err := c.FormFile("file")
+		if err != nil {
+			if body.exceeded {
+				serv.respondUploadTooLarge(c, http.StatusRequestEntityTooLarge)
+				return
+			}
+			c.Error(err).SetType(gin.ErrorTypePrivate)
+			abortWithErrorResponse(c, http.StatusBadRequest, "invalid_multipart_upload",
+				`Expected a multipart/form-data request with a "file" field`, nil)
+			return
+		}
+		if fileHeader.Size > maxSize {
+			serv.respondUploadTooLarge(c, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if serv.rejectEmptyUpload(c, fileHeader.Size) {
+			return
+		}
+
+		// present the form fields as tus metadata so the usual checks apply
+		metadata := parseMeta(c.Request.Header.Get("Upload-Metadata"))
+		metadata["filename"] = fileHeader.Filename
+		if filetype := fileHeader.Header.Get("Content-Type"); filetype != "" {
+			metadata["filetype"] = filetype
+		}
+		if token := c.PostForm("extjwt"); token != "" {
+			metadata["extjwt"] = token
+		}
+		c.Request.Header.Set("Upload-Metadata", serializeMeta(metadata))
+
+		defer serv.releaseIncompleteSlot(c)
+		if !serv.prepareCreationMetadata(c) {
+			return
+		}
+		metadata = parseMeta(c.Request.Header.Get("Upload-Metadata"))
+		if !serv.enforceMimeTypeSizeLimit(c, metadata["filetype"], fileHeader.Size) {
+			return
+		}
+
+		if !serv.enforceAccountQuota(c, metadata, fileHeader.Size, false) {
+			return
+		}
+
+		hash, err := serv.duplicateCandidateHash(fileHeader, metadata)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+		if existingID := serv.findRecentDuplicate(c.Request, metadata, fileHeader.Size, hash); existingID != "" {
+			serv.requestLog(c.Request).Info().
+				Str("event", "duplicate_upload").
+				Str("id", existingID).
+				Msg("Creation request matched a recently completed upload")
+			serv.respondMultipartCreated(c, existingID, metadata)
+			return
+		}
+
+		id, err := serv.storeMultipartFile(fileHeader, metadata)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+
+		info, err := serv.store.GetInfo(id)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+		serv.requestLog(c.Request).Info().
+			Str("event", "upload_created").
+			Str("id", id).
+			Msg("Created upload")
+		handler.CreatedUploads <- info
+		handler.CompleteUploads <- info
+
+		serv.respondMultipartCreated(c, id, metadata)
+	}
+}
+
+func (serv *UploadServer) respondMultipartCreated(c *gin.Context, id string, metadata map[string]string) {
+	downloadURL := serv.downloadURL(c.Request, id, metadata)
+	c.Header("Location", serv.publicBaseURL(c.Request)+"/"+url.PathEscape(id))
+	c.Header("X-Download-URL", downloadURL)
+	c.JSON(http.StatusCreated, gin.H{
+		"id":  id,
+		"url": downloadURL,
+	})
+}
+
+// duplicateCandidateHash returns the SHA-256 hash of an uploaded form file for
+// findRecentDuplicate, or nil if the upload can't be matched anyway, to save
+// reading the file
+func (serv *UploadServer) duplicateCandidateHash(fileHeader *multipart.FileHeader, metadata map[string]string) ([]byte, error) {
+	if serv.cfg.Storage.DuplicateUploadWindow.Duration <= 0 || metadata["account"] == "" {
+		return nil, nil
+	}
+
+	src, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, src); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// storeMultipartFile writes an uploaded form file into the store as a finished
+// upload. A partially stored upload is terminated if anything fails.
+func (serv *UploadServer) storeMultipartFile(fileHeader *multipart.FileHeader, metadata map[string]string) (string, error) {
+	src, err := fileHeader.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	id, err := serv.store.NewUpload(tusd.FileInfo{
+		Size:     fileHeader.Size,
+		MetaData: metadata,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	written, err := serv.store.WriteChunk(id, 0, src)
+	if err == nil && written != fileHeader.Size {
+		err = fmt.Errorf("Wrote %d of %d bytes", written, fileHeader.Size)
+	}
+	if err == nil {
+		err = serv.store.FinishUpload(id)
+	}
+	if err != nil {
+		if termErr := serv.store.Terminate(id); termErr != nil {
+			serv.log.Error().
+				Err(termErr).
+				Str("id", id).
+				Msg("Failed to remove incomplete multipart upload")
+		}
+		return "", err
+	}
+
+	return id, nil
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newMultipartRequest returns a multipart upload request for content
+func (ts *testServer) newMultipartRequest(content string, filename string, token string) *http.Request {
+	ts.t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, err := form.CreateFormFile("file", filename)
+	if err == nil {
+		_, err = file.Write([]byte(content))
+	}
+	if err == nil && token != "" {
+		err = form.WriteField("extjwt", token)
+	}
+	if err == nil {
+		err = form.Close()
+	}
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ts.url("/files/multipart"), &body)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+// readTrackingBody is a request body that records whether it was read
+type readTrackingBody struct {
+	io.Reader
+	read bool
+}
+
+func (body *readTrackingBody) Read(p []byte) (int, error) {
+	body.read = true
+	return body.Reader.Read(p)
+}
+
+func (body *readTrackingBody) Close() error {
+	return nil
+}
+
+func TestMultipartUploadRejectedBeforeReadingBody(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Server.EnableMultipartUploads = true
+		cfg.RateLimit.CreationsPerIPPerHour = 1
+	})
+	defer ts.Close()
+
+	// serve the request directly to see whether the handler read the body
+	serve := func() (*httptest.ResponseRecorder, *readTrackingBody) {
+		req := ts.newMultipartRequest("hello", "hello.txt", "")
+		body := &readTrackingBody{Reader: req.Body}
+		req.Body = body
+		req.RemoteAddr = "127.0.0.1:1234"
+		rec := httptest.NewRecorder()
+		ts.http.Config.Handler.ServeHTTP(rec, req)
+		return rec, body
+	}
+
+	ts.uploadPause.set(true)
+	if rec, body := serve(); rec.Code != http.StatusServiceUnavailable || body.read {
+		t.Fatalf("Expected status 503 without reading the body while paused, got %d (read: %v)", rec.Code, body.read)
+	}
+	ts.uploadPause.set(false)
+
+	if rec, _ := serve(); rec.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d with body %q", rec.Code, rec.Body.String())
+	}
+	if rec, body := serve(); rec.Code != http.StatusTooManyRequests || body.read {
+		t.Fatalf("Expected status 429 without reading the body when rate limited, got %d (read: %v)", rec.Code, body.read)
+	}
+}
+
+func TestMultipartUploadTooLarge(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Server.EnableMultipartUploads = true
+		cfg.Storage.MaximumUploadSize = 1024
+	})
+	defer ts.Close()
+
+	// slightly too large files are rejected once parsed, files much larger than
+	// the limit while parsing
+	for _, size := range []int{2048, 2 * multipartOverhead} {
+		resp, body := ts.do(ts.newMultipartRequest(strings.Repeat("x", size), "large.txt", ""))
+		if resp.StatusCode != http.StatusRequestEntityTooLarge {
+			t.Fatalf("%d bytes: expected status 413, got %d with body %q", size, resp.StatusCode, body)
+		}
+		if errResp := decodeErrorResponse(t, body); errResp.Code != "upload_too_large" {
+			t.Fatalf("%d bytes: expected error code upload_too_large, got %q", size, errResp.Code)
+		}
+	}
+
+	if resp, body := ts.do(ts.newMultipartRequest("small", "small.txt", "")); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d with body %q", resp.StatusCode, body)
+	}
+}
+
+func TestMultipartUploadDuplicate(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Server.EnableMultipartUploads = true
+		cfg.JwtSecretsByIssuer = map[string]string{testJwtIssuer: testJwtSecret}
+		cfg.Storage.DuplicateUploadWindow.Duration = time.Hour
+	})
+	defer ts.Close()
+
+	upload := func(content string, token string) string {
+		t.Helper()
+		resp, body := ts.do(ts.newMultipartRequest(content, "file.txt", token))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d with body %q", resp.StatusCode, body)
+		}
+		var created struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(body), &created); err != nil {
+			t.Fatal(err)
+		}
+		return created.ID
+	}
+
+	token := accountJwt(t, "alice")
+	first := upload("same content", token)
+	if retried := upload("same content", token); retried != first {
+		t.Fatalf("Expected the retried upload to be answered with %s, got %s", first, retried)
+	}
+	if other := upload("other content", token); other == first {
+		t.Fatal("Expected different content to create a new upload")
+	}
+	if anonymous := upload("same content", ""); anonymous == first {
+		t.Fatal("Expected an anonymous upload not to match the account's upload")
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/gin-gonic/gin"
+)
+
+// validateMaxSizePerOrigin checks that every origin in Storage.MaxSizePerOrigin
+// is allowed by Server.CorsOrigins, as the Origin header of other requests is
+// not trusted
+func validateMaxSizePerOrigin(limits map[string]datasize.ByteSize, corsOrigins []string) error {
+	allowed := make(map[string]bool, len(corsOrigins))
+	for _, origin := range corsOrigins {
+		allowed[origin] = true
+	}
+
+	for origin, limit := range limits {
+		if !allowed[origin] {
+			return fmt.Errorf("Storage.MaxSizePerOrigin origin %#v is not listed in Server.CorsOrigins", origin)
+		}
+		if limit == 0 {
+			return fmt.Errorf("Storage.MaxSizePerOrigin limit for %#v must be greater than 0", origin)
+		}
+	}
+	return nil
+}
+
+// largestUploadSize returns the largest upload size allowed for any origin.
+// This is the limit enforced by tusd; the smaller limits of other origins are
+// enforced by the handlers.
+func (cfg *Config) largestUploadSize() datasize.ByteSize {
+	largest := cfg.Storage.MaximumUploadSize
+	for _, limit := range cfg.Storage.MaxSizePerOrigin {
+		if limit > largest {
+			largest = limit
+		}
+	}
+	return largest
+}
+
+// maxUploadSize returns the upload size limit for a request, which is the limit
+// from Storage.MaxSizePerOrigin for its Origin header, or
+// Storage.MaximumUploadSize for origins without an override
+func (serv *UploadServer) maxUploadSize(req *http.Request) datasize.ByteSize {
+	if limit, ok := serv.cfg.Storage.MaxSizePerOrigin[req.Header.Get("Origin")]; ok {
+		return limit
+	}
+	return serv.cfg.Storage.MaximumUploadSize
+}
+
+// enforceOriginSizeLimit rejects a creation request whose declared size exceeds
+// the limit for its origin. Returns false if the request was rejected and
+// aborted.
+func (serv *UploadServer) enforceOriginSizeLimit(c *gin.Context, size int64) bool {
+	if size <= int64(serv.maxUploadSize(c.Request).Bytes()) {
+		return true
+	}
+	serv.respondUploadTooLarge(c, http.StatusRequestEntityTooLarge)
+	return false
+}
+
+// rejectIfOverOriginLimit rejects a PATCH to an upload with a deferred length
+// that would grow it past the limit for the request's origin. Uploads with a
+// known length were already checked when they were created. Returns true if
+// the request was rejected and aborted.
+func (serv *UploadServer) rejectIfOverOriginLimit(c *gin.Context) (handled bool) {
+	limit := int64(serv.maxUploadSize(c.Request).Bytes())
+	if limit >= int64(serv.cfg.largestUploadSize().Bytes()) {
+		// tusd enforces this limit already
+		return false
+	}
+
+	info, err := serv.store.GetInfo(c.Param("id"))
+	if err != nil || !info.SizeIsDeferred {
+		return false
+	}
+
+	size := info.Offset + c.Request.ContentLength
+	if length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64); err == nil {
+		size = length
+	}
+	if size <= limit {
+		return false
+	}
+	return serv.respondUploadTooLarge(c, http.StatusRequestEntityTooLarge)
+}
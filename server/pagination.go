@@ -0,0 +1,123 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listPage addresses a page of a list ordered by created_at and id. Cursors
+// have the form "<created_at>.<id>" and point between two entries, so entries
+// created while paging don't shift the following pages.
+type listPage struct {
+	limit int
+
+	// with after set, the page starts after the cursor; with before set, it
+	// ends before the cursor. Neither means the first page.
+	after     bool
+	before    bool
+	createdAt int64
+	id        string
+}
+
+// parseListPage reads the limit, cursor and before query parameters. limit
+// defaults to Server.ListPageSize and may be at most Server.MaxListPageSize.
+// Responds with 400 and returns false if a parameter is invalid.
+func (serv *UploadServer) parseListPage(c *gin.Context) (page listPage, ok bool) {
+	maxLimit := serv.cfg.Server.MaxListPageSize
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(serv.cfg.Server.ListPageSize)))
+	if err != nil || limit < 1 || limit > maxLimit {
+		abortWithErrorResponse(c, http.StatusBadRequest, "invalid_parameter",
+			fmt.Sprintf("limit must be between 1 and %d", maxLimit), nil)
+		return page, false
+	}
+	page.limit = limit
+
+	cursor, param := c.Query("cursor"), "cursor"
+	if before := c.Query("before"); before != "" {
+		cursor, param = before, "before"
+	}
+	if cursor == "" {
+		return page, true
+	}
+
+	parts := strings.SplitN(cursor, ".", 2)
+	if len(parts) == 2 {
+		page.createdAt, err = strconv.ParseInt(parts[0], 10, 64)
+	}
+	if len(parts) != 2 || err != nil {
+		abortWithErrorResponse(c, http.StatusBadRequest, "invalid_parameter", param+" is malformed", nil)
+		return page, false
+	}
+	page.id = parts[1]
+	page.after = param == "cursor"
+	page.before = param == "before"
+	return page, true
+}
+
+// query completes a query selecting the columns created_at and id, which must
+// end in a WHERE clause, to select the rows of the page in ascending order
+func (page listPage) query(query string, args ...interface{}) (string, []interface{}) {
+	if page.before {
+		query = `SELECT * FROM (` + query + `
+			AND (created_at < ? OR (created_at = ? AND id < ?))
+			ORDER BY created_at DESC, id DESC
+			LIMIT ?
+		) AS page ORDER BY created_at, id`
+		return query, append(args, page.createdAt, page.createdAt, page.id, page.limit)
+	}
+
+	if page.after {
+		query += `
+			AND (created_at > ? OR (created_at = ? AND id > ?))`
+		args = append(args, page.createdAt, page.createdAt, page.id)
+	}
+	query += `
+		ORDER BY created_at, id
+		LIMIT ?`
+	return query, append(args, page.limit)
+}
+
+// pageCursor returns the cursor pointing after an entry
+func pageCursor(createdAt int64, id string) string {
+	return strconv.FormatInt(createdAt, 10) + "." + id
+}
+
+// setLinks sets a Link header with the URLs of the next and previous pages,
+// given the number of entries on this page and the cursors of the first and
+// last one, and returns the cursors of those pages. A next or previous page is
+// only linked if it may contain entries.
+func (page listPage) setLinks(c *gin.Context, count int, first string, last string) (next string, prev string) {
+	full := count == page.limit
+	if count > 0 && (page.before || full) {
+		next = last
+	}
+	if count > 0 && (page.after || page.before && full) {
+		prev = first
+	}
+
+	var links []string
+	if next != "" {
+		links = append(links, `<`+pageURL(c, "cursor", next)+`>; rel="next"`)
+	}
+	if prev != "" {
+		links = append(links, `<`+pageURL(c, "before", prev)+`>; rel="prev"`)
+	}
+	if len(links) > 0 {
+		c.Header("Link", strings.Join(links, ", "))
+	}
+	return next, prev
+}
+
+// pageURL returns the URL of the request, relative to its host, with the
+// cursor replaced
+func pageURL(c *gin.Context, param string, cursor string) string {
+	query := c.Request.URL.Query()
+	query.Del("cursor")
+	query.Del("before")
+	query.Set(param, cursor)
+	return c.Request.URL.Path + "?" + query.Encode()
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// how concurrent PATCH requests for the same upload are handled
+const (
+	concurrentPatchesReject    = "reject"
+	concurrentPatchesSerialize = "serialize"
+)
+
+func validateConcurrentPatches(mode string) error {
+	switch mode {
+	case concurrentPatchesReject, concurrentPatchesSerialize:
+		return nil
+	}
+	return fmt.Errorf("Unsupported Server.ConcurrentPatches %#v, expected %#v or %#v",
+		mode, concurrentPatchesReject, concurrentPatchesSerialize)
+}
+
+// uploadLocks allows only one PATCH request at a time per upload within the
+// process. The lock files of the store do the same across processes, but make
+// a second request fail immediately instead of letting it wait.
+type uploadLocks struct {
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+}
+
+type uploadLock struct {
+	held chan struct{} // holds a value while the lock is taken
+	refs int           // requests holding or waiting for the lock
+}
+
+func newUploadLocks() *uploadLocks {
+	return &uploadLocks{locks: make(map[string]*uploadLock)}
+}
+
+// lock takes the lock of an upload, waiting up to wait for it to be released.
+// Returns false if the lock couldn't be taken in time or cancel was closed.
+func (l *uploadLocks) lock(id string, wait time.Duration, cancel <-chan struct{}) bool {
+	l.mu.Lock()
+	lock, ok := l.locks[id]
+	if !ok {
+		lock = &uploadLock{held: make(chan struct{}, 1)}
+		l.locks[id] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	select {
+	case lock.held <- struct{}{}:
+		return true
+	default:
+	}
+
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case lock.held <- struct{}{}:
+			return true
+		case <-timer.C:
+		case <-cancel:
+		}
+	}
+
+	l.release(id, lock)
+	return false
+}
+
+// unlock releases the lock of an upload taken with lock
+func (l *uploadLocks) unlock(id string) {
+	l.mu.Lock()
+	lock := l.locks[id]
+	l.mu.Unlock()
+
+	<-lock.held
+	l.release(id, lock)
+}
+
+func (l *uploadLocks) release(id string, lock *uploadLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, id)
+	}
+}
+
+// lockUploadForPatch takes the lock of the upload a PATCH request is for. With
+// Server.ConcurrentPatches = "serialize" the request waits up to
+// Server.ConcurrentPatchWait for an earlier PATCH to finish, otherwise it is
+// rejected with 423 Locked right away. Returns false if the request was
+// rejected and aborted; otherwise the caller must call unlock when done.
+func (serv *UploadServer) lockUploadForPatch(c *gin.Context) bool {
+	id := c.Param("id")
+
+	wait := time.Duration(0)
+	if serv.cfg.Server.ConcurrentPatches == concurrentPatchesSerialize {
+		wait = serv.cfg.Server.ConcurrentPatchWait.Duration
+	}
+	if serv.patchLocks.lock(id, wait, c.Request.Context().Done()) {
+		return true
+	}
+
+	metrics.add("uploads.concurrentPatchesRejected", 1)
+	serv.requestLog(c.Request).Warn().
+		Str("event", "concurrent_patch").
+		Str("id", id).
+		Msg("Rejected PATCH while another PATCH for the upload is in progress")
+	abortWithErrorResponse(c, http.StatusLocked, "upload_locked",
+		"Another request is currently writing to this upload", nil)
+	return false
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForPatchLock waits until refs requests hold or wait for the lock of an
+// upload
+func (ts *testServer) waitForPatchLock(uploadURL string, refs int) {
+	ts.t.Helper()
+
+	id := uploadID(uploadURL)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		ts.patchLocks.mu.Lock()
+		lock := ts.patchLocks.locks[id]
+		locked := lock != nil && lock.refs == refs
+		ts.patchLocks.mu.Unlock()
+		if locked {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ts.t.Fatalf("Timed out waiting for %d requests on the lock of the upload", refs)
+}
+
+func TestConcurrentPatches(t *testing.T) {
+	tests := []struct {
+		mode   string
+		status int
+	}{
+		{concurrentPatchesReject, http.StatusLocked},
+		{concurrentPatchesSerialize, http.StatusConflict},
+	}
+
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			ts := newTestServer(t, func(cfg *Config) {
+				cfg.Server.ConcurrentPatches = test.mode
+			})
+			defer ts.Close()
+
+			const first, second = "aaaaaaaaaa", "bbbbbbbbbb"
+			uploadURL := ts.createUpload(len(first), nil)
+
+			// the first PATCH holds the lock while its body is still being sent
+			body, bodyWriter := io.Pipe()
+			req := ts.newPatchRequest(uploadURL, 0, "")
+			req.Body = body
+			req.ContentLength = int64(len(first))
+			firstDone := make(chan *http.Response)
+			go func() {
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+				}
+				firstDone <- resp
+			}()
+			if _, err := io.WriteString(bodyWriter, first[:5]); err != nil {
+				t.Fatal(err)
+			}
+			ts.waitForPatchLock(uploadURL, 1)
+
+			secondDone := make(chan *http.Response)
+			go func() {
+				resp, err := http.DefaultClient.Do(ts.newPatchRequest(uploadURL, 0, second))
+				if err != nil {
+					t.Error(err)
+				}
+				secondDone <- resp
+			}()
+
+			if test.mode == concurrentPatchesReject {
+				// rejected while the first PATCH is still writing
+				resp := <-secondDone
+				resp.Body.Close()
+				if resp.StatusCode != test.status {
+					t.Errorf("Expected status %d for the second PATCH, got %d", test.status, resp.StatusCode)
+				}
+			}
+
+			if test.mode == concurrentPatchesSerialize {
+				ts.waitForPatchLock(uploadURL, 2)
+			}
+			io.WriteString(bodyWriter, first[5:])
+			bodyWriter.Close()
+			resp := <-firstDone
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusNoContent {
+				t.Errorf("Expected status 204 for the first PATCH, got %d", resp.StatusCode)
+			}
+
+			if test.mode == concurrentPatchesSerialize {
+				// waited for the first PATCH, after which the offset has moved on
+				resp := <-secondDone
+				resp.Body.Close()
+				if resp.StatusCode != test.status {
+					t.Errorf("Expected status %d for the second PATCH, got %d", test.status, resp.StatusCode)
+				}
+			}
+
+			head, _ := ts.do(ts.newTusRequest(http.MethodHead, uploadURL, ""))
+			if offset := head.Header.Get("Upload-Offset"); offset != "10" {
+				t.Errorf("Expected Upload-Offset 10, got %q", offset)
+			}
+			if _, content := ts.get(uploadURL); content != first {
+				t.Errorf("Expected the content of the first PATCH %q, got %q", first, content)
+			}
+			if strings.Contains(ts.storedContent(uploadURL), "b") {
+				t.Error("Data of the second PATCH was stored")
+			}
+		})
+	}
+}
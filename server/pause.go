@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadPause is the switch for accepting new uploads, toggled through the
+// admin API. Like the admin token it outlives a single UploadServer, so a pause
+// stays in effect across config reloads, but not across restarts.
+type uploadPause struct {
+	mu     sync.RWMutex
+	paused bool
+	since  time.Time
+}
+
+// set pauses or resumes new uploads. Returns false if the state didn't change.
+func (p *uploadPause) set(paused bool) (changed bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.paused == paused {
+		return false
+	}
+	p.paused = paused
+	p.since = time.Now()
+	return true
+}
+
+// state returns whether new uploads are paused and since when
+func (p *uploadPause) state() (paused bool, since time.Time) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.paused, p.since
+}
+
+// rejectIfPaused responds with 503 uploads_paused to creation requests while
+// uploads are paused. PATCH requests to existing uploads and downloads are not
+// affected. Returns true if the request was rejected and aborted.
+func (serv *UploadServer) rejectIfPaused(c *gin.Context) (handled bool) {
+	if paused, _ := serv.uploadPause.state(); !paused {
+		return false
+	}
+
+	abortWithErrorResponse(c, http.StatusServiceUnavailable, "uploads_paused",
+		"New uploads are temporarily not accepted", nil)
+	return true
+}
+
+// pauseUploads stops accepting new uploads
+func (serv *UploadServer) pauseUploads(c *gin.Context) {
+	serv.setUploadsPaused(c, true)
+}
+
+// resumeUploads accepts new uploads again after pauseUploads
+func (serv *UploadServer) resumeUploads(c *gin.Context) {
+	serv.setUploadsPaused(c, false)
+}
+
+func (serv *UploadServer) setUploadsPaused(c *gin.Context, paused bool) {
+	if serv.uploadPause.set(paused) {
+		event, msg := "uploads_resumed", "Resumed accepting new uploads"
+		if paused {
+			event, msg = "uploads_paused", "Paused accepting new uploads"
+		}
+		serv.requestLog(c.Request).Warn().
+			Str("event", event).
+			Msg(msg)
+	}
+
+	_, since := serv.uploadPause.state()
+	c.JSON(http.StatusOK, gin.H{"paused": paused, "since": since.Unix()})
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+)
+
+// metadata fields that hold secrets and are never stored
+var secretMetadataFields = []string{"extjwt"}
+
+// validatePersistedMetadataFields rejects the fields set by the server, which
+// are stored in their own columns, and secrets in
+// Database.PersistedMetadataFields
+func validatePersistedMetadataFields(fields []string) error {
+	for _, field := range fields {
+		for _, reservedFields := range [][]string{serverMetadataFields, secretMetadataFields} {
+			for _, reserved := range reservedFields {
+				if field == reserved {
+					return fmt.Errorf("Database.PersistedMetadataFields must not contain the reserved field %#v", field)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// persistedMetadata returns the metadata fields allowed by
+// Database.PersistedMetadataFields as JSON for the metadata column. Fields not
+// on the list are never written to the database. NULL is returned when no
+// allowed fields are present.
+//
+// At most Database.MaxPersistedMetadataFields fields are stored, and field names
+// and values together are limited to Database.MaxPersistedMetadataBytes. Fields
+// are taken in the order of the list; a value that doesn't fit the remaining
+// bytes is truncated and the fields after the limits are dropped. The names of
+// truncated and dropped fields are returned as overflow. The metadata of the
+// upload itself is left untouched.
+func (serv *UploadServer) persistedMetadata(metadata map[string]string) (persistedJSON sql.NullString, overflow []string, err error) {
+	maxFields := serv.cfg.Database.MaxPersistedMetadataFields
+	maxBytes := int(serv.cfg.Database.MaxPersistedMetadataBytes.Bytes())
+
+	persisted := make(map[string]string)
+	totalBytes := 0
+	for _, field := range serv.cfg.Database.PersistedMetadataFields {
+		value, ok := metadata[field]
+		if !ok {
+			continue
+		}
+		if maxFields > 0 && len(persisted) >= maxFields {
+			overflow = append(overflow, field)
+			continue
+		}
+		if maxBytes > 0 && totalBytes+len(field)+len(value) > maxBytes {
+			overflow = append(overflow, field)
+			remaining := maxBytes - totalBytes - len(field)
+			if remaining <= 0 {
+				continue
+			}
+			value = truncateUTF8(value, remaining)
+		}
+		persisted[field] = value
+		totalBytes += len(field) + len(value)
+	}
+	if len(persisted) == 0 {
+		return sql.NullString{}, overflow, nil
+	}
+
+	data, err := json.Marshal(persisted)
+	if err != nil {
+		return sql.NullString{}, overflow, err
+	}
+	return sql.NullString{String: string(data), Valid: true}, overflow, nil
+}
@@ -0,0 +1,160 @@
+package server
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/kiwiirc/plugin-fileuploader/events"
+	"github.com/rs/zerolog"
+	"github.com/tus/tusd"
+	"github.com/tus/tusd/cmd/tusd/cli/hooks"
+)
+
+// errStopProcessing is returned by a processor to skip the remaining processors
+// for an upload, e.g. because it terminated the upload
+var errStopProcessing = errors.New("stop processing")
+
+// postFinishProcessor is a processing step run for every completed upload
+type postFinishProcessor struct {
+	name    string
+	process func(event *events.TusEvent) error
+}
+
+// postFinishPool runs the post-finish processors on a bounded number of workers.
+//
+// Events are queued as soon as they are received so that the broadcaster is never
+// blocked by slow processors. Uploads are processed concurrently, so processors
+// must not assume that uploads are handled in the order they finished. The
+// processors for a single upload run sequentially in registration order.
+type postFinishPool struct {
+	log        *zerolog.Logger
+	processors []postFinishProcessor
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  []*events.TusEvent
+	closed bool
+	wg     sync.WaitGroup
+
+	// ids of uploads queued for reprocessing, so they are queued only once
+	reprocessing map[string]struct{}
+}
+
+func newPostFinishPool(concurrency int, log *zerolog.Logger) *postFinishPool {
+	pool := &postFinishPool{
+		log:          log,
+		reprocessing: make(map[string]struct{}),
+	}
+	pool.cond = sync.NewCond(&pool.mu)
+
+	pool.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go pool.worker()
+	}
+
+	return pool
+}
+
+// register adds a processor. Must be called before events are received.
+func (pool *postFinishPool) register(name string, process func(event *events.TusEvent) error) {
+	pool.processors = append(pool.processors, postFinishProcessor{name, process})
+}
+
+// listen queues every post-finish event from the broadcaster until it closes
+func (pool *postFinishPool) listen(broadcaster *events.TusEventBroadcaster) {
+	channel := broadcaster.Listen("post-finish", events.DefaultBufferSize, events.OverflowBlock)
+	for {
+		event, ok := <-channel
+		if !ok {
+			return // channel closed
+		}
+		if event.Type == hooks.HookPostFinish {
+			pool.enqueue(event)
+		}
+	}
+}
+
+func (pool *postFinishPool) enqueue(event *events.TusEvent) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if pool.closed {
+		return
+	}
+	pool.queue = append(pool.queue, event)
+	pool.cond.Signal()
+}
+
+// reprocess queues a completed upload to run through the processors again,
+// without emitting an event to other listeners. Returns false if the upload is
+// already queued for reprocessing or the pool is closed.
+func (pool *postFinishPool) reprocess(info tusd.FileInfo) (queued bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if _, ok := pool.reprocessing[info.ID]; ok || pool.closed {
+		return false
+	}
+	pool.reprocessing[info.ID] = struct{}{}
+	pool.queue = append(pool.queue, &events.TusEvent{Info: info, Type: hooks.HookPostFinish})
+	pool.cond.Signal()
+	return true
+}
+
+// processorNames lists the names of the registered processors in order
+func (pool *postFinishPool) processorNames() []string {
+	names := make([]string, 0, len(pool.processors))
+	for _, processor := range pool.processors {
+		names = append(names, processor.name)
+	}
+	return names
+}
+
+func (pool *postFinishPool) worker() {
+	defer pool.wg.Done()
+
+	for {
+		pool.mu.Lock()
+		for len(pool.queue) == 0 && !pool.closed {
+			pool.cond.Wait()
+		}
+		if len(pool.queue) == 0 {
+			// closed and drained
+			pool.mu.Unlock()
+			return
+		}
+		event := pool.queue[0]
+		pool.queue[0] = nil
+		pool.queue = pool.queue[1:]
+		delete(pool.reprocessing, event.Info.ID)
+		pool.mu.Unlock()
+
+		pool.run(event)
+	}
+}
+
+func (pool *postFinishPool) run(event *events.TusEvent) {
+	for _, processor := range pool.processors {
+		err := processor.process(event)
+		if err == errStopProcessing {
+			return
+		}
+		if err != nil {
+			pool.log.Error().
+				Err(err).
+				Str("id", event.Info.ID).
+				Str("processor", processor.name).
+				Msg("Post-finish processing failed")
+		}
+	}
+}
+
+// Close stops accepting new events and blocks until the queued ones are processed
+func (pool *postFinishPool) Close() {
+	pool.mu.Lock()
+	pool.closed = true
+	pool.cond.Broadcast()
+	pool.mu.Unlock()
+
+	pool.wg.Wait()
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"database/sql"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// when a rate limiter holds more than this many buckets, full ones are purged
+const rateLimiterPurgeThreshold = 10000
+
+type rateBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimiter is a token bucket rate limiter with one bucket per key. Each
+// bucket holds up to perHour tokens and refills continuously over an hour.
+type rateLimiter struct {
+	perHour int
+
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+}
+
+func newRateLimiter(perHour int) *rateLimiter {
+	return &rateLimiter{
+		perHour: perHour,
+		buckets: make(map[string]*rateBucket),
+	}
+}
+
+// take consumes a token from the bucket for key. If the bucket is empty,
+// retryAfter is the time until a token becomes available.
+func (l *rateLimiter) take(key string) (allowed bool, retryAfter time.Duration) {
+	return l.takeAt(key, time.Now())
+}
+
+// takeAt consumes a token as of time now. Calls must be made in chronological
+// order per key.
+func (l *rateLimiter) takeAt(key string, now time.Time) (allowed bool, retryAfter time.Duration) {
+	capacity := float64(l.perHour)
+	perSecond := capacity / time.Hour.Seconds()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= rateLimiterPurgeThreshold {
+			l.purge(now, perSecond)
+		}
+		bucket = &rateBucket{tokens: capacity, updated: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(capacity, bucket.tokens+now.Sub(bucket.updated).Seconds()*perSecond)
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		wait := (1 - bucket.tokens) / perSecond
+		return false, time.Duration(wait * float64(time.Second))
+	}
+
+	bucket.tokens--
+	return true, 0
+}
+
+// check reports whether a token is available for key without consuming it. If
+// not, retryAfter is the time until one becomes available.
+func (l *rateLimiter) check(key string) (allowed bool, retryAfter time.Duration) {
+	capacity := float64(l.perHour)
+	perSecond := capacity / time.Hour.Seconds()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		return true, 0
+	}
+
+	tokens := math.Min(capacity, bucket.tokens+time.Since(bucket.updated).Seconds()*perSecond)
+	if tokens < 1 {
+		wait := (1 - tokens) / perSecond
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	return true, 0
+}
+
+// purge removes buckets that have refilled completely, as they are equivalent
+// to a new bucket. Must be called with mu held.
+func (l *rateLimiter) purge(now time.Time, perSecond float64) {
+	capacity := float64(l.perHour)
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*perSecond >= capacity {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// enforceCreationRateLimit limits upload creations per account, or per IP for
+// anonymous uploads, and responds with 429 when the limit is exceeded. Accounts
+// and IPs are counted separately. Must run after the account was resolved from
+// the EXTJWT. Returns false if the request was rejected and aborted.
+func (serv *UploadServer) enforceCreationRateLimit(c *gin.Context) bool {
+	metadata := parseMeta(c.Request.Header.Get("Upload-Metadata"))
+
+	limiter, key := serv.ipRateLimiter, metadata["RemoteIP"]
+	if account := metadata["account"]; account != "" {
+		limiter, key = serv.accountRateLimiter, metadata["issuer"]+"/"+account
+	}
+	if limiter == nil {
+		return true
+	}
+
+	allowed, retryAfter := limiter.take(key)
+	if allowed {
+		return true
+	}
+	serv.respondRateLimited(c, key, retryAfter)
+	return false
+}
+
+// rejectIfIPRateLimited responds with 429 if the client IP has used up its
+// creations, without counting the request. This lets an endpoint turn a client
+// away before reading the body, when the account it uploads for isn't known
+// yet. enforceCreationRateLimit must still run once it is. Must run after
+// addRemoteIPToMetadata. Returns false if the request was rejected and aborted.
+func (serv *UploadServer) rejectIfIPRateLimited(c *gin.Context) bool {
+	if serv.ipRateLimiter == nil {
+		return true
+	}
+
+	key := parseMeta(c.Request.Header.Get("Upload-Metadata"))[remoteIPKey]
+	allowed, retryAfter := serv.ipRateLimiter.check(key)
+	if allowed {
+		return true
+	}
+	serv.respondRateLimited(c, key, retryAfter)
+	return false
+}
+
+func (serv *UploadServer) respondRateLimited(c *gin.Context, key string, retryAfter time.Duration) {
+	retrySeconds := int(math.Ceil(retryAfter.Seconds()))
+	serv.requestLog(c.Request).Warn().
+		Str("event", "rate_limited").
+		Str("key", key).
+		Int("retryAfter", retrySeconds).
+		Msg("Upload creation rate limit exceeded")
+
+	c.Header("Retry-After", strconv.Itoa(retrySeconds))
+	abortWithErrorResponse(c, http.StatusTooManyRequests, "rate_limited",
+		"Too many uploads, try again later", gin.H{"retryAfter": retrySeconds})
+}
+
+type rateLimitRecord struct {
+	UploaderIP sql.NullString `db:"uploader_ip"`
+	JwtAccount sql.NullString `db:"jwt_account"`
+	JwtIssuer  sql.NullString `db:"jwt_issuer"`
+	CreatedAt  int64          `db:"created_at"`
+}
+
+// restoreCreationRateLimits replays the upload creations of the past hour from
+// the database into the creation rate limiters, so that restarting the server
+// or reloading the config doesn't reset the limits
+func (serv *UploadServer) restoreCreationRateLimits() error {
+	if serv.accountRateLimiter == nil && serv.ipRateLimiter == nil {
+		return nil
+	}
+
+	// deleted uploads count as well. The condition on deleted lets the
+	// database use the (deleted, created_at) index.
+	var records []rateLimitRecord
+	err := serv.DBConn.DB.Select(&records, `
+		SELECT uploader_ip, jwt_account, jwt_issuer, created_at FROM uploads
+		WHERE
+			deleted IN (0, 1)
+		AND created_at >= ?
+		ORDER BY created_at
+		`,
+		time.Now().Add(-time.Hour).Unix(),
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		limiter, key := serv.ipRateLimiter, record.UploaderIP.String
+		if record.JwtAccount.Valid {
+			limiter, key = serv.accountRateLimiter, record.JwtIssuer.String+"/"+record.JwtAccount.String
+		}
+		if limiter == nil || key == "" {
+			continue
+		}
+		limiter.takeAt(key, time.Unix(record.CreatedAt, 0))
+	}
+	return nil
+}
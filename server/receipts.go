@@ -0,0 +1,96 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/receipts"
+)
+
+// minimum length of Security.ReceiptSigningKey
+const minReceiptKeyLength = 32
+
+type receiptRecord struct {
+	SHA256Sum []byte         `db:"sha256sum"`
+	CreatedAt int64          `db:"created_at"`
+	Size      sql.NullInt64  `db:"size"`
+	Account   sql.NullString `db:"jwt_account"`
+	Issuer    sql.NullString `db:"jwt_issuer"`
+}
+
+// issueReceipt returns a signed receipt for a completed upload, stating its
+// hash, size, uploader account and upload time
+func (serv *UploadServer) issueReceipt(c *gin.Context) {
+	id := c.Param("id")
+
+	var record receiptRecord
+	err := serv.DBConn.DB.Get(&record, `
+		SELECT sha256sum, created_at, size, jwt_account, jwt_issuer FROM uploads
+		WHERE id = ? AND deleted = 0
+		`,
+		id,
+	)
+	if err == sql.ErrNoRows {
+		abortWithErrorResponse(c, http.StatusNotFound, "upload_not_found", "No such upload", nil)
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+	if record.SHA256Sum == nil {
+		abortWithErrorResponse(c, http.StatusConflict, "upload_incomplete",
+			"Receipts are only issued for completed uploads", nil)
+		return
+	}
+
+	receipt := receipts.Receipt{
+		ID:         id,
+		SHA256:     hex.EncodeToString(record.SHA256Sum),
+		Size:       record.Size.Int64,
+		Account:    record.Account.String,
+		Issuer:     record.Issuer.String,
+		UploadedAt: record.CreatedAt,
+	}
+	if !record.Size.Valid {
+		// completed before the size was recorded
+		info, err := serv.store.GetInfo(id)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+			return
+		}
+		receipt.Size = info.Size
+	}
+
+	token, err := receipts.Sign(receipt, []byte(serv.cfg.Security.ReceiptSigningKey))
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"receipt": token})
+}
+
+// verifyReceipt checks the signature of a receipt posted as
+// {"receipt": "<token>"} and returns its claims
+func (serv *UploadServer) verifyReceipt(c *gin.Context) {
+	var body struct {
+		Receipt string `json:"receipt" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		abortWithErrorResponse(c, http.StatusBadRequest, "invalid_request",
+			`Expected a JSON body with a "receipt" field`, nil)
+		return
+	}
+
+	receipt, err := receipts.Verify(body.Receipt, []byte(serv.cfg.Security.ReceiptSigningKey))
+	if err != nil {
+		abortWithErrorResponse(c, http.StatusBadRequest, "invalid_receipt",
+			"The receipt is malformed or its signature is invalid", nil)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"valid": true, "receipt": receipt})
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+)
+
+// loadedConfig is a config file that was read and validated, ready to be
+// swapped in for the running config
+type loadedConfig struct {
+	cfg          *Config
+	md           toml.MetaData
+	adminToken   string
+	virtualHosts []*virtualHost
+}
+
+// loadConfig reads and validates the config file and the virtual host profiles
+// it lists. On reload, an error means the running config is kept as is.
+func (runCtx *RunContext) loadConfig() (*loadedConfig, error) {
+	loaded, err := runCtx.loadConfigFile(runCtx.configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	loaded.virtualHosts, err = runCtx.loadVirtualHosts(loaded.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config: %v", err)
+	}
+	return loaded, nil
+}
+
+// loadConfigFile reads and validates a single config file
+func (runCtx *RunContext) loadConfigFile(configPath string) (*loadedConfig, error) {
+	cfg := NewConfig()
+	md, err := cfg.Load(runCtx.log, configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load config: %v", err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid config: %v", err)
+	}
+
+	adminToken, err := loadAdminToken(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load admin token: %v", err)
+	}
+
+	return &loadedConfig{cfg: cfg, md: md, adminToken: adminToken}, nil
+}
+
+// restartOnlySettings returns the settings that are not applied by a reload,
+// as changing them under a running process would strand the listener, existing
+// uploads or the database
+func restartOnlySettings(cfg *Config) map[string]interface{} {
+	return map[string]interface{}{
+		"Server.ListenAddress":         &cfg.Server.ListenAddress,
+		"Server.DownloadListenAddress": &cfg.Server.DownloadListenAddress,
+		"Storage.Path":                 &cfg.Storage.Path,
+		"Storage.ShardLayers":          &cfg.Storage.ShardLayers,
+		"Storage.DerivativesDir":       &cfg.Storage.DerivativesDir,
+		"Storage.Tiers":                &cfg.Storage.Tiers,
+		"Database.Type":                &cfg.Database.Type,
+		"Database.Path":                &cfg.Database.Path,
+		"Audit":                        &cfg.Audit,
+	}
+}
+
+// retainVirtualHostRestartOnlySettings applies retainRestartOnlySettings to the
+// reloaded virtual host profiles that were already running. Returns the changed
+// keys prefixed with the profile's config path.
+func retainVirtualHostRestartOnlySettings(running []*virtualHost, reloaded []*virtualHost) (changed []string) {
+	for _, reloadedHost := range reloaded {
+		for _, runningHost := range running {
+			if runningHost.configPath != reloadedHost.configPath {
+				continue
+			}
+			for _, key := range retainRestartOnlySettings(runningHost.loaded.cfg, reloadedHost.loaded.cfg) {
+				changed = append(changed, reloadedHost.configPath+": "+key)
+			}
+		}
+	}
+	return changed
+}
+
+// retainRestartOnlySettings reverts the restart-only settings of a reloaded
+// config to their running values and returns the keys that had changed
+func retainRestartOnlySettings(running *Config, reloaded *Config) (changed []string) {
+	runningSettings := restartOnlySettings(running)
+	for key, reloadedValue := range restartOnlySettings(reloaded) {
+		runningValue := reflect.ValueOf(runningSettings[key]).Elem()
+		target := reflect.ValueOf(reloadedValue).Elem()
+		if !reflect.DeepEqual(runningValue.Interface(), target.Interface()) {
+			changed = append(changed, key)
+			target.Set(runningValue)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reprocessUpload runs the post-finish processors, such as the content type
+// size limit check and watermarking, again for a completed upload. The
+// processors overwrite their previous results, so reprocessing is idempotent.
+func (serv *UploadServer) reprocessUpload(c *gin.Context) {
+	id := c.Param("id")
+
+	var complete bool
+	err := serv.DBConn.DB.Get(&complete, `
+		SELECT sha256sum IS NOT NULL FROM uploads WHERE id = ? AND deleted = 0
+	`, id)
+	if err != nil && err != sql.ErrNoRows {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+	info, infoErr := serv.store.GetInfo(id)
+	if err == sql.ErrNoRows || infoErr != nil {
+		abortWithErrorResponse(c, http.StatusNotFound, "upload_not_found", "No such upload", nil)
+		return
+	}
+	if !complete {
+		abortWithErrorResponse(c, http.StatusConflict, "upload_incomplete", "The upload has not been completed", nil)
+		return
+	}
+
+	queued := serv.postFinishPool.reprocess(info)
+	if queued {
+		serv.logReprocessing(c, 1)
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"id":         id,
+		"queued":     queued,
+		"processors": serv.postFinishPool.processorNames(),
+	})
+}
+
+// reprocessUploads queues the completed uploads matching the since, until,
+// issuer and account query parameters for post-finish processing, see
+// reprocessUpload. since and until are unix timestamps of the upload creation.
+// An empty issuer or account selects anonymous uploads.
+func (serv *UploadServer) reprocessUploads(c *gin.Context) {
+	query := `
+		SELECT id FROM uploads
+		WHERE deleted = 0 AND sha256sum IS NOT NULL
+	`
+	var args []interface{}
+	for param, condition := range map[string]string{"since": "created_at >= ?", "until": "created_at < ?"} {
+		value, ok := c.GetQuery(param)
+		if !ok {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			abortWithErrorResponse(c, http.StatusBadRequest, "invalid_parameter", param+" must be a unix timestamp", nil)
+			return
+		}
+		query += ` AND ` + condition
+		args = append(args, timestamp)
+	}
+	if issuer, ok := c.GetQuery("issuer"); ok {
+		query += ` AND COALESCE(jwt_issuer, '') = ?`
+		args = append(args, issuer)
+	}
+	if account, ok := c.GetQuery("account"); ok {
+		query += ` AND COALESCE(jwt_account, '') = ?`
+		args = append(args, account)
+	}
+
+	var ids []string
+	if err := serv.DBConn.DB.Select(&ids, query, args...); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+
+	queued, missing := 0, 0
+	for _, id := range ids {
+		info, err := serv.store.GetInfo(id)
+		if err != nil {
+			missing++
+			continue
+		}
+		if serv.postFinishPool.reprocess(info) {
+			queued++
+		}
+	}
+	serv.logReprocessing(c, queued)
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"matched":    len(ids),
+		"queued":     queued,
+		"missing":    missing,
+		"processors": serv.postFinishPool.processorNames(),
+	})
+}
+
+func (serv *UploadServer) logReprocessing(c *gin.Context, queued int) {
+	serv.requestLog(c.Request).Info().
+		Str("event", "uploads_reprocessing").
+		Int("queued", queued).
+		Msg("Queued uploads for post-finish processing")
+}
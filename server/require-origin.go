@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// validateRequireOrigin checks that Server.RequireOrigin leaves an origin that
+// can be recognized
+func validateRequireOrigin(requireOrigin bool, corsOrigins []string) error {
+	if requireOrigin && len(corsOrigins) == 0 {
+		return errors.New("Server.RequireOrigin needs at least one origin in Server.CorsOrigins")
+	}
+	return nil
+}
+
+// requireOrigin returns a middleware for Server.RequireOrigin that rejects
+// requests below routePrefix with 403 and the error code "origin_required"
+// unless their Origin header is listed in Server.CorsOrigins. Requests without
+// an Origin header, as sent by non-browser clients, are rejected as well. The
+// admin API, metrics and other routes outside routePrefix are not affected.
+//
+// GET requests are always served, so downloads keep working: browsers send no
+// Origin when following a link or loading an image, and for them CorsOrigins
+// only decides whether scripts of a page may read the response. This leaves
+// the requests that create, resume, write to or delete uploads, the ones sent
+// by upload clients.
+//
+// Without Server.RequireOrigin, the Origin header only decides whether
+// browsers may read the response (see customizedCors), and requests without
+// one are served.
+func (serv *UploadServer) requireOrigin(routePrefix string) gin.HandlerFunc {
+	routePrefix = strings.TrimSuffix(routePrefix, "/")
+	allowed := make(map[string]bool, len(serv.cfg.Server.CorsOrigins))
+	for _, origin := range serv.cfg.Server.CorsOrigins {
+		allowed[origin] = true
+	}
+
+	return func(c *gin.Context) {
+		reqPath := c.Request.URL.Path
+		if reqPath != routePrefix && !strings.HasPrefix(reqPath, routePrefix+"/") {
+			return
+		}
+		if c.Request.Method == http.MethodGet {
+			return
+		}
+
+		origin := c.GetHeader("Origin")
+		if allowed[origin] {
+			return
+		}
+
+		metrics.add("cors.requiredOriginRejections", 1)
+		serv.requestLog(c.Request).Debug().
+			Str("event", "origin_required").
+			Str("origin", origin).
+			Msg("Rejected request without an origin listed in Server.CorsOrigins")
+		abortWithErrorResponse(c, http.StatusForbidden, "origin_required",
+			"Requests must come from an allowed origin", nil)
+	}
+}
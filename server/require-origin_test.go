@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireOrigin(t *testing.T) {
+	const allowedOrigin = "https://allowed.example"
+
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Server.CorsOrigins = []string{allowedOrigin}
+		cfg.Server.RequireOrigin = true
+	})
+	defer ts.Close()
+
+	routePrefix, err := routePrefixFromBasePath(ts.cfg.Server.BasePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloads := httptest.NewServer(ts.newDownloadRouter(routePrefix))
+	defer downloads.Close()
+
+	// an upload made from the allowed origin
+	const content = "hello"
+	req := ts.newCreationRequest(len(content), map[string]string{"filename": "hello.txt"})
+	req.Header.Set("Origin", allowedOrigin)
+	resp, body := ts.do(req)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Creating upload: got status %d, body %q", resp.StatusCode, body)
+	}
+	uploadURL := resp.Header.Get("Location")
+	req = ts.newPatchRequest(uploadURL, 0, content)
+	req.Header.Set("Origin", allowedOrigin)
+	if resp, body := ts.do(req); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Writing upload: got status %d, body %q", resp.StatusCode, body)
+	}
+
+	tests := []struct {
+		name        string
+		origin      string
+		wantUploads int
+		allowOrigin string // expected Access-Control-Allow-Origin
+	}{
+		{"missing origin", "", http.StatusForbidden, ""},
+		{"disallowed origin", "https://other.example", http.StatusForbidden, ""},
+		{"allowed origin", allowedOrigin, http.StatusCreated, allowedOrigin},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := ts.newCreationRequest(len(content), map[string]string{"filename": "hello.txt"})
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			resp, body := ts.do(req)
+			if resp.StatusCode != test.wantUploads {
+				t.Fatalf("Creating upload: expected status %d, got %d with body %q", test.wantUploads, resp.StatusCode, body)
+			}
+			if resp.StatusCode == http.StatusForbidden {
+				if errResp := decodeErrorResponse(t, body); errResp.Code != "origin_required" {
+					t.Fatalf("Expected error code origin_required, got %q", errResp.Code)
+				}
+			}
+
+			// downloads are served whatever the origin, on both listeners
+			downloadURLs := map[string]string{
+				"main listener":     uploadURL,
+				"download listener": downloads.URL + "/files/" + uploadID(uploadURL),
+			}
+			for listener, url := range downloadURLs {
+				req, err := http.NewRequest(http.MethodGet, url, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if test.origin != "" {
+					req.Header.Set("Origin", test.origin)
+				}
+				resp, body := ts.do(req)
+				if resp.StatusCode != http.StatusOK || body != content {
+					t.Fatalf("Download on the %s: expected status 200, got %d with body %q", listener, resp.StatusCode, body)
+				}
+				// the allowlist still decides whether scripts may read it
+				if allowOrigin := resp.Header.Get("Access-Control-Allow-Origin"); allowOrigin != test.allowOrigin {
+					t.Fatalf("Download on the %s: expected Access-Control-Allow-Origin %q, got %q", listener, test.allowOrigin, allowOrigin)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// metadata fields injected by the server into new uploads
+const (
+	remoteIPKey      = "RemoteIP"
+	remoteCountryKey = "RemoteCountry"
+	accountKey       = "account"
+	issuerKey        = "issuer"
+)
+
+// serverMetadataFields are the metadata fields set by the server. A new field
+// injected into uploads must be added here, which keeps clients from setting
+// it and metadata transformers from changing it.
+var serverMetadataFields = []string{remoteIPKey, remoteCountryKey, accountKey, issuerKey}
+
+// validateReservedMetadataFields checks Metadata.ReservedFields
+func validateReservedMetadataFields(fields []string) error {
+	for _, field := range fields {
+		if field == "" {
+			return fmt.Errorf("Metadata.ReservedFields must not contain empty field names")
+		}
+	}
+	return nil
+}
+
+// reservedMetadataField returns the first field in metadata that clients must
+// not set, either set by the server or listed in Metadata.ReservedFields.
+// Returns "" if there is none.
+func (serv *UploadServer) reservedMetadataField(metadata map[string]string) string {
+	for _, fields := range [][]string{serverMetadataFields, serv.cfg.Metadata.ReservedFields} {
+		for _, field := range fields {
+			if _, ok := metadata[field]; ok {
+				return field
+			}
+		}
+	}
+	return ""
+}
+
+// rejectReservedMetadata rejects a creation request whose Upload-Metadata sets
+// a reserved field. It must run before any server field is injected. Returns
+// false if the request was rejected and aborted.
+func (serv *UploadServer) rejectReservedMetadata(c *gin.Context) bool {
+	metadata := parseMeta(c.GetHeader("Upload-Metadata"))
+	field := serv.reservedMetadataField(metadata)
+	if field == "" {
+		return true
+	}
+
+	abortWithErrorResponse(c, http.StatusBadRequest, "reserved_metadata_field",
+		fmt.Sprintf("Metadata field %s cannot be set by client", field), gin.H{"field": field})
+	return false
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestReservedMetadataFields(t *testing.T) {
+	ts := newTestServer(t, func(cfg *Config) {
+		cfg.Metadata.ReservedFields = []string{"useragent"}
+	})
+	defer ts.Close()
+
+	fields := append(append([]string(nil), serverMetadataFields...), "useragent")
+	for _, field := range fields {
+		t.Run(field, func(t *testing.T) {
+			var before int
+			if err := ts.DBConn.DB.Get(&before, `SELECT COUNT(*) FROM uploads`); err != nil {
+				t.Fatal(err)
+			}
+
+			resp, body := ts.do(ts.newCreationRequest(5, map[string]string{
+				"filename": "a.txt",
+				field:      "client value",
+			}))
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("Expected status 400, got %d with body %q", resp.StatusCode, body)
+			}
+			if contentType := resp.Header.Get("Content-Type"); contentType != "application/json; charset=utf-8" {
+				t.Fatalf("Expected a JSON response, got Content-Type %q", contentType)
+			}
+
+			errResp := decodeErrorResponse(t, body)
+			if errResp.Code != "reserved_metadata_field" {
+				t.Fatalf("Expected error code reserved_metadata_field, got %q", errResp.Code)
+			}
+			if want := "Metadata field " + field + " cannot be set by client"; errResp.Message != want {
+				t.Fatalf("Expected message %q, got %q", want, errResp.Message)
+			}
+			if errResp.Details["field"] != field {
+				t.Fatalf("Expected details to name the field %q, got %v", field, errResp.Details)
+			}
+
+			var after int
+			if err := ts.DBConn.DB.Get(&after, `SELECT COUNT(*) FROM uploads`); err != nil {
+				t.Fatal(err)
+			}
+			if after != before {
+				t.Fatal("Expected no upload to be created")
+			}
+		})
+	}
+
+	t.Run("unreserved field", func(t *testing.T) {
+		resp, body := ts.do(ts.newCreationRequest(5, map[string]string{"filename": "a.txt", "filetype": "text/plain"}))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d with body %q", resp.StatusCode, body)
+		}
+	})
+}
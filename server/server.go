@@ -1,7 +1,6 @@
 package server
 
 import (
-	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -21,6 +20,14 @@ type RunContext struct {
 	reloadSignals   chan os.Signal
 	shutdownSignals chan os.Signal
 	log             *zerolog.Logger
+	adminToken      *adminTokenStore
+	uploadPause     *uploadPause
+	jwtNonces       *jwtNonceStore
+	audit           *auditExporter
+	countries       *countryResolvers
+
+	// admin tokens of the virtual host profiles by config path
+	virtualHostAdminTokens map[string]*adminTokenStore
 }
 
 func NewRunContext(parentRouter *http.ServeMux, configPath string) *RunContext {
@@ -30,6 +37,12 @@ func NewRunContext(parentRouter *http.ServeMux, configPath string) *RunContext {
 		log:             &globalZerolog.Logger, // default global zerolog
 		reloadSignals:   make(chan os.Signal, 1),
 		shutdownSignals: make(chan os.Signal, 1),
+		adminToken:      &adminTokenStore{},
+		uploadPause:     &uploadPause{},
+		jwtNonces:       newJwtNonceStore(),
+		countries:       newCountryResolvers(),
+
+		virtualHostAdminTokens: make(map[string]*adminTokenStore),
 	}
 	runCtx.ShutdownPromise.Add(1)
 	return runCtx
@@ -75,29 +88,44 @@ func (runCtx *RunContext) runLoop() {
 	}
 	registeredPrefixes := make(map[string]struct{}, 0)
 
+	loaded, err := runCtx.loadConfig()
+	if err != nil {
+		runCtx.log.Error().Err(err).Msg("Failed to load config")
+		return
+	}
+
 	for {
 		// new server instance
 		serv := UploadServer{}
-		cfg := NewConfig()
-
-		// refresh config
-		md, err := cfg.Load(runCtx.log, runCtx.configPath)
-		if err != nil {
-			runCtx.log.Error().Err(err).Msg("Failed to load config")
-			return
-		}
-
-		serv.cfg = *cfg
+		serv.cfg = *loaded.cfg
 
 		multiLogger, err := createMultiLogger(serv.cfg.Loggers)
 		if err != nil {
-			runCtx.log.Err(err).Msg("Failed to create MultiLogger")
+			runCtx.log.Err(err).Msg("Failed to create MultiLogger, keeping the previous loggers")
+		} else {
+			runCtx.log = multiLogger
 		}
-
-		runCtx.log = multiLogger
 		serv.log = runCtx.log
 		runCtx.log.Info().Str("path", runCtx.configPath).Msg("Loaded config file")
-		cfg.DoPostLoadLogging(runCtx.log, runCtx.configPath, md)
+		loaded.cfg.DoPostLoadLogging(runCtx.log, runCtx.configPath, loaded.md)
+
+		runCtx.adminToken.configure(loaded.adminToken)
+		serv.adminToken = runCtx.adminToken
+		serv.uploadPause = runCtx.uploadPause
+		serv.jwtNonces = runCtx.jwtNonces
+		serv.countryResolvers = runCtx.countries
+
+		// the audit settings require a restart, so the exporter is only started once
+		if runCtx.audit == nil && serv.cfg.Audit.Endpoint != "" {
+			runCtx.audit, err = newAuditExporter(&serv.cfg, runCtx.log)
+			if err != nil {
+				runCtx.log.Fatal().
+					Err(err).
+					Msg("Failed to start the audit export")
+			}
+		}
+		serv.audit = runCtx.audit
+		serv.virtualHosts = loaded.virtualHosts
 
 		// register handler on parentRouter if any, when prefix has not been previously registered
 		if runCtx.parentRouter != nil {
@@ -105,16 +133,25 @@ func (runCtx *RunContext) runLoop() {
 			if err != nil {
 				panic(err)
 			}
-			if _, ok := registeredPrefixes[routePrefix]; !ok { // this prefix not yet registered
-				registeredPrefixes[routePrefix] = struct{}{}
-				runCtx.parentRouter.Handle(routePrefix, replaceableHandler)
-				if !strings.HasSuffix(routePrefix, "/") {
-					runCtx.parentRouter.Handle(routePrefix+"/", replaceableHandler)
+			mountPrefixes := []string{routePrefix}
+			if serv.adminToken.enabled() {
+				mountPrefixes = append(mountPrefixes, serv.cfg.Server.AdminPath)
+			}
+			if serv.cfg.Server.PublicManifestPath != "" {
+				mountPrefixes = append(mountPrefixes, serv.cfg.Server.PublicManifestPath)
+			}
+			for _, prefix := range mountPrefixes {
+				if _, ok := registeredPrefixes[prefix]; !ok { // this prefix not yet registered
+					registeredPrefixes[prefix] = struct{}{}
+					runCtx.parentRouter.Handle(prefix, replaceableHandler)
+					if !strings.HasSuffix(prefix, "/") {
+						runCtx.parentRouter.Handle(prefix+"/", replaceableHandler)
+					}
+					runCtx.log.Info().
+						Str("event", "startup").
+						Str("routePrefix", prefix).
+						Msg("Fileuploader handler mounted on parent router")
 				}
-				runCtx.log.Info().
-					Str("event", "startup").
-					Str("routePrefix", routePrefix).
-					Msg("Fileuploader handler mounted on parent router")
 			}
 		}
 
@@ -129,53 +166,82 @@ func (runCtx *RunContext) runLoop() {
 		}()
 
 		// wait for startup to complete
-		<-serv.GetStartedChan()
+		select {
+		case <-serv.GetStartedChan():
+		case err := <-errChan:
+			runCtx.log.Fatal().
+				Err(err).
+				Msg("Failed to start upload server")
+		}
 		if runCtx.parentRouter == nil {
 			runCtx.log.Info().
 				Str("event", "startup").
 				Str("address", serv.cfg.Server.ListenAddress).
 				Msg("Server listening")
 		}
+		serv.logStartupSummary(runCtx.parentRouter != nil)
+		serv.warnWeakJwtSecrets()
 
 		// wait for error or reload request
 		shouldRestart := func() bool {
-			select {
+			for {
+				select {
 
-			case err := <-errChan:
+				case err := <-errChan:
 
-				fmt.Printf("errChan: %#v\n", err)
-				// quit if unexpected error occurred
-				if err != http.ErrServerClosed {
-					runCtx.log.Fatal().
-						Err(err).
-						Msg("Error running upload server")
-				}
+					// quit if unexpected error occurred
+					if err != http.ErrServerClosed {
+						runCtx.log.Fatal().
+							Err(err).
+							Msg("Error running upload server")
+					}
 
-				// server closed by request, exit loop to allow it to restart
-				return true
+					// server closed by request, exit loop to allow it to restart
+					return true
 
-			case <-runCtx.reloadSignals:
-				// Run in separate goroutine so we don't wait for .Shutdown()
-				// to return before starting the new server.
-				// This allows us to handle outstanding requests using the old
-				// server instance while we've already replaced it as the listener
-				// for new connections.
-				go func() {
+				case <-runCtx.reloadSignals:
 					runCtx.log.Info().
 						Str("event", "config_reload").
 						Msg("Reloading server config")
-					serv.Shutdown()
-				}()
-				return true
 
-			case <-runCtx.shutdownSignals:
-				runCtx.log.Info().
-					Str("event", "shutdown_started").
-					Msg("Shutdown initiated. Handling existing requests")
-				serv.Shutdown()
-				runCtx.ShutdownPromise.Done()
-				return false
+					// keep serving with the running config if the new one is unusable
+					reloaded, err := runCtx.loadConfig()
+					if err != nil {
+						runCtx.log.Error().
+							Str("event", "config_reload_rejected").
+							Err(err).
+							Msg("Rejected reloaded config, keeping the running config")
+						continue
+					}
+					changed := retainRestartOnlySettings(&serv.cfg, reloaded.cfg)
+					changed = append(changed, retainVirtualHostRestartOnlySettings(serv.virtualHosts, reloaded.virtualHosts)...)
+					if len(changed) > 0 {
+						runCtx.log.Warn().
+							Str("event", "config_reload").
+							Strs("keys", changed).
+							Msg("Changed settings require a full restart and were not applied")
+					}
+					loaded = reloaded
+
+					// Run in separate goroutine so we don't wait for .Shutdown()
+					// to return before starting the new server.
+					// This allows us to handle outstanding requests using the old
+					// server instance while we've already replaced it as the listener
+					// for new connections.
+					go serv.Shutdown()
+					return true
+
+				case <-runCtx.shutdownSignals:
+					runCtx.log.Info().
+						Str("event", "shutdown_started").
+						Msg("Shutdown initiated. Handling existing requests")
+					serv.Shutdown()
+					runCtx.audit.Close()
+					runCtx.countries.Close()
+					runCtx.ShutdownPromise.Done()
+					return false
 
+				}
 			}
 		}()
 
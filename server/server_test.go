@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+// testServer is an UploadServer storing its uploads and database in a
+// temporary directory, served by an httptest.Server
+type testServer struct {
+	*UploadServer
+	t    *testing.T
+	dir  string
+	http *httptest.Server
+}
+
+// newTestServer starts an UploadServer with the default config, after
+// configure has been applied to it. Close must be called when done.
+func newTestServer(t *testing.T, configure func(cfg *Config)) *testServer {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "fileuploader-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := NewConfig()
+	cfg.Storage.Path = filepath.Join(dir, "uploads")
+	cfg.Database.Path = filepath.Join(dir, "uploads.db")
+	if configure != nil {
+		configure(cfg)
+	}
+	if err := cfg.Validate(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Invalid config: %v", err)
+	}
+
+	log := zerolog.Nop()
+	serv := &UploadServer{
+		cfg:         *cfg,
+		log:         &log,
+		adminToken:  &adminTokenStore{},
+		uploadPause: &uploadPause{},
+		jwtNonces:   newJwtNonceStore(),
+
+		countryResolvers: newCountryResolvers(),
+	}
+	handler := &ReplaceableHandler{}
+	if err := serv.Run(handler); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Failed to start server: %v", err)
+	}
+
+	return &testServer{
+		UploadServer: serv,
+		t:            t,
+		dir:          dir,
+		http:         httptest.NewServer(handler),
+	}
+}
+
+// Close stops the server and removes its files
+func (ts *testServer) Close() {
+	ts.http.Close()
+	ts.Shutdown()
+	ts.countryResolvers.Close()
+	os.RemoveAll(ts.dir)
+}
+
+// url returns the absolute URL of a path on the server
+func (ts *testServer) url(path string) string {
+	return ts.http.URL + path
+}
+
+// do sends a request, failing the test if it can't be sent. The response body
+// is read and returned along with the response.
+func (ts *testServer) do(req *http.Request) (*http.Response, string) {
+	ts.t.Helper()
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+// newTusRequest returns a request speaking the tus protocol
+func (ts *testServer) newTusRequest(method string, url string, body string) *http.Request {
+	ts.t.Helper()
+
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	req.Header.Set("Tus-Resumable", supportedTusVersion)
+	return req
+}
+
+// newCreationRequest returns a tus creation request for an upload of length
+// bytes with the given metadata
+func (ts *testServer) newCreationRequest(length int, metadata map[string]string) *http.Request {
+	req := ts.newTusRequest(http.MethodPost, ts.url("/files"), "")
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	if len(metadata) > 0 {
+		req.Header.Set("Upload-Metadata", encodeTestMetadata(metadata))
+	}
+	return req
+}
+
+// createUpload creates an upload and returns its absolute URL
+func (ts *testServer) createUpload(length int, metadata map[string]string) string {
+	ts.t.Helper()
+
+	resp, body := ts.do(ts.newCreationRequest(length, metadata))
+	if resp.StatusCode != http.StatusCreated {
+		ts.t.Fatalf("Creating upload: got status %d, body %q", resp.StatusCode, body)
+	}
+	return resp.Header.Get("Location")
+}
+
+// newPatchRequest returns a PATCH request writing data at offset
+func (ts *testServer) newPatchRequest(uploadURL string, offset int, data string) *http.Request {
+	req := ts.newTusRequest(http.MethodPatch, uploadURL, data)
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	return req
+}
+
+// patch writes data at offset, returning the response
+func (ts *testServer) patch(uploadURL string, offset int, data string) (*http.Response, string) {
+	ts.t.Helper()
+	return ts.do(ts.newPatchRequest(uploadURL, offset, data))
+}
+
+// upload creates an upload with the given content and metadata, writes the
+// content in a single PATCH and returns the upload's absolute URL
+func (ts *testServer) upload(content string, metadata map[string]string) string {
+	ts.t.Helper()
+
+	uploadURL := ts.createUpload(len(content), metadata)
+	if content == "" {
+		return uploadURL
+	}
+	resp, body := ts.patch(uploadURL, 0, content)
+	if resp.StatusCode != http.StatusNoContent {
+		ts.t.Fatalf("Writing upload: got status %d, body %q", resp.StatusCode, body)
+	}
+	return uploadURL
+}
+
+// get sends a GET request for url
+func (ts *testServer) get(url string) (*http.Response, string) {
+	ts.t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return ts.do(req)
+}
+
+// storedContent returns the data stored for an upload, bypassing the download
+// handlers
+func (ts *testServer) storedContent(uploadURL string) string {
+	ts.t.Helper()
+
+	reader, err := ts.store.GetReader(uploadID(uploadURL))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return string(data)
+}
+
+// uploadID returns the id at the end of an upload URL
+func uploadID(uploadURL string) string {
+	return uploadURL[strings.LastIndex(uploadURL, "/")+1:]
+}
+
+// encodeTestMetadata encodes metadata for the Upload-Metadata header, sorted
+// by key so requests are reproducible
+func encodeTestMetadata(metadata map[string]string) string {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(metadata[key])))
+	}
+	return strings.Join(pairs, ",")
+}
+
+// decodeErrorResponse returns the error envelope of a JSON error response,
+// failing the test if body isn't one
+func decodeErrorResponse(t *testing.T, body string) ErrorResponse {
+	t.Helper()
+
+	var envelope struct {
+		Error ErrorResponse `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(body), &envelope); err != nil || envelope.Error.Code == "" {
+		t.Fatalf("Expected a JSON error envelope, got %q", body)
+	}
+	return envelope.Error
+}
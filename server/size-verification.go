@@ -0,0 +1,39 @@
+package server
+
+import (
+	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/kiwiirc/plugin-fileuploader/events"
+)
+
+// verifyStoredSize is a post-finish processor that compares the size of the
+// stored file with the declared Upload-Length. On a mismatch, which points at
+// truncation or a storage bug, the upload is marked as corrupt so it isn't
+// served and the remaining processors are skipped.
+func (serv *UploadServer) verifyStoredSize(event *events.TusEvent) error {
+	id := event.Info.ID
+	stored, err := serv.store.GetInfo(id)
+	if err != nil {
+		return err
+	}
+	if stored.Offset == event.Info.Size {
+		return nil
+	}
+
+	metrics.add("uploads.corrupt", 1)
+	serv.log.Error().
+		Str("event", "upload_corrupt").
+		Str("id", id).
+		Int64("declaredSize", event.Info.Size).
+		Int64("storedSize", stored.Offset).
+		Msg("Stored upload does not match its declared length")
+
+	if err := db.UpdateRow(serv.DBConn.DB, `UPDATE uploads SET corrupt = 1 WHERE id = ?`, id); err != nil {
+		return err
+	}
+	serv.audit.record(auditEvent{
+		Action:   auditUploadQuarantined,
+		UploadID: id,
+		Reason:   "size_mismatch",
+	})
+	return errStopProcessing
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// processStartTime is used to report the uptime, which isn't reset by config reloads
+var processStartTime = time.Now()
+
+// Stats is an overview of the server state for operators
+type Stats struct {
+	UptimeSeconds int64 `json:"uptimeSeconds"`
+	// whether new uploads are paused through POST <AdminPath>/pause, and since when
+	UploadsPaused      bool  `json:"uploadsPaused"`
+	UploadsPausedSince int64 `json:"uploadsPausedSince,omitempty"`
+	// uploads that were created but not completed yet
+	ActiveUploads int64 `json:"activeUploads"`
+	// uploads created since midnight UTC
+	UploadsToday int64 `json:"uploadsToday"`
+	// completed uploads that haven't been deleted
+	StoredUploads int64 `json:"storedUploads"`
+	// size of the stored files, counting files shared by duplicate uploads once
+	BytesStored int64 `json:"bytesStored"`
+	// stored uploads completed before their size was recorded, not included in BytesStored
+	UploadsWithoutSize int64  `json:"uploadsWithoutSize"`
+	DatabaseBytes      int64  `json:"databaseBytes"`
+	FreeDiskBytes      uint64 `json:"freeDiskBytes"`
+	// stored and active uploads by EXTJWT issuer, uploads without an account are
+	// counted under an empty issuer
+	UploadsByIssuer map[string]int64 `json:"uploadsByIssuer"`
+	// stored uploads by content category (Processing.ContentCategories),
+	// uploads completed before categories were recorded are counted under an
+	// empty category
+	UploadsByCategory map[string]int64 `json:"uploadsByCategory"`
+}
+
+// reportStats responds with an overview of the uploads, storage and database.
+// Values that can't be determined are left at 0 and logged.
+func (serv *UploadServer) reportStats(c *gin.Context) {
+	log := serv.requestLog(c.Request)
+	now := time.Now()
+	startOfDay := now.UTC().Truncate(24 * time.Hour)
+
+	stats := Stats{
+		UptimeSeconds:     int64(now.Sub(processStartTime).Seconds()),
+		UploadsByIssuer:   make(map[string]int64),
+		UploadsByCategory: make(map[string]int64),
+	}
+	if paused, since := serv.uploadPause.state(); paused {
+		stats.UploadsPaused = true
+		stats.UploadsPausedSince = since.Unix()
+	}
+
+	var counts struct {
+		Active      sql.NullInt64 `db:"active"`
+		Today       sql.NullInt64 `db:"today"`
+		Stored      sql.NullInt64 `db:"stored"`
+		WithoutSize sql.NullInt64 `db:"without_size"`
+	}
+	err := serv.DBConn.DB.Get(&counts, `
+		SELECT
+			SUM(CASE WHEN sha256sum IS NULL THEN 1 ELSE 0 END) AS active,
+			SUM(CASE WHEN created_at >= ? THEN 1 ELSE 0 END) AS today,
+			SUM(CASE WHEN sha256sum IS NOT NULL THEN 1 ELSE 0 END) AS stored,
+			SUM(CASE WHEN sha256sum IS NOT NULL AND size IS NULL THEN 1 ELSE 0 END) AS without_size
+		FROM uploads
+		WHERE deleted = 0
+		`,
+		startOfDay.Unix(),
+	)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+	stats.ActiveUploads = counts.Active.Int64
+	stats.UploadsToday = counts.Today.Int64
+	stats.StoredUploads = counts.Stored.Int64
+	stats.UploadsWithoutSize = counts.WithoutSize.Int64
+
+	var bytesStored sql.NullInt64
+	err = serv.DBConn.DB.Get(&bytesStored, `
+		SELECT SUM(size) FROM (
+			SELECT MAX(size) AS size FROM uploads
+			WHERE deleted = 0 AND sha256sum IS NOT NULL
+			GROUP BY sha256sum
+		) AS blobs
+	`)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+	stats.BytesStored = bytesStored.Int64
+
+	var issuers []struct {
+		Issuer sql.NullString `db:"jwt_issuer"`
+		Count  int64          `db:"count"`
+	}
+	err = serv.DBConn.DB.Select(&issuers, `
+		SELECT jwt_issuer, COUNT(*) AS count FROM uploads
+		WHERE deleted = 0
+		GROUP BY jwt_issuer
+	`)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+	for _, issuer := range issuers {
+		stats.UploadsByIssuer[issuer.Issuer.String] += issuer.Count
+	}
+
+	var categories []struct {
+		Category sql.NullString `db:"content_category"`
+		Count    int64          `db:"count"`
+	}
+	err = serv.DBConn.DB.Select(&categories, `
+		SELECT content_category, COUNT(*) AS count FROM uploads
+		WHERE deleted = 0 AND sha256sum IS NOT NULL
+		GROUP BY content_category
+	`)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+	for _, category := range categories {
+		stats.UploadsByCategory[category.Category.String] += category.Count
+	}
+
+	stats.DatabaseBytes, err = serv.databaseSize()
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to determine database size")
+	}
+
+	// a store kept in memory has no disk, its free space is reported as 0
+	if !serv.store.InMemory() {
+		stats.FreeDiskBytes, err = freeDiskSpace(serv.cfg.Storage.Path)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to determine free disk space")
+		}
+	}
+
+	c.JSON(http.StatusOK, stats)
+}
+
+// databaseSize returns the size of the database in bytes
+func (serv *UploadServer) databaseSize() (size int64, err error) {
+	switch serv.DBConn.DriverName {
+	case "sqlite3":
+		err = serv.DBConn.DB.Get(&size, `SELECT page_count * page_size FROM pragma_page_count(), pragma_page_size()`)
+	case "mysql":
+		var total sql.NullInt64
+		err = serv.DBConn.DB.Get(&total, `
+			SELECT SUM(data_length + index_length) FROM information_schema.tables
+			WHERE table_schema = DATABASE()
+		`)
+		size = total.Int64
+	}
+	return
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+// prepareStorageDirs makes sure the storage directories exist and are
+// writable, creating missing ones if Storage.CreateDirectories is set. This
+// way a missing or read-only volume fails at startup with a clear message
+// instead of at the first upload. Nothing is checked for a store kept in
+// memory, where all storage paths are in memory too.
+func (serv *UploadServer) prepareStorageDirs() error {
+	storage := serv.cfg.Storage
+	if storage.Path == shardedfilestore.MemoryPath {
+		return nil
+	}
+
+	dirs := []struct {
+		key  string
+		path string
+	}{
+		{"Storage.Path", storage.Path},
+	}
+	if storage.DerivativesDir != "" {
+		dirs = append(dirs, struct{ key, path string }{"Storage.DerivativesDir", storage.DerivativesDir})
+	}
+	for _, tier := range storage.Tiers {
+		dirs = append(dirs, struct{ key, path string }{fmt.Sprintf("Storage.Tiers %#v", tier.Name), tier.Path})
+	}
+
+	for _, dir := range dirs {
+		if err := checkStorageDir(dir.key, dir.path, storage.CreateDirectories, storage.DirMode.FileMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkStorageDir(key string, path string, create bool, perm os.FileMode) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) && create {
+		if err := os.MkdirAll(path, perm); err != nil {
+			return fmt.Errorf("Failed to create the %s directory %#v: %v", key, path, err)
+		}
+		info, err = os.Stat(path)
+	}
+	if err != nil {
+		return fmt.Errorf("The %s directory %#v is not accessible: %v", key, path, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("The %s %#v is not a directory", key, path)
+	}
+
+	probe, err := ioutil.TempFile(path, ".write-test")
+	if err != nil {
+		return fmt.Errorf("The %s directory %#v is not writable: %v", key, path, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
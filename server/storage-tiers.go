@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/c2h5oh/datasize"
+	"github.com/tus/tusd"
+)
+
+// storageTier is an additional storage root for finished uploads, configured
+// with [[Storage.Tiers]]
+type storageTier struct {
+	Name      string
+	Path      string
+	MimeTypes []string
+	MinSize   datasize.ByteSize
+}
+
+// matches reports whether a finished upload belongs on the tier. An upload
+// matches if its declared filetype matches one of MimeTypes, or MimeTypes is
+// empty, and it is at least MinSize bytes large.
+func (tier *storageTier) matches(info tusd.FileInfo) bool {
+	if info.Size < int64(tier.MinSize.Bytes()) {
+		return false
+	}
+	if len(tier.MimeTypes) == 0 {
+		return true
+	}
+	for _, pattern := range tier.MimeTypes {
+		if matchesMimeType(pattern, info.MetaData["filetype"]) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateStorageTiers(tiers []storageTier) error {
+	names := make(map[string]struct{}, len(tiers))
+	for _, tier := range tiers {
+		if tier.Name == "" || len(tier.Name) > 64 {
+			return fmt.Errorf("Storage.Tiers names must be between 1 and 64 characters, got %#v", tier.Name)
+		}
+		if _, duplicate := names[tier.Name]; duplicate {
+			return fmt.Errorf("Storage.Tiers name %#v is used more than once", tier.Name)
+		}
+		names[tier.Name] = struct{}{}
+
+		if tier.Path == "" {
+			return fmt.Errorf("Storage.Tiers %#v must have a Path", tier.Name)
+		}
+		for _, pattern := range tier.MimeTypes {
+			if !isMimeTypePattern(pattern) {
+				return fmt.Errorf("Storage.Tiers %#v MimeTypes entry %#v is not a media type such as \"text/plain\" or \"image/*\"", tier.Name, pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// chooseStorageTier returns the first configured tier matching a finished
+// upload, or "" for the default Storage.Path
+func (serv *UploadServer) chooseStorageTier(info tusd.FileInfo) string {
+	for i := range serv.cfg.Storage.Tiers {
+		if serv.cfg.Storage.Tiers[i].matches(info) {
+			return serv.cfg.Storage.Tiers[i].Name
+		}
+	}
+	return ""
+}
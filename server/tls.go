@@ -0,0 +1,117 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+)
+
+var tlsVersionsByName = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipher suites that can be listed in Server.TLS.CipherSuites. The TLS 1.3
+// suites are not configurable.
+var cipherSuitesByName = map[string]uint16{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256": tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":   tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384": tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":   tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":  tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":    tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":    tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":      tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	"TLS_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// defaultCipherSuites are used when Server.TLS.CipherSuites is empty: the
+// suites with forward secrecy and authenticated encryption
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+}
+
+// validateTLS checks that a certificate and key are given together and that
+// the cipher suites include one required by HTTP/2, without which the server
+// would fail to start
+func (cfg *Config) validateTLS() error {
+	t := cfg.Server.TLS
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return errors.New("Server.TLS.CertFile and Server.TLS.KeyFile must be set together")
+	}
+	if len(t.CipherSuites) == 0 || t.MinVersion.uint16 >= tls.VersionTLS13 {
+		return nil
+	}
+	for _, suite := range t.CipherSuites {
+		if suite.uint16 == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || suite.uint16 == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+			return nil
+		}
+	}
+	return errors.New("Server.TLS.CipherSuites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, as required by HTTP/2")
+}
+
+// tlsEnabled reports whether the listeners serve HTTPS
+func (cfg *Config) tlsEnabled() bool {
+	return cfg.Server.TLS.CertFile != ""
+}
+
+// tlsConfig returns the TLS settings of the listeners, nil unless
+// Server.TLS.CertFile is set
+func (cfg *Config) tlsConfig() *tls.Config {
+	if !cfg.tlsEnabled() {
+		return nil
+	}
+
+	suites := defaultCipherSuites
+	if len(cfg.Server.TLS.CipherSuites) > 0 {
+		suites = make([]uint16, 0, len(cfg.Server.TLS.CipherSuites))
+		for _, suite := range cfg.Server.TLS.CipherSuites {
+			suites = append(suites, suite.uint16)
+		}
+	}
+
+	return &tls.Config{
+		MinVersion:               cfg.Server.TLS.MinVersion.uint16,
+		CipherSuites:             suites,
+		PreferServerCipherSuites: true,
+	}
+}
+
+// serve accepts connections on listener, over TLS if Server.TLS.CertFile is
+// set, and at most Server.MaxConnections at once. The server's TLSConfig must
+// be set from tlsConfig.
+func (serv *UploadServer) serve(server *http.Server, listener net.Listener) error {
+	listener = serv.limitListener(listener)
+	if serv.cfg.tlsEnabled() {
+		return server.ServeTLS(listener, serv.cfg.Server.TLS.CertFile, serv.cfg.Server.TLS.KeyFile)
+	}
+	return server.Serve(listener)
+}
+
+// listenAndServe listens on the server's address and accepts connections, over
+// TLS if Server.TLS.CertFile is set, and at most Server.MaxConnections at once.
+// The server's TLSConfig must be set from tlsConfig.
+func (serv *UploadServer) listenAndServe(server *http.Server) error {
+	if serv.cfg.Server.MaxConnections > 0 {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			return err
+		}
+		return serv.serve(server, listener)
+	}
+	if serv.cfg.tlsEnabled() {
+		return server.ListenAndServeTLS(serv.cfg.Server.TLS.CertFile, serv.cfg.Server.TLS.KeyFile)
+	}
+	return server.ListenAndServe()
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type tombstoneRecord struct {
+	ID        string         `db:"id"`
+	Sha256sum []byte         `db:"sha256sum"`
+	Size      sql.NullInt64  `db:"size"`
+	Account   sql.NullString `db:"jwt_account"`
+	Issuer    sql.NullString `db:"jwt_issuer"`
+	Reason    sql.NullString `db:"reason"`
+	CreatedAt int64          `db:"created_at"`
+	DeletedAt int64          `db:"deleted_at"`
+}
+
+// listTombstones lists the removed uploads recorded with
+// Database.KeepTombstones, ordered by their creation. The id, account, issuer
+// and sha256sum query parameters restrict the list to matching uploads. The
+// page is selected with limit, cursor and before, see parseListPage.
+func (serv *UploadServer) listTombstones(c *gin.Context) {
+	page, ok := serv.parseListPage(c)
+	if !ok {
+		return
+	}
+
+	query := `
+		SELECT id, sha256sum, size, jwt_account, jwt_issuer, reason, created_at, deleted_at
+		FROM tombstones
+		WHERE 1 = 1
+		`
+	var args []interface{}
+	for param, column := range map[string]string{"id": "id", "account": "jwt_account", "issuer": "jwt_issuer"} {
+		if value := c.Query(param); value != "" {
+			query += " AND " + column + " = ?"
+			args = append(args, value)
+		}
+	}
+	if sum := c.Query("sha256sum"); sum != "" {
+		hash, err := hex.DecodeString(sum)
+		if err != nil {
+			abortWithErrorResponse(c, http.StatusBadRequest, "invalid_parameter", "sha256sum must be hex encoded", nil)
+			return
+		}
+		query += " AND sha256sum = ?"
+		args = append(args, hash)
+	}
+
+	var records []tombstoneRecord
+	query, args = page.query(query, args...)
+	if err := serv.DBConn.DB.Select(&records, query, args...); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+
+	tombstones := make([]gin.H, 0, len(records))
+	for _, record := range records {
+		tombstones = append(tombstones, gin.H{
+			"id":        record.ID,
+			"sha256sum": hex.EncodeToString(record.Sha256sum),
+			"size":      record.Size.Int64,
+			"account":   record.Account.String,
+			"issuer":    record.Issuer.String,
+			"reason":    record.Reason.String,
+			"createdAt": record.CreatedAt,
+			"deletedAt": record.DeletedAt,
+		})
+	}
+
+	response := gin.H{"tombstones": tombstones}
+	if len(records) > 0 {
+		first, last := records[0], records[len(records)-1]
+		next, prev := page.setLinks(c, len(records),
+			pageCursor(first.CreatedAt, first.ID), pageCursor(last.CreatedAt, last.ID))
+		if next != "" {
+			response["nextCursor"] = next
+		}
+		if prev != "" {
+			response["prevCursor"] = prev
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
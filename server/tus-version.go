@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// supportedTusVersion is the only version of the tus protocol spoken by tusd
+const supportedTusVersion = "1.0.0"
+
+// rejectUnsupportedTusVersion answers requests for an unsupported version of
+// the tus protocol with the JSON error envelope, before tusd rejects them with
+// a plain text body. GET and OPTIONS requests are not checked, as tusd doesn't
+// check them either. cors is applied to the rejection so browser clients can
+// read it.
+func (serv *UploadServer) rejectUnsupportedTusVersion(cors gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		method := c.Request.Method
+		if override := c.GetHeader("X-HTTP-Method-Override"); override != "" {
+			method = override
+		}
+		version := c.GetHeader("Tus-Resumable")
+		if method == http.MethodGet || method == http.MethodOptions || version == supportedTusVersion {
+			return
+		}
+
+		metrics.add("tus.unsupportedVersions", 1)
+		serv.requestLog(c.Request).Info().
+			Str("event", "unsupported_tus_version").
+			Str("version", version).
+			Str("userAgent", c.Request.UserAgent()).
+			Msg("Rejected request for an unsupported tus version")
+
+		cors(c)
+		header := c.Writer.Header()
+		header.Set("Tus-Resumable", supportedTusVersion)
+		header.Set("Tus-Version", supportedTusVersion)
+		header.Add("Access-Control-Expose-Headers", "Tus-Resumable, Tus-Version")
+
+		message := fmt.Sprintf("Tus-Resumable %#v is not supported, the server supports %s", version, supportedTusVersion)
+		if version == "" {
+			message = "The Tus-Resumable header is missing, the server supports " + supportedTusVersion
+		}
+		abortWithErrorResponse(c, http.StatusPreconditionFailed, "unsupported_tus_version", message,
+			gin.H{"version": version, "supportedVersions": []string{supportedTusVersion}},
+		)
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"database/sql"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -9,7 +10,9 @@ import (
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
@@ -17,6 +20,7 @@ import (
 	"github.com/kiwiirc/plugin-fileuploader/events"
 	"github.com/kiwiirc/plugin-fileuploader/logging"
 	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+	"github.com/rs/zerolog"
 	"github.com/tus/tusd"
 	"github.com/tus/tusd/cmd/tusd/cli/hooks"
 )
@@ -30,7 +34,7 @@ func routePrefixFromBasePath(basePath string) (string, error) {
 	return url.Path, nil
 }
 
-func customizedCors(allowedOrigins []string) gin.HandlerFunc {
+func customizedCors(allowedOrigins []string, log *zerolog.Logger) gin.HandlerFunc {
 	// convert slice values to keys of map for "contains" test
 	originSet := make(map[string]struct{}, len(allowedOrigins))
 	exists := struct{}{}
@@ -47,8 +51,19 @@ func customizedCors(allowedOrigins []string) gin.HandlerFunc {
 			respHeader.Set("Access-Control-Allow-Origin", origin)
 		} else {
 			respHeader.Del("Access-Control-Allow-Origin")
+			if origin != "" {
+				// helps to tell a misconfigured allowlist from cross-origin abuse
+				metrics.add("cors.rejectedOrigins", 1)
+				logging.RequestLogger(c.Request, log).Debug().
+					Str("event", "cors_rejected").
+					Str("origin", origin).
+					Msg("Origin not allowed by Server.CorsOrigins")
+			}
 		}
 
+		// allow browser clients to read our own headers in addition to those exposed by tusd
+		respHeader.Add("Access-Control-Expose-Headers", "X-Download-URL, X-Upload-State, X-Account-Quota-Warning, X-Upload-Gone-Reason, Upload-Expires, "+logging.RequestIDHeader)
+
 		// lets the user-agent know the response can vary depending on the origin of the request.
 		// ensures correct behavior of browser cache.
 		respHeader.Add("Vary", "Origin")
@@ -59,7 +74,7 @@ func (serv *UploadServer) registerTusHandlers(r *gin.Engine, store *shardedfiles
 	composer := tusd.NewStoreComposer()
 	store.UseIn(composer)
 
-	maximumUploadSize := serv.cfg.Storage.MaximumUploadSize
+	maximumUploadSize := serv.cfg.largestUploadSize()
 	serv.log.Debug().Str("size", maximumUploadSize.String()).Msg("Using upload limit")
 
 	config := tusd.Config{
@@ -86,111 +101,446 @@ func (serv *UploadServer) registerTusHandlers(r *gin.Engine, store *shardedfiles
 
 	// create event broadcaster
 	serv.tusEventBroadcaster = events.NewTusEventBroadcaster(handler)
+	serv.tusEventBroadcaster.OnBacklog(serv.cfg.Processing.EventBacklogWarning, func(name string, queued int) {
+		metrics.add("events.backlogWarnings", 1)
+		serv.log.Warn().
+			Str("event", "event_backlog").
+			Str("listener", name).
+			Int("queued", queued).
+			Msg("Event listener is falling behind")
+	})
+	broadcaster := serv.tusEventBroadcaster
+	metrics.setGauge("events.listeners", func() interface{} {
+		return broadcaster.Stats()
+	})
 
 	// attach logger
 	go logging.TusdLogger(serv.log, serv.tusEventBroadcaster)
 
-	// attach uploader IP recorder
-	go serv.ipRecorder(serv.tusEventBroadcaster)
+	// attach uploader IP and metadata recorder
+	go serv.uploadRecorder(serv.tusEventBroadcaster)
+
+	if serv.audit != nil {
+		go serv.auditRecorder(serv.tusEventBroadcaster)
+	}
+
+	if serv.cfg.Watermark.Enabled {
+		serv.watermarker, err = newWatermarker(serv.cfg.Watermark.LogoPath, serv.cfg.Watermark.Text, serv.cfg.Watermark.Position, serv.cfg.Watermark.Opacity)
+		if err != nil {
+			return err
+		}
+	}
+
+	// attach post-finish processing
+	serv.postFinishPool = newPostFinishPool(serv.cfg.Processing.PostFinishConcurrency, serv.log)
+	serv.postFinishPool.register("size-verification", serv.verifyStoredSize)
+	if len(serv.cfg.Storage.MaxSizePerMimeType) > 0 {
+		serv.postFinishPool.register("mime-type-size-limit", serv.checkMimeTypeSizeLimit)
+	}
+	serv.postFinishPool.register("content-category", serv.recordContentCategory)
+	if serv.watermarker != nil {
+		serv.postFinishPool.register("watermark", serv.watermarkUpload)
+	}
+	if serv.webhookClient != nil {
+		serv.postFinishPool.register("completion-webhook", serv.notifyCompletionWebhook)
+	}
+	go serv.postFinishPool.listen(serv.tusEventBroadcaster)
 
 	noopHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
 
+	// Must run before any handler that builds absolute URLs from the request
+	r.Use(serv.sanitizeForwardedHeaders())
+
 	// For unknown reasons, this middleware must be mounted on the top level router.
 	// When attached to the RouterGroup, it does not get called for some requests.
+	cors := customizedCors(serv.cfg.Server.CorsOrigins, serv.log)
+	if serv.cfg.Server.RequireOrigin {
+		// before tusd, which answers preflight requests itself
+		r.Use(serv.requireOrigin(routePrefix))
+	}
+	if serv.cfg.Server.ExplainUnsupportedTusVersion {
+		r.Use(onlyForTusRoutes(routePrefix, serv.rejectUnsupportedTusVersion(cors)))
+	}
 	tusdMiddleware := gin.WrapH(handler.Middleware(noopHandler))
-	r.Use(tusdMiddleware)
-	r.Use(customizedCors(serv.cfg.Server.CorsOrigins))
+	r.Use(onlyForTusRoutes(routePrefix, tusdMiddleware))
+	r.Use(cors)
 
 	rg := r.Group(routePrefix)
-	rg.POST("", serv.postFile(handler))
-	rg.HEAD(":id", gin.WrapF(handler.HeadFile))
-	rg.PATCH(":id", gin.WrapF(handler.PatchFile))
+
+	// accept creation requests both with and without a trailing slash, as
+	// reverse proxies may add or strip it and gin would answer with a redirect
+	// that tus clients don't follow for POST requests
+	postFile := serv.postFile(handler)
+	if basePath := strings.TrimSuffix(routePrefix, "/"); basePath != "" {
+		r.POST(basePath, postFile)
+	}
+	r.POST(strings.TrimSuffix(routePrefix, "/")+"/", postFile)
+	if serv.cfg.Server.EnableMultipartUploads {
+		rg.POST("multipart", serv.postMultipartFile(handler))
+	}
+
+	// malformed upload IDs are answered like unknown ones before reaching the store
+	uploadRoutes := rg.Group("", requireValidUploadID)
+	uploadRoutes.HEAD(":id", serv.headFile(handler))
+	uploadRoutes.PATCH(":id", serv.patchFile(handler))
 
 	// Only attach the DELETE handler if the Terminate() method is provided
 	if config.StoreComposer.UsesTerminater {
-		rg.DELETE(":id", gin.WrapF(handler.DelFile))
+		uploadRoutes.DELETE(":id", gin.WrapF(handler.DelFile))
 	}
 
 	// GET handler requires the GetReader() method
 	if config.StoreComposer.UsesGetReader {
-		getFile := gin.WrapF(handler.GetFile)
-		rg.GET(":id", getFile)
-		rg.GET(":id/:filename", func(c *gin.Context) {
-			// rewrite request path to ":id" route pattern
-			c.Request.URL.Path = path.Join(routePrefix, url.PathEscape(c.Param("id")))
-
-			// call the normal handler
-			getFile(c)
-		})
+		serv.registerDownloadRoutes(uploadRoutes)
 	}
 
+	// IDs matching no route, e.g. because they contain an encoded slash, are
+	// answered like unknown ones too
+	uploadPathPrefix := strings.TrimSuffix(routePrefix, "/") + "/"
+	r.NoRoute(func(c *gin.Context) {
+		if strings.HasPrefix(c.Request.URL.Path, uploadPathPrefix) {
+			respondUploadNotFound(c)
+		}
+	})
+
 	return nil
 }
 
-func isFatalJwtError(err error) (fatal bool) {
-	fatal = true
+// requireValidUploadID responds to requests for a malformed upload ID exactly
+// as tusd responds to an unknown one, so probing the ID format reveals nothing
+func requireValidUploadID(c *gin.Context) {
+	if shardedfilestore.ValidID(c.Param("id")) {
+		return
+	}
+
+	respondUploadNotFound(c)
+}
+
+// respondUploadNotFound sends the same 404 response as tusd for unknown uploads
+func respondUploadNotFound(c *gin.Context) {
+	// like tusd, HEAD responses announce the empty body they have
+	body := tusd.ErrNotFound.Error() + "\n"
+	if c.Request.Method == http.MethodHead {
+		body = ""
+	}
+	c.Header("Content-Type", "text/plain; charset=utf-8")
+	c.Header("Content-Length", strconv.Itoa(len(body)))
+	c.Status(http.StatusNotFound)
+	c.Writer.WriteString(body)
+	c.Abort()
+}
 
-	// jwt.ValidationError<UnknownIssuerError> => non-fatal
+// onlyForTusRoutes restricts a middleware to requests handled by tusd. Other
+// endpoints such as the multipart upload and the admin API don't speak the tus
+// protocol and would be rejected for lacking a Tus-Resumable header.
+func onlyForTusRoutes(routePrefix string, middleware gin.HandlerFunc) gin.HandlerFunc {
+	routePrefix = strings.TrimSuffix(routePrefix, "/")
+	multipartPath := routePrefix + "/multipart"
+
+	return func(c *gin.Context) {
+		reqPath := c.Request.URL.Path
+		if reqPath == multipartPath || (reqPath != routePrefix && !strings.HasPrefix(reqPath, routePrefix+"/")) {
+			return
+		}
+		middleware(c)
+	}
+}
+
+// isUnknownIssuerError reports whether err is a jwt.ValidationError<UnknownIssuerError>
+func isUnknownIssuerError(err error) bool {
 	if jwtValidationErr, ok := err.(*jwt.ValidationError); ok {
 		if _, ok := jwtValidationErr.Inner.(*UnknownIssuerError); ok {
-			fatal = false
-			return
+			return true
 		}
 	}
+	return false
+}
 
-	return
+// isFatalJwtError reports whether the upload must be rejected because of err.
+// Tokens from unknown issuers are ignored, so the upload proceeds as anonymous,
+// unless rejectUnknownIssuer is set.
+func isFatalJwtError(err error, rejectUnknownIssuer bool) (fatal bool) {
+	if isUnknownIssuerError(err) {
+		return rejectUnknownIssuer
+	}
+	return true
 }
 
+// postFile injects server-controlled metadata into the Upload-Metadata header
+// before handing the request to tusd.
+//
+// Requests using the creation-with-upload extension carry the first chunk in
+// the POST body. The body is only read inside handler.PostFile, after the
+// metadata has been rewritten and after tusd has checked Upload-Length against
+// MaxSize, so bundled data is always stored with the injected metadata and is
+// subject to the same size limits as a subsequent PATCH.
 func (serv *UploadServer) postFile(handler *tusd.UnroutedHandler) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		err := serv.addRemoteIPToMetadata(c.Request)
-		if err != nil {
-			if addrErr, ok := err.(*net.AddrError); ok {
-				c.AbortWithError(http.StatusInternalServerError, addrErr).SetType(gin.ErrorTypePrivate)
-			} else {
-				c.AbortWithError(http.StatusNotAcceptable, err)
+		defer serv.releaseIncompleteSlot(c)
+		if !serv.prepareCreation(c) {
+			return
+		}
+
+		metadata := parseMeta(c.Request.Header.Get("Upload-Metadata"))
+		serv.logCreationMetadata(c.Request, metadata)
+
+		// with a deferred length, the limit is only checked once the upload finished
+		size, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+		declared := err == nil
+		if declared {
+			if serv.rejectEmptyUpload(c, size) {
+				return
 			}
+			if !serv.enforceOriginSizeLimit(c, size) {
+				return
+			}
+			if !serv.enforceMimeTypeSizeLimit(c, metadata["filetype"], size) {
+				return
+			}
+		} else {
+			size = 0
+		}
+
+		if !serv.enforceAccountQuota(c, metadata, size, c.GetHeader("Upload-Defer-Length") == "1") {
 			return
 		}
 
-		err = serv.processJwt(c.Request)
+		if declared {
+			if existingID := serv.findRecentDuplicate(c.Request, metadata, size, metadataSHA256(metadata)); existingID != "" {
+				serv.respondWithExistingUpload(c, existingID, metadata)
+				return
+			}
+		}
 
-		if err != nil {
-			if isFatalJwtError(err) {
-				if jwtValidationErr, ok := err.(*jwt.ValidationError); ok && jwtValidationErr.Inner == jwt.ErrSignatureInvalid {
-					c.Error(jwtValidationErr).SetType(gin.ErrorTypePublic)
-					c.AbortWithStatusJSON(http.StatusUnauthorized, fmt.Sprintf("Failed to process EXTJWT: %s. Configured secret may be incorrect.", jwtValidationErr))
-					return
+		w := &interceptingResponseWriter{
+			ResponseWriter: c.Writer,
+			OnWriteHeader: func(status int) bool {
+				if status == http.StatusCreated {
+					if id := createdUploadID(c); id != "" {
+						serv.requestLog(c.Request).Info().
+							Str("event", "upload_created").
+							Str("id", id).
+							Msg("Created upload")
+						serv.setDownloadURLHeader(c, id, metadata)
+						length := c.GetHeader("Upload-Length")
+						complete := length == "0" || c.Writer.Header().Get("Upload-Offset") == length
+						if !complete {
+							serv.setUploadExpires(c, time.Now(), metadata["account"] != "")
+						}
+						if serv.cfg.Server.CreationResponseBody {
+							serv.writeCreationResponse(c, id, metadata, complete)
+							return true
+						}
+					}
 				}
-				c.AbortWithError(http.StatusBadRequest, err).SetType(gin.ErrorTypePublic)
-				return
+				return serv.respondUploadTooLarge(c, status)
+			},
+		}
+		handler.PostFile(w, c.Request)
+	}
+}
+
+// prepareCreation runs the checks shared by all upload creation endpoints and
+// injects the server-controlled fields into the Upload-Metadata header of the
+// request. Returns false if the request was rejected and aborted.
+func (serv *UploadServer) prepareCreation(c *gin.Context) bool {
+	return serv.admitCreation(c) && serv.prepareCreationMetadata(c)
+}
+
+// admitCreation runs the part of prepareCreation that only depends on the
+// server state and the client address, not on the metadata of the upload, and
+// adds the RemoteIP and country fields to the Upload-Metadata header. Returns
+// false if the request was rejected and aborted.
+func (serv *UploadServer) admitCreation(c *gin.Context) bool {
+	if serv.rejectIfPaused(c) {
+		return false
+	}
+	if !serv.requireDatabase(c) {
+		return false
+	}
+	if !serv.rejectReservedMetadata(c) {
+		return false
+	}
+
+	remoteIP, err := serv.addRemoteIPToMetadata(c.Request)
+	if err != nil {
+		if addrErr, ok := err.(*net.AddrError); ok {
+			c.AbortWithError(http.StatusInternalServerError, addrErr).SetType(gin.ErrorTypePrivate)
+		} else {
+			c.AbortWithError(http.StatusNotAcceptable, err)
+		}
+		return false
+	}
+
+	if denied, reason := serv.isDeniedIP(net.ParseIP(remoteIP)); denied {
+		serv.requestLog(c.Request).Warn().
+			Str("event", "upload_denied").
+			Str("ip", remoteIP).
+			Str("reason", reason).
+			Msg("Rejected upload from denied IP")
+		abortWithErrorResponse(c, http.StatusForbidden, "ip_denied", "Uploads are not accepted from this address", nil)
+		return false
+	}
+
+	return serv.enforceCountryRestriction(c, remoteIP)
+}
+
+// prepareCreationMetadata runs the part of prepareCreation that depends on the
+// metadata of the upload, after admitCreation. Returns false if the request
+// was rejected and aborted.
+func (serv *UploadServer) prepareCreationMetadata(c *gin.Context) bool {
+	if !serv.applyFilenamePolicy(c) {
+		return false
+	}
+
+	if !validateLanguage(c) {
+		return false
+	}
+
+	err := serv.processJwt(c.Request)
+
+	if err != nil {
+		if isFatalJwtError(err, serv.cfg.Jwt.RejectUnknownIssuer) {
+			if isUnknownIssuerError(err) {
+				abortWithErrorResponse(c, http.StatusUnauthorized, "jwt_unknown_issuer",
+					"The issuer of the EXTJWT is not accepted by this server", nil)
+				return false
+			}
+			if err == ErrJwtReplayed {
+				metrics.add("jwt.replays", 1)
+				serv.requestLog(c.Request).Warn().
+					Str("event", "jwt_replayed").
+					Msg("Rejected an EXTJWT that has already been used")
+				abortWithErrorResponse(c, http.StatusUnauthorized, "jwt_replayed", err.Error(), nil)
+				return false
 			}
-			serv.log.Warn().
-				Err(err).
-				Msg("Failed to process EXTJWT")
+			if err == ErrJwtNotSingleUse {
+				abortWithErrorResponse(c, http.StatusUnauthorized, "jwt_not_single_use", err.Error(), nil)
+				return false
+			}
+			// the validation error itself only goes to the log
+			c.Error(err).SetType(gin.ErrorTypePrivate)
+			if jwtValidationErr, ok := err.(*jwt.ValidationError); ok && jwtValidationErr.Inner == jwt.ErrSignatureInvalid {
+				abortWithErrorResponse(c, http.StatusUnauthorized, "jwt_invalid_signature",
+					"The signature of the EXTJWT is invalid. Configured secret may be incorrect.", nil)
+				return false
+			}
+			abortWithErrorResponse(c, http.StatusBadRequest, "jwt_invalid", "The EXTJWT could not be processed", nil)
+			return false
 		}
+		serv.requestLog(c.Request).Warn().
+			Err(err).
+			Msg("Failed to process EXTJWT")
+	}
+
+	if !serv.verifyAccount(c) {
+		return false
+	}
+
+	if !serv.enforceCreationRateLimit(c) {
+		return false
+	}
+
+	if !serv.enforceIncompleteUploadLimit(c) {
+		return false
+	}
 
-		handler.PostFile(c.Writer, c.Request)
+	if !serv.enforceMaxTotalUploads(c) {
+		return false
 	}
+
+	if !serv.transformMetadata(c) {
+		return false
+	}
+
+	return true
 }
 
-func (serv *UploadServer) addRemoteIPToMetadata(req *http.Request) (err error) {
-	const uploadMetadataHeader = "Upload-Metadata"
-	const remoteIPKey = "RemoteIP"
+// createdUploadID returns the id of a newly created upload, taken from the
+// Location header set by tusd
+func createdUploadID(c *gin.Context) string {
+	location, err := url.Parse(c.Writer.Header().Get("Location"))
+	if err != nil || location.Path == "" {
+		return ""
+	}
+	return path.Base(location.Path)
+}
 
-	metadata := parseMeta(req.Header.Get(uploadMetadataHeader))
+// setDownloadURLHeader adds the eventual public download URL of a newly created upload
+func (serv *UploadServer) setDownloadURLHeader(c *gin.Context, id string, metadata map[string]string) {
+	c.Writer.Header().Set("X-Download-URL", serv.downloadURL(c.Request, id, metadata))
+}
 
-	// ensure the client doesn't attempt to specify their own RemoteIP
-	for k := range metadata {
-		if k == remoteIPKey {
-			return fmt.Errorf("Metadata field " + remoteIPKey + " cannot be set by client")
+func (serv *UploadServer) patchFile(handler *tusd.UnroutedHandler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if serv.respondIfAlreadyComplete(c) {
+			return
+		}
+		if serv.rejectIfUploadExpired(c) {
+			return
+		}
+		if serv.rejectIfOverOriginLimit(c) {
+			return
+		}
+		if !serv.lockUploadForPatch(c) {
+			return
+		}
+		defer serv.patchLocks.unlock(c.Param("id"))
+
+		excess, handled := serv.checkPatchLength(c)
+		if handled {
+			return
 		}
+
+		w := &interceptingResponseWriter{
+			ResponseWriter: c.Writer,
+			OnWriteHeader: func(status int) bool {
+				if status == http.StatusNoContent && excess != nil && excess() {
+					// the excess is only left once the declared length was reached
+					offset, _ := strconv.ParseInt(c.Writer.Header().Get("Upload-Offset"), 10, 64)
+					respondExcessPatchData(c, offset, offset)
+					return true
+				}
+				return serv.respondUploadTooLarge(c, status)
+			},
+		}
+		handler.PatchFile(w, c.Request)
+	}
+}
+
+// respondUploadTooLarge replaces tusd's plain 413 responses with an
+// upload_too_large error including the limit. tusd sends 413 both when
+// Upload-Length exceeds MaxSize at creation and when a PATCH would grow the
+// upload past its length, so clients see the same error.
+func (serv *UploadServer) respondUploadTooLarge(c *gin.Context, status int) (handled bool) {
+	if status != http.StatusRequestEntityTooLarge {
+		return false
 	}
 
+	maxSize := serv.maxUploadSize(c.Request)
+	abortWithErrorResponse(c, status, "upload_too_large",
+		fmt.Sprintf("Upload exceeds its declared length or the maximum size of %s", maxSize.String()),
+		gin.H{"maxSize": maxSize.Bytes()},
+	)
+	return true
+}
+
+func (serv *UploadServer) addRemoteIPToMetadata(req *http.Request) (remoteIP string, err error) {
+	const uploadMetadataHeader = "Upload-Metadata"
+
+	metadata := parseMeta(req.Header.Get(uploadMetadataHeader))
+
 	// determine the originating IP
-	remoteIP, err := serv.getDirectOrForwardedRemoteIP(req)
+	remoteIP, err = serv.getDirectOrForwardedRemoteIP(req)
 	if err != nil {
-		return err
+		if serv.cfg.Server.UndeterminedRemoteIP != undeterminedRemoteIPPlaceholder {
+			return "", err
+		}
+		serv.requestLog(req).Warn().
+			Err(err).
+			Str("event", "remote_ip_undetermined").
+			Msg("Could not determine the client IP, storing a placeholder")
+		remoteIP, err = remoteIPPlaceholder, nil
 	}
 
 	// add RemoteIP to metadata
@@ -213,7 +563,8 @@ func (e UnknownIssuerError) Error() string {
 }
 
 func (serv *UploadServer) getSecretForToken(token *jwt.Token) (interface{}, error) {
-	// Don't forget to validate the alg is what you expect:
+	// the parser already checked Jwt.AllowedAlgorithms, the secret must only
+	// ever be used as an HMAC key
 	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 	}
@@ -244,21 +595,12 @@ func (serv *UploadServer) getSecretForToken(token *jwt.Token) (interface{}, erro
 func (serv *UploadServer) processJwt(req *http.Request) (err error) {
 	metadata := parseMeta(req.Header.Get("Upload-Metadata"))
 
-	// ensure the client doesn't attempt to specify their own account/issuer fields
-	for k := range metadata {
-		switch k {
-		case "account":
-		case "issuer":
-			return fmt.Errorf("Metadata field %#v cannot be set by client", k)
-		}
-	}
-
 	tokenString := metadata["extjwt"]
 	if tokenString == "" {
 		return nil
 	}
 
-	token, err := jwt.Parse(tokenString, serv.getSecretForToken)
+	token, err := serv.jwtParser().Parse(tokenString, serv.getSecretForToken)
 	if err != nil {
 		return err
 	}
@@ -269,21 +611,48 @@ func (serv *UploadServer) processJwt(req *http.Request) (err error) {
 	}
 
 	issuer := claims["iss"].(string)
+	if serv.cfg.Jwt.SingleUse {
+		if err := serv.jwtNonces.use(issuer, claims); err != nil {
+			return err
+		}
+	}
+
 	account, ok := claims["account"].(string)
 	if !ok {
 		return nil
 	}
 
-	metadata["issuer"] = issuer
-	metadata["account"] = account
+	metadata[issuerKey] = issuer
+	metadata[accountKey] = account
 
 	// override original header
 	req.Header.Set("Upload-Metadata", serializeMeta(metadata))
 
-	fmt.Printf("metadata updated: account=%v issuer=%v\n", account, issuer)
+	serv.requestLog(req).Debug().
+		Str("account", account).
+		Str("issuer", issuer).
+		Msg("Added EXTJWT account to metadata")
 	return
 }
 
+// what happens to a creation request whose client IP can't be determined
+const (
+	undeterminedRemoteIPReject      = "reject"
+	undeterminedRemoteIPPlaceholder = "placeholder"
+)
+
+// stored as the uploader IP with Server.UndeterminedRemoteIP = "placeholder"
+const remoteIPPlaceholder = "unknown"
+
+func validateUndeterminedRemoteIP(mode string) error {
+	switch mode {
+	case undeterminedRemoteIPReject, undeterminedRemoteIPPlaceholder:
+		return nil
+	}
+	return fmt.Errorf("Unsupported Server.UndeterminedRemoteIP %#v, expected %#v or %#v",
+		mode, undeterminedRemoteIPReject, undeterminedRemoteIPPlaceholder)
+}
+
 // ErrInvalidXForwardedFor occurs if the X-Forwarded-For header is trusted but invalid
 var ErrInvalidXForwardedFor = errors.New("Failed to parse IP from X-Forwarded-For header")
 
@@ -291,7 +660,7 @@ func (serv *UploadServer) getDirectOrForwardedRemoteIP(req *http.Request) (strin
 	// extract direct IP
 	remoteIP, _, err := net.SplitHostPort(req.RemoteAddr)
 	if err != nil {
-		serv.log.Error().
+		serv.requestLog(req).Error().
 			Err(err).
 			Msg("Could not split address into host and port")
 		return "", err
@@ -312,7 +681,7 @@ func (serv *UploadServer) getDirectOrForwardedRemoteIP(req *http.Request) (strin
 			forwardedForIP := net.ParseIP(forwardedForClient)
 			if forwardedForIP == nil {
 				err := ErrInvalidXForwardedFor
-				serv.log.Error().
+				serv.requestLog(req).Error().
 					Err(err).
 					Str("client", forwardedForClient).
 					Str("remoteIP", remoteIP).
@@ -321,7 +690,7 @@ func (serv *UploadServer) getDirectOrForwardedRemoteIP(req *http.Request) (strin
 			}
 			return forwardedForIP.String(), nil
 		}
-		serv.log.Warn().
+		serv.requestLog(req).Warn().
 			Str("X-Forwarded-For", forwardedFor).
 			Str("remoteIP", remoteIP).
 			Msg("Untrusted remote attempted to override stored IP")
@@ -341,8 +710,10 @@ func (serv *UploadServer) remoteIPisTrusted(remoteIP net.IP) bool {
 	return false
 }
 
-func (serv *UploadServer) ipRecorder(broadcaster *events.TusEventBroadcaster) {
-	channel := broadcaster.Listen()
+// uploadRecorder stores the uploader IP and the allowed client metadata of
+// newly created uploads in their database record
+func (serv *UploadServer) uploadRecorder(broadcaster *events.TusEventBroadcaster) {
+	channel := broadcaster.Listen("upload-recorder", events.DefaultBufferSize, events.OverflowBlock)
 	for {
 		event, ok := <-channel
 		if !ok {
@@ -351,24 +722,44 @@ func (serv *UploadServer) ipRecorder(broadcaster *events.TusEventBroadcaster) {
 		if event.Type == hooks.HookPostCreate {
 			go func() {
 				ip := event.Info.MetaData["RemoteIP"]
+				country := sql.NullString{String: event.Info.MetaData[remoteCountryKey], Valid: event.Info.MetaData[remoteCountryKey] != ""}
 
 				serv.log.Debug().
 					Str("id", event.Info.ID).
 					Str("ip", ip).
 					Msg("Recording uploader IP")
 
-				err := db.UpdateRow(serv.DBConn.DB, `
+				metadata, overflow, err := serv.persistedMetadata(event.Info.MetaData)
+				if err != nil {
+					serv.log.Error().
+						Err(err).
+						Msg("Failed to serialize metadata")
+				}
+				if len(overflow) > 0 {
+					serv.log.Warn().
+						Str("event", "metadata_truncated").
+						Str("id", event.Info.ID).
+						Strs("fields", overflow).
+						Msg("Persisted metadata exceeds Database.MaxPersistedMetadataFields or MaxPersistedMetadataBytes, fields were truncated or dropped")
+				}
+
+				const query = `
 					UPDATE uploads
-					SET uploader_ip = ?
+					SET uploader_ip = ?, country = ?, metadata = ?
 					WHERE id = ?
-				`, ip, event.Info.ID)
-
+				`
+				err = db.UpdateRow(serv.DBConn.DB, query, ip, country, metadata, event.Info.ID)
 				if err != nil {
-					serv.log.Error().
+					serv.log.Warn().
 						Err(err).
-						Msg("Failed to record uploader IP")
+						Str("id", event.Info.ID).
+						Msg("Failed to record uploader IP, retrying later")
+					serv.dbRetryBuffer.add("record uploader IP of "+event.Info.ID, query, ip, country, metadata, event.Info.ID)
 				}
 			}()
 		}
+		if event.Type == hooks.HookPostFinish {
+			recordUploadUsage(event.Info)
+		}
 	}
 }
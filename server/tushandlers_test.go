@@ -0,0 +1,150 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMalformedUploadIDsLookUnknown(t *testing.T) {
+	ts := newTestServer(t, nil)
+	defer ts.Close()
+
+	// a stored upload, so the unknown IDs are looked up in a non-empty store
+	ts.upload("hello", map[string]string{"filename": "hello.txt"})
+
+	unknownID := strings.Repeat("0123456789abcdef", 2)
+	malformedIDs := []string{
+		"1",
+		"abc",
+		unknownID[:31],
+		unknownID + "0",
+		strings.ToUpper(unknownID),
+		strings.Repeat("z", 32),
+		strings.Repeat("ab", 257),
+		"%2e%2e",
+		"..%2f..%2fetc%2fpasswd",
+		unknownID[:30] + "%00",
+	}
+
+	requests := []struct {
+		method string
+		suffix string
+	}{
+		{http.MethodGet, ""},
+		{http.MethodGet, "/hello.txt"},
+		{http.MethodHead, ""},
+		{http.MethodPatch, ""},
+		{http.MethodDelete, ""},
+	}
+	for _, request := range requests {
+		t.Run(request.method+request.suffix, func(t *testing.T) {
+			wantResp, wantBody := ts.sendForID(request.method, unknownID, request.suffix)
+			if wantResp.StatusCode != http.StatusNotFound {
+				t.Fatalf("Expected status 404 for an unknown ID, got %d", wantResp.StatusCode)
+			}
+			wantHeader := comparableHeader(wantResp.Header)
+
+			for _, id := range malformedIDs {
+				resp, body := ts.sendForID(request.method, id, request.suffix)
+				if resp.StatusCode != wantResp.StatusCode {
+					t.Errorf("ID %q: expected status %d like an unknown ID, got %d", id, wantResp.StatusCode, resp.StatusCode)
+				}
+				if header := comparableHeader(resp.Header); !reflect.DeepEqual(header, wantHeader) {
+					t.Errorf("ID %q: expected the headers of an unknown ID %v, got %v", id, wantHeader, header)
+				}
+				if body != wantBody {
+					t.Errorf("ID %q: expected the body of an unknown ID %q, got %q", id, wantBody, body)
+				}
+			}
+		})
+	}
+}
+
+// sendForID sends a tus request for the upload with the given ID, which is
+// put into the path as it is
+func (ts *testServer) sendForID(method string, id string, suffix string) (*http.Response, string) {
+	ts.t.Helper()
+
+	req := ts.newTusRequest(method, ts.url("/files/"+id+suffix), "")
+	if method == http.MethodPatch {
+		req = ts.newPatchRequest(ts.url("/files/"+id), 0, "data")
+	}
+	return ts.do(req)
+}
+
+// comparableHeader returns the response headers that don't change between
+// requests
+func comparableHeader(header http.Header) http.Header {
+	comparable := http.Header{}
+	for key, values := range header {
+		if key != "Date" && key != "X-Request-Id" {
+			comparable[key] = values
+		}
+	}
+	return comparable
+}
+
+func TestCreationWithAndWithoutTrailingSlash(t *testing.T) {
+	for _, basePath := range []string{"/files", "/files/", "/upload/files"} {
+		t.Run(basePath, func(t *testing.T) {
+			ts := newTestServer(t, func(cfg *Config) {
+				cfg.Server.BasePath = basePath
+			})
+			defer ts.Close()
+
+			prefix := strings.TrimSuffix(basePath, "/")
+			var headerKeys [][]string
+			for _, path := range []string{prefix, prefix + "/"} {
+				req := ts.newTusRequest(http.MethodPost, ts.url(path), "")
+				req.Header.Set("Upload-Length", "5")
+				req.Header.Set("Upload-Metadata", encodeTestMetadata(map[string]string{"filename": "a.txt"}))
+				resp, body := ts.do(req)
+
+				if resp.StatusCode != http.StatusCreated {
+					t.Fatalf("POST %s: expected status 201, got %d with body %q", path, resp.StatusCode, body)
+				}
+				if resp.Request.URL.Path != path {
+					t.Fatalf("POST %s: was redirected to %s", path, resp.Request.URL.Path)
+				}
+				location := resp.Header.Get("Location")
+				if !strings.HasPrefix(location, ts.url(prefix+"/")) || strings.Contains(strings.TrimPrefix(location, ts.url("")), "//") {
+					t.Fatalf("POST %s: unexpected Location %q", path, location)
+				}
+
+				// the server-controlled metadata is only added by postFile
+				var uploaderIP string
+				if err := ts.DBConn.DB.Get(&uploaderIP, `SELECT uploader_ip FROM uploads WHERE id = ?`, uploadID(location)); err != nil {
+					t.Fatalf("POST %s: upload not recorded: %v", path, err)
+				}
+				if uploaderIP != "127.0.0.1" {
+					t.Fatalf("POST %s: expected the uploader IP to be recorded, got %q", path, uploaderIP)
+				}
+
+				if resp, body := ts.patch(location, 0, "hello"); resp.StatusCode != http.StatusNoContent {
+					t.Fatalf("POST %s: writing to the created upload got status %d, body %q", path, resp.StatusCode, body)
+				}
+
+				// and so are its rejections
+				req = ts.newTusRequest(http.MethodPost, ts.url(path), "")
+				req.Header.Set("Upload-Length", "5")
+				req.Header.Set("Upload-Metadata", encodeTestMetadata(map[string]string{remoteIPKey: "192.0.2.1"}))
+				if rejected, body := ts.do(req); rejected.StatusCode != http.StatusBadRequest {
+					t.Fatalf("POST %s: expected reserved metadata to be rejected, got status %d with body %q", path, rejected.StatusCode, body)
+				}
+
+				keys := make([]string, 0, len(resp.Header))
+				for key := range comparableHeader(resp.Header) {
+					keys = append(keys, key)
+				}
+				sort.Strings(keys)
+				headerKeys = append(headerKeys, keys)
+			}
+			if !reflect.DeepEqual(headerKeys[0], headerKeys[1]) {
+				t.Fatalf("Expected the same response headers with and without the trailing slash, got %v and %v", headerKeys[0], headerKeys[1])
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/shardedfilestore"
+)
+
+// enforceMaxTotalUploads rejects a creation request with 507 storage_full once
+// Storage.MaxTotalUploads uploads are stored, counting uploads in progress.
+// With Storage.EvictOldestUploads, the oldest completed uploads are removed to
+// make room instead. Returns false if the request was rejected and aborted.
+func (serv *UploadServer) enforceMaxTotalUploads(c *gin.Context) bool {
+	maxUploads := serv.cfg.Storage.MaxTotalUploads
+	if maxUploads <= 0 {
+		return true
+	}
+
+	// serialise eviction so concurrent creations don't evict more than needed
+	serv.uploadCapMu.Lock()
+	defer serv.uploadCapMu.Unlock()
+
+	var count int
+	err := serv.DBConn.DB.Get(&count, `SELECT COUNT(*) FROM uploads WHERE deleted = 0`)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return false
+	}
+	if count < maxUploads {
+		return true
+	}
+
+	if serv.cfg.Storage.EvictOldestUploads {
+		evicted, err := serv.evictOldestUploads(count - maxUploads + 1)
+		if err != nil {
+			serv.requestLog(c.Request).Error().
+				Err(err).
+				Msg("Failed to evict uploads")
+		}
+		if count-evicted < maxUploads {
+			return true
+		}
+	}
+
+	serv.requestLog(c.Request).Warn().
+		Str("event", "storage_full").
+		Int("uploads", count).
+		Msg("Rejected upload, Storage.MaxTotalUploads reached")
+	abortWithErrorResponse(c, http.StatusInsufficientStorage, "storage_full",
+		fmt.Sprintf("The server stores at most %d uploads", maxUploads), gin.H{"maxUploads": maxUploads})
+	return false
+}
+
+// evictOldestUploads removes up to n of the oldest completed uploads. Uploads
+// in progress are never evicted. Returns the number of removed uploads.
+func (serv *UploadServer) evictOldestUploads(n int) (evicted int, err error) {
+	var ids []string
+	err = serv.DBConn.DB.Select(&ids, `
+		SELECT id FROM uploads
+		WHERE deleted = 0 AND sha256sum IS NOT NULL
+		ORDER BY created_at, id
+		LIMIT ?
+		`,
+		n,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, id := range ids {
+		if err := serv.store.TerminateWithReason(id, shardedfilestore.DeletedReasonEvicted); err != nil {
+			return evicted, err
+		}
+		evicted++
+		serv.log.Info().
+			Str("event", "evicted").
+			Str("id", id).
+			Msg("Evicted oldest upload to make room")
+	}
+	return evicted, nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadExpiry returns when an incomplete upload can no longer be resumed:
+// Storage.MaxUploadDuration after its creation, or when the expirer removes it
+// after Expiration.MaxAge (IdentifiedMaxAge for uploads with an account),
+// whichever comes first
+func (serv *UploadServer) uploadExpiry(created time.Time, identified bool) time.Time {
+	maxAge := serv.cfg.Expiration.MaxAge.Duration
+	if identified {
+		maxAge = serv.cfg.Expiration.IdentifiedMaxAge.Duration
+	}
+	if maxDuration := serv.cfg.Storage.MaxUploadDuration.Duration; maxDuration > 0 && maxDuration < maxAge {
+		maxAge = maxDuration
+	}
+	return created.Add(maxAge)
+}
+
+// setUploadExpires sets the Upload-Expires header of the tus expiration
+// extension, which tells clients until when an incomplete upload can be resumed
+func (serv *UploadServer) setUploadExpires(c *gin.Context, created time.Time, identified bool) {
+	c.Header("Upload-Expires", serv.uploadExpiry(created, identified).UTC().Format(http.TimeFormat))
+}
+
+// setUploadExpiresForID sets the Upload-Expires header for an existing upload.
+// Unknown uploads are left without the header.
+func (serv *UploadServer) setUploadExpiresForID(c *gin.Context, id string) {
+	if created, identified, err := serv.uploadCreation(id); err == nil {
+		serv.setUploadExpires(c, created, identified)
+	}
+}
+
+// uploadCreation returns when an upload was created and whether it has an account
+func (serv *UploadServer) uploadCreation(id string) (created time.Time, identified bool, err error) {
+	var createdAt int64
+	err = serv.DBConn.DB.QueryRow(`SELECT created_at, jwt_account IS NOT NULL FROM uploads WHERE id = ?`, id).Scan(&createdAt, &identified)
+	return time.Unix(createdAt, 0), identified, err
+}
+
+// rejectIfUploadExpired rejects a PATCH to an upload whose resumability window
+// from uploadExpiry has passed with 410 Gone, the same window that is
+// advertised in the Upload-Expires header. The window ends when the expirer
+// would remove the upload, so a client gets a clear answer instead of its data
+// being accepted until the next expirer run and 404 afterwards, or earlier with
+// Storage.MaxUploadDuration, so a client can't keep an upload alive
+// indefinitely by trickling data. The upload itself is left for the expirer to
+// remove. Accepted requests get the Upload-Expires header. Returns true if the
+// request was rejected and aborted.
+func (serv *UploadServer) rejectIfUploadExpired(c *gin.Context) (handled bool) {
+	id := c.Param("id")
+	created, identified, err := serv.uploadCreation(id)
+	if err != nil {
+		// unknown uploads are left to tusd
+		return false
+	}
+
+	expiry := serv.uploadExpiry(created, identified)
+	if !time.Now().After(expiry) {
+		serv.setUploadExpires(c, created, identified)
+		return false
+	}
+
+	maxDuration := serv.cfg.Storage.MaxUploadDuration.Duration
+	if maxDuration > 0 && !created.Add(maxDuration).After(expiry) {
+		serv.requestLog(c.Request).Warn().
+			Str("event", "upload_duration_exceeded").
+			Str("id", id).
+			Time("createdAt", created).
+			Dur("maxUploadDuration", maxDuration).
+			Msg("Rejected PATCH to upload exceeding the maximum upload duration")
+
+		abortWithErrorResponse(c, http.StatusGone, "upload_duration_exceeded",
+			fmt.Sprintf("The upload was not completed within %s", maxDuration),
+			gin.H{"maxUploadDuration": maxDuration.Seconds()})
+		return true
+	}
+
+	serv.requestLog(c.Request).Info().
+		Str("event", "upload_expired").
+		Str("id", id).
+		Time("createdAt", created).
+		Time("expiredAt", expiry).
+		Msg("Rejected PATCH to expired upload")
+
+	abortWithErrorResponse(c, http.StatusGone, "upload_expired",
+		"The upload expired before it was completed",
+		gin.H{"expiredAt": expiry.UTC().Format(time.RFC3339)})
+	return true
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// backdateUpload moves the creation time of an upload into the past
+func (ts *testServer) backdateUpload(uploadURL string, age time.Duration) {
+	ts.t.Helper()
+
+	_, err := ts.DBConn.DB.Exec(`UPDATE uploads SET created_at = ? WHERE id = ?`,
+		time.Now().Add(-age).Unix(), uploadID(uploadURL))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+}
+
+func TestPatchAfterUploadExpiry(t *testing.T) {
+	tests := []struct {
+		name              string
+		maxUploadDuration string
+		age               time.Duration
+		status            int
+		code              string
+	}{
+		{"within MaxAge", "0s", 30 * time.Second, http.StatusNoContent, ""},
+		{"after MaxAge", "0s", 2 * time.Minute, http.StatusGone, "upload_expired"},
+		{"after MaxUploadDuration", "30s", 45 * time.Second, http.StatusGone, "upload_duration_exceeded"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ts := newTestServer(t, func(cfg *Config) {
+				cfg.Expiration.MaxAge.Duration = time.Minute
+				cfg.Expiration.CheckInterval.Duration = time.Hour
+				cfg.Storage.MaxUploadDuration.Duration, _ = time.ParseDuration(test.maxUploadDuration)
+			})
+			defer ts.Close()
+
+			uploadURL := ts.createUpload(10, nil)
+			ts.backdateUpload(uploadURL, test.age)
+
+			resp, body := ts.patch(uploadURL, 0, "0123456789")
+			if resp.StatusCode != test.status {
+				t.Fatalf("Expected status %d, got %d: %q", test.status, resp.StatusCode, body)
+			}
+			if test.code != "" {
+				if code := decodeErrorResponse(t, body).Code; code != test.code {
+					t.Errorf("Expected error code %q, got %q", test.code, code)
+				}
+			} else if resp.Header.Get("Upload-Expires") == "" {
+				t.Error("Expected an Upload-Expires header")
+			}
+		})
+	}
+}
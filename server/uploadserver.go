@@ -1,7 +1,9 @@
 package server
 
 import (
+	"fmt"
 	"net/http"
+	"sort"
 	"sync"
 
 	"github.com/gin-gonic/gin"
@@ -24,9 +26,34 @@ type UploadServer struct {
 	store               *shardedfilestore.ShardedFileStore
 	expirer             *expirer.Expirer
 	httpServer          *http.Server
+	downloadServer      *http.Server
 	startedMu           sync.Mutex
 	started             chan struct{}
 	tusEventBroadcaster *events.TusEventBroadcaster
+	dnsbl               *dnsblChecker
+	postFinishPool      *postFinishPool
+	dbHealth            *dbHealthCheck
+	watermarker         *watermarker
+	accountRateLimiter  *rateLimiter
+	ipRateLimiter       *rateLimiter
+	manifestRateLimiter *rateLimiter
+	adminToken          *adminTokenStore
+	uploadPause         *uploadPause
+	jwtNonces           *jwtNonceStore
+	patchLocks          *uploadLocks
+	creationGate        *creationGate
+	integrityCheck      *integrityCheck
+	audit               *auditExporter
+	uploadCapMu         sync.Mutex
+	virtualHosts        []*virtualHost
+	virtualHostServers  []*UploadServer
+	imageSlots          chan struct{}
+	accountVerifier     *accountVerifier
+	webhookClient       *http.Client
+	countries           *countryResolver
+	countryResolvers    *countryResolvers
+	transformers        []configuredTransformer
+	dbRetryBuffer       *dbRetryBuffer
 }
 
 // GetStartedChan returns a channel that will close when the server startup is complete
@@ -41,6 +68,11 @@ func (serv *UploadServer) GetStartedChan() chan struct{} {
 	return serv.started
 }
 
+// requestLog returns the logger for log lines about a request, which includes its request ID
+func (serv *UploadServer) requestLog(req *http.Request) *zerolog.Logger {
+	return logging.RequestLogger(req, serv.log)
+}
+
 func init() {
 	gin.SetMode(gin.ReleaseMode)
 }
@@ -48,19 +80,62 @@ func init() {
 // Run starts the UploadServer
 func (serv *UploadServer) Run(replaceableHandler *ReplaceableHandler) error {
 	serv.Router = gin.New()
-	serv.Router.Use(logging.GinLogger(serv.log), gin.Recovery())
+	serv.Router.Use(logging.RequestID(serv.log), logging.GinLogger(serv.log), gin.Recovery(), serv.limitErrorMessages)
+	if serv.audit != nil {
+		serv.Router.Use(serv.auditRequests)
+	}
+	serv.handleMethodNotAllowed(serv.Router)
+
+	if err := serv.prepareStorageDirs(); err != nil {
+		return err
+	}
 
 	serv.DBConn = db.ConnectToDB(serv.log, db.DBConfig{
 		DriverName: serv.cfg.Database.Type,
 		DSN:        serv.cfg.Database.Path,
+		SQLite: db.SQLiteOptions{
+			BusyTimeout: serv.cfg.Database.SQLite.BusyTimeout.Duration,
+			JournalMode: serv.cfg.Database.SQLite.JournalMode,
+			Synchronous: serv.cfg.Database.SQLite.Synchronous,
+		},
+		Pool: db.PoolOptions{
+			MaxOpenConns:    serv.cfg.Database.MaxOpenConns,
+			MaxIdleConns:    serv.cfg.Database.MaxIdleConns,
+			ConnMaxLifetime: serv.cfg.Database.ConnMaxLifetime.Duration,
+		},
 	})
 
+	serv.dbRetryBuffer = newDBRetryBuffer(serv.DBConn.DB, serv.log)
+
+	if serv.cfg.Database.RequireForUpload {
+		serv.dbHealth = newDBHealthCheck(serv.DBConn.DB)
+	}
+
 	serv.store = shardedfilestore.New(
 		serv.cfg.Storage.Path,
 		serv.cfg.Storage.ShardLayers,
 		serv.DBConn,
 		serv.log,
 	)
+	serv.store.HardDeleteTerminated = serv.cfg.Database.HardDeleteTerminated
+	serv.store.KeepTombstones = serv.cfg.Database.KeepTombstones
+	serv.store.IDBits = serv.cfg.Storage.UploadIDBits
+	serv.store.VariantsPath = serv.cfg.Storage.DerivativesDir
+	serv.store.HoldNewUploads = serv.cfg.Moderation.HoldNewUploads
+	serv.store.PreallocateSpace = serv.cfg.Storage.PreallocateSpace
+	serv.store.FileMode = serv.cfg.Storage.FileMode.FileMode
+	serv.store.DirMode = serv.cfg.Storage.DirMode.FileMode
+	serv.store.OnCreated = serv.onUploadCreated
+	if serv.audit != nil {
+		serv.store.OnRemoved = serv.auditRemoval
+	}
+	if len(serv.cfg.Storage.Tiers) > 0 {
+		serv.store.Tiers = make(map[string]string, len(serv.cfg.Storage.Tiers))
+		for _, tier := range serv.cfg.Storage.Tiers {
+			serv.store.Tiers[tier.Name] = tier.Path
+		}
+		serv.store.ChooseTier = serv.chooseStorageTier
+	}
 
 	serv.expirer = expirer.New(
 		serv.store,
@@ -71,27 +146,144 @@ func (serv *UploadServer) Run(replaceableHandler *ReplaceableHandler) error {
 		serv.log,
 	)
 
+	if len(serv.cfg.Security.DNSBLZones) > 0 {
+		serv.dnsbl = newDNSBLChecker(serv.cfg.Security.DNSBLZones, serv.cfg.Security.DNSBLCacheTTL.Duration)
+	}
+
+	if path := serv.cfg.Security.GeoIPDatabase; path != "" {
+		countries, err := serv.countryResolvers.open(path)
+		if err != nil {
+			return fmt.Errorf("Failed to open Security.GeoIPDatabase: %v", err)
+		}
+		serv.countries = countries
+	}
+
+	if integration := serv.cfg.Integration; integration.AccountVerifyURL != "" {
+		serv.accountVerifier = newAccountVerifier(
+			integration.AccountVerifyURL,
+			integration.ConnectTimeout.Duration,
+			integration.AccountVerifyTimeout.Duration,
+			integration.AccountVerifyCacheTTL.Duration,
+		)
+	}
+
+	if integration := serv.cfg.Integration; integration.CompletionWebhookURL != "" {
+		serv.webhookClient = newHTTPClient(integration.ConnectTimeout.Duration, integration.CompletionWebhookTimeout.Duration)
+	}
+
+	serv.transformers = newMetadataTransformers(
+		serv.cfg.MetadataTransformers,
+		serv.cfg.Integration.ConnectTimeout.Duration,
+	)
+
+	serv.imageSlots = make(chan struct{}, serv.cfg.Processing.ImageConcurrency)
+	serv.patchLocks = newUploadLocks()
+	serv.creationGate = newCreationGate()
+	serv.integrityCheck = newIntegrityCheck()
+
+	if perHour := serv.cfg.RateLimit.CreationsPerAccountPerHour; perHour > 0 {
+		serv.accountRateLimiter = newRateLimiter(perHour)
+	}
+	if perHour := serv.cfg.RateLimit.CreationsPerIPPerHour; perHour > 0 {
+		serv.ipRateLimiter = newRateLimiter(perHour)
+	}
+	if err := serv.restoreCreationRateLimits(); err != nil {
+		serv.log.Warn().
+			Err(err).
+			Msg("Failed to restore upload creation rate limits, starting with full limits")
+	}
+	if perHour := serv.cfg.RateLimit.ManifestRequestsPerIPPerHour; perHour > 0 {
+		serv.manifestRateLimiter = newRateLimiter(perHour)
+	}
+
 	err := serv.registerTusHandlers(serv.Router, serv.store)
 	if err != nil {
 		return err
 	}
 
+	if serv.adminToken.enabled() {
+		serv.registerAdminHandlers(serv.Router)
+	}
+	if serv.cfg.Server.PublicManifestPath != "" {
+		serv.registerPublicManifestHandler(serv.Router)
+	}
+
+	handler := http.Handler(serv.Router)
+	if len(serv.virtualHosts) > 0 {
+		if handler, err = serv.startVirtualHosts(serv.Router); err != nil {
+			return err
+		}
+	}
+
 	// closed channel indicates that startup is complete
 	close(serv.GetStartedChan())
 
 	if replaceableHandler != nil {
+		if serv.cfg.Server.DownloadListenAddress != "" {
+			serv.log.Warn().Msg("Server.DownloadListenAddress is not used when running as a webircgateway plugin")
+		}
+		if serv.cfg.tlsEnabled() {
+			serv.log.Warn().Msg("Server.TLS is not used when running as a webircgateway plugin, configure TLS on the gateway")
+		}
+
 		// set ReplaceableHandler that's mounted in an external server
-		replaceableHandler.Handler = serv.Router
+		replaceableHandler.Handler = handler
 		return nil
 	}
 
 	// otherwise run our own http server
+	if serv.cfg.Server.DownloadListenAddress != "" {
+		routePrefix, err := routePrefixFromBasePath(serv.cfg.Server.BasePath)
+		if err != nil {
+			return err
+		}
+		serv.serveDownloads(routePrefix)
+	}
 	serv.httpServer = &http.Server{
-		Addr:    serv.cfg.Server.ListenAddress,
-		Handler: serv.Router,
+		Addr:              serv.cfg.Server.ListenAddress,
+		Handler:           handler,
+		ReadTimeout:       serv.cfg.Server.ReadTimeout.Duration,
+		ReadHeaderTimeout: serv.cfg.Server.ReadHeaderTimeout.Duration,
+		WriteTimeout:      serv.cfg.Server.WriteTimeout.Duration,
+		IdleTimeout:       serv.cfg.Server.IdleTimeout.Duration,
+		TLSConfig:         serv.cfg.tlsConfig(),
 	}
 
-	return serv.httpServer.ListenAndServe()
+	return serv.listenAndServe(serv.httpServer)
+}
+
+// logStartupSummary logs the effective configuration in a single line. Secrets
+// such as JWT keys and database credentials are never included.
+func (serv *UploadServer) logStartupSummary(mountedOnParent bool) {
+	cfg := &serv.cfg
+
+	issuers := make([]string, 0, len(cfg.JwtSecretsByIssuer))
+	for issuer := range cfg.JwtSecretsByIssuer {
+		issuers = append(issuers, issuer)
+	}
+	sort.Strings(issuers)
+
+	listenAddress := cfg.Server.ListenAddress
+	if mountedOnParent {
+		listenAddress = "webircgateway"
+	}
+
+	routePrefix, _ := routePrefixFromBasePath(cfg.Server.BasePath)
+
+	serv.log.Info().
+		Str("event", "startup_summary").
+		Str("address", listenAddress).
+		Str("basePath", cfg.Server.BasePath).
+		Str("routePrefix", routePrefix).
+		Str("storageBackend", "sharded-filestore").
+		Str("storagePath", cfg.Storage.Path).
+		Int("shardLayers", cfg.Storage.ShardLayers).
+		Uint64("maxUploadSize", cfg.Storage.MaximumUploadSize.Bytes()).
+		Str("databaseType", cfg.Database.Type).
+		Strs("jwtIssuers", issuers).
+		Strs("corsOrigins", cfg.Server.CorsOrigins).
+		Strs("features", cfg.enabledFeatures()).
+		Msg("Effective configuration")
 }
 
 // Shutdown gracefully terminates the UploadServer instance.
@@ -106,13 +298,28 @@ func (serv *UploadServer) Shutdown() {
 	if serv.httpServer != nil {
 		serv.httpServer.Shutdown(nil)
 	}
+	serv.shutdownDownloads()
+
+	// shut down the virtual hosts, which share the listener
+	for _, child := range serv.virtualHostServers {
+		child.Shutdown()
+	}
 
 	// stop running FileStore GC cycles
 	serv.expirer.Stop()
 
-	// close db connections
-	serv.DBConn.DB.Close()
+	// stop verifying stored files
+	serv.integrityCheck.Close()
 
 	// close event broadcaster
 	serv.tusEventBroadcaster.Close()
+
+	// finish queued post-finish processing while the db is still available
+	serv.postFinishPool.Close()
+
+	// make a last attempt at failed db updates
+	serv.dbRetryBuffer.Close()
+
+	// close db connections
+	serv.DBConn.DB.Close()
 }
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kiwiirc/plugin-fileuploader/db"
+	"github.com/tus/tusd"
+)
+
+// Usage metrics are labeled by EXTJWT issuer only. Issuers are limited to those
+// in JwtSecretsByIssuer, while accounts are unbounded and reported from the
+// database by GET <AdminPath>/usage instead. Anonymous uploads have an empty
+// issuer.
+
+// recordUploadUsage counts a finished upload in the usage metrics
+func recordUploadUsage(info tusd.FileInfo) {
+	issuer := info.MetaData["issuer"]
+	metrics.addLabeled("usage.uploads", "issuer", issuer, 1)
+	metrics.addLabeled("usage.bytesUploaded", "issuer", issuer, uint64(info.Size))
+}
+
+// recordDownloadUsage counts the bytes sent for a download in the usage
+// metrics and in the downloaded_bytes column of the upload
+func (serv *UploadServer) recordDownloadUsage(info tusd.FileInfo, written int64) {
+	if written <= 0 {
+		return
+	}
+	metrics.addLabeled("usage.bytesDownloaded", "issuer", info.MetaData["issuer"], uint64(written))
+
+	go func() {
+		const query = `
+			UPDATE uploads
+			SET downloaded_bytes = downloaded_bytes + ?
+			WHERE id = ?
+		`
+		if err := db.UpdateRow(serv.DBConn.DB, query, written, info.ID); err != nil {
+			serv.log.Warn().
+				Err(err).
+				Str("id", info.ID).
+				Msg("Failed to record downloaded bytes, retrying later")
+			serv.dbRetryBuffer.add("record downloaded bytes of "+info.ID, query, written, info.ID)
+		}
+	}()
+}
+
+// countingResponseWriter counts the bytes of the response body
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+type accountUsage struct {
+	Issuer          sql.NullString `db:"jwt_issuer"`
+	Account         sql.NullString `db:"jwt_account"`
+	Uploads         int64          `db:"uploads"`
+	StoredUploads   int64          `db:"stored_uploads"`
+	BytesStored     int64          `db:"bytes_stored"`
+	BytesDownloaded int64          `db:"bytes_downloaded"`
+}
+
+// reportUsage responds with the usage per issuer and account from the
+// database: uploads created, uploads and bytes currently stored, and bytes
+// downloaded, including downloads of uploads deleted since. ?issuer= and
+// ?account= restrict the report. Hard deleted uploads are not included.
+func (serv *UploadServer) reportUsage(c *gin.Context) {
+	query := `
+		SELECT
+			jwt_issuer,
+			jwt_account,
+			COUNT(*) AS uploads,
+			SUM(CASE WHEN deleted = 0 AND sha256sum IS NOT NULL THEN 1 ELSE 0 END) AS stored_uploads,
+			COALESCE(SUM(CASE WHEN deleted = 0 THEN size END), 0) AS bytes_stored,
+			COALESCE(SUM(downloaded_bytes), 0) AS bytes_downloaded
+		FROM uploads
+		WHERE deleted IN (0, 1)
+	`
+	var args []interface{}
+	if issuer, ok := c.GetQuery("issuer"); ok {
+		query += ` AND COALESCE(jwt_issuer, '') = ?`
+		args = append(args, issuer)
+	}
+	if account, ok := c.GetQuery("account"); ok {
+		query += ` AND COALESCE(jwt_account, '') = ?`
+		args = append(args, account)
+	}
+	query += `
+		GROUP BY jwt_issuer, jwt_account
+		ORDER BY bytes_stored DESC
+		LIMIT ?
+	`
+	args = append(args, serv.cfg.Server.MaxListPageSize)
+
+	var records []accountUsage
+	if err := serv.DBConn.DB.Select(&records, query, args...); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err).SetType(gin.ErrorTypePrivate)
+		return
+	}
+
+	usage := make([]gin.H, 0, len(records))
+	for _, record := range records {
+		usage = append(usage, gin.H{
+			"issuer":          record.Issuer.String,
+			"account":         record.Account.String,
+			"uploads":         record.Uploads,
+			"storedUploads":   record.StoredUploads,
+			"bytesStored":     record.BytesStored,
+			"bytesDownloaded": record.BytesDownloaded,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"usage": usage})
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+type virtualHostConfig struct {
+	Hosts  []string
+	Config string
+}
+
+// validateVirtualHosts checks the [[VirtualHosts]] entries of the main config
+func validateVirtualHosts(virtualHosts []virtualHostConfig) error {
+	seen := make(map[string]bool)
+	for i, virtualHost := range virtualHosts {
+		if virtualHost.Config == "" {
+			return fmt.Errorf("VirtualHosts entry %d is missing its Config path", i+1)
+		}
+		if len(virtualHost.Hosts) == 0 {
+			return fmt.Errorf("VirtualHosts entry %d (%#v) has no Hosts", i+1, virtualHost.Config)
+		}
+		for _, host := range virtualHost.Hosts {
+			if host == "" || host != strings.ToLower(host) || strings.ContainsAny(host, ":/ ") {
+				return fmt.Errorf("VirtualHosts host %#v must be a lowercase host name without a port", host)
+			}
+			if seen[host] {
+				return fmt.Errorf("VirtualHosts host %#v is listed more than once", host)
+			}
+			seen[host] = true
+		}
+	}
+	return nil
+}
+
+// virtualHost is a config profile served for requests whose Host header
+// matches one of its hosts. Each profile runs as a separate UploadServer with
+// its own store, database, issuers and limits.
+type virtualHost struct {
+	hosts      []string
+	configPath string
+	loaded     *loadedConfig
+	adminToken *adminTokenStore
+}
+
+// loadVirtualHosts loads the config profiles listed in the main config.
+// Relative paths are resolved against the directory of the main config file.
+func (runCtx *RunContext) loadVirtualHosts(main *Config) ([]*virtualHost, error) {
+	var virtualHosts []*virtualHost
+	for _, virtualHostCfg := range main.VirtualHosts {
+		configPath := virtualHostCfg.Config
+		if !filepath.IsAbs(configPath) {
+			configPath = filepath.Join(filepath.Dir(runCtx.configPath), configPath)
+		}
+
+		loaded, err := runCtx.loadConfigFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("VirtualHosts profile %#v: %v", virtualHostCfg.Config, err)
+		}
+		if len(loaded.cfg.VirtualHosts) > 0 {
+			return nil, fmt.Errorf("VirtualHosts profile %#v must not define VirtualHosts itself", virtualHostCfg.Config)
+		}
+		if loaded.cfg.Audit.Endpoint != "" {
+			return nil, fmt.Errorf("VirtualHosts profile %#v must not set Audit.Endpoint, the audit export of the main config covers all hosts", virtualHostCfg.Config)
+		}
+
+		// like the main admin token, rotated tokens outlive a reload
+		adminToken, ok := runCtx.virtualHostAdminTokens[configPath]
+		if !ok {
+			adminToken = &adminTokenStore{}
+			runCtx.virtualHostAdminTokens[configPath] = adminToken
+		}
+
+		virtualHosts = append(virtualHosts, &virtualHost{
+			hosts:      virtualHostCfg.Hosts,
+			configPath: configPath,
+			loaded:     loaded,
+			adminToken: adminToken,
+		})
+	}
+
+	if err := checkSeparateStorage(main, virtualHosts); err != nil {
+		return nil, err
+	}
+	return virtualHosts, nil
+}
+
+// checkSeparateStorage makes sure that no two profiles share a storage path or
+// database, as each one expires and checks the uploads it finds there as its own
+func checkSeparateStorage(main *Config, virtualHosts []*virtualHost) error {
+	storagePaths := map[string]string{}
+	databases := map[string]string{}
+
+	check := func(name string, cfg *Config) error {
+		storagePath, _ := filepath.Abs(cfg.Storage.Path)
+		if other, ok := storagePaths[storagePath]; ok {
+			return fmt.Errorf("VirtualHosts profiles %s and %s must not share the Storage.Path %#v", other, name, cfg.Storage.Path)
+		}
+		storagePaths[storagePath] = name
+
+		database := cfg.Database.Type + ":" + cfg.Database.Path
+		if other, ok := databases[database]; ok {
+			return fmt.Errorf("VirtualHosts profiles %s and %s must not share the Database.Path %#v", other, name, cfg.Database.Path)
+		}
+		databases[database] = name
+		return nil
+	}
+
+	if err := check("main config", main); err != nil {
+		return err
+	}
+	for _, virtualHost := range virtualHosts {
+		if err := check(fmt.Sprintf("%#v", virtualHost.configPath), virtualHost.loaded.cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startVirtualHosts runs an UploadServer for every config profile without a
+// listener of its own and returns a handler dispatching requests by their
+// Host header. Requests for other hosts are handled by fallback, or rejected
+// if Server.RejectUnknownHosts is set.
+func (serv *UploadServer) startVirtualHosts(fallback http.Handler) (http.Handler, error) {
+	router := &virtualHostRouter{byHost: make(map[string]http.Handler)}
+	if !serv.cfg.Server.RejectUnknownHosts {
+		router.fallback = fallback
+	}
+
+	for _, virtualHost := range serv.virtualHosts {
+		log := serv.log.With().Str("virtualHost", virtualHost.hosts[0]).Logger()
+		virtualHost.adminToken.configure(virtualHost.loaded.adminToken)
+
+		child := &UploadServer{
+			cfg:         *virtualHost.loaded.cfg,
+			log:         &log,
+			adminToken:  virtualHost.adminToken,
+			uploadPause: serv.uploadPause,
+			jwtNonces:   serv.jwtNonces,
+			audit:       serv.audit,
+
+			countryResolvers: serv.countryResolvers,
+		}
+		handler := &ReplaceableHandler{}
+		if err := child.Run(handler); err != nil {
+			return nil, fmt.Errorf("VirtualHosts profile %#v: %v", virtualHost.configPath, err)
+		}
+		serv.virtualHostServers = append(serv.virtualHostServers, child)
+
+		for _, host := range virtualHost.hosts {
+			router.byHost[host] = handler
+		}
+		log.Info().
+			Str("event", "startup").
+			Strs("hosts", virtualHost.hosts).
+			Str("storagePath", child.cfg.Storage.Path).
+			Msg("Virtual host started")
+	}
+
+	return router, nil
+}
+
+// virtualHostRouter dispatches requests to the UploadServer of the config
+// profile matching their Host header
+type virtualHostRouter struct {
+	byHost   map[string]http.Handler
+	fallback http.Handler
+}
+
+func (router *virtualHostRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	host := strings.ToLower(req.Host)
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+
+	if handler, ok := router.byHost[host]; ok {
+		handler.ServeHTTP(w, req)
+		return
+	}
+	if router.fallback != nil {
+		router.fallback.ServeHTTP(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusMisdirectedRequest)
+	json.NewEncoder(w).Encode(gin.H{
+		"error": ErrorResponse{
+			Code:    "unknown_host",
+			Message: "This server does not serve uploads for the requested host",
+		},
+	})
+}
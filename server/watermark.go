@@ -0,0 +1,280 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/kiwiirc/plugin-fileuploader/events"
+	"github.com/tus/tusd"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// prefix of the name of the store variant holding the watermarked image, see
+// watermarker.variant
+const watermarkVariant = "watermark"
+
+// distance between the logo and the image edges
+const watermarkMargin = 10
+
+// text watermarks are scaled up to about this fraction of the image width
+const watermarkTextWidthFraction = 4
+
+// space around text watermarks on their darkened background
+const watermarkTextPadding = 2
+
+// how much of the file is read to determine the image type and dimensions
+const watermarkSniffSize = 64 * 1024
+
+// watermarker overlays a logo or a line of text on uploaded PNG and JPEG images
+type watermarker struct {
+	logo     image.Image
+	text     *image.RGBA // rendered at the size of the font, see renderWatermarkText
+	position string
+	opacity  float64
+
+	// hash of the logo file and the settings, which change the watermarked images
+	fingerprint []byte
+}
+
+// newWatermarker returns a watermarker for the logo at logoPath, or for text if
+// it is not empty
+func newWatermarker(logoPath string, text string, position string, opacity float64) (*watermarker, error) {
+	wm := &watermarker{
+		position: position,
+		opacity:  opacity,
+	}
+	h := sha256.New()
+
+	if text != "" {
+		wm.text = renderWatermarkText(text)
+		fmt.Fprintf(h, "text\x00%s", text)
+	} else {
+		data, err := ioutil.ReadFile(logoPath)
+		if err != nil {
+			return nil, err
+		}
+		wm.logo, _, err = image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode watermark logo %#v: %s", logoPath, err)
+		}
+		h.Write(data)
+	}
+
+	fmt.Fprintf(h, "\x00%s\x00%g", position, opacity)
+	wm.fingerprint = h.Sum(nil)
+	return wm, nil
+}
+
+// renderWatermarkText draws text in white on a darkened background, so it is
+// readable on light and dark images alike
+func renderWatermarkText(text string) *image.RGBA {
+	face := basicfont.Face7x13
+	width := font.MeasureString(face, text).Ceil()
+
+	img := image.NewRGBA(image.Rect(0, 0, width+2*watermarkTextPadding, face.Height+2*watermarkTextPadding))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{A: 128}), image.ZP, draw.Src)
+
+	drawer := font.Drawer{
+		Dst:  img,
+		Src:  image.White,
+		Face: face,
+		Dot:  fixed.P(watermarkTextPadding, watermarkTextPadding+face.Ascent),
+	}
+	drawer.DrawString(text)
+	return img
+}
+
+// scaleUp enlarges img by an integer factor without smoothing, which keeps
+// the pixels of the bitmap font sharp
+func scaleUp(img *image.RGBA, factor int) *image.RGBA {
+	if factor <= 1 {
+		return img
+	}
+	bounds := img.Bounds()
+	scaled := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*factor, bounds.Dy()*factor))
+	for y := 0; y < scaled.Rect.Dy(); y++ {
+		for x := 0; x < scaled.Rect.Dx(); x++ {
+			scaled.SetRGBA(x, y, img.RGBAAt(bounds.Min.X+x/factor, bounds.Min.Y+y/factor))
+		}
+	}
+	return scaled
+}
+
+// variant returns the name of the store variant holding the images
+// watermarked with this logo and settings. After they change, the variants
+// made with the previous ones are no longer used and new ones are generated.
+func (wm *watermarker) variant() string {
+	return watermarkVariant + "-" + hex.EncodeToString(wm.fingerprint)[:contentVersionLength]
+}
+
+// watermarkUpload is a post-finish processor that stores a watermarked variant
+// of image uploads
+func (serv *UploadServer) watermarkUpload(event *events.TusEvent) error {
+	return serv.generateWatermark(event.Info.ID)
+}
+
+// generateWatermark stores a watermarked variant of an image upload. For
+// uploads that are not PNG or JPEG images, or exceed the image limits, an empty
+// variant is stored to record that the original is served unchanged.
+func (serv *UploadServer) generateWatermark(id string) error {
+	watermarked, err := serv.watermarkImage(id)
+	if _, tooLarge := err.(*ImageTooLargeError); err != nil && !tooLarge {
+		return err
+	}
+	if watermarked == nil {
+		if writeErr := serv.store.WriteVariant(id, serv.watermarker.variant(), &bytes.Buffer{}); writeErr != nil {
+			return writeErr
+		}
+		return err
+	}
+
+	return serv.store.WriteVariant(id, serv.watermarker.variant(), watermarked)
+}
+
+// watermarkImage returns the encoded watermarked image, or nil if the upload is
+// not a PNG or JPEG image that can be watermarked
+func (serv *UploadServer) watermarkImage(id string) (*bytes.Buffer, error) {
+	reader, err := serv.store.GetReader(id)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	src := bufio.NewReaderSize(reader, watermarkSniffSize)
+	sniffed, _ := src.Peek(watermarkSniffSize)
+	contentType := http.DetectContentType(sniffed)
+	if contentType != "image/png" && contentType != "image/jpeg" {
+		return nil, nil
+	}
+
+	// dimensions must be known before decoding to bound memory use
+	imgConfig, _, err := image.DecodeConfig(bytes.NewReader(sniffed))
+	if err != nil {
+		return nil, nil
+	}
+	if err := serv.checkImageLimits(imgConfig); err != nil {
+		return nil, err
+	}
+
+	release := serv.acquireImageSlot()
+	defer release()
+
+	img, format, err := image.Decode(src)
+	if err != nil {
+		// not actually a decodable image, serve it unchanged
+		return nil, nil
+	}
+
+	var buf bytes.Buffer
+	watermarked := serv.watermarker.apply(img)
+	switch format {
+	case "png":
+		err = png.Encode(&buf, watermarked)
+	case "jpeg":
+		err = jpeg.Encode(&buf, watermarked, &jpeg.Options{Quality: 90})
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &buf, nil
+}
+
+// apply returns a copy of img with the logo or text drawn over it
+func (wm *watermarker) apply(img image.Image) image.Image {
+	bounds := img.Bounds()
+	dst := image.NewRGBA(bounds)
+	draw.Draw(dst, bounds, img, bounds.Min, draw.Src)
+
+	logo := wm.logo
+	if wm.text != nil {
+		logo = scaleUp(wm.text, bounds.Dx()/watermarkTextWidthFraction/wm.text.Rect.Dx())
+	}
+
+	logoBounds := logo.Bounds()
+	width, height := logoBounds.Dx(), logoBounds.Dy()
+
+	var origin image.Point
+	switch wm.position {
+	case "top-left":
+		origin = image.Pt(bounds.Min.X+watermarkMargin, bounds.Min.Y+watermarkMargin)
+	case "top-right":
+		origin = image.Pt(bounds.Max.X-watermarkMargin-width, bounds.Min.Y+watermarkMargin)
+	case "bottom-left":
+		origin = image.Pt(bounds.Min.X+watermarkMargin, bounds.Max.Y-watermarkMargin-height)
+	case "center":
+		origin = image.Pt(bounds.Min.X+(bounds.Dx()-width)/2, bounds.Min.Y+(bounds.Dy()-height)/2)
+	default: // bottom-right
+		origin = image.Pt(bounds.Max.X-watermarkMargin-width, bounds.Max.Y-watermarkMargin-height)
+	}
+
+	mask := image.NewUniform(color.Alpha{A: uint8(wm.opacity * 255)})
+	target := image.Rectangle{Min: origin, Max: origin.Add(image.Pt(width, height))}
+	draw.DrawMask(dst, target, logo, logoBounds.Min, mask, image.ZP, draw.Over)
+
+	return dst
+}
+
+// serveWatermarked sends the watermarked variant of an upload. A missing
+// variant, e.g. after the variants directory was cleared, is generated first.
+// Returns false if the original should be served instead.
+func (serv *UploadServer) serveWatermarked(w http.ResponseWriter, req *http.Request, info tusd.FileInfo) (served bool) {
+	id := info.ID
+	if !isUploadComplete(info) {
+		return false
+	}
+
+	variant, err := serv.store.GetVariantReader(id, serv.watermarker.variant())
+	if os.IsNotExist(err) {
+		if err := serv.generateWatermark(id); err != nil {
+			serv.requestLog(req).Error().
+				Err(err).
+				Str("id", id).
+				Msg("Failed to generate watermarked variant")
+		}
+		variant, err = serv.store.GetVariantReader(id, serv.watermarker.variant())
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			serv.requestLog(req).Error().
+				Err(err).
+				Str("id", id).
+				Msg("Failed to open watermarked variant")
+		}
+		return false
+	}
+	defer variant.Close()
+
+	stat, err := variant.Stat()
+	if err != nil || stat.Size() == 0 {
+		// an empty variant means the upload is not watermarked
+		return false
+	}
+
+	sniffed := make([]byte, 512)
+	n, _ := io.ReadFull(variant, sniffed)
+	if _, err := variant.Seek(0, io.SeekStart); err != nil {
+		return false
+	}
+
+	serv.serveDownload(w, req, info, http.DetectContentType(sniffed[:n]), "-"+watermarkVariant, variant)
+	return true
+}
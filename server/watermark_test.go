@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// encodeTestPNG returns a PNG image of the given size filled with c
+func encodeTestPNG(t *testing.T, size int, c color.Color) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestContentVersionIncludesWatermark(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fileuploader-logo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	logoPath := filepath.Join(dir, "logo.png")
+	if err := ioutil.WriteFile(logoPath, encodeTestPNG(t, 4, color.RGBA{R: 255, A: 255}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	content := string(encodeTestPNG(t, 40, color.White))
+	contentHash := sha256.Sum256([]byte(content))
+	plainVersion := hex.EncodeToString(contentHash[:])[:contentVersionLength]
+
+	type download struct {
+		version string
+		etag    string
+		body    string
+	}
+	// roundTrip uploads the image to a server with the given watermark settings
+	// and downloads it again
+	roundTrip := func(enabled bool, opacity float64) download {
+		t.Helper()
+
+		ts := newTestServer(t, func(cfg *Config) {
+			cfg.Watermark.Enabled = enabled
+			cfg.Watermark.LogoPath = logoPath
+			cfg.Watermark.Position = "bottom-right"
+			cfg.Watermark.Opacity = opacity
+		})
+		defer ts.Close()
+
+		uploadURL := ts.upload(content, map[string]string{"filename": "image.png"})
+		resp, body := ts.get(uploadURL)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		return download{ts.contentVersion(uploadID(uploadURL)), resp.Header.Get("ETag"), body}
+	}
+
+	plain := roundTrip(false, 0.5)
+	half := roundTrip(true, 0.5)
+	halfAgain := roundTrip(true, 0.5)
+	opaque := roundTrip(true, 1)
+
+	if plain.version != plainVersion || plain.body != content {
+		t.Fatalf("Expected the original with version %q without watermarking, got version %q", plainVersion, plain.version)
+	}
+	if half.version != halfAgain.version || half.etag != halfAgain.etag || half.body != halfAgain.body {
+		t.Fatal("Expected the same version and image for the same watermark settings")
+	}
+	if half.body == content || opaque.body == half.body {
+		t.Fatal("Expected a differently watermarked image for each watermark setting")
+	}
+
+	versions := map[string]bool{plain.version: true, half.version: true, opaque.version: true}
+	if len(versions) != 3 {
+		t.Fatalf("Expected a different version for each watermark setting, got %q, %q and %q", plain.version, half.version, opaque.version)
+	}
+	for _, d := range []download{plain, half, opaque} {
+		if !strings.HasPrefix(d.etag, `"`+d.version) {
+			t.Fatalf("Expected the ETag %s to start with the version %q", d.etag, d.version)
+		}
+	}
+}
+
+func TestTextWatermark(t *testing.T) {
+	content := string(encodeTestPNG(t, 1000, color.White))
+
+	// roundTrip uploads the image to a server watermarking it with text and
+	// returns the version and downloaded image
+	roundTrip := func(text string) (string, image.Image) {
+		t.Helper()
+
+		ts := newTestServer(t, func(cfg *Config) {
+			cfg.Watermark.Enabled = true
+			cfg.Watermark.Text = text
+			cfg.Watermark.Position = "bottom-right"
+			cfg.Watermark.Opacity = 1
+		})
+		defer ts.Close()
+
+		uploadURL := ts.upload(content, map[string]string{"filename": "image.png"})
+		resp, body := ts.get(uploadURL)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		img, err := png.Decode(strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Expected a PNG image: %v", err)
+		}
+		return ts.contentVersion(uploadID(uploadURL)), img
+	}
+
+	version, img := roundTrip("kiwiirc")
+	otherVersion, _ := roundTrip("example")
+	if version == otherVersion {
+		t.Fatal("Expected a different version for a different watermark text")
+	}
+
+	// the text is enlarged to about a quarter of the width, on a darkened
+	// background in the bottom right corner, and leaves the rest untouched
+	corner := img.At(1000-watermarkMargin-1, 1000-watermarkMargin-1)
+	if r, g, b, _ := corner.RGBA(); r == 0xffff && g == 0xffff && b == 0xffff {
+		t.Fatal("Expected the bottom right corner to be watermarked")
+	}
+	if r, g, b, _ := img.At(1000-watermarkMargin-150, 1000-watermarkMargin-1).RGBA(); r == 0xffff && g == 0xffff && b == 0xffff {
+		t.Fatal("Expected the text to be enlarged")
+	}
+	if r, g, b, _ := img.At(10, 10).RGBA(); r != 0xffff || g != 0xffff || b != 0xffff {
+		t.Fatal("Expected the rest of the image to be unchanged")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package shardedfilestore
+
+import "syscall"
+
+func isCrossDeviceError(err error) bool {
+	return err == syscall.EXDEV
+}
@@ -0,0 +1,10 @@
+package shardedfilestore
+
+import "syscall"
+
+// ERROR_NOT_SAME_DEVICE
+const errorNotSameDevice syscall.Errno = 17
+
+func isCrossDeviceError(err error) bool {
+	return err == errorNotSameDevice
+}
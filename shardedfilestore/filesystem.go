@@ -0,0 +1,46 @@
+package shardedfilestore
+
+import (
+	"sync"
+
+	"github.com/spf13/afero"
+	"github.com/tus/tusd"
+)
+
+// MemoryPath is the BasePath of a store that keeps its files in memory instead
+// of on disk, e.g. for tests. All such stores in the process share the same
+// files, which last until the process exits, like an in-memory database.
+const MemoryPath = ":memory:"
+
+var (
+	osFs     = afero.NewOsFs()
+	memoryFs = afero.NewMemMapFs()
+)
+
+// fs returns the filesystem the files of the store are kept in
+func (store *ShardedFileStore) fs() afero.Fs {
+	if store.InMemory() {
+		return memoryFs
+	}
+	return osFs
+}
+
+// InMemory reports whether the store keeps its files in memory, see MemoryPath
+func (store *ShardedFileStore) InMemory() bool {
+	return store.BasePath == MemoryPath
+}
+
+// memoryLocks holds the locks of uploads in a store kept in memory, which has
+// no lockfiles. Like those, they are shared by all stores in the process.
+var memoryLocks sync.Map
+
+func lockInMemory(path string) error {
+	if _, locked := memoryLocks.LoadOrStore(path, struct{}{}); locked {
+		return tusd.ErrFileLocked
+	}
+	return nil
+}
+
+func unlockInMemory(path string) {
+	memoryLocks.Delete(path)
+}
@@ -0,0 +1,150 @@
+package shardedfilestore
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// files and records younger than this are skipped by Fsck, as they may belong
+// to an upload that is being created right now
+const fsckGracePeriod = 10 * time.Minute
+
+// FsckReport lists the inconsistencies between the files on disk and the
+// uploads table found by Fsck
+type FsckReport struct {
+	// files, relative to BasePath, that no live upload record refers to.
+	// Variants and tiers stored outside of BasePath have a relative path starting with "..".
+	OrphanedFiles []string `json:"orphanedFiles"`
+	// ids of live upload records whose files are missing
+	DanglingRecords []string `json:"danglingRecords"`
+	// whether the inconsistencies were repaired
+	Repaired bool `json:"repaired"`
+}
+
+type fsckRecord struct {
+	ID        string         `db:"id"`
+	Sha256sum []byte         `db:"sha256sum"`
+	Tier      sql.NullString `db:"tier"`
+	CreatedAt int64          `db:"created_at"`
+}
+
+// Fsck checks that every file in the store belongs to a live upload record and
+// every live upload record has its files. Only a report is produced unless
+// repair is set, in which case orphaned files are deleted and dangling records
+// are removed the same way Terminate removes them.
+func (store *ShardedFileStore) Fsck(repair bool) (*FsckReport, error) {
+	report := &FsckReport{
+		OrphanedFiles:   []string{},
+		DanglingRecords: []string{},
+		Repaired:        repair,
+	}
+	cutoff := time.Now().Add(-fsckGracePeriod)
+
+	var records []fsckRecord
+	err := store.DBConn.DB.Select(&records, `SELECT id, sha256sum, tier, created_at FROM uploads WHERE deleted = 0`)
+	if err != nil {
+		return nil, err
+	}
+
+	liveIDs := make(map[string]struct{}, len(records))
+	liveHashes := make(map[string]struct{}, len(records))
+	for _, record := range records {
+		liveIDs[record.ID] = struct{}{}
+		if record.Sha256sum != nil {
+			liveHashes[fmt.Sprintf("%x", record.Sha256sum)] = struct{}{}
+		}
+	}
+
+	// files on disk without a live record
+	isOrphan := func(dir string, name string) bool {
+		switch dir {
+		case "complete":
+			_, live := liveHashes[strings.TrimSuffix(name, ".bin")]
+			return !live
+		case "incomplete":
+			_, live := liveIDs[strings.TrimSuffix(name, ".bin")]
+			return !live
+		default:
+			// meta and variants: <id>.info, <id>.lock and <id>.<name>.variant
+			_, live := liveIDs[strings.SplitN(name, ".", 2)[0]]
+			return !live
+		}
+	}
+
+	// directories to check, with the root that emptied parent directories are removed up to
+	type fsckDir struct {
+		kind string
+		path string
+		root string
+	}
+	dirs := []fsckDir{
+		{"complete", filepath.Join(store.BasePath, "complete"), store.BasePath},
+		{"incomplete", filepath.Join(store.BasePath, "incomplete"), store.BasePath},
+		{"meta", filepath.Join(store.BasePath, "meta"), store.BasePath},
+	}
+	if store.VariantsPath != "" {
+		dirs = append(dirs, fsckDir{"variants", store.VariantsPath, store.VariantsPath})
+	}
+	for _, tierRoot := range store.Tiers {
+		dirs = append(dirs, fsckDir{"complete", filepath.Join(tierRoot, "complete"), tierRoot})
+	}
+
+	for _, dir := range dirs {
+		err := afero.Walk(store.fs(), dir.path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if info.IsDir() || info.ModTime().After(cutoff) || !isOrphan(dir.kind, info.Name()) {
+				return nil
+			}
+
+			rel, _ := filepath.Rel(store.BasePath, path)
+			report.OrphanedFiles = append(report.OrphanedFiles, rel)
+			if repair {
+				return removeWithDirs(store.fs(), path, dir.root)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// live records without their files
+	for _, record := range records {
+		if time.Unix(record.CreatedAt, 0).After(cutoff) {
+			continue
+		}
+
+		binPath := store.incompleteBinPath(record.ID)
+		if record.Sha256sum != nil {
+			binPath = store.completeBinPath(store.tierRoot(record.Tier.String), record.Sha256sum)
+		}
+		if store.fileExists(store.infoPath(record.ID)) && store.fileExists(binPath) {
+			continue
+		}
+
+		report.DanglingRecords = append(report.DanglingRecords, record.ID)
+		if repair {
+			if err := store.removeRecord(record.ID, DeletedReasonMissing); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return report, nil
+}
+
+func (store *ShardedFileStore) fileExists(path string) bool {
+	_, err := store.fs().Stat(path)
+	return err == nil
+}
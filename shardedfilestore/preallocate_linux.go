@@ -0,0 +1,20 @@
+package shardedfilestore
+
+import (
+	"os"
+	"syscall"
+)
+
+// FALLOC_FL_KEEP_SIZE from linux/falloc.h
+const fallocKeepSize = 0x01
+
+// preallocate reserves disk space for size bytes of file without changing
+// its apparent size, which GetInfo reports as the upload offset. Filesystems
+// without fallocate support are skipped.
+func preallocate(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), fallocKeepSize, 0, size)
+	if err == syscall.EOPNOTSUPP {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package shardedfilestore
+
+import "os"
+
+// preallocate is only supported on linux
+func preallocate(file *os.File, size int64) error {
+	return nil
+}
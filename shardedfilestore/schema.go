@@ -71,6 +71,158 @@ func (store *ShardedFileStore) initDB() {
 					`ALTER TABLE new_uploads RENAME TO uploads;`,
 				},
 			},
+			{
+				Id: "5",
+				Up: []string{
+					`
+					CREATE TABLE new_uploads(
+						id VARCHAR(128) PRIMARY KEY,
+						uploader_ip VARCHAR(45),
+						sha256sum BLOB,
+						created_at INTEGER(8),
+						deleted INTEGER(1) DEFAULT 0 NOT NULL,
+						jwt_account TEXT,
+						jwt_issuer TEXT
+					);`,
+					`
+					INSERT INTO new_uploads(id, uploader_ip, sha256sum, created_at, deleted, jwt_account, jwt_issuer)
+						SELECT id, uploader_ip, sha256sum, created_at, deleted, jwt_account, jwt_issuer
+						FROM uploads
+					;`,
+					`DROP TABLE uploads;`,
+					`ALTER TABLE new_uploads RENAME TO uploads;`,
+				},
+			},
+			{
+				Id: "6",
+				Up: []string{
+					`CREATE INDEX uploads_deleted_created_at ON uploads(deleted, created_at);`,
+				},
+			},
+			{
+				Id: "7",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD metadata TEXT
+					;`,
+				},
+			},
+			{
+				Id: "8",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD approved INTEGER(1) DEFAULT 1 NOT NULL
+					;`,
+				},
+			},
+			{
+				Id: "9",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD size INTEGER(8)
+					;`,
+				},
+			},
+			{
+				Id: "10",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD tier VARCHAR(64)
+					;`,
+				},
+			},
+			{
+				Id: "11",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD deleted_reason VARCHAR(32)
+					;`,
+				},
+			},
+			{
+				Id: "12",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD downloaded_bytes INTEGER(8) DEFAULT 0 NOT NULL
+					;`,
+				},
+			},
+			{
+				Id: "13",
+				Up: []string{
+					`
+					CREATE TABLE tombstones(
+						id VARCHAR(128) NOT NULL,
+						sha256sum BLOB,
+						size INTEGER(8),
+						jwt_account TEXT,
+						jwt_issuer TEXT,
+						reason VARCHAR(32),
+						created_at INTEGER(8),
+						deleted_at INTEGER(8)
+					);`,
+					`CREATE INDEX tombstones_id ON tombstones(id);`,
+					`CREATE INDEX tombstones_created_at ON tombstones(created_at);`,
+				},
+				Down: []string{"DROP TABLE tombstones;"},
+			},
+			{
+				Id: "14",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD corrupt INTEGER(1) DEFAULT 0 NOT NULL
+					;`,
+				},
+			},
+			{
+				Id: "15",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD country VARCHAR(2)
+					;`,
+				},
+			},
+			{
+				Id: "16",
+				Up: []string{
+					`
+					CREATE TABLE admin_actions(
+						action VARCHAR(32) NOT NULL,
+						upload_id VARCHAR(128),
+						remote_ip VARCHAR(45),
+						status INTEGER,
+						created_at INTEGER(8)
+					);`,
+					`CREATE INDEX admin_actions_created_at ON admin_actions(created_at);`,
+				},
+				Down: []string{"DROP TABLE admin_actions;"},
+			},
+			{
+				Id: "17",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD content_category VARCHAR(32)
+					;`,
+				},
+			},
+			{
+				Id: "18",
+				Up: []string{
+					`
+					ALTER TABLE uploads
+						ADD upload_length INTEGER(8)
+					;`,
+				},
+			},
 		},
 	}
 
@@ -7,22 +7,33 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql" // register mysql driver
 	"github.com/kiwiirc/plugin-fileuploader/db"
 	_ "github.com/mattn/go-sqlite3" // register SQL driver
 	"github.com/rs/zerolog"
+	"github.com/spf13/afero"
 	lockfile "gopkg.in/Acconut/lockfile.v1"
 
 	"github.com/tus/tusd"
-	"github.com/tus/tusd/uid"
+)
+
+// Reasons recorded in the deleted_reason column of a removed upload
+const (
+	DeletedReasonTerminated = "terminated" // terminated by the client
+	DeletedReasonExpired    = "expired"    // removed by the expirer
+	DeletedReasonRejected   = "rejected"   // rejected by the server, e.g. for exceeding a limit
+	DeletedReasonMissing    = "missing"    // files found missing by fsck
+	DeletedReasonEvicted    = "evicted"    // removed to make room for new uploads
 )
 
 var defaultFilePerm = os.FileMode(0664)
@@ -35,11 +46,69 @@ type ShardedFileStore struct {
 	PrefixShardLayers int    // Number of extra directory layers to prefix file paths with.
 	DBConn            *db.DatabaseConnection
 	log               *zerolog.Logger
+
+	// HardDeleteTerminated removes the uploads row of a terminated upload
+	// instead of marking it as deleted.
+	HardDeleteTerminated bool
+
+	// KeepTombstones records every removed upload in the tombstones table,
+	// which is kept even when HardDeleteTerminated removes the uploads row.
+	KeepTombstones bool
+
+	// VariantsPath is the directory variants are stored in. When empty, they
+	// are stored next to the .info files in BasePath.
+	VariantsPath string
+
+	// IDBits is the entropy of newly generated upload IDs, a multiple of 8
+	// between MinIDBits and MaxIDBits. Defaults to DefaultIDBits when zero.
+	IDBits int
+
+	// HoldNewUploads creates uploads as not approved, so they are not served
+	// until approved by a moderator.
+	HoldNewUploads bool
+
+	// PreallocateSpace reserves the disk space for the declared length of new
+	// uploads, so writing them can't fail because the disk filled up. Only
+	// supported on linux.
+	PreallocateSpace bool
+
+	// Tiers maps the names of additional storage roots to their paths.
+	// ChooseTier picks the tier a finished upload is moved to, "" for BasePath.
+	Tiers      map[string]string
+	ChooseTier func(info tusd.FileInfo) string
+
+	// FileMode and DirMode are the permissions of new files and directories.
+	// The defaults are 0664 and 0775 when zero.
+	FileMode os.FileMode
+	DirMode  os.FileMode
+
+	// OnCreated is called with the ID and info of a new upload right after its
+	// record was stored.
+	OnCreated func(id string, info tusd.FileInfo)
+
+	// OnRemoved is called with the ID and one of the DeletedReason constants
+	// after the record of an upload was removed.
+	OnRemoved func(id string, reason string)
+}
+
+func (store *ShardedFileStore) fileMode() os.FileMode {
+	if store.FileMode != 0 {
+		return store.FileMode
+	}
+	return defaultFilePerm
+}
+
+func (store *ShardedFileStore) dirMode() os.FileMode {
+	if store.DirMode != 0 {
+		return store.DirMode
+	}
+	return defaultDirectoryPerm
 }
 
 // New creates a new file based storage backend. The directory specified will
-// be used as the only storage entry. This method does not check
-// whether the path exists, use os.MkdirAll to ensure.
+// be used as the only storage entry, or MemoryPath to keep the files in
+// memory. This method does not check whether the path exists, use
+// os.MkdirAll to ensure.
 // In addition, a locking mechanism is provided.
 func New(basePath string, prefixShardLayers int, dbConnection *db.DatabaseConnection, log *zerolog.Logger) *ShardedFileStore {
 
@@ -70,46 +139,72 @@ func (store *ShardedFileStore) UseIn(composer *tusd.StoreComposer) {
 }
 
 func (store *ShardedFileStore) NewUpload(info tusd.FileInfo) (id string, err error) {
-	id = uid.Uid()
+	id, err = store.newID()
+	if err != nil {
+		return "", err
+	}
 	info.ID = id
 
 	// Create the directory stucture if needed
-	err = os.MkdirAll(store.metaDir(id), defaultDirectoryPerm)
+	err = store.fs().MkdirAll(store.metaDir(id), store.dirMode())
 	if err != nil {
 		return "", err
 	}
-	err = os.MkdirAll(store.incompleteBinDir(), defaultDirectoryPerm)
+	err = store.fs().MkdirAll(store.incompleteBinDir(), store.dirMode())
 	if err != nil {
 		return "", err
 	}
 
 	// create record in uploads table
+	// the uploader ip and declared length are stored right away, as limits on
+	// incomplete uploads count rows by them
+	approved := !store.HoldNewUploads
+	uploaderIP := sql.NullString{String: info.MetaData["RemoteIP"], Valid: info.MetaData["RemoteIP"] != ""}
+	uploadLength := sql.NullInt64{Int64: info.Size, Valid: !info.SizeIsDeferred}
 	if info.MetaData["account"] == "" {
-		err = db.UpdateRow(store.DBConn.DB, `INSERT INTO uploads(id, created_at) VALUES (?, ?)`, id, time.Now().Unix())
+		err = db.UpdateRow(store.DBConn.DB,
+			`INSERT INTO uploads(id, created_at, uploader_ip, upload_length, approved) VALUES (?, ?, ?, ?, ?)`,
+			id, time.Now().Unix(), uploaderIP, uploadLength, approved,
+		)
 	} else {
 		err = db.UpdateRow(store.DBConn.DB,
-			`INSERT INTO uploads(id, created_at, jwt_account, jwt_issuer) VALUES (?, ?, ?, ?)`,
-			id, time.Now().Unix(), info.MetaData["account"], info.MetaData["issuer"],
+			`INSERT INTO uploads(id, created_at, uploader_ip, upload_length, jwt_account, jwt_issuer, approved) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			id, time.Now().Unix(), uploaderIP, uploadLength, info.MetaData["account"], info.MetaData["issuer"], approved,
 		)
 	}
 	if err != nil {
 		return "", err
 	}
+	if store.OnCreated != nil {
+		store.OnCreated(id, info)
+	}
 
 	// Create .bin file with no content
-	file, err := os.OpenFile(store.binPath(id), os.O_CREATE|os.O_WRONLY, defaultFilePerm)
+	file, err := store.fs().OpenFile(store.binPath(id), os.O_CREATE|os.O_WRONLY, store.fileMode())
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
+	// files kept in memory take no disk space
+	if osFile, ok := file.(*os.File); ok && store.PreallocateSpace && !info.SizeIsDeferred && info.Size > 0 {
+		if err := preallocate(osFile, info.Size); err != nil {
+			store.fs().Remove(store.binPath(id))
+			store.removeRecord(id, DeletedReasonRejected)
+			if err == syscall.ENOSPC {
+				return "", tusd.NewHTTPError(errors.New("insufficient storage"), http.StatusInsufficientStorage)
+			}
+			return "", err
+		}
+	}
+
 	// writeInfo creates the file by itself if necessary
 	err = store.writeInfo(id, info)
 	return
 }
 
 func (store *ShardedFileStore) WriteChunk(id string, offset int64, src io.Reader) (int64, error) {
-	file, err := os.OpenFile(store.binPath(id), os.O_WRONLY|os.O_APPEND, defaultFilePerm)
+	file, err := store.fs().OpenFile(store.binPath(id), os.O_WRONLY|os.O_APPEND, store.fileMode())
 	if err != nil {
 		return 0, err
 	}
@@ -121,7 +216,7 @@ func (store *ShardedFileStore) WriteChunk(id string, offset int64, src io.Reader
 
 func (store *ShardedFileStore) GetInfo(id string) (tusd.FileInfo, error) {
 	info := tusd.FileInfo{}
-	data, err := ioutil.ReadFile(store.infoPath(id))
+	data, err := afero.ReadFile(store.fs(), store.infoPath(id))
 	if err != nil {
 		return info, err
 	}
@@ -129,7 +224,7 @@ func (store *ShardedFileStore) GetInfo(id string) (tusd.FileInfo, error) {
 		return info, err
 	}
 
-	stat, err := os.Stat(store.binPath(id))
+	stat, err := store.fs().Stat(store.binPath(id))
 	if err != nil {
 		return info, err
 	}
@@ -140,12 +235,12 @@ func (store *ShardedFileStore) GetInfo(id string) (tusd.FileInfo, error) {
 }
 
 func (store *ShardedFileStore) GetReader(id string) (io.Reader, error) {
-	return os.Open(store.binPath(id))
+	return store.fs().Open(store.binPath(id))
 }
 
 func (store *ShardedFileStore) getDuplicateCount(id string) (duplicates int, err error) {
 	// fetch hash
-	hash, _, err := store.lookupHash(id)
+	hash, _, _, err := store.lookupHash(id)
 	if err != nil {
 		return
 	}
@@ -165,7 +260,12 @@ func (store *ShardedFileStore) getDuplicateCount(id string) (duplicates int, err
 
 // RemoveWithDirs deletes the given path and its empty parent directories
 // up to the given basePath
-func RemoveWithDirs(path string, basePath string) (err error) {
+func RemoveWithDirs(path string, basePath string) error {
+	return removeWithDirs(osFs, path, basePath)
+}
+
+// removeWithDirs is RemoveWithDirs on the given filesystem
+func removeWithDirs(fs afero.Fs, path string, basePath string) (err error) {
 	absBase, err := filepath.Abs(basePath)
 	if err != nil {
 		return
@@ -180,8 +280,8 @@ func RemoveWithDirs(path string, basePath string) (err error) {
 		return fmt.Errorf("Path %#v is not prefixed by basepath %#v", path, basePath)
 	}
 
-	if _, err := os.Stat(path); err == nil {
-		err = os.Remove(path)
+	if _, err := fs.Stat(path); err == nil {
+		err = fs.Remove(path)
 	} else if os.IsNotExist(err) {
 		return nil
 	}
@@ -200,9 +300,9 @@ func RemoveWithDirs(path string, basePath string) (err error) {
 			return err
 		}
 
-		empty, err := isDirEmpty(parent);
+		empty, err := isDirEmpty(fs, parent);
 		if empty {
-			err = os.Remove(parent)
+			err = fs.Remove(parent)
 		}
 		if err != nil {
 			return err
@@ -210,22 +310,34 @@ func RemoveWithDirs(path string, basePath string) (err error) {
 	}
 }
 
+// Terminate removes an upload terminated by the client
 func (store *ShardedFileStore) Terminate(id string) error {
+	return store.TerminateWithReason(id, DeletedReasonTerminated)
+}
+
+// TerminateWithReason removes an upload, recording one of the DeletedReason
+// constants as the reason in its uploads row
+func (store *ShardedFileStore) TerminateWithReason(id string, reason string) error {
 	duplicates, err := store.getDuplicateCount(id)
 	if err != nil {
 		return err
 	}
 
-	binPath := store.binPath(id)
+	binPath, binRoot := store.binLocation(id)
+
+	// remove derived variants before the .info file so the directory can be cleaned up
+	if err := store.removeVariants(id); err != nil {
+		return err
+	}
 
 	// remove upload .info file
-	if err := RemoveWithDirs(store.infoPath(id), store.BasePath); err != nil {
+	if err := removeWithDirs(store.fs(), store.infoPath(id), store.BasePath); err != nil {
 		return err
 	}
 
 	// delete .bin if there are no other upload records using it
 	if duplicates == 0 {
-		if err := RemoveWithDirs(binPath, store.BasePath); err != nil {
+		if err := removeWithDirs(store.fs(), binPath, binRoot); err != nil {
 			return err
 		}
 		store.log.Info().
@@ -234,21 +346,52 @@ func (store *ShardedFileStore) Terminate(id string) error {
 			Msg("Removed upload bin")
 	}
 
+	return store.removeRecord(id, reason)
+}
+
+// removeRecord deletes or marks as deleted the uploads row of an upload,
+// depending on HardDeleteTerminated, after writing its tombstone if
+// KeepTombstones is set
+func (store *ShardedFileStore) removeRecord(id string, reason string) (err error) {
+	if store.OnRemoved != nil {
+		defer func() {
+			if err == nil {
+				store.OnRemoved(id, reason)
+			}
+		}()
+	}
+
+	if store.KeepTombstones {
+		// rows already marked as deleted have their tombstone
+		_, err := store.DBConn.DB.Exec(`
+			INSERT INTO tombstones(id, sha256sum, size, jwt_account, jwt_issuer, reason, created_at, deleted_at)
+			SELECT id, sha256sum, size, jwt_account, jwt_issuer, ?, created_at, ?
+			FROM uploads
+			WHERE id = ? AND deleted = 0
+		`, reason, time.Now().Unix(), id)
+		if err != nil {
+			return err
+		}
+	}
+
+	if store.HardDeleteTerminated {
+		// remove upload db record
+		return db.UpdateRow(store.DBConn.DB, `
+			DELETE FROM uploads
+			WHERE id = ?
+		`, id)
+	}
+
 	// mark upload db record as deleted
-	err = db.UpdateRow(store.DBConn.DB, `
+	return db.UpdateRow(store.DBConn.DB, `
 		UPDATE uploads
-		SET deleted = 1
+		SET deleted = 1, deleted_reason = ?
 		WHERE id = ?
-	`, id)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	`, reason, id)
 }
 
 func (store *ShardedFileStore) ConcatUploads(dest string, uploads []string) (err error) {
-	file, err := os.OpenFile(store.binPath(dest), os.O_WRONLY|os.O_APPEND, defaultFilePerm)
+	file, err := store.fs().OpenFile(store.binPath(dest), os.O_WRONLY|os.O_APPEND, store.fileMode())
 	if err != nil {
 		return err
 	}
@@ -269,6 +412,10 @@ func (store *ShardedFileStore) ConcatUploads(dest string, uploads []string) (err
 }
 
 func (store *ShardedFileStore) LockUpload(id string) error {
+	if store.InMemory() {
+		return lockInMemory(store.lockPath(id))
+	}
+
 	lock, err := store.newLock(id)
 	if err != nil {
 		return err
@@ -283,6 +430,11 @@ func (store *ShardedFileStore) LockUpload(id string) error {
 }
 
 func (store *ShardedFileStore) UnlockUpload(id string) error {
+	if store.InMemory() {
+		unlockInMemory(store.lockPath(id))
+		return nil
+	}
+
 	lock, err := store.newLock(id)
 	if err != nil {
 		return err
@@ -315,9 +467,11 @@ func (store *ShardedFileStore) newLock(id string) (lockfile.Lockfile, error) {
 
 // lookupHash translates a randomly generated upload id into its cryptographic
 // hash by querying the upload database.
-func (store *ShardedFileStore) lookupHash(id string) (hash []byte, isFinal bool, err error) {
-	row := store.DBConn.DB.QueryRow(`SELECT sha256sum FROM uploads WHERE id = ?`, id)
-	err = row.Scan(&hash)
+func (store *ShardedFileStore) lookupHash(id string) (hash []byte, tier string, isFinal bool, err error) {
+	var tierName sql.NullString
+	row := store.DBConn.DB.QueryRow(`SELECT sha256sum, tier FROM uploads WHERE id = ?`, id)
+	err = row.Scan(&hash, &tierName)
+	tier = tierName.String
 
 	// no finalized upload exists
 	if err == sql.ErrNoRows {
@@ -356,25 +510,33 @@ func (store *ShardedFileStore) incompleteBinPath(id string) string {
 	return filepath.Join(store.incompleteBinDir(), id+".bin")
 }
 
-func (store ShardedFileStore) completeBinPath(hashBytes []byte) string {
-	// finished: <base-path>/complete/<hash-shards>/<hash>.bin
+func (store ShardedFileStore) completeBinPath(root string, hashBytes []byte) string {
+	// finished: <tier-root>/complete/<hash-shards>/<hash>.bin
 	hash := fmt.Sprintf("%x", hashBytes)
 	shards := store.shards(hash)
-	return filepath.Join(store.BasePath, "complete", shards, hash+".bin")
+	return filepath.Join(root, "complete", shards, hash+".bin")
 }
 
 // binPath returns the path to the .bin storing the binary data.
 func (store *ShardedFileStore) binPath(id string) string {
-	hashBytes, isFinal, err := store.lookupHash(id)
+	path, _ := store.binLocation(id)
+	return path
+}
+
+// binLocation returns the path to the .bin storing the binary data and the
+// storage root it resides in
+func (store *ShardedFileStore) binLocation(id string) (path string, root string) {
+	hashBytes, tier, isFinal, err := store.lookupHash(id)
 	if err != nil {
 		store.log.Fatal().Err(err).Msg("Could not look up hash")
 	}
 
 	if !isFinal {
-		return store.incompleteBinPath(id)
+		return store.incompleteBinPath(id), store.BasePath
 	}
 
-	return store.completeBinPath(hashBytes)
+	root = store.tierRoot(tier)
+	return store.completeBinPath(root, hashBytes), root
 }
 
 // metaDir returns the directory that the info and lock files reside in for a given id
@@ -402,7 +564,7 @@ func (store *ShardedFileStore) writeInfo(id string, info tusd.FileInfo) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(store.infoPath(id), data, defaultFilePerm)
+	return afero.WriteFile(store.fs(), store.infoPath(id), data, store.fileMode())
 }
 
 // FinishUpload deduplicates the upload by its cryptographic hash
@@ -417,21 +579,31 @@ func (store *ShardedFileStore) FinishUpload(id string) error {
 		return err
 	}
 
-	// update hash in uploads table
+	binInfo, err := store.fs().Stat(store.incompleteBinPath(id))
+	if err != nil {
+		return err
+	}
+
+	tier, err := store.finishTier(id, hash)
+	if err != nil {
+		return err
+	}
+
+	// update hash, size and tier in uploads table
 	err = db.UpdateRow(store.DBConn.DB, `
 		UPDATE uploads
-		SET sha256sum = ?
+		SET sha256sum = ?, size = ?, tier = ?
 		WHERE id = ?
-	`, hash, id)
+	`, hash, binInfo.Size(), sql.NullString{String: tier, Valid: tier != ""}, id)
 	if err != nil {
 		return err
 	}
 
 	// relocate file
-	newPath := store.completeBinPath(hash)
-	os.MkdirAll(filepath.Dir(newPath), defaultDirectoryPerm)
+	newPath := store.completeBinPath(store.tierRoot(tier), hash)
+	store.fs().MkdirAll(filepath.Dir(newPath), store.dirMode())
 	oldPath := store.incompleteBinPath(id)
-	err = os.Rename(oldPath, newPath)
+	err = moveFile(store.fs(), oldPath, newPath, store.fileMode())
 	if err != nil {
 		store.log.Error().
 			Err(err).
@@ -443,7 +615,7 @@ func (store *ShardedFileStore) FinishUpload(id string) error {
 }
 
 func (store *ShardedFileStore) hashFile(id string) ([]byte, error) {
-	f, err := os.Open(store.binPath(id))
+	f, err := store.fs().Open(store.binPath(id))
 	if err != nil {
 		return nil, err
 	}
@@ -457,8 +629,31 @@ func (store *ShardedFileStore) hashFile(id string) ([]byte, error) {
 	return h.Sum(nil), nil
 }
 
-func isDirEmpty(path string) (bool, error) {
-	f, err := os.Open(path)
+// VerifyHash reads the stored file of a completed upload again and returns its
+// hash along with the hash recorded when the upload was finished, so callers
+// can detect files that changed on disk. Both are nil if the upload isn't
+// finished.
+func (store *ShardedFileStore) VerifyHash(id string) (recorded []byte, actual []byte, err error) {
+	recorded, tier, isFinal, err := store.lookupHash(id)
+	if err != nil || !isFinal {
+		return nil, nil, err
+	}
+
+	f, err := store.fs().Open(store.completeBinPath(store.tierRoot(tier), recorded))
+	if err != nil {
+		return recorded, nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return recorded, nil, err
+	}
+	return recorded, h.Sum(nil), nil
+}
+
+func isDirEmpty(fs afero.Fs, path string) (bool, error) {
+	f, err := fs.Open(path)
 	if err != nil {
 		return false, err
 	}
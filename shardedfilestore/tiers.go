@@ -0,0 +1,96 @@
+package shardedfilestore
+
+import (
+	"database/sql"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// Tiers are additional storage roots that finished uploads are moved to, e.g.
+// to keep large files on cheaper storage. The tier of an upload is recorded in
+// the uploads table. Incomplete uploads, .info files and variants always stay
+// below BasePath.
+
+// tierRoot returns the storage root of a tier, BasePath for the default tier ""
+func (store *ShardedFileStore) tierRoot(tier string) string {
+	if tier == "" {
+		return store.BasePath
+	}
+	if root, ok := store.Tiers[tier]; ok {
+		return root
+	}
+
+	store.log.Error().
+		Str("tier", tier).
+		Msg("Upload is stored on an unknown tier, using the default storage path")
+	return store.BasePath
+}
+
+// finishTier decides which tier a finished upload is stored on. If a file
+// with the same content is already stored, it is reused on its tier.
+func (store *ShardedFileStore) finishTier(id string, hash []byte) (string, error) {
+	var existing sql.NullString
+	err := store.DBConn.DB.QueryRow(`
+		SELECT tier FROM uploads
+		WHERE sha256sum = ? AND id != ? AND deleted = 0
+		LIMIT 1
+	`, hash, id).Scan(&existing)
+	if err == nil {
+		return existing.String, nil
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	if store.ChooseTier == nil {
+		return "", nil
+	}
+	info, err := store.GetInfo(id)
+	if err != nil {
+		return "", err
+	}
+	return store.ChooseTier(info), nil
+}
+
+// moveFile renames oldPath to newPath, copying the file if they are on
+// different filesystems, in which case the copy gets mode
+func moveFile(fs afero.Fs, oldPath string, newPath string, mode os.FileMode) error {
+	err := fs.Rename(oldPath, newPath)
+	if linkErr, ok := err.(*os.LinkError); !ok || !isCrossDeviceError(linkErr.Err) {
+		return err
+	}
+
+	src, err := fs.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmp, err := afero.TempFile(fs, filepath.Dir(newPath), filepath.Base(newPath)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer fs.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, src)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := fs.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	if err := fs.Rename(tmp.Name(), newPath); err != nil {
+		return err
+	}
+	return fs.Remove(oldPath)
+}
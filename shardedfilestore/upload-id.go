@@ -0,0 +1,52 @@
+package shardedfilestore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	// DefaultIDBits is the entropy of upload IDs when IDBits is not set,
+	// matching the IDs generated by tusd
+	DefaultIDBits = 128
+
+	// MinIDBits and MaxIDBits bound the configurable entropy of upload IDs.
+	// Every ID ever generated is between these sizes, so ValidID accepts
+	// existing uploads after IDBits is changed.
+	MinIDBits = 128
+	MaxIDBits = 512
+)
+
+// newID generates a random upload ID with IDBits bits of entropy, hex encoded
+func (store *ShardedFileStore) newID() (string, error) {
+	bits := store.IDBits
+	if bits == 0 {
+		bits = DefaultIDBits
+	}
+	if bits < MinIDBits || bits > MaxIDBits || bits%8 != 0 {
+		return "", fmt.Errorf("Invalid upload ID size of %d bits", bits)
+	}
+
+	buf := make([]byte, bits/8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// ValidID reports whether id has the format of an upload ID generated by the
+// store, so that malformed IDs can be rejected without touching the disk or
+// database
+func ValidID(id string) bool {
+	if len(id) < MinIDBits/4 || len(id) > MaxIDBits/4 || len(id)%2 != 0 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
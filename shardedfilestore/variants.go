@@ -0,0 +1,83 @@
+package shardedfilestore
+
+import (
+	"io"
+	"path/filepath"
+
+	"github.com/spf13/afero"
+)
+
+// Variants are derived versions of an upload, such as a watermarked image,
+// produced after the upload finished. They are stored next to the .info file,
+// or below VariantsPath if set, and removed together with the upload.
+
+// variantsBase returns the directory that the variant directory hierarchy starts at
+func (store *ShardedFileStore) variantsBase() string {
+	if store.VariantsPath != "" {
+		return store.VariantsPath
+	}
+	return store.BasePath
+}
+
+// variantDir returns the directory that the variants of an upload reside in
+func (store *ShardedFileStore) variantDir(id string) string {
+	if store.VariantsPath != "" {
+		// <variants-path>/<id-shards>
+		return filepath.Join(store.VariantsPath, store.shards(id))
+	}
+	// <base-path>/meta/<id-shards>
+	return store.metaDir(id)
+}
+
+// variantPath returns the path to a named variant of an upload
+func (store *ShardedFileStore) variantPath(id string, name string) string {
+	// <variant-dir>/<id>.<name>.variant
+	return filepath.Join(store.variantDir(id), id+"."+name+".variant")
+}
+
+// WriteVariant stores a named variant of an upload, replacing any previous one
+func (store *ShardedFileStore) WriteVariant(id string, name string, src io.Reader) error {
+	fs := store.fs()
+	if err := fs.MkdirAll(store.variantDir(id), store.dirMode()); err != nil {
+		return err
+	}
+
+	tmp, err := afero.TempFile(fs, store.variantDir(id), id+".tmp")
+	if err != nil {
+		return err
+	}
+	defer fs.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, src)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := fs.Chmod(tmp.Name(), store.fileMode()); err != nil {
+		return err
+	}
+	return fs.Rename(tmp.Name(), store.variantPath(id, name))
+}
+
+// GetVariantReader opens a named variant of an upload. The error satisfies
+// os.IsNotExist if the variant was not produced.
+func (store *ShardedFileStore) GetVariantReader(id string, name string) (afero.File, error) {
+	return store.fs().Open(store.variantPath(id, name))
+}
+
+// removeVariants deletes all variants of an upload
+func (store *ShardedFileStore) removeVariants(id string) error {
+	paths, err := afero.Glob(store.fs(), filepath.Join(store.variantDir(id), id+".*.variant"))
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if err := removeWithDirs(store.fs(), path, store.variantsBase()); err != nil {
+			return err
+		}
+	}
+	return nil
+}